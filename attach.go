@@ -0,0 +1,466 @@
+package box
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const attachSocketFilename = "attach.sock"
+
+// frameResize carries the new window size of an attached terminal, as two big endian uint16
+// with the rows and columns. The other frame types are the stream constants.
+const frameResize byte = 3
+
+// maxFrameSize is the max payload size of a single frame.
+const maxFrameSize = 1 << 20
+
+// attachWriteTimeout is how long writing the box's output to an attached client can take
+// before the client is disconnected.
+const attachWriteTimeout = 5 * time.Second
+
+// attachQueueSize is how many chunks of the box's output are queued for an attached client.
+// Clients too slow to keep up with the box's output are disconnected once their queue is full,
+// so that they don't hold back the box or the other clients.
+const attachQueueSize = 256
+
+// DefaultDetachKeys is the key sequence used to detach from a box: ctrl-p, ctrl-q.
+var DefaultDetachKeys = []byte{0x10, 0x11}
+
+// ErrDetached is returned by Attach when the client detaches using the detach keys.
+var ErrDetached = errors.New("detached")
+
+// AttachOptions configures how to attach to a box.
+type AttachOptions struct {
+	// ReadOnly attaches only to the box's output. Any number of read-only clients can be
+	// attached at once, but only one can write to the box's input.
+	ReadOnly bool
+	// DetachKeys is the key sequence which detaches the client from the box, leaving it
+	// running. Defaults to DefaultDetachKeys.
+	DetachKeys []byte
+}
+
+// attachRequest is the first message sent by a client, as a single JSON line.
+type attachRequest struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+// attachResponse is the server's reply to an attachRequest, as a single JSON line. After it,
+// both ends exchange frames until the box exits or the client detaches.
+type attachResponse struct {
+	Error    string `json:"error,omitempty"`
+	Terminal bool   `json:"terminal"`
+}
+
+// attachServer serves the box's stdio to clients connected to a unix socket, fanning out the
+// box's output to all of them and taking the box's input from the only read-write client.
+type attachServer struct {
+	path     string
+	listener net.Listener
+	terminal bool
+
+	lock    sync.Mutex
+	input   io.Writer
+	console *os.File
+	writer  *attachConn
+	conns   map[*attachConn]struct{}
+	closed  bool
+}
+
+// attachConn is an attached client, whose share of the box's output is queued and written by
+// its own writer.
+type attachConn struct {
+	net.Conn
+	frames    chan attachFrame
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type attachFrame struct {
+	stream byte
+	p      []byte
+}
+
+func newAttachConn(conn net.Conn) *attachConn {
+	return &attachConn{
+		Conn:   conn,
+		frames: make(chan attachFrame, attachQueueSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// queue queues the given output to be written to the client, disconnecting it if its queue is
+// full.
+func (c *attachConn) queue(stream byte, p []byte) {
+	select {
+	case c.frames <- attachFrame{stream: stream, p: p}:
+	case <-c.done:
+	default:
+		c.Close()
+	}
+}
+
+// writeFrames writes the queued output to the client until it's closed, or the queue is closed
+// and drained, disconnecting it if a write fails.
+func (c *attachConn) writeFrames() {
+	for {
+		select {
+		case f, ok := <-c.frames:
+			if !ok {
+				c.Close()
+				return
+			}
+			_ = c.SetWriteDeadline(time.Now().Add(attachWriteTimeout))
+			if err := writeFrame(c.Conn, f.stream, f.p); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *attachConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
+
+func newAttachServer(path string, terminal bool) (*attachServer, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &attachServer{
+		path:     path,
+		listener: l,
+		terminal: terminal,
+		conns:    map[*attachConn]struct{}{},
+	}, nil
+}
+
+// serve starts accepting clients, writing their input to input. If the box has a terminal,
+// console is the pty master, also used to resize the terminal.
+func (s *attachServer) serve(input io.Writer, console *os.File) {
+	s.lock.Lock()
+	s.input = input
+	s.console = console
+	s.lock.Unlock()
+
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(newAttachConn(conn))
+		}
+	}()
+}
+
+func (s *attachServer) handle(conn *attachConn) {
+	defer conn.Close()
+
+	rd := bufio.NewReader(conn)
+	line, err := rd.ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	req := attachRequest{}
+	if err = json.Unmarshal(line, &req); err != nil {
+		_ = writeJSONLine(conn, attachResponse{Error: "invalid request: " + err.Error()})
+		return
+	}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		_ = writeJSONLine(conn, attachResponse{Error: "box exited"})
+		return
+	}
+	if !req.ReadOnly && s.writer != nil {
+		s.lock.Unlock()
+		_ = writeJSONLine(conn, attachResponse{Error: "a read-write client is already attached"})
+		return
+	}
+	if !req.ReadOnly {
+		s.writer = conn
+	}
+	s.conns[conn] = struct{}{}
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		if s.writer == conn {
+			s.writer = nil
+		}
+		s.lock.Unlock()
+	}()
+
+	// the output queued meanwhile is only written after the response
+	if err = writeJSONLine(conn, attachResponse{Terminal: s.terminal}); err != nil {
+		return
+	}
+	go conn.writeFrames()
+
+	for {
+		t, p, err := readFrame(rd)
+		if err != nil {
+			return
+		}
+		if req.ReadOnly {
+			continue
+		}
+
+		switch t {
+		case streamStdin:
+			if s.input != nil {
+				_, _ = s.input.Write(p)
+			}
+		case frameResize:
+			if s.console != nil && len(p) == 4 {
+				ws := &unix.Winsize{
+					Row: binary.BigEndian.Uint16(p[:2]),
+					Col: binary.BigEndian.Uint16(p[2:]),
+				}
+				_ = unix.IoctlSetWinsize(int(s.console.Fd()), unix.TIOCSWINSZ, ws)
+			}
+		}
+	}
+}
+
+// broadcast queues the given output for all attached clients, without waiting for them to
+// receive it, dropping the ones that fail or are too slow to receive it.
+func (s *attachServer) broadcast(stream byte, p []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed || len(s.conns) == 0 {
+		return
+	}
+
+	// p is reused by the caller once this returns
+	p = append([]byte(nil), p...)
+	for c := range s.conns {
+		c.queue(stream, p)
+	}
+}
+
+// close stops accepting clients and disconnects the attached ones, once they receive the output
+// queued so far.
+func (s *attachServer) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	_ = s.listener.Close()
+	for c := range s.conns {
+		close(c.frames)
+	}
+	if f, ok := s.input.(io.Closer); ok && !s.terminal {
+		f.Close()
+	}
+	_ = os.Remove(s.path)
+}
+
+// attach connects the given io to the box's attach socket at path, until the box exits or the
+// client detaches.
+func attach(path string, pio ProcessIO, opts AttachOptions) (err error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("connecting to attach socket: %s", err)
+	}
+	defer conn.Close()
+
+	if err = writeJSONLine(conn, attachRequest{ReadOnly: opts.ReadOnly}); err != nil {
+		return fmt.Errorf("sending attach request: %s", err)
+	}
+
+	rd := bufio.NewReader(conn)
+	line, err := rd.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("reading attach response: %s", err)
+	}
+	resp := attachResponse{}
+	if err = json.Unmarshal(line, &resp); err != nil {
+		return fmt.Errorf("parsing attach response: %s", err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+
+	detached := make(chan struct{})
+	if !opts.ReadOnly && pio.In != nil {
+		if resp.Terminal && isTerminal(pio.In) {
+			restore, err := setRawTerminal(int(pio.In.Fd()))
+			if err != nil {
+				return fmt.Errorf("setting terminal in raw mode: %s", err)
+			}
+			defer restore()
+
+			stopResize := make(chan struct{})
+			defer close(stopResize)
+			go sendResizes(conn, pio.In, stopResize)
+		}
+
+		keys := opts.DetachKeys
+		if keys == nil {
+			keys = DefaultDetachKeys
+		}
+		go func() {
+			if copyInput(conn, pio.In, keys) == ErrDetached {
+				close(detached)
+				conn.Close()
+			}
+		}()
+	}
+
+	for {
+		t, p, e := readFrame(rd)
+		if e != nil {
+			select {
+			case <-detached:
+				return ErrDetached
+			default:
+			}
+			if e == io.EOF {
+				return nil
+			}
+			return e
+		}
+
+		var w io.Writer
+		switch t {
+		case streamStdout:
+			w = pio.Out
+		case streamStderr:
+			w = pio.Err
+		}
+		if w != nil {
+			if _, err = w.Write(p); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// copyInput sends everything read from in to conn, until the detach keys are read.
+func copyInput(conn net.Conn, in io.Reader, detachKeys []byte) error {
+	buf := make([]byte, 4096)
+	matched := 0
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		out := make([]byte, 0, n+matched)
+		for _, c := range buf[:n] {
+			if len(detachKeys) > 0 && c == detachKeys[matched] {
+				matched++
+				if matched == len(detachKeys) {
+					if len(out) > 0 {
+						_ = writeFrame(conn, streamStdin, out)
+					}
+					return ErrDetached
+				}
+				continue
+			}
+
+			// not a detach sequence after all so, send the keys held so far
+			out = append(out, detachKeys[:matched]...)
+			matched = 0
+			if len(detachKeys) > 0 && c == detachKeys[0] {
+				matched = 1
+				continue
+			}
+			out = append(out, c)
+		}
+
+		if len(out) > 0 {
+			if err = writeFrame(conn, streamStdin, out); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func sendResizes(conn net.Conn, term *os.File, stop <-chan struct{}) {
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, unix.SIGWINCH)
+	defer signal.Stop(winch)
+
+	for {
+		if ws, err := unix.IoctlGetWinsize(int(term.Fd()), unix.TIOCGWINSZ); err == nil {
+			p := make([]byte, 4)
+			binary.BigEndian.PutUint16(p[:2], ws.Row)
+			binary.BigEndian.PutUint16(p[2:], ws.Col)
+			if err = writeFrame(conn, frameResize, p); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-winch:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func writeJSONLine(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// writeFrame writes a frame with the given type and payload. Frames have a 5 bytes header with
+// the type followed by the payload size as a big endian uint32.
+func writeFrame(w io.Writer, t byte, p []byte) error {
+	frame := make([]byte, 5+len(p))
+	frame[0] = t
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(p)))
+	copy(frame[5:], p)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) (t byte, p []byte, err error) {
+	header := make([]byte, 5)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		err = fmt.Errorf("frame too big: %d bytes", size)
+		return
+	}
+
+	p = make([]byte, size)
+	if _, err = io.ReadFull(r, p); err != nil {
+		return
+	}
+
+	return header[0], p, nil
+}
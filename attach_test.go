@@ -0,0 +1,217 @@
+package box
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		t    byte
+		p    []byte
+	}{
+		{"stdout", streamStdout, []byte("hello")},
+		{"stderr", streamStderr, []byte("oops\n")},
+		{"empty", streamStdin, []byte{}},
+		{"resize", frameResize, []byte{0, 24, 0, 80}},
+		{"max size", streamStdout, make([]byte, maxFrameSize)},
+	}
+
+	buf := &bytes.Buffer{}
+	for _, tt := range tests {
+		if err := writeFrame(buf, tt.t, tt.p); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+	}
+	for _, tt := range tests {
+		typ, p, err := readFrame(buf)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if typ != tt.t || !bytes.Equal(p, tt.p) {
+			t.Errorf("%s: expected frame %d with %d bytes, got %d with %d", tt.name, tt.t,
+				len(tt.p), typ, len(p))
+		}
+	}
+	if _, _, err := readFrame(buf); err != io.EOF {
+		t.Errorf("expected EOF once all frames are read, got %v", err)
+	}
+
+	bad := []struct {
+		name  string
+		frame []byte
+	}{
+		{"truncated header", []byte{streamStdout, 0, 0}},
+		{"truncated payload", []byte{streamStdout, 0, 0, 0, 4, 'a'}},
+		{"too big", []byte{streamStdout, 0, 0x10, 0, 1}},
+	}
+	for _, tt := range bad {
+		if _, _, err := readFrame(bytes.NewReader(tt.frame)); err == nil || err == io.EOF {
+			t.Errorf("%s: expected an error, got %v", tt.name, err)
+		}
+	}
+}
+
+// chunkReader returns a chunk per read.
+type chunkReader [][]byte
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(*r) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, (*r)[0])
+	*r = (*r)[1:]
+	return n, nil
+}
+
+func TestCopyInput(t *testing.T) {
+	keys := DefaultDetachKeys
+	tests := []struct {
+		name   string
+		keys   []byte
+		chunks []string
+		sent   string
+		err    error
+	}{
+		{"no keys read", keys, []string{"abc", "def"}, "abcdef", io.EOF},
+		{"detach", keys, []string{"ab\x10\x11cd"}, "ab", ErrDetached},
+		{"detach only", keys, []string{"\x10\x11"}, "", ErrDetached},
+		{"detach across reads", keys, []string{"a\x10", "\x11b"}, "a", ErrDetached},
+		{"partial sequence", keys, []string{"a\x10b"}, "a\x10b", io.EOF},
+		{"partial sequence across reads", keys, []string{"a\x10", "b"}, "a\x10b", io.EOF},
+		{"repeated first key", keys, []string{"\x10\x10\x11"}, "\x10", ErrDetached},
+		{"single key", []byte{'q'}, []string{"abq"}, "ab", ErrDetached},
+		{"no detach keys", nil, []string{"\x10\x11"}, "\x10\x11", io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			sent := make(chan string)
+			go func() {
+				buf := &bytes.Buffer{}
+				for {
+					typ, p, err := readFrame(server)
+					if err != nil {
+						break
+					}
+					if typ != streamStdin {
+						t.Errorf("expected stdin frame, got %d", typ)
+					}
+					buf.Write(p)
+				}
+				sent <- buf.String()
+			}()
+
+			var in chunkReader
+			for _, c := range tt.chunks {
+				in = append(in, []byte(c))
+			}
+			err := copyInput(client, &in, tt.keys)
+			client.Close()
+			if err != tt.err {
+				t.Errorf("expected error %v, got %v", tt.err, err)
+			}
+			if s := <-sent; s != tt.sent {
+				t.Errorf("expected %q to be sent, got %q", tt.sent, s)
+			}
+		})
+	}
+}
+
+// attachTestClient attaches a read-only client to the attach server at path.
+func attachTestClient(t *testing.T, path string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeJSONLine(conn, attachRequest{ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	rd := bufio.NewReader(conn)
+	line, err := rd.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := attachResponse{}
+	if err = json.Unmarshal(line, &resp); err != nil || resp.Error != "" {
+		t.Fatalf("attaching: %v, %s", err, resp.Error)
+	}
+
+	return conn, rd
+}
+
+func TestBroadcast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newAttachServer(filepath.Join(dir, attachSocketFilename), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serve(nil, nil)
+	defer s.close()
+
+	stalled, _ := attachTestClient(t, s.path)
+	defer stalled.Close()
+	conn, rd := attachTestClient(t, s.path)
+	defer conn.Close()
+	// attached clients are registered right before the response is written
+	time.Sleep(100 * time.Millisecond)
+
+	// the client reading its output gets all of it, even though the stalled one never reads
+	chunk := bytes.Repeat([]byte("x"), 64<<10)
+	frames := make(chan int)
+	go func() {
+		defer close(frames)
+		for {
+			_, p, err := readFrame(rd)
+			if err != nil {
+				return
+			}
+			frames <- len(p)
+		}
+	}()
+
+	for i := 0; i < attachQueueSize*2; i++ {
+		s.broadcast(streamStdout, chunk)
+		select {
+		case n := <-frames:
+			if n != len(chunk) {
+				t.Fatalf("expected %d bytes, got %d", len(chunk), n)
+			}
+		case <-time.After(attachWriteTimeout):
+			t.Fatalf("expected output %d not to wait for the stalled client", i)
+		}
+	}
+
+	s.lock.Lock()
+	attached := len(s.conns)
+	s.lock.Unlock()
+	if attached != 1 {
+		t.Errorf("expected the stalled client to be dropped, got %d clients", attached)
+	}
+
+	// the output queued when the server is closed is still written
+	s.broadcast(streamStdout, chunk)
+	s.close()
+	var n []int
+	for l := range frames {
+		n = append(n, l)
+	}
+	if len(n) != 1 || n[0] != len(chunk) {
+		t.Errorf("expected the queued output to be written before disconnecting, got %v", n)
+	}
+}
@@ -3,6 +3,7 @@ package bootstrap
 import (
 	"bytes"
 	"github.com/cprates/box/boxnet"
+	"reflect"
 	"testing"
 )
 
@@ -51,6 +52,25 @@ func TestSetDNS(t *testing.T) {
 	}
 }
 
+func TestSetDNSIPv6(t *testing.T) {
+	buf := bytes.Buffer{}
+
+	cfg := boxnet.DNSConf{
+		Nameservers: []string{"8.8.8.8", "2001:4860:4860::8888", "[2001:db8::53]", "fe80::1%eth0"},
+	}
+	if err := setDNS(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	expects := "nameserver 8.8.8.8\n" +
+		"nameserver 2001:4860:4860::8888\n" +
+		"nameserver 2001:db8::53\n" +
+		"nameserver fe80::1%eth0\n"
+	if buf.String() != expects {
+		t.Errorf("nameservers check failed. Expects %q, got %q", expects, buf.String())
+	}
+}
+
 func TestSetHostsWithDomain(t *testing.T) {
 	buf := bytes.Buffer{}
 
@@ -107,3 +127,94 @@ func TestSetHostsWithoutDomain(t *testing.T) {
 		t.Errorf("ipv6 host check failed. Expects %q, got %q", expects, l)
 	}
 }
+
+func TestSetHostsWithEntries(t *testing.T) {
+	buf := bytes.Buffer{}
+
+	cfg := boxnet.DNSConf{
+		ExtraHosts: []string{"db:10.0.0.5", "v6:fd00::5"},
+	}
+	entries := []boxnet.HostEntry{
+		{IP: "10.0.0.2", Names: []string{"box1.domain1", "box1"}},
+	}
+	err := setHosts(&buf, cfg, entries...)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expects := "127.0.0.1 localhost\n" +
+		"::1 localhost\n" +
+		"10.0.0.2 box1.domain1 box1\n" +
+		"10.0.0.5 db\n" +
+		"fd00::5 v6\n"
+	if buf.String() != expects {
+		t.Errorf("hosts check failed. Expects %q, got %q", expects, buf.String())
+	}
+}
+
+func TestSetHostsInvalidExtraHost(t *testing.T) {
+	for _, h := range []string{"db", ":10.0.0.5", "db:10.0.0"} {
+		buf := bytes.Buffer{}
+		err := setHosts(&buf, boxnet.DNSConf{ExtraHosts: []string{h}})
+		if err == nil {
+			t.Errorf("expected extra host %q to be rejected", h)
+		}
+	}
+}
+
+func TestHostEntries(t *testing.T) {
+	cfg := Config{
+		Hostname: "box1",
+		NetConfig: &boxnet.NetConf{
+			Interfaces: []map[string]interface{}{
+				{"type": "veth", "name": "eth1", "ip": "10.0.0.1/30", "peer_ip": "10.0.0.2/30"},
+			},
+			DNS: boxnet.DNSConf{Domain: "domain1"},
+		},
+		Hosts: []boxnet.HostEntry{{IP: "10.0.0.6", Names: []string{"box2"}}},
+	}
+
+	entries, err := hostEntries(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expects := []boxnet.HostEntry{
+		{IP: "10.0.0.2", Names: []string{"box1.domain1", "box1"}},
+		{IP: "10.0.0.6", Names: []string{"box2"}},
+	}
+	if !reflect.DeepEqual(entries, expects) {
+		t.Errorf("entries check failed. Expects %+v, got %+v", expects, entries)
+	}
+}
+
+func TestHostEntriesDualStack(t *testing.T) {
+	cfg := Config{
+		Hostname: "box1",
+		NetConfig: &boxnet.NetConf{
+			Interfaces: []map[string]interface{}{
+				{
+					"type":     "veth",
+					"name":     "eth1",
+					"peer_ip":  "10.0.0.2/30",
+					"peer_ips": []string{"fd00::2/64"},
+				},
+				{"type": "macvlan", "name": "eth2", "ips": []string{"fd01::2/64"}},
+			},
+		},
+	}
+
+	entries, err := hostEntries(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expects := []boxnet.HostEntry{
+		{IP: "10.0.0.2", Names: []string{"box1"}},
+		{IP: "fd00::2", Names: []string{"box1"}},
+		{IP: "fd01::2", Names: []string{"box1"}},
+	}
+	if !reflect.DeepEqual(entries, expects) {
+		t.Errorf("entries check failed. Expects %+v, got %+v", expects, entries)
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/cprates/box/boxnet"
+	"github.com/cprates/box/spec"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
@@ -27,15 +30,46 @@ type Config struct {
 	Cwd            string
 	EntryPoint     string
 	EntryPointArgs []string
-	NetConfig      *boxnet.NetConf `json:"NetConfig,omitempty"`
+	UID            uint32
+	GID            uint32
+	AdditionalGids []uint32 `json:",omitempty"`
+	Terminal       bool
+	// when set, an overlay made of these dirs is mounted at RootFs
+	RootFsLowerdirs []string `json:",omitempty"`
+	RootFsUpperdir  string   `json:",omitempty"`
+	RootFsWorkdir   string   `json:",omitempty"`
+	// dir where the box's /etc files, such as hosts, are generated
+	EtcDir string
+	// dir where the upper layers of the overlays providing the mount points missing in a rootfs
+	// without an overlay are kept, in a tmpfs
+	MountpointsDir string
+	// when set, RootFsDevice is mounted read-only at RootFsFileMount
+	RootFsDevice    string `json:",omitempty"`
+	RootFsType      string `json:",omitempty"`
+	RootFsFileMount string `json:",omitempty"`
+	// sizes in bytes of /tmp and /dev/shm, 0 for the defaults
+	TmpSize int64 `json:",omitempty"`
+	ShmSize int64 `json:",omitempty"`
+	// additional mounts, with volumes already resolved to bind mounts
+	Mounts []spec.Mount `json:",omitempty"`
+	// entries for the hosts file other than the box's own, such as for its bridge peers
+	Hosts []boxnet.HostEntry `json:",omitempty"`
+	// addresses of the box set up by its network model besides the ones of its netconf
+	// interfaces, such as the CNI ones
+	NetAddresses []string        `json:",omitempty"`
+	NetConfig    *boxnet.NetConf `json:"NetConfig,omitempty"`
 }
 
 func options(cfg Config) (opts []Option) {
 	opts = append(
 		opts,
-		DefaultMounts(cfg.RootFs)...,
+		DefaultMounts(cfg.RootFs, cfg.TmpSize, cfg.ShmSize)...,
 	)
 
+	for _, m := range cfg.Mounts {
+		opts = append(opts, SpecMount(cfg.RootFs, m))
+	}
+
 	opts = append(
 		opts,
 		DefaultNodeDevs(cfg.RootFs)...,
@@ -44,15 +78,32 @@ func options(cfg Config) (opts []Option) {
 	return
 }
 
-func setupEnv(cfg Config) (err error) {
+func setupEnv(cfg Config, r reporter) (err error) {
+	if cfg.RootFsDevice != "" {
+		r.stage(StageRootFs)
+		if err = mountRootFsDevice(cfg); err != nil {
+			return stageError(StageRootFs, cfg.RootFsFileMount, err)
+		}
+	}
+
+	if len(cfg.RootFsLowerdirs) > 0 {
+		r.stage(StageRootFs)
+		if err = mountOverlay(cfg); err != nil {
+			return stageError(StageRootFs, cfg.RootFs, err)
+		}
+	}
+
+	r.stage(StageMounts)
+	if err = provideMountpoints(cfg); err != nil {
+		return
+	}
 	for _, opt := range options(cfg) {
-		if e := opt(); e != nil {
-			err = fmt.Errorf("unable to setup environment: %s", e)
-			log.Error(err)
+		if err = opt(); err != nil {
 			return
 		}
 	}
 
+	r.stage(StageDevices)
 	if err = createDevSymlinks(cfg.RootFs); err != nil {
 		return
 	}
@@ -60,56 +111,84 @@ func setupEnv(cfg Config) (err error) {
 	// TODO
 	//  https://github.com/opencontainers/runc/blob/master/libcontainer/SPEC.md#runtime-and-init-process
 	//  Still need localtime
-	if err = setHostname(cfg.Hostname, path.Join(cfg.RootFs, "/etc/hostname")); err != nil {
-		return fmt.Errorf("setting hostname: %s", err)
+	// the box's /etc files are generated in its workdir and bind mounted into its rootfs, which
+	// is left untouched, allowing it to be read-only and shared by several boxes
+	r.stage(StageHostname)
+	hostnamePath := filepath.Join(cfg.EtcDir, "hostname")
+	if err = os.MkdirAll(cfg.EtcDir, 0755); err != nil {
+		return stageError(StageHostname, cfg.EtcDir, err)
+	}
+	if err = setHostname(cfg.Hostname, hostnamePath); err != nil {
+		return stageError(StageHostname, hostnamePath, err)
+	}
+	if err = bindEtcFile(cfg.RootFs, hostnamePath); err != nil {
+		return stageError(StageHostname, hostnamePath, err)
 	}
 
-	resolvF, err := os.OpenFile(path.Join(
-		cfg.RootFs, "/etc/resolv.conf"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0664,
-	)
+	r.stage(StageDNS)
+	resolvPath := filepath.Join(cfg.EtcDir, "resolv.conf")
+	resolvF, err := os.OpenFile(resolvPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
-		return err
+		return stageError(StageDNS, resolvPath, err)
 	}
 	defer resolvF.Close()
-	hostsF, err := os.OpenFile(path.Join(
-		cfg.RootFs, "/etc/hosts"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0664,
-	)
+	hostsPath := filepath.Join(cfg.EtcDir, "hosts")
+	hostsF, err := os.OpenFile(hostsPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
-		return err
+		return stageError(StageDNS, hostsPath, err)
 	}
 	defer hostsF.Close()
 	if cfg.NetConfig != nil {
-		if err = setLoopbackUp(cfg.NetConfig.LoopbackName); err != nil {
-			return fmt.Errorf("setting loopback interface up: %s", err)
+		// a shared NS is set up by its owner
+		if !cfg.NetConfig.SharesNS() {
+			r.stage(StageNetwork)
+			err = setLoopbackUp(cfg.NetConfig.LoopbackName)
+			if err != nil {
+				return stageError(
+					StageNetwork, "", fmt.Errorf("setting loopback interface up: %w", err),
+				)
+			}
 		}
 
 		if err = setDNS(resolvF, cfg.NetConfig.DNS); err != nil {
-			return fmt.Errorf("setting dns configs: %s", err)
+			return stageError(StageDNS, resolvPath, err)
 		}
 
-		if err = setHosts(hostsF, cfg.NetConfig.DNS); err != nil {
-			return fmt.Errorf("setting hosts: %s", err)
+		var entries []boxnet.HostEntry
+		if entries, err = hostEntries(cfg); err != nil {
+			return stageError(StageDNS, hostsPath, err)
+		}
+		if err = setHosts(hostsF, cfg.NetConfig.DNS, entries...); err != nil {
+			return stageError(StageDNS, hostsPath, err)
+		}
+	}
+	for _, p := range []string{resolvPath, hostsPath} {
+		if err = bindEtcFile(cfg.RootFs, p); err != nil {
+			return stageError(StageDNS, p, err)
 		}
 	}
 
+	r.stage(StageEnv)
 	os.Clearenv()
 	if err = setEnvVars(cfg.EnvVars); err != nil {
-		return
+		return stageError(StageEnv, "", err)
 	}
 
+	r.stage(StageChroot)
 	if err = syscall.Chroot(cfg.RootFs); err != nil {
-		return
+		return stageError(StageChroot, cfg.RootFs, err)
 	}
 
+	r.stage(StageCwd)
 	if err = os.Chdir(cfg.Cwd); err != nil {
-		return
+		return stageError(StageCwd, cfg.Cwd, err)
 	}
 
 	return
 }
 
 func setHostname(hostname, path string) (err error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0665)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return
 	}
@@ -145,6 +224,11 @@ func setDNS(f io.Writer, cfg boxnet.DNSConf) error {
 	}
 
 	for _, server := range cfg.Nameservers {
+		// IPv6 nameservers are written as is, along with their zone if link-local, but they are
+		// often given in brackets as in URLs
+		if strings.HasPrefix(server, "[") && strings.HasSuffix(server, "]") {
+			server = server[1 : len(server)-1]
+		}
 		if _, err := fmt.Fprintf(f, "nameserver %s\n", server); err != nil {
 			return err
 		}
@@ -153,9 +237,9 @@ func setDNS(f io.Writer, cfg boxnet.DNSConf) error {
 	return nil
 }
 
-func setHosts(f io.Writer, cfg boxnet.DNSConf) error {
-	// for now just configure localhost
-
+// setHosts writes a hosts file with the localhost entries, followed by the given entries and
+// the configured extra hosts.
+func setHosts(f io.Writer, cfg boxnet.DNSConf, entries ...boxnet.HostEntry) error {
 	ipv4 := "127.0.0.1 localhost"
 	ipv6 := "::1 localhost"
 	if cfg.Domain != "" {
@@ -163,18 +247,50 @@ func setHosts(f io.Writer, cfg boxnet.DNSConf) error {
 		ipv6 += " localhost." + cfg.Domain
 	}
 
-	_, err := fmt.Fprintf(f, strings.Join([]string{ipv4, ipv6}, "\n")+"\n")
+	extra, err := boxnet.ParseExtraHosts(cfg.ExtraHosts)
+	if err != nil {
+		return err
+	}
+
+	lines := []string{ipv4, ipv6}
+	for _, e := range append(entries, extra...) {
+		lines = append(lines, e.IP+" "+strings.Join(e.Names, " "))
+	}
+
+	_, err = fmt.Fprint(f, strings.Join(lines, "\n")+"\n")
 	return err
 }
 
+// hostEntries returns the hosts file entries mapping the box's own addresses to its hostname,
+// followed by the ones given by the parent.
+func hostEntries(cfg Config) ([]boxnet.HostEntry, error) {
+	addrs, err := cfg.NetConfig.Addresses()
+	if err != nil {
+		return nil, err
+	}
+	addrs = append(addrs, cfg.NetAddresses...)
+
+	names := []string{cfg.Hostname}
+	if domain := cfg.NetConfig.DNS.Domain; domain != "" && !strings.Contains(cfg.Hostname, ".") {
+		names = []string{cfg.Hostname + "." + domain, cfg.Hostname}
+	}
+
+	var entries []boxnet.HostEntry
+	for _, addr := range addrs {
+		entries = append(entries, boxnet.HostEntry{IP: addr, Names: names})
+	}
+
+	return append(entries, cfg.Hosts...), nil
+}
+
 func setLoopbackUp(name string) error {
 	link, err := netlink.LinkByName(name)
 	if err != nil {
-		return fmt.Errorf("unable to find interface %q: %s", name, err)
+		return fmt.Errorf("unable to find interface %q: %w", name, err)
 	}
 
 	if err = netlink.LinkSetUp(link); err != nil {
-		return fmt.Errorf("unable to set interface %q up: %s", name, err)
+		return fmt.Errorf("unable to set interface %q up: %w", name, err)
 	}
 
 	return nil
@@ -202,9 +318,9 @@ func pipe(sFd, name string) (f *os.File, err error) {
 	return
 }
 
-// TODO: failures must be properly handled while bootstrapping
+// Boot bootstraps the box's environment and executes its entry point, reporting its progress
+// and any failure to the parent through the sync pipe.
 func Boot(configFd, logFd string) (err error) {
-
 	logPipe, err := pipe(logFd, "logPipe")
 	if err != nil {
 		err = fmt.Errorf("creating log pipe: %s\n", err)
@@ -215,10 +331,29 @@ func Boot(configFd, logFd string) (err error) {
 	}()
 	log.SetOutput(logPipe)
 
+	r := reporter{}
+	if syncFd := os.Getenv("BOX_BOOTSTRAP_SYNC_FD"); syncFd != "" {
+		syncPipe, e := pipe(syncFd, "syncPipe")
+		if e != nil {
+			err = fmt.Errorf("creating sync pipe: %s", e)
+			log.Error(err)
+			return
+		}
+		// the parent knows the entry point was executed once the pipe is closed
+		unix.CloseOnExec(int(syncPipe.Fd()))
+		r.w = syncPipe
+	}
+	defer func() {
+		if err != nil {
+			log.Error(err)
+			r.fail(err)
+		}
+	}()
+
+	r.stage(StageConfig)
 	configPipe, err := pipe(configFd, "configPipe")
 	if err != nil {
-		err = fmt.Errorf("creating config pipe: %s\n", err)
-		log.Error(err)
+		err = stageError(StageConfig, "", fmt.Errorf("creating config pipe: %w", err))
 		return
 	}
 	defer func() {
@@ -227,61 +362,118 @@ func Boot(configFd, logFd string) (err error) {
 
 	cfg := Config{}
 	if err = json.NewDecoder(configPipe).Decode(&cfg); err != nil {
-		err = fmt.Errorf("reading config: %s\n", err)
-		log.Error(err)
+		err = stageError(StageConfig, "", fmt.Errorf("reading config: %w", err))
 		return
 	}
 
 	// capture the env var before setting up the env since all env vars are deleted
 	// in order to set up the box's env
 	fifoFd := os.Getenv("BOX_FIFO_FD")
+	consoleFd := os.Getenv("BOX_CONSOLE_FD")
 
-	err = setupEnv(cfg)
+	err = setupEnv(cfg, r)
 	if err != nil {
-		err = fmt.Errorf("unable to setup environment: %s", err)
-		log.Error(err)
 		return
 	}
 	defer func() {
 		cleanup()
 	}()
 
+	if cfg.Terminal {
+		r.stage(StageConsole)
+		consoleSocket, e := pipe(consoleFd, "consoleSocket")
+		if e != nil {
+			err = stageError(StageConsole, "", fmt.Errorf("opening console socket: %w", e))
+			return
+		}
+
+		err = setupConsole(consoleSocket)
+		_ = consoleSocket.Close()
+		if err != nil {
+			err = stageError(StageConsole, "/dev/console", err)
+			return
+		}
+	}
+
+	r.stage(StageEntryPoint)
+	if err = unix.Access(cfg.EntryPoint, unix.X_OK); err != nil {
+		err = stageError(
+			StageEntryPoint, cfg.EntryPoint, fmt.Errorf("entry point not executable: %w", err),
+		)
+		return
+	}
+
 	log.Debugf("Bootstrapping box %s: %s %v \n", cfg.Name, cfg.EntryPoint, cfg.EntryPointArgs)
 
+	r.ready()
 	if fifoFd != "" {
 		fd, e := strconv.Atoi(fifoFd)
 		if e != nil {
-			err = fmt.Errorf("unable to convert fifo fd: %s", e)
-			log.Error(err)
+			err = stageError(StageSync, "", fmt.Errorf("unable to convert fifo fd: %w", e))
 			return
 		}
 
 		if err = syncParent(fd); err != nil {
+			err = stageError(StageSync, "", err)
 			return
 		}
 	}
 
+	// the user is only changed at the very end since the box's process isn't able to open its
+	// own fds through /proc after dropping privileges. The ids are set on the current thread
+	// only, so it must be the one executing the entry point
+	runtime.LockOSThread()
+	if err = setUser(cfg.UID, cfg.GID, cfg.AdditionalGids); err != nil {
+		err = stageError(StageUser, "", err)
+		return
+	}
+
 	err = syscall.Exec(
 		cfg.EntryPoint,
 		append([]string{path.Base(cfg.EntryPoint)}, cfg.EntryPointArgs...),
 		os.Environ(),
 	)
-	log.Errorf("bootstrap: executing entry point: %s", err)
+	err = stageError(StageExec, cfg.EntryPoint, fmt.Errorf("executing entry point: %w", err))
 
 	return
 }
 
+// setUser sets the identity of the box's process on the calling thread, dropping any
+// supplementary group inherited from the parent. Nothing is changed if no user is given, the
+// box's process running as root.
+func setUser(uid, gid uint32, additionalGids []uint32) error {
+	if uid == 0 && gid == 0 && len(additionalGids) == 0 {
+		return nil
+	}
+
+	groups := make([]int, 0, len(additionalGids))
+	for _, g := range additionalGids {
+		groups = append(groups, int(g))
+	}
+
+	// unlike syscall's, these only change the ids of the calling thread, locked by the caller
+	if err := unix.Setgroups(groups); err != nil {
+		return fmt.Errorf("setting additional groups: %w", err)
+	}
+	if err := unix.Setresgid(int(gid), int(gid), int(gid)); err != nil {
+		return fmt.Errorf("setting gid %d: %w", gid, err)
+	}
+	if err := unix.Setresuid(int(uid), int(uid), int(uid)); err != nil {
+		return fmt.Errorf("setting uid %d: %w", uid, err)
+	}
+
+	return nil
+}
+
 func syncParent(fifoFd int) (err error) {
 	fd, err := unix.Open(fmt.Sprintf("/proc/self/fd/%d", fifoFd), unix.O_WRONLY|unix.O_CLOEXEC, 0)
 	if err != nil {
-		err = fmt.Errorf("open exec fifo: %s", err)
-		log.Error(err)
+		err = fmt.Errorf("open exec fifo: %w", err)
 		return
 	}
 
 	if _, err = unix.Write(fd, []byte("0")); err != nil {
-		err = fmt.Errorf("write 0 exec fifo: %s", err)
-		log.Error(err)
+		err = fmt.Errorf("write 0 exec fifo: %w", err)
 		return
 	}
 
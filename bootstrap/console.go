@@ -0,0 +1,92 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setupConsole allocates a new pty from the box's devpts instance, sends its master to the
+// parent through the given socket and sets the slave as the controlling terminal and stdio of
+// the box. It must be called after chroot.
+func setupConsole(socket *os.File) (err error) {
+	master, slavePath, err := newPty()
+	if err != nil {
+		return fmt.Errorf("allocating pty: %w", err)
+	}
+	defer master.Close()
+
+	if err = bindConsole(slavePath); err != nil {
+		return fmt.Errorf("binding console: %w", err)
+	}
+
+	if err = sendMaster(socket, master, slavePath); err != nil {
+		return fmt.Errorf("sending pty master: %w", err)
+	}
+
+	if _, err = unix.Setsid(); err != nil {
+		return fmt.Errorf("creating new session: %w", err)
+	}
+
+	slave, err := os.OpenFile(slavePath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("opening pty slave %q: %w", slavePath, err)
+	}
+	defer slave.Close()
+
+	if err = unix.IoctlSetInt(int(slave.Fd()), unix.TIOCSCTTY, 0); err != nil {
+		return fmt.Errorf("setting controlling terminal: %w", err)
+	}
+
+	for fd := 0; fd < 3; fd++ {
+		if err = unix.Dup2(int(slave.Fd()), fd); err != nil {
+			return fmt.Errorf("duplicating pty slave to fd %d: %w", fd, err)
+		}
+	}
+
+	return nil
+}
+
+// sendMaster sends the given pty master through the given socket, along with the path of its
+// slave.
+func sendMaster(socket, master *os.File, slavePath string) error {
+	oob := unix.UnixRights(int(master.Fd()))
+	return unix.Sendmsg(int(socket.Fd()), []byte(slavePath), oob, nil, 0)
+}
+
+func newPty() (master *os.File, slavePath string, err error) {
+	master, err = os.OpenFile("/dev/pts/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+
+	// unlockpt
+	if err = unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return
+	}
+
+	// ptsname
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return
+	}
+
+	slavePath = "/dev/pts/" + strconv.Itoa(n)
+	return
+}
+
+// bindConsole bind mounts the given pty slave to /dev/console.
+func bindConsole(slavePath string) error {
+	f, err := os.OpenFile("/dev/console", os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return syscall.Mount(slavePath, "/dev/console", "", unix.MS_BIND, "")
+}
@@ -0,0 +1,58 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSendMaster(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := os.NewFile(uintptr(fds[0]), "parent")
+	defer parent.Close()
+	child := os.NewFile(uintptr(fds[1]), "child")
+	defer child.Close()
+
+	// a pipe stands for the pty, whose write end is sent
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err = sendMaster(child, w, "/dev/pts/3"); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	name := make([]byte, 64)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := unix.Recvmsg(int(parent.Fd()), name, oob, unix.MSG_CMSG_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(name[:n]) != "/dev/pts/3" {
+		t.Errorf("expected the slave path to be sent, got %q", name[:n])
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("expected a single control message, got %d, %v", len(msgs), err)
+	}
+	rights, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(rights) != 1 {
+		t.Fatalf("expected a single fd, got %v, %v", rights, err)
+	}
+
+	received := os.NewFile(uintptr(rights[0]), "received")
+	if _, err = received.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	received.Close()
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "hello" {
+		t.Errorf("expected the received fd to be the sent one, got %q, %v", b, err)
+	}
+}
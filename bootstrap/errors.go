@@ -0,0 +1,125 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+// Bootstrap stages, in the order they are run.
+const (
+	StageConfig     = "config"
+	StageRootFs     = "rootfs"
+	StageMounts     = "mounts"
+	StageDevices    = "devices"
+	StageHostname   = "hostname"
+	StageNetwork    = "network"
+	StageDNS        = "dns"
+	StageEnv        = "env"
+	StageChroot     = "chroot"
+	StageCwd        = "cwd"
+	StageConsole    = "console"
+	StageEntryPoint = "entrypoint"
+	StageSync       = "sync"
+	StageUser       = "user"
+	StageExec       = "exec"
+)
+
+// Error describes a failure while bootstrapping a box.
+type Error struct {
+	// Stage is the bootstrap stage that failed
+	Stage string `json:"stage"`
+	// Path is the file involved in the failure, if any
+	Path string `json:"path,omitempty"`
+	// Errno is the error returned by the failing syscall, if any
+	Errno syscall.Errno `json:"errno,omitempty"`
+	// Message describes the failure
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	msg := "bootstrap stage " + e.Stage
+	if e.Path != "" {
+		msg += fmt.Sprintf(" at %q", e.Path)
+	}
+
+	return msg + ": " + e.Message
+}
+
+// Unwrap allows matching the errno with errors.Is.
+func (e *Error) Unwrap() error {
+	if e.Errno == 0 {
+		return nil
+	}
+
+	return e.Errno
+}
+
+// stageError returns an *Error describing a failure on the given stage. If err already is an
+// *Error, it is returned as is.
+func stageError(stage, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var bErr *Error
+	if errors.As(err, &bErr) {
+		return bErr
+	}
+
+	bErr = &Error{Stage: stage, Path: path, Message: err.Error()}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		bErr.Errno = errno
+	}
+
+	return bErr
+}
+
+// Message types sent by the box's process through the sync pipe.
+const (
+	MsgStage = "stage"
+	MsgReady = "ready"
+	MsgError = "error"
+)
+
+// SyncMsg is sent by the box's process to its parent, as a JSON line, to report its progress.
+// A box is successfully bootstrapped once a MsgReady is received, and if the entry point is
+// executed successfully the pipe is closed without any further message.
+type SyncMsg struct {
+	Type  string `json:"type"`
+	Stage string `json:"stage,omitempty"`
+	Error *Error `json:"error,omitempty"`
+}
+
+type reporter struct {
+	w io.Writer
+}
+
+func (r reporter) send(msg SyncMsg) {
+	if r.w == nil {
+		return
+	}
+
+	// there is no one else to report to so, ignore errors
+	_ = json.NewEncoder(r.w).Encode(msg)
+}
+
+func (r reporter) stage(stage string) {
+	r.send(SyncMsg{Type: MsgStage, Stage: stage})
+}
+
+func (r reporter) ready() {
+	r.send(SyncMsg{Type: MsgReady})
+}
+
+func (r reporter) fail(err error) {
+	var bErr *Error
+	if !errors.As(err, &bErr) {
+		bErr = &Error{Stage: "unknown", Message: err.Error()}
+	}
+
+	r.send(SyncMsg{Type: MsgError, Error: bErr})
+}
@@ -0,0 +1,75 @@
+package bootstrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestStageError(t *testing.T) {
+	err := stageError(StageCwd, "/nope", fmt.Errorf("chdir: %w", &os.PathError{
+		Op:   "chdir",
+		Path: "/nope",
+		Err:  syscall.ENOENT,
+	}))
+
+	var bErr *Error
+	if !errors.As(err, &bErr) {
+		t.Fatalf("expects a *Error, got %T", err)
+	}
+	if bErr.Stage != StageCwd || bErr.Path != "/nope" || bErr.Errno != syscall.ENOENT {
+		t.Errorf("unexpected error: %+v", bErr)
+	}
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Error("expects error to match errno")
+	}
+
+	if again := stageError(StageExec, "/other", err); again != err {
+		t.Errorf("expects the original error to be kept, got %+v", again)
+	}
+
+	if stageError(StageExec, "", nil) != nil {
+		t.Error("expects nil for a nil error")
+	}
+}
+
+func TestReporter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	r := reporter{w: buf}
+	r.stage(StageMounts)
+	r.fail(stageError(StageMounts, "/proc", syscall.EPERM))
+	r.fail(errors.New("boom"))
+	r.ready()
+	// a box without a sync pipe reports nothing
+	reporter{}.stage(StageMounts)
+
+	expects := []SyncMsg{
+		{Type: MsgStage, Stage: StageMounts},
+		{Type: MsgError, Error: &Error{
+			Stage:   StageMounts,
+			Path:    "/proc",
+			Errno:   syscall.EPERM,
+			Message: syscall.EPERM.Error(),
+		}},
+		{Type: MsgError, Error: &Error{Stage: "unknown", Message: "boom"}},
+		{Type: MsgReady},
+	}
+	dec := json.NewDecoder(buf)
+	for _, expect := range expects {
+		msg := SyncMsg{}
+		if err := dec.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msg, expect) {
+			t.Errorf("expects %+v, got %+v", expect, msg)
+		}
+	}
+	if dec.More() {
+		t.Error("expects no more messages")
+	}
+}
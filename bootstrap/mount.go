@@ -4,22 +4,29 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 
+	"github.com/cprates/box/spec"
+	"github.com/cprates/box/system"
+
 	"golang.org/x/sys/unix"
 )
 
 // DefaultMounts returns a list of the default device nodes for a container as specified at
 // https://github.com/opencontainers/runc/blob/master/libcontainer/SPEC.md#filesystem
-func DefaultMounts(rootFs string) []Option {
+// The sizes of /tmp and /dev/shm are given in bytes, where 0 uses the defaults.
+func DefaultMounts(rootFs string, tmpSize, shmSize int64) []Option {
 	return []Option{
 		ProcMount(rootFs),
-		TmpMount(rootFs),
+		TmpMount(rootFs, tmpSize),
 		DevMount(rootFs),
 		SysMount(rootFs),
 		MqueueMount(rootFs),
 		PtsMount(rootFs),
-		ShmMount(rootFs),
+		ShmMount(rootFs, shmSize),
 	}
 }
 
@@ -30,10 +37,15 @@ func ProcMount(rootFs string) Option {
 	}
 }
 
-func TmpMount(rootFs string) Option {
+// TmpMount mounts a tmpfs at /tmp with the given size in bytes, or half of the RAM if 0.
+func TmpMount(rootFs string, size int64) Option {
 	return func() error {
 		flags := unix.MS_NODEV | unix.MS_NOSUID
-		return mount("tmpfs", "/tmp", "tmpfs", rootFs, uintptr(flags), "")
+		data := ""
+		if size > 0 {
+			data = "size=" + strconv.FormatInt(size, 10)
+		}
+		return mount("tmpfs", "/tmp", "tmpfs", rootFs, uintptr(flags), data)
 	}
 }
 
@@ -66,27 +78,164 @@ func PtsMount(rootFs string) Option {
 	}
 }
 
-func ShmMount(rootFs string) Option {
+// DefaultShmSize is the default size in bytes of /dev/shm.
+const DefaultShmSize = 64 << 20
+
+// ShmMount mounts a tmpfs at /dev/shm with the given size in bytes, or DefaultShmSize if 0.
+func ShmMount(rootFs string, size int64) Option {
 	return func() error {
+		if size == 0 {
+			size = DefaultShmSize
+		}
 		flags := unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOSUID
-		data := "mode=1777,size=65536k"
+		data := "mode=1777,size=" + strconv.FormatInt(size, 10)
 		return mount("tmpfs", "/dev/shm", "tmpfs", rootFs, uintptr(flags), data)
 	}
 }
 
+// mount mounts source at target in the given rootfs. Its mount point is expected to be provided
+// by provideMountpoints unless it's nested in another mount, such as /dev, where it's created.
 func mount(source, target, fsType, rootFs string, flags uintptr, data string) (err error) {
 	at := path.Join(rootFs, target)
 
 	if err = os.MkdirAll(at, 0755); err != nil {
-		err = fmt.Errorf("creating dir %q: %s", at, err)
+		err = stageError(StageMounts, at, fmt.Errorf("creating dir: %w", err))
 		return
 	}
 
 	err = syscall.Mount(source, at, fsType, flags, data)
 	if err != nil {
-		err = fmt.Errorf("mounting target at %q: %s", at, err)
+		err = stageError(StageMounts, at, fmt.Errorf("mounting %s: %w", fsType, err))
 		return
 	}
 
 	return
 }
+
+// SpecMount mounts the given spec mount, whose volume, if any, must have been resolved to a
+// bind mount. Its destination is resolved in the rootfs so that symlinks can't escape it.
+func SpecMount(rootFs string, m spec.Mount) Option {
+	return func() (err error) {
+		at, err := system.SecureJoin(rootFs, m.Destination)
+		if err != nil {
+			return stageError(StageMounts, m.Destination, err)
+		}
+
+		flags, data := parseMountOptions(m.Options)
+		if m.Type != spec.MountBind {
+			return mount(m.Type, strings.TrimPrefix(at, rootFs), m.Type, rootFs, flags, data)
+		}
+
+		if flags&unix.MS_BIND == 0 {
+			flags |= unix.MS_BIND | unix.MS_REC
+		}
+
+		fi, err := os.Stat(m.Source)
+		if err != nil {
+			return stageError(StageMounts, m.Source, err)
+		}
+		if fi.IsDir() {
+			err = os.MkdirAll(at, 0755)
+		} else {
+			err = createFile(at)
+		}
+		if err != nil {
+			return stageError(StageMounts, at, fmt.Errorf("creating mount point: %w", err))
+		}
+
+		if err = unix.Mount(m.Source, at, "", flags, data); err != nil {
+			return stageError(StageMounts, at, fmt.Errorf("bind mounting: %w", err))
+		}
+
+		// the flags of bind mounts, other than the recursive one, are only applied on remount
+		if remountFlags := flags &^ (unix.MS_BIND | unix.MS_REC); remountFlags != 0 {
+			err = unix.Mount("", at, "", remountFlags|unix.MS_BIND|unix.MS_REMOUNT, "")
+			if err != nil {
+				return stageError(StageMounts, at, fmt.Errorf("remounting bind mount: %w", err))
+			}
+		}
+
+		return nil
+	}
+}
+
+// mountFlags are the mount options which translate into mount flags. Options negating a flag,
+// such as rw, clear it.
+var mountFlags = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"ro":          {false, unix.MS_RDONLY},
+	"rw":          {true, unix.MS_RDONLY},
+	"nosuid":      {false, unix.MS_NOSUID},
+	"suid":        {true, unix.MS_NOSUID},
+	"nodev":       {false, unix.MS_NODEV},
+	"dev":         {true, unix.MS_NODEV},
+	"noexec":      {false, unix.MS_NOEXEC},
+	"exec":        {true, unix.MS_NOEXEC},
+	"noatime":     {false, unix.MS_NOATIME},
+	"atime":       {true, unix.MS_NOATIME},
+	"nodiratime":  {false, unix.MS_NODIRATIME},
+	"relatime":    {false, unix.MS_RELATIME},
+	"strictatime": {false, unix.MS_STRICTATIME},
+	"sync":        {false, unix.MS_SYNCHRONOUS},
+	"bind":        {false, unix.MS_BIND},
+	"rbind":       {false, unix.MS_BIND | unix.MS_REC},
+}
+
+// parseMountOptions splits the given fstab style options into mount flags and the data of the
+// filesystem specific options.
+func parseMountOptions(options []string) (flags uintptr, data string) {
+	var fsOpts []string
+	for _, o := range options {
+		f, ok := mountFlags[o]
+		switch {
+		case !ok:
+			fsOpts = append(fsOpts, o)
+		case f.clear:
+			flags &^= f.flag
+		default:
+			flags |= f.flag
+		}
+	}
+
+	return flags, strings.Join(fsOpts, ",")
+}
+
+// createFile creates an empty file at path, along with its parent dirs, to be used as the
+// mount point of a file.
+func createFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// bindEtcFile bind mounts the given file, generated by the runtime, over the file with the same
+// name in the /etc of the given rootfs. Its mount point is provided by provideMountpoints, unless
+// /etc is a mount of its own, where it's created.
+func bindEtcFile(rootFs, file string) error {
+	at, err := system.SecureJoin(rootFs, path.Join("/etc", filepath.Base(file)))
+	if err != nil {
+		return err
+	}
+
+	if _, err = os.Stat(at); os.IsNotExist(err) {
+		err = createFile(at)
+	}
+	if err != nil {
+		return fmt.Errorf("creating mount point: %w", err)
+	}
+
+	if err = unix.Mount(file, at, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind mounting: %w", err)
+	}
+
+	return nil
+}
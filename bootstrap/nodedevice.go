@@ -66,10 +66,12 @@ func PtmxDev(rootFs string) Option {
 	return func() error {
 		ptmx := filepath.Join(rootFs, "/dev/ptmx")
 		if err := os.Remove(ptmx); err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("unable to remove existing symlink dev ptmx at %q: %s", ptmx, err)
+			return stageError(
+				StageDevices, ptmx, fmt.Errorf("unable to remove existing symlink: %w", err),
+			)
 		}
 		if err := os.Symlink("pts/ptmx", ptmx); err != nil {
-			return fmt.Errorf("creating symlink dev ptmx %s", err)
+			return stageError(StageDevices, ptmx, fmt.Errorf("creating symlink: %w", err))
 		}
 
 		return nil
@@ -86,7 +88,7 @@ func createDeviceNode(
 ) (err error) {
 	absPath := filepath.Join(rootFs, target)
 	if err = os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
-		return
+		return stageError(StageDevices, filepath.Dir(absPath), err)
 	}
 
 	mode := fileMode
@@ -110,10 +112,12 @@ func createDeviceNode(
 			// if it already exists, that's not a problem
 			return nil
 		}
-		return fmt.Errorf("unable to create device node %q: %s", absPath, err)
+		return stageError(
+			StageDevices, absPath, fmt.Errorf("unable to create device node: %w", err),
+		)
 	}
 
-	return unix.Chown(absPath, uid, gid)
+	return stageError(StageDevices, absPath, unix.Chown(absPath, uid, gid))
 }
 
 // copied from runc
@@ -135,7 +139,9 @@ func createDevSymlinks(rootFs string) (err error) {
 			dst = filepath.Join(rootFs, link[1])
 		)
 		if err := os.Symlink(src, dst); err != nil && !os.IsExist(err) {
-			return fmt.Errorf("creating symlink %s %s %s", src, dst, err)
+			return stageError(
+				StageDevices, dst, fmt.Errorf("creating symlink to %s: %w", src, err),
+			)
 		}
 	}
 	return nil
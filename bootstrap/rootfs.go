@@ -0,0 +1,180 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cprates/box/spec"
+	"github.com/cprates/box/system"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountOverlay mounts an overlay at the box's rootfs, with the configured lowerdirs on the
+// bottom and the upperdir on top. The lowerdirs are given from the top to the bottom layer.
+func mountOverlay(cfg Config) error {
+	data := fmt.Sprintf(
+		"lowerdir=%s,upperdir=%s,workdir=%s",
+		strings.Join(cfg.RootFsLowerdirs, ":"), cfg.RootFsUpperdir, cfg.RootFsWorkdir,
+	)
+
+	if err := unix.Mount("overlay", cfg.RootFs, "overlay", 0, data); err != nil {
+		return fmt.Errorf("mounting overlay: %w", err)
+	}
+
+	return nil
+}
+
+// mountRootFsDevice mounts the loop device of the box's rootfs file, read-only, either at the
+// box's rootfs or at the lowerdir of its overlay.
+func mountRootFsDevice(cfg Config) error {
+	err := unix.Mount(cfg.RootFsDevice, cfg.RootFsFileMount, cfg.RootFsType, unix.MS_RDONLY, "")
+	if err != nil {
+		return fmt.Errorf("mounting %s: %w", cfg.RootFsType, err)
+	}
+
+	return nil
+}
+
+// mountpoint is a path in the box, where something is mounted by the bootstrap, which must exist
+// in its rootfs.
+type mountpoint struct {
+	path string
+	file bool
+}
+
+// mountpoints returns the mount points in the rootfs of the box with the given config, sorted
+// from the shallowest to the deepest one. The ones nested in another mount, such as /dev/pts,
+// are left out as they are created in it.
+func mountpoints(cfg Config) (points []mountpoint) {
+	all := []mountpoint{{path: "/proc"}, {path: "/tmp"}, {path: "/dev"}, {path: "/sys"}}
+	for _, m := range cfg.Mounts {
+		p := mountpoint{path: path.Clean("/" + m.Destination)}
+		if m.Type == spec.MountBind {
+			fi, err := os.Stat(m.Source)
+			p.file = err == nil && !fi.IsDir()
+		}
+		all = append(all, p)
+	}
+	for _, name := range []string{"hostname", "hosts", "resolv.conf"} {
+		all = append(all, mountpoint{path: path.Join("/etc", name), file: true})
+	}
+
+	for _, p := range all {
+		if !nestedIn(p.path, all) {
+			points = append(points, p)
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		return strings.Count(points[i].path, "/") < strings.Count(points[j].path, "/")
+	})
+
+	return points
+}
+
+// nestedIn returns whether p is in one of the given mount points, other than p itself.
+func nestedIn(p string, points []mountpoint) bool {
+	for _, other := range points {
+		if other.path != "/" && strings.HasPrefix(p, other.path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// provideMountpoints creates the missing mount points of the box with the given config. With an
+// overlay rootfs, they are created in the box's upper layer. Otherwise the rootfs is left
+// untouched, and an overlay is mounted over the nearest existing parent of each missing mount
+// point, with its upper layer in a tmpfs at the box's MountpointsDir, in which it is created.
+func provideMountpoints(cfg Config) error {
+	var overlays []string
+	for _, p := range mountpoints(cfg) {
+		at, err := system.SecureJoin(cfg.RootFs, p.path)
+		if err != nil {
+			return stageError(StageMounts, p.path, err)
+		}
+		if _, err = os.Lstat(at); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return stageError(StageMounts, at, err)
+		}
+
+		if len(cfg.RootFsLowerdirs) == 0 && !inDirs(at, overlays) {
+			parent, err := existingParent(cfg.RootFs, at)
+			if err != nil {
+				return stageError(StageMounts, at, err)
+			}
+			if err = mountScratchOverlay(cfg.MountpointsDir, len(overlays), parent); err != nil {
+				return stageError(StageMounts, parent, err)
+			}
+			overlays = append(overlays, parent)
+		}
+
+		if p.file {
+			err = createFile(at)
+		} else {
+			err = os.MkdirAll(at, 0755)
+		}
+		if err != nil {
+			return stageError(StageMounts, at, fmt.Errorf("creating mount point: %w", err))
+		}
+	}
+
+	return nil
+}
+
+// inDirs returns whether p is one of the given dirs or is in one of them.
+func inDirs(p string, dirs []string) bool {
+	for _, dir := range dirs {
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// existingParent returns the nearest parent of p, up to rootFs, which exists.
+func existingParent(rootFs, p string) (parent string, err error) {
+	for parent = filepath.Dir(p); parent != rootFs; parent = filepath.Dir(parent) {
+		if _, err = os.Lstat(parent); err == nil {
+			return parent, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return rootFs, nil
+}
+
+// mountScratchOverlay mounts an overlay over dir, with dir as its lowerdir and its upper layer in
+// a tmpfs at scratchDir, mounted on the first call. Each overlay is given its own index.
+func mountScratchOverlay(scratchDir string, index int, dir string) error {
+	if index == 0 {
+		if err := os.MkdirAll(scratchDir, 0755); err != nil {
+			return fmt.Errorf("creating scratch dir: %w", err)
+		}
+		err := unix.Mount("tmpfs", scratchDir, "tmpfs", unix.MS_NODEV|unix.MS_NOSUID, "mode=755")
+		if err != nil {
+			return fmt.Errorf("mounting scratch tmpfs: %w", err)
+		}
+	}
+
+	upper := filepath.Join(scratchDir, strconv.Itoa(index), "upper")
+	work := filepath.Join(scratchDir, strconv.Itoa(index), "work")
+	for _, d := range []string{upper, work} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return fmt.Errorf("creating overlay dir: %w", err)
+		}
+	}
+
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", dir, upper, work)
+	if err := unix.Mount("overlay", dir, "overlay", 0, data); err != nil {
+		return fmt.Errorf("mounting overlay: %w", err)
+	}
+
+	return nil
+}
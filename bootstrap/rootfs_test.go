@@ -0,0 +1,97 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cprates/box/spec"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMountpoints(t *testing.T) {
+	cfg := Config{
+		Mounts: []spec.Mount{
+			{Destination: "/data/cache", Type: spec.MountTmpfs},
+			{Destination: "/dev/hugepages", Type: spec.MountTmpfs},
+			{Destination: "/etc", Type: spec.MountTmpfs},
+		},
+	}
+
+	expected := []mountpoint{
+		{path: "/proc"}, {path: "/tmp"}, {path: "/dev"}, {path: "/sys"}, {path: "/etc"},
+		{path: "/data/cache"},
+	}
+	if points := mountpoints(cfg); !reflect.DeepEqual(points, expected) {
+		t.Errorf("expected %v, got %v", expected, points)
+	}
+}
+
+func TestProvideMountpoints(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "mountpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootFs := filepath.Join(dir, "rootfs")
+	if err = os.MkdirAll(filepath.Join(rootFs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(rootFs, "etc", "hosts"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a read-only rootfs can't be changed, so its mount points must be provided elsewhere
+	if err = unix.Mount(rootFs, rootFs, "", unix.MS_BIND, ""); err != nil {
+		t.Fatal(err)
+	}
+	err = unix.Mount("", rootFs, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scratch := filepath.Join(dir, "scratch")
+	defer func() {
+		for _, mnt := range []string{rootFs, rootFs, scratch} {
+			_ = unix.Unmount(mnt, unix.MNT_DETACH)
+		}
+	}()
+
+	cfg := Config{
+		RootFs:         rootFs,
+		MountpointsDir: scratch,
+		Mounts:         []spec.Mount{{Destination: "/data/cache", Type: spec.MountTmpfs}},
+	}
+	if err = provideMountpoints(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{
+		"/proc", "/tmp", "/dev", "/sys", "/data/cache",
+		"/etc/hostname", "/etc/hosts", "/etc/resolv.conf",
+	} {
+		if _, err = os.Stat(filepath.Join(rootFs, p)); err != nil {
+			t.Errorf("expected mount point %s to exist: %s", p, err)
+		}
+	}
+
+	for _, mnt := range []string{rootFs, rootFs} {
+		if err = unix.Unmount(mnt, unix.MNT_DETACH); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := ioutil.ReadDir(rootFs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected rootfs to be left untouched, got %d entries", len(files))
+	}
+}
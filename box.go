@@ -14,6 +14,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/cprates/box/boxlog"
 	"github.com/cprates/box/boxnet"
 	"github.com/cprates/box/spec"
 	"github.com/cprates/box/system"
@@ -38,12 +39,25 @@ type boxInternal struct {
 	childProcess process
 	config
 	lock sync.Mutex
+	// networks and ipam resolve the box's network and allocate its addresses, if its netconf
+	// asks for it
+	networks *boxnet.NetworkStore
+	ipam     *boxnet.IPAM
 }
 
 type process struct {
 	created bool
 	pid     int
 	io      ProcessIO
+	console *os.File
+	cmd     *exec.Cmd
+	logger  *boxlog.Writer
+	attach  *attachServer
+	ioWG    sync.WaitGroup
+	// execResult receives the result of executing the entry point
+	execResult <-chan error
+	// proxies of the box's ports published by this process
+	proxies []*boxnet.PortProxy
 }
 
 // ProcessIO is used to pass to the runtime the communication channels.
@@ -61,9 +75,52 @@ type config struct {
 	EntryPoint     string
 	EntryPointArgs []string // entryPoint args
 	EnvVars        []string
+	UID            uint32
+	GID            uint32
+	AdditionalGids []uint32 `json:",omitempty"`
 	ExecFifoPath   string
 	StateFilePath  string
-	NetConfig      *boxnet.NetConf `json:"NetConfig,omitempty"`
+	Terminal       bool
+	ConsoleSocket  string
+	Shim           bool
+	LogFile        string
+	LogMaxSize     int64
+	LogMaxFiles    int
+	Attach         bool
+	// dir where the box's /etc files, such as hosts, are generated
+	EtcDir string
+	// dir where the upper layers of the overlays providing the mount points missing in the
+	// rootfs are kept, when it doesn't have an overlay
+	MountpointsDir string
+	// when Overlay is set, RootFs is the mount point of an overlay made of the following dirs
+	Overlay         bool
+	KeepUpper       bool
+	RootFsLowerdirs []string `json:",omitempty"`
+	RootFsUpperdir  string   `json:",omitempty"`
+	RootFsWorkdir   string   `json:",omitempty"`
+	// when RootFsFile is set, it is attached to RootFsDevice and mounted read-only at
+	// RootFsFileMount, which is either RootFs or the overlay's lowerdir
+	RootFsFile      string `json:",omitempty"`
+	RootFsType      string `json:",omitempty"`
+	RootFsDevice    string `json:",omitempty"`
+	RootFsFileMount string `json:",omitempty"`
+	// max size in bytes of the overlay's upper dir, 0 if unlimited
+	DiskQuota int64 `json:",omitempty"`
+	// sizes in bytes of /tmp and /dev/shm, 0 for the defaults
+	TmpSize int64 `json:",omitempty"`
+	ShmSize int64 `json:",omitempty"`
+	// additional mounts, with volumes already resolved to bind mounts
+	Mounts []spec.Mount `json:",omitempty"`
+	// names of the volumes used by the box, released once it is destroyed
+	Volumes []string `json:",omitempty"`
+	// entries for the hosts file other than the box's own, such as for its bridge peers
+	Hosts []boxnet.HostEntry `json:",omitempty"`
+	// addresses of the box set up by its network model besides the ones of its netconf
+	// interfaces, such as the CNI ones
+	NetAddresses []string `json:",omitempty"`
+	// PID of the box whose NS is joined by the box, when sharing the NS of another box
+	NetNSPID  int             `json:",omitempty"`
+	NetConfig *boxnet.NetConf `json:"NetConfig,omitempty"`
 }
 
 type openResult struct {
@@ -114,14 +171,57 @@ func (b *boxInternal) create(
 		EntryPoint:     spec.Process.Args[0],
 		EntryPointArgs: append(spec.Process.Args[:0:0], spec.Process.Args...)[1:],
 		EnvVars:        spec.Process.Env,
+		UID:            spec.Process.User.UID,
+		GID:            spec.Process.User.GID,
+		AdditionalGids: spec.Process.User.AdditionalGids,
 		ExecFifoPath:   filepath.Join(workdir, execFifoFilename),
 		StateFilePath:  filepath.Join(workdir, stateFilename),
+		EtcDir:         filepath.Join(workdir, etcDirname),
+		MountpointsDir: filepath.Join(workdir, mountpointsDirname),
+		Terminal:       spec.Process.Terminal,
+		LogMaxSize:     boxlog.DefaultMaxSize,
+		LogMaxFiles:    boxlog.DefaultMaxFiles,
+		// image layers are always stacked with an overlay
+		Overlay:         len(spec.Root.Layers) > 0,
+		RootFsLowerdirs: overlayLowerdirs(spec.Root.Layers),
+		RootFsFile:      spec.Root.File,
+		RootFsType:      spec.Root.FsType,
+		Mounts:          spec.Mounts,
 	}
 
 	for _, opt := range opts {
 		opt(b)
 	}
 
+	if err = b.resolveNetwork(); err != nil {
+		err = fmt.Errorf("resolving network: %s", err)
+		return
+	}
+
+	if err = b.prepareRootFs(workdir); err != nil {
+		err = fmt.Errorf("preparing rootfs: %s", err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = releaseQuota(b.config)
+		}
+	}()
+
+	if b.config.Shim {
+		return b.createOnShim()
+	}
+
+	if err = b.createBox(); err != nil {
+		return
+	}
+	b.closeProxiesOnExit()
+
+	return
+}
+
+// createBox creates the box's process on this process, which becomes its parent.
+func (b *boxInternal) createBox() (err error) {
 	if err = b.createExecFifo(); err != nil {
 		err = fmt.Errorf("creating exec fifo: %s", err)
 		return
@@ -132,10 +232,18 @@ func (b *boxInternal) create(
 	err = b.start()
 	if err != nil {
 		b.deleteExecFifo()
-		err = fmt.Errorf("creating container: %s", err)
+		err = fmt.Errorf("creating container: %w", err)
 		return
 	}
 
+	if b.childProcess.console != nil {
+		err = b.handOverConsole()
+		if err != nil {
+			err = fmt.Errorf("handing over console: %s", err)
+			return
+		}
+	}
+
 	return
 }
 
@@ -158,19 +266,76 @@ func (b *boxInternal) run(
 		EntryPoint:     spec.Process.Args[0],
 		EntryPointArgs: append(spec.Process.Args[:0:0], spec.Process.Args...)[1:],
 		EnvVars:        spec.Process.Env,
+		UID:            spec.Process.User.UID,
+		GID:            spec.Process.User.GID,
+		AdditionalGids: spec.Process.User.AdditionalGids,
 		StateFilePath:  filepath.Join(workdir, stateFilename),
+		EtcDir:         filepath.Join(workdir, etcDirname),
+		MountpointsDir: filepath.Join(workdir, mountpointsDirname),
+		Terminal:       spec.Process.Terminal,
+		LogMaxSize:     boxlog.DefaultMaxSize,
+		LogMaxFiles:    boxlog.DefaultMaxFiles,
+		// image layers are always stacked with an overlay
+		Overlay:         len(spec.Root.Layers) > 0,
+		RootFsLowerdirs: overlayLowerdirs(spec.Root.Layers),
+		RootFsFile:      spec.Root.File,
+		RootFsType:      spec.Root.FsType,
+		Mounts:          spec.Mounts,
 	}
 
 	for _, opt := range opts {
 		opt(b)
 	}
 
+	if err = b.resolveNetwork(); err != nil {
+		err = fmt.Errorf("resolving network: %s", err)
+		return
+	}
+
+	if err = b.prepareRootFs(workdir); err != nil {
+		err = fmt.Errorf("preparing rootfs: %s", err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = releaseQuota(b.config)
+		}
+	}()
+
 	err = b.start()
 	if err != nil {
 		return
 	}
 
-	<-awaitProcessExit(b.childProcess.pid, make(chan struct{}))
+	var consoleDone <-chan struct{}
+	if b.childProcess.console != nil {
+		consoleDone, err = b.proxyConsole(true)
+		if err != nil {
+			err = fmt.Errorf("proxying console: %s", err)
+			return
+		}
+	}
+
+	// this process is the box's parent so, it must reap it
+	_ = b.childProcess.cmd.Wait()
+	if b.childProcess.console != nil {
+		<-consoleDone
+		b.childProcess.console.Close()
+	}
+	b.closeIO()
+	b.closeProxies()
+
+	execErr := <-b.childProcess.execResult
+
+	if err = releaseNet(b.state); err != nil {
+		err = fmt.Errorf("releasing network: %s", err)
+		return
+	}
+
+	if err = releaseRootFs(b.config); err != nil {
+		err = fmt.Errorf("releasing rootfs: %s", err)
+		return
+	}
 
 	err = os.RemoveAll(workdir)
 	if err != nil {
@@ -178,6 +343,10 @@ func (b *boxInternal) run(
 		return
 	}
 
+	if execErr != nil {
+		err = fmt.Errorf("starting box: %w", execErr)
+	}
+
 	return
 }
 
@@ -204,19 +373,37 @@ func (b *boxInternal) Start() error {
 }
 
 func (b *boxInternal) start() (err error) {
+	if b.config.RootFsFile != "" {
+		var dev *os.File
+		dev, err = system.AttachLoop(b.config.RootFsFile, true)
+		if err != nil {
+			err = fmt.Errorf("attaching rootfs file: %s", err)
+			return
+		}
+		// once the child mounts it, the device is detached as soon as the box's mount namespace
+		// is gone, otherwise it is detached once closed
+		defer dev.Close()
+		defer func() {
+			if err != nil {
+				_ = system.DetachLoop(dev.Name(), b.config.RootFsFile)
+			}
+		}()
+		b.config.RootFsDevice = dev.Name()
+	}
+
 	cmd := exec.Command("/proc/self/exe", "bootstrap")
-	cmd.Stdin = b.childProcess.io.In
-	cmd.Stdout = b.childProcess.io.Out
-	cmd.Stderr = b.childProcess.io.Err
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Cloneflags: syscall.CLONE_NEWUTS |
 			syscall.CLONE_NEWPID |
 			syscall.CLONE_NEWNS |
-			syscall.CLONE_NEWIPC |
-			syscall.CLONE_NEWNET,
+			syscall.CLONE_NEWIPC,
 		//syscall.CLONE_NEWUSER,
 		Unshareflags: syscall.CLONE_NEWNS,
 	}
+	sharesNS := b.config.NetConfig != nil && b.config.NetConfig.SharesNS()
+	if !sharesNS {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
 
 	configRPipe, configWPipe, err := os.Pipe()
 	if err != nil {
@@ -229,16 +416,27 @@ func (b *boxInternal) start() (err error) {
 	cmd.ExtraFiles = append(cmd.ExtraFiles, os.NewFile(configRPipe.Fd(), "configPipe"))
 	configFd := stdioFdCount + len(cmd.ExtraFiles) - 1
 
+	syncRPipe, syncWPipe, err := os.Pipe()
+	if err != nil {
+		err = fmt.Errorf("creating syncPipe: %s", err)
+		return
+	}
+	defer syncWPipe.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, syncWPipe)
+	syncFd := stdioFdCount + len(cmd.ExtraFiles) - 1
+
 	cmd.Env = []string{
 		"BOX_BOOTSTRAP_CONFIG_FD=" + strconv.Itoa(configFd),
-		"BOX_BOOTSTRAP_LOG_FD=" + strconv.Itoa(int(b.childProcess.io.Out.Fd())),
+		"BOX_BOOTSTRAP_SYNC_FD=" + strconv.Itoa(syncFd),
+		"BOX_BOOTSTRAP_LOG_FD=" + strconv.Itoa(syscall.Stdout),
 		"BOX_DEBUG=" + os.Getenv("BOX_DEBUG"),
 	}
 
-	// send box config
-	if err = json.NewEncoder(configWPipe).Encode(&b.config); err != nil {
-		err = fmt.Errorf("sending config to child: %s", err)
-		return
+	if b.config.NetConfig != nil && b.config.NetConfig.DNS.BridgePeers {
+		if b.config.Hosts, err = b.bridgePeers(); err != nil {
+			err = fmt.Errorf("looking up bridge peers: %s", err)
+			return
+		}
 	}
 
 	if err = b.includeExecFifo(cmd); err != nil {
@@ -246,39 +444,153 @@ func (b *boxInternal) start() (err error) {
 		return
 	}
 
-	if err = cmd.Start(); err != nil {
+	var consoleSocket, childSocket *os.File
+	if b.config.Terminal {
+		consoleSocket, childSocket, err = newConsoleSocketPair()
+		if err != nil {
+			err = fmt.Errorf("creating console socket: %s", err)
+			return
+		}
+		defer consoleSocket.Close()
+		// the parent must drop its copy of the child's end so that it gets notified if the
+		// child dies before sending the console
+		defer childSocket.Close()
+
+		cmd.ExtraFiles = append(cmd.ExtraFiles, childSocket)
+		cmd.Env = append(
+			cmd.Env,
+			fmt.Sprintf("BOX_CONSOLE_FD=%d", stdioFdCount+len(cmd.ExtraFiles)-1),
+		)
+	}
+
+	stdioStarted, err := b.setupStdio(cmd)
+	if err != nil {
+		err = fmt.Errorf("setting up stdio: %s", err)
+		return
+	}
+
+	if b.config.NetNSPID != 0 {
+		err = startOnNetNS(cmd, b.config.NetNSPID)
+	} else {
+		err = cmd.Start()
+	}
+	stdioStarted()
+	// only the child must hold the write end, so that EOF is read once it execs or dies
+	syncWPipe.Close()
+	if err != nil {
+		syncRPipe.Close()
 		err = fmt.Errorf("starting child: %s", err)
 		return
 	}
+	bootSync := json.NewDecoder(syncRPipe)
+	defer func() {
+		if err != nil {
+			syncRPipe.Close()
+		}
+	}()
 
 	b.childProcess.pid = cmd.Process.Pid
 	b.childProcess.created = true
+	b.childProcess.cmd = cmd
 	b.state = state{
 		BoxPID:    b.childProcess.pid,
 		Created:   b.childProcess.created,
 		BoxConfig: b.config,
 	}
+	if b.config.Shim {
+		shimStat, err := system.Stat(os.Getpid())
+		if err != nil {
+			return killChild(cmd, fmt.Errorf("unable to stat shim: %s", err))
+		}
+		b.state.ShimPID = os.Getpid()
+		b.state.ShimStartClockTicks = shimStat.StartTime
+	}
 
 	stat, err := system.Stat(cmd.Process.Pid)
-	if err == nil {
-		b.state.ProcessStartClockTicks = stat.StartTime
+	if err != nil {
+		return killChild(cmd, fmt.Errorf("unable to stat child: %s", err))
+	}
+	b.state.ProcessStartClockTicks = stat.StartTime
 
-		if b.config.NetConfig != nil {
-			if err = b.setupNetFromConfig(); err != nil {
-				return
+	// the NS shared with the host or another box is already set up
+	if b.config.NetConfig != nil && !sharesNS {
+		if b.state.Net, err = b.setupNetFromConfig(); err != nil {
+			return killChild(cmd, err)
+		}
+		defer func() {
+			if err != nil {
+				_ = releaseNet(b.state)
 			}
+		}()
+		if err = b.applyNetResult(); err != nil {
+			return killChild(cmd, err)
 		}
+		b.state.BoxConfig = b.config
 
-		if err = b.saveState(); err == nil {
-			return
+		if b.state.Net.Ports, err = b.publishPorts(); err != nil {
+			return killChild(cmd, fmt.Errorf("publishing ports: %s", err))
+		}
+		defer func() {
+			if err != nil {
+				b.closeProxies()
+			}
+		}()
+	}
+
+	// the config is only sent once the network is set up, since the child writes the box's
+	// hosts and resolv.conf files with the addresses and DNS config set up by its model
+	if err = json.NewEncoder(configWPipe).Encode(&b.config); err != nil {
+		return killChild(cmd, fmt.Errorf("sending config to child: %s", err))
+	}
+
+	if err = waitBootstrap(bootSync); err != nil {
+		return killChild(cmd, fmt.Errorf("bootstrapping box: %w", err))
+	}
+	// the result of executing the entry point is only known when the box is started
+	b.childProcess.execResult = awaitExec(bootSync, syncRPipe)
+
+	if consoleSocket != nil {
+		childSocket.Close()
+		b.childProcess.console, err = receiveConsole(consoleSocket)
+		if err != nil {
+			return killChild(cmd, fmt.Errorf("receiving console: %s", err))
 		}
 	}
 
-	// we were unable to save the box's state so, kill the brand new child process
-	err = fmt.Errorf("unable to save state: %s", err)
+	if err = b.saveState(); err != nil {
+		if b.childProcess.console != nil {
+			b.childProcess.console.Close()
+		}
+		return killChild(cmd, fmt.Errorf("unable to save state: %s", err))
+	}
+
+	return
+}
+
+// startOnNetNS starts cmd in the net NS of the process with the given PID, which the child
+// inherits from the thread starting it.
+func startOnNetNS(cmd *exec.Cmd, pid int) (err error) {
+	nsErr := boxnet.ExecuteOnNs(pid, func() {
+		err = cmd.Start()
+	})
+	if err == nil && nsErr != nil {
+		if cmd.Process != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}
+		return fmt.Errorf("joining net NS of PID %d: %s", pid, nsErr)
+	}
+
+	return
+}
+
+// killChild kills the given child process and waits for it to die, returning the given cause
+// enriched with any error found in the process.
+func killChild(cmd *exec.Cmd, cause error) (err error) {
+	err = cause
 
 	if e := cmd.Process.Kill(); e != nil {
-		e = fmt.Errorf("%s, also failed to kill child process: %s", err, e)
+		err = fmt.Errorf("%w, also failed to kill child process: %s", err, e)
 		return
 	}
 
@@ -288,29 +600,40 @@ func (b *boxInternal) start() (err error) {
 	}()
 
 	select {
-	case e := <-errC:
-		if e != nil {
-			e = fmt.Errorf("%s, also failed while waiting for child process to die: %s", err, e)
-			return
-		}
+	case <-errC:
 	case <-time.After(500 * time.Millisecond):
-		err = fmt.Errorf("%s, also child process didn't return in time after being killed", err)
-		return
+		err = fmt.Errorf("%w, also child process didn't return in time after being killed", err)
 	}
 
-	// TODO
-	//go func() {
-	//	// TODO: Not sure but the doc string state that cmd.Wait releases resources, but this
-	//	//   will never return because this process will finish before the child
-	//	if err = cmd.Wait(); err != nil {
-	//		err = fmt.Errorf("box: bootstrapping box instance: %s", err)
-	//		return
-	//	}
-	//}()
-
 	return
 }
 
+// handOverConsole sends the box's console to the configured console socket if any. Otherwise,
+// if the box is logged or can be attached to, the console is served by this process, or else
+// it's proxied through the box's ProcessIO. Either way, for as long as this process lives.
+func (b *boxInternal) handOverConsole() error {
+	if b.config.ConsoleSocket != "" {
+		defer b.childProcess.console.Close()
+		return sendConsole(b.config.ConsoleSocket, b.childProcess.console)
+	}
+
+	if b.childProcess.logger == nil && b.childProcess.attach == nil {
+		_, err := b.proxyConsole(false)
+		return err
+	}
+
+	b.childProcess.ioWG.Add(1)
+	go func() {
+		// the copy ends with EIO as soon as the last process holding the slave exits
+		b.copyOutput(streamStdout, b.childProcess.console)
+	}()
+	if b.childProcess.attach != nil {
+		b.childProcess.attach.serve(b.childProcess.console, b.childProcess.console)
+	}
+
+	return nil
+}
+
 func (b *boxInternal) exec() error {
 	fifoOpen := make(chan struct{})
 	select {
@@ -369,59 +692,71 @@ func (b *boxInternal) includeExecFifo(cmd *exec.Cmd) error {
 	return nil
 }
 
-func (b *boxInternal) setupNetFromConfig() error {
-	// search for module
-	netConfig := b.config.NetConfig
-	if netConfig.Model != nil {
-		m, err := boxnet.ModelFromConfig(netConfig.Model)
+// setupNetFromConfig sets up the box's network, returning the host side resources created,
+// which are tagged so that they can be found if leaked.
+func (b *boxInternal) setupNetFromConfig() (res boxnet.Resources, err error) {
+	tag := boxnet.Tag(filepath.Dir(b.config.StateFilePath))
+	var ifaces []boxnet.NsIFacer
+	defer func() {
 		if err != nil {
-			return fmt.Errorf("getting network model type: %s", err)
+			for _, iface := range ifaces {
+				_ = iface.Delete()
+			}
 		}
+	}()
 
-		switch m {
-		case "bridge":
-			modelConfig := boxnet.ModelBridge{}
-			err := boxnet.ConfigFromRawConfig(netConfig.Model, &modelConfig)
-			if err != nil {
-				return fmt.Errorf("parsing model config: %+v ** %s", netConfig.Model, err)
-			}
-			_, err = boxnet.NewBridgeModel(modelConfig.BrName, b.childProcess.pid, netConfig.Interfaces)
-			if err != nil {
-				return fmt.Errorf("creating network model: %s", err)
-			}
-		default:
-			return fmt.Errorf("unknown model type %q", m)
+	netConfig := b.config.NetConfig
+	if netConfig.IPv6 != nil {
+		if err = boxnet.ConfigureIPv6(*netConfig.IPv6, b.childProcess.pid); err != nil {
+			return res, fmt.Errorf("configuring ipv6: %s", err)
 		}
+	}
 
-		return nil
+	// the model, if any, is in charge of all the interfaces
+	if netConfig.Model != nil {
+		var model boxnet.Modeler
+		if model, err = boxnet.NewModel(netConfig, b.childProcess.pid); err != nil {
+			return res, fmt.Errorf("creating network model: %s", err)
+		}
+		if res, err = tagIFaces(model.IFaces(), tag); err != nil {
+			_ = model.Close()
+			return
+		}
+		if rm, ok := model.(boxnet.ResourceModeler); ok {
+			modelRes := rm.Resources()
+			res.CNI, res.Masquerade = modelRes.CNI, modelRes.Masquerade
+		}
+
+		return
 	}
 
-	// if a model is not configured, handle interfaces on their own
+	var hostIfaces []boxnet.IFacer
 	for _, rawConf := range netConfig.Interfaces {
-		t, err := boxnet.TypeFromConfig(rawConf)
+		iface, err := boxnet.IFaceFromConfig(rawConf, b.childProcess.pid)
 		if err != nil {
-			return fmt.Errorf("getting iface type: %s", err)
+			return res, fmt.Errorf("setting up iface: %s", err)
 		}
+		ifaces = append(ifaces, iface)
 
-		switch t {
-		case "veth":
-			cfg := boxnet.VethConf{}
-			err := boxnet.ConfigFromRawConfig(rawConf, &cfg)
-			if err != nil {
-				return fmt.Errorf("parsing iface config: %+v ** %s", rawConf, err)
-			}
-
-			_, err = boxnet.AttachVeth(cfg, b.childProcess.pid)
-			if err != nil {
-				return fmt.Errorf("unable to attach veth %q: %s", cfg.Name, t)
-			}
-		default:
-			return fmt.Errorf("unexpected iface type: %s", t)
+		// the ones only living in the box's NS leave nothing to tag on the host
+		if hostIface, ok := iface.(boxnet.IFacer); ok {
+			hostIfaces = append(hostIfaces, hostIface)
 		}
+	}
 
+	return tagIFaces(hostIfaces, tag)
+}
+
+// tagIFaces tags the host side links of the given interfaces, returning them as resources.
+func tagIFaces(ifaces []boxnet.IFacer, tag string) (res boxnet.Resources, err error) {
+	for _, iface := range ifaces {
+		if err = iface.SetAlias(tag); err != nil {
+			return res, fmt.Errorf("tagging iface %q: %s", iface.Name(), err)
+		}
+		res.Links = append(res.Links, iface.Name())
 	}
 
-	return nil
+	return res, nil
 }
 
 func readFromExecFifo(execFifo io.Reader) error {
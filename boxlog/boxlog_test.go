@@ -0,0 +1,138 @@
+package boxlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func readAll(t *testing.T, path string, opts ReadOptions) (lines []string) {
+	err := Read(path, opts, func(e Entry) error {
+		lines = append(lines, e.Stream+":"+e.Log)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func TestWriteAndRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boxlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "box.log")
+
+	w, err := NewWriter(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := w.Stream("stdout")
+	errOut := w.Stream("stderr")
+	_, _ = out.Write([]byte("line 1\nline"))
+	_, _ = errOut.Write([]byte("error 1\n"))
+	_, _ = out.Write([]byte(" 2\nunfinished"))
+	_ = out.Close()
+	_ = w.Close()
+
+	expects := []string{"stdout:line 1\n", "stderr:error 1\n", "stdout:line 2\n", "stdout:unfinished"}
+	lines := readAll(t, path, ReadOptions{Tail: -1})
+	if !reflect.DeepEqual(lines, expects) {
+		t.Errorf("expects %q, got %q", expects, lines)
+	}
+
+	lines = readAll(t, path, ReadOptions{Tail: 2})
+	if !reflect.DeepEqual(lines, expects[2:]) {
+		t.Errorf("tail: expects %q, got %q", expects[2:], lines)
+	}
+
+	lines = readAll(t, path, ReadOptions{Tail: -1, Since: time.Now().Add(time.Hour)})
+	if len(lines) != 0 {
+		t.Errorf("since: expects no entries, got %q", lines)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boxlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "box.log")
+
+	// each entry is ~70 bytes so, each file holds a single entry
+	w, err := NewWriter(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := w.Stream("stdout")
+	for _, l := range []string{"1\n", "2\n", "3\n", "4\n"} {
+		_, _ = out.Write([]byte(l))
+	}
+	_ = w.Close()
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expects at most 2 rotated files, got err %v", err)
+	}
+
+	expects := []string{"stdout:2\n", "stdout:3\n", "stdout:4\n"}
+	lines := readAll(t, path, ReadOptions{Tail: -1})
+	if !reflect.DeepEqual(lines, expects) {
+		t.Errorf("expects %q, got %q", expects, lines)
+	}
+
+	lines = readAll(t, path, ReadOptions{Tail: 2})
+	if !reflect.DeepEqual(lines, expects[1:]) {
+		t.Errorf("tail: expects %q, got %q", expects[1:], lines)
+	}
+}
+
+func TestRotatedSince(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boxlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "box.log")
+
+	w, err := NewWriter(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	out := w.Stream("stdout")
+	_, _ = out.Write([]byte("1\n"))
+
+	rotated, err := openRotated(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 0 || rotatedSince(path, rotated) {
+		t.Fatalf("expects no rotated files, got %d", len(rotated))
+	}
+
+	_, _ = out.Write([]byte("2\n"))
+	if !rotatedSince(path, rotated) {
+		t.Error("expects a rotation to be detected with no rotated files opened")
+	}
+
+	rotated, err = openRotated(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAll(rotated)
+	if len(rotated) != 1 || rotatedSince(path, rotated) {
+		t.Fatalf("expects a single rotated file and no rotation, got %d", len(rotated))
+	}
+
+	_, _ = out.Write([]byte("3\n"))
+	if !rotatedSince(path, rotated) {
+		t.Error("expects a rotation to be detected")
+	}
+}
@@ -0,0 +1,224 @@
+package boxlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ReadOptions controls which entries are read from a log file.
+type ReadOptions struct {
+	// Follow keeps waiting for new entries after reaching the end of the log, until Stop is
+	// closed.
+	Follow bool
+	// Since filters out entries older than the given time, if set.
+	Since time.Time
+	// Tail limits the output to the last Tail entries. A negative value reads all entries.
+	Tail int
+	// Stop stops following the log, after reading what is already written.
+	Stop <-chan struct{}
+}
+
+// followInterval is how often a followed log file is checked for new entries.
+const followInterval = 100 * time.Millisecond
+
+// Read reads the entries of the log at path, including its rotated files, calling handle for
+// each one in the order they were written.
+func Read(path string, opts ReadOptions, handle func(Entry) error) (err error) {
+	var tail []Entry
+	emit := since(opts.Since, handle)
+	if opts.Tail >= 0 {
+		// entries are only emitted once all files are read, keeping the last ones
+		emit = since(opts.Since, func(e Entry) error {
+			if opts.Tail == 0 {
+				return nil
+			}
+			if len(tail) == opts.Tail {
+				tail = tail[1:]
+			}
+			tail = append(tail, e)
+			return nil
+		})
+	}
+
+	rotated, f, err := openLog(path)
+	if err != nil {
+		return
+	}
+	defer func() {
+		f.Close()
+	}()
+	defer closeAll(rotated)
+
+	for _, r := range rotated {
+		if _, err = readEntries(bufio.NewReader(r), nil, emit); err != nil {
+			return
+		}
+	}
+
+	rd := bufio.NewReader(f)
+	var partial []byte
+	if partial, err = readEntries(rd, nil, emit); err != nil {
+		return
+	}
+
+	for _, e := range tail {
+		if err = handle(e); err != nil {
+			return
+		}
+	}
+
+	if !opts.Follow {
+		return nil
+	}
+	handle = since(opts.Since, handle)
+
+	for {
+		stopped := false
+		select {
+		case <-opts.Stop:
+			stopped = true
+		case <-time.After(followInterval):
+		}
+
+		if partial, err = readEntries(rd, partial, handle); err != nil {
+			return
+		}
+		if stopped {
+			return nil
+		}
+
+		rotated, e := wasRotated(f, path)
+		if e != nil || !rotated {
+			continue
+		}
+
+		// the file we hold was rotated, so after reading what's left switch to the new one
+		if partial, err = readEntries(rd, partial, handle); err != nil {
+			return
+		}
+		newF, e := os.Open(path)
+		if e != nil {
+			continue
+		}
+		f.Close()
+		f = newF
+		rd = bufio.NewReader(f)
+		partial = nil
+	}
+}
+
+func since(t time.Time, handle func(Entry) error) func(Entry) error {
+	return func(e Entry) error {
+		if !t.IsZero() && e.Time.Before(t) {
+			return nil
+		}
+		return handle(e)
+	}
+}
+
+// openLog opens the rotated files of the log at path, from the oldest to the newest, and then
+// the active one. The rotated files are opened first, and all are opened again if the log was
+// rotated meanwhile, so that no entry is missed nor read twice.
+func openLog(path string) (rotated []*os.File, active *os.File, err error) {
+	for {
+		rotated, err = openRotated(path)
+		if err != nil {
+			return
+		}
+		if active, err = os.Open(path); err != nil {
+			closeAll(rotated)
+			return nil, nil, fmt.Errorf("opening log file: %s", err)
+		}
+
+		if !rotatedSince(path, rotated) {
+			return
+		}
+		closeAll(rotated)
+		active.Close()
+	}
+}
+
+// openRotated opens the existing rotated files of the log at path, returning them from the
+// oldest to the newest.
+func openRotated(path string) (files []*os.File, err error) {
+	for i := 1; ; i++ {
+		f, e := os.Open(rotatedName(path, i))
+		if os.IsNotExist(e) {
+			return
+		}
+		if e != nil {
+			closeAll(files)
+			return nil, fmt.Errorf("opening log file: %s", e)
+		}
+		files = append([]*os.File{f}, files...)
+	}
+}
+
+// rotatedSince returns whether the log at path was rotated after its rotated files were
+// opened, i.e. the newest rotated file on disk isn't the newest one opened.
+func rotatedSince(path string, rotated []*os.File) bool {
+	onDisk, err := os.Stat(rotatedName(path, 1))
+	if len(rotated) == 0 {
+		return err == nil
+	}
+	if err != nil {
+		return true
+	}
+	opened, err := rotated[len(rotated)-1].Stat()
+	if err != nil {
+		return true
+	}
+
+	return !os.SameFile(opened, onDisk)
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// readEntries reads all the complete entries available in rd, returning any incomplete line
+// found at the end so that it can be completed in the next call.
+func readEntries(rd *bufio.Reader, partial []byte, handle func(Entry) error) ([]byte, error) {
+	for {
+		line, err := rd.ReadBytes('\n')
+		partial = append(partial, line...)
+		if err == io.EOF {
+			return partial, nil
+		}
+		if err != nil {
+			return partial, fmt.Errorf("reading log file: %s", err)
+		}
+
+		e := Entry{}
+		err = json.Unmarshal(partial, &e)
+		partial = nil
+		if err != nil {
+			// skip corrupted entries instead of failing the whole read
+			continue
+		}
+
+		if err = handle(e); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func wasRotated(f *os.File, path string) (bool, error) {
+	current, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	onDisk, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	return !os.SameFile(current, onDisk), nil
+}
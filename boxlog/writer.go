@@ -0,0 +1,170 @@
+package boxlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxSize is the size in bytes a log file can grow up to before being rotated.
+	DefaultMaxSize = 10 * 1024 * 1024
+	// DefaultMaxFiles is the number of rotated log files kept, besides the current one.
+	DefaultMaxFiles = 3
+)
+
+// Entry is a single line of a box log.
+type Entry struct {
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+	Log    string    `json:"log"`
+}
+
+// Writer writes the output streams of a box to a JSON lines log file, rotating it when it
+// reaches its max size. It is safe for concurrent use.
+type Writer struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	lock sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewWriter opens, or creates, the log file at path. The file is rotated as soon as it grows
+// beyond maxSize bytes, keeping at most maxFiles rotated files named path.1, path.2, etc.
+// A maxSize <= 0 disables rotation.
+func NewWriter(path string, maxSize int64, maxFiles int) (*Writer, error) {
+	w := &Writer{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Stream returns a writer which logs each line written to it as an entry of the given stream.
+// Incomplete lines are buffered until complete or the returned writer is closed.
+func (w *Writer) Stream(name string) io.WriteCloser {
+	return &streamWriter{w: w, name: name}
+}
+
+// Close closes the underlying log file.
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.f.Close()
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("opening log file: %s", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("getting log file size: %s", err)
+	}
+
+	w.f = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *Writer) write(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+		if err = w.rotate(); err != nil {
+			return fmt.Errorf("rotating log file: %s", err)
+		}
+	}
+
+	n, err := w.f.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+func (w *Writer) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	if w.maxFiles <= 0 {
+		if err := os.Remove(w.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return w.open()
+	}
+
+	for i := w.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(rotatedName(w.path, i), rotatedName(w.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(w.path, rotatedName(w.path, 1)); err != nil {
+		return err
+	}
+
+	return w.open()
+}
+
+func rotatedName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+type streamWriter struct {
+	w    *Writer
+	name string
+	buf  []byte
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		err := s.w.write(Entry{Stream: s.name, Time: time.Now().UTC(), Log: string(s.buf[:i+1])})
+		s.buf = s.buf[i+1:]
+		if err != nil {
+			return len(p), err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close flushes any incomplete line. It doesn't close the underlying Writer.
+func (s *streamWriter) Close() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+
+	err := s.w.write(Entry{Stream: s.name, Time: time.Now().UTC(), Log: string(s.buf)})
+	s.buf = nil
+	return err
+}
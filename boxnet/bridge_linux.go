@@ -0,0 +1,100 @@
+package boxnet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+)
+
+const ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+// sysClassNetDir is where the links of the NS are listed by sysfs. It only lists the links of the
+// NS which mounted it so, tests use one of their own.
+var sysClassNetDir = "/sys/class/net"
+
+// BridgeConf configures a bridge.
+type BridgeConf struct {
+	Name string
+	// Gateway is the address of the bridge in CIDR format, if any
+	Gateway string
+	// MTU of the bridge, defaults to the kernel's default
+	MTU int
+	// STP enables the spanning tree protocol
+	STP bool
+}
+
+// EnsureBridge returns the bridge with the given name, creating it according to conf if it is
+// missing, in which case IP forwarding is enabled as well so that boxes can reach out through
+// the host. Existing bridges are left as they are.
+func EnsureBridge(conf BridgeConf) (link netlink.Link, created bool, err error) {
+	link, err = netlink.LinkByName(conf.Name)
+	if err == nil {
+		if link.Type() != "bridge" {
+			return nil, false, fmt.Errorf("link %q isn't a bridge", conf.Name)
+		}
+		return link, false, nil
+	}
+	if _, ok := err.(netlink.LinkNotFoundError); !ok {
+		return nil, false, fmt.Errorf("getting bridge %q: %s", conf.Name, err)
+	}
+
+	la := netlink.NewLinkAttrs()
+	la.Name = conf.Name
+	la.MTU = conf.MTU
+	br := &netlink.Bridge{LinkAttrs: la}
+	if err = netlink.LinkAdd(br); err != nil {
+		return nil, false, fmt.Errorf("creating bridge %q: %s", conf.Name, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = netlink.LinkDel(br)
+		}
+	}()
+
+	if conf.STP {
+		stp := filepath.Join(sysClassNetDir, conf.Name, "bridge/stp_state")
+		if err = ioutil.WriteFile(stp, []byte("1"), 0644); err != nil {
+			return nil, false, fmt.Errorf("enabling stp: %s", err)
+		}
+	}
+
+	if conf.Gateway != "" {
+		ip, subnet, err := net.ParseCIDR(conf.Gateway)
+		if err != nil {
+			return nil, false, fmt.Errorf("parsing gateway %q: %s", conf.Gateway, err)
+		}
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: subnet.Mask}}
+		if err = netlink.AddrAdd(br, addr); err != nil {
+			return nil, false, fmt.Errorf("setting bridge address: %s", err)
+		}
+	}
+
+	if err = netlink.LinkSetUp(br); err != nil {
+		return nil, false, fmt.Errorf("setting bridge up: %s", err)
+	}
+
+	if err = ioutil.WriteFile(ipForwardPath, []byte("1"), 0644); err != nil {
+		return nil, false, fmt.Errorf("enabling ip forwarding: %s", err)
+	}
+
+	return br, true, nil
+}
+
+// DeleteBridge deletes the bridge with the given name, if it exists.
+func DeleteBridge(name string) error {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if link.Type() != "bridge" {
+		return fmt.Errorf("link %q isn't a bridge", name)
+	}
+
+	return netlink.LinkDel(link)
+}
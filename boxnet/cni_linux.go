@@ -0,0 +1,473 @@
+package boxnet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cprates/box/system"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultCNIBinDir is the default dir of the CNI plugin binaries
+	DefaultCNIBinDir = "/opt/cni/bin"
+	// DefaultCNIConfDir is the default dir where CNI network configs are looked up
+	DefaultCNIConfDir = "/etc/cni/net.d"
+	cniDefaultIfName  = "eth0"
+	cniDefaultPath    = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// CNIAttachment is the attachment of a box to a CNI network, recorded in its state so that the
+// plugins can be run again with the same arguments to check or delete it.
+type CNIAttachment struct {
+	BinDir string `json:"bin_dir"`
+	// Conf is the network config as a plugin list, as of when the box was attached
+	Conf        json.RawMessage `json:"conf"`
+	ContainerID string          `json:"container_id"`
+	IfName      string          `json:"if_name"`
+	NetNS       string          `json:"netns"`
+	// BindMounted is set when NetNS is a bind mount of the box's NS, removed by Delete
+	BindMounted bool `json:"bind_mounted,omitempty"`
+	// NetNSPID and NetNSStartTime, in clock ticks, identify the process whose NS is NetNS, unless
+	// bind mounted, so that the NS of another process reusing its PID isn't taken as the box's
+	NetNSPID       int    `json:"netns_pid,omitempty"`
+	NetNSStartTime uint64 `json:"netns_start_time,omitempty"`
+	// Result is the result of adding the box to the network
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// cniConfList is a CNI network config list, with each plugin config kept as is.
+type cniConfList struct {
+	CNIVersion string                   `json:"cniVersion"`
+	Name       string                   `json:"name"`
+	Plugins    []map[string]interface{} `json:"plugins"`
+}
+
+// cniResult is the part of a CNI result used by box, the same since version 0.3.0.
+type cniResult struct {
+	Interfaces []struct {
+		Name    string `json:"name"`
+		Sandbox string `json:"sandbox,omitempty"`
+	} `json:"interfaces,omitempty"`
+	IPs []struct {
+		Address   string `json:"address"`
+		Interface *int   `json:"interface,omitempty"`
+	} `json:"ips,omitempty"`
+	DNS struct {
+		Nameservers []string `json:"nameservers,omitempty"`
+		Domain      string   `json:"domain,omitempty"`
+		Search      []string `json:"search,omitempty"`
+	} `json:"dns,omitempty"`
+}
+
+// cniError is the error reported by a failed CNI plugin.
+type cniError struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Details string `json:"details,omitempty"`
+}
+
+type cniModel struct {
+	attachment *CNIAttachment
+}
+
+var _ ResourceModeler = (*cniModel)(nil)
+
+// newCNINetModel is the constructor of the built-in cni model.
+func newCNINetModel(conf interface{}, netConf *NetConf, nsPID int) (Modeler, error) {
+	if len(netConf.Interfaces) > 0 {
+		return nil, errors.New("interfaces are created by the CNI plugins, none can be configured")
+	}
+
+	a, err := AddCNI(*conf.(*ModelCNI), nsPID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cniModel{attachment: a}, nil
+}
+
+func (m *cniModel) IFaces() []IFacer {
+	return nil
+}
+
+func (m *cniModel) Close() error {
+	return m.attachment.Delete()
+}
+
+func (m *cniModel) Resources() Resources {
+	return Resources{CNI: m.attachment}
+}
+
+// AddCNI attaches the box with the given NS PID to the configured CNI network, running the ADD
+// command of each of its plugins. The box is deleted from the network if any of them fails.
+func AddCNI(conf ModelCNI, nsPID int) (a *CNIAttachment, err error) {
+	list, err := loadCNIConf(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 32)
+	if _, err = rand.Read(id); err != nil {
+		return nil, fmt.Errorf("generating container id: %s", err)
+	}
+	a = &CNIAttachment{
+		BinDir:      conf.BinDir,
+		ContainerID: hex.EncodeToString(id),
+		IfName:      conf.IfName,
+		NetNS:       "/proc/" + strconv.Itoa(nsPID) + "/ns/net",
+	}
+	if a.BinDir == "" {
+		a.BinDir = DefaultCNIBinDir
+	}
+	if a.IfName == "" {
+		a.IfName = cniDefaultIfName
+	}
+	if a.Conf, err = json.Marshal(list); err != nil {
+		return nil, err
+	}
+
+	if conf.NetNSDir != "" {
+		path := filepath.Join(conf.NetNSDir, a.ContainerID)
+		if err = bindNetNS(a.NetNS, path); err != nil {
+			return nil, fmt.Errorf("bind mounting netns: %s", err)
+		}
+		a.NetNS = path
+		a.BindMounted = true
+	} else {
+		stat, err := system.Stat(nsPID)
+		if err != nil {
+			return nil, fmt.Errorf("getting start time of NS PID %d: %s", nsPID, err)
+		}
+		a.NetNSPID, a.NetNSStartTime = nsPID, stat.StartTime
+	}
+	defer func() {
+		if err != nil {
+			_ = a.Delete()
+			a = nil
+		}
+	}()
+
+	var result json.RawMessage
+	for _, plugin := range list.Plugins {
+		if result, err = a.exec("ADD", list, plugin, result); err != nil {
+			return
+		}
+	}
+	a.Result = result
+
+	return a, nil
+}
+
+// Check runs the CHECK command of each plugin, which is only supported since version 0.4.0.
+func (a *CNIAttachment) Check() (err error) {
+	list := cniConfList{}
+	if err = json.Unmarshal(a.Conf, &list); err != nil {
+		return fmt.Errorf("parsing network config: %s", err)
+	}
+	if !cniVersionAtLeast(list.CNIVersion, 0, 4) {
+		return fmt.Errorf("CHECK not supported by cniVersion %q", list.CNIVersion)
+	}
+
+	for _, plugin := range list.Plugins {
+		if _, err = a.exec("CHECK", list, plugin, a.Result); err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+// Delete deletes the box from the network, running the DEL command of each plugin in reverse
+// order, returning the first error, and removes the bind mount of its NS, if any, even if a
+// plugin fails. Since the box's NS may be gone already, the plugins get no netns in that case,
+// see netNS.
+func (a *CNIAttachment) Delete() (err error) {
+	list := cniConfList{}
+	if err = json.Unmarshal(a.Conf, &list); err != nil {
+		return fmt.Errorf("parsing network config: %s", err)
+	}
+
+	// the result was only given on DEL since version 0.4.0
+	var prevResult json.RawMessage
+	if cniVersionAtLeast(list.CNIVersion, 0, 4) {
+		prevResult = a.Result
+	}
+	// all the plugins are run, so that a failing one doesn't leak the resources of the others
+	for i := len(list.Plugins) - 1; i >= 0; i-- {
+		if _, e := a.exec("DEL", list, list.Plugins[i], prevResult); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if a.BindMounted {
+		e := unix.Unmount(a.NetNS, unix.MNT_DETACH)
+		if e != nil && e != unix.EINVAL && !os.IsNotExist(e) {
+			return fmt.Errorf("unmounting netns %q: %s", a.NetNS, e)
+		}
+		if e = os.Remove(a.NetNS); e != nil && !os.IsNotExist(e) {
+			return fmt.Errorf("removing netns %q: %s", a.NetNS, e)
+		}
+	}
+
+	return
+}
+
+// Addresses returns the box's addresses in the result, the ones of interfaces in its NS or of
+// no interface in particular.
+func (a *CNIAttachment) Addresses() ([]string, error) {
+	res, err := a.result()
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, ipConf := range res.IPs {
+		if i := ipConf.Interface; i != nil && *i < len(res.Interfaces) &&
+			res.Interfaces[*i].Sandbox == "" {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(ipConf.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address in CNI result: %s", err)
+		}
+		addrs = append(addrs, ip.String())
+	}
+
+	return addrs, nil
+}
+
+// DNS returns the DNS config in the result.
+func (a *CNIAttachment) DNS() (DNSConf, error) {
+	res, err := a.result()
+	if err != nil {
+		return DNSConf{}, err
+	}
+
+	return DNSConf{
+		Nameservers: res.DNS.Nameservers,
+		Domain:      res.DNS.Domain,
+		Search:      res.DNS.Search,
+	}, nil
+}
+
+func (a *CNIAttachment) result() (res cniResult, err error) {
+	if len(a.Result) == 0 {
+		return
+	}
+	if err = json.Unmarshal(a.Result, &res); err != nil {
+		err = fmt.Errorf("parsing CNI result: %s", err)
+	}
+
+	return
+}
+
+// netNS returns the path of the box's NS, or an empty string if it's gone, including when the PID
+// of its process was reused by another process.
+func (a *CNIAttachment) netNS() string {
+	if _, err := os.Stat(a.NetNS); err != nil {
+		return ""
+	}
+
+	if a.NetNSPID != 0 {
+		stat, err := system.Stat(a.NetNSPID)
+		if err != nil || stat.StartTime != a.NetNSStartTime {
+			return ""
+		}
+	}
+
+	return a.NetNS
+}
+
+// exec runs the given command of the given plugin of list, returning its result.
+func (a *CNIAttachment) exec(
+	command string,
+	list cniConfList,
+	plugin map[string]interface{},
+	prevResult json.RawMessage,
+) (
+	result json.RawMessage,
+	err error,
+) {
+	t, _ := plugin["type"].(string)
+	if t == "" || strings.ContainsRune(t, '/') {
+		return nil, fmt.Errorf("invalid plugin type %q", t)
+	}
+
+	conf := make(map[string]interface{}, len(plugin)+3)
+	for k, v := range plugin {
+		conf[k] = v
+	}
+	conf["name"] = list.Name
+	conf["cniVersion"] = list.CNIVersion
+	if len(prevResult) > 0 {
+		conf["prevResult"] = prevResult
+	}
+	stdin, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	netNS := a.netNS()
+
+	// plugins run other binaries, such as iptables, but the shim's env is empty
+	path := os.Getenv("PATH")
+	if path == "" {
+		path = cniDefaultPath
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(filepath.Join(a.BinDir, t))
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = []string{
+		"CNI_COMMAND=" + command,
+		"CNI_CONTAINERID=" + a.ContainerID,
+		"CNI_NETNS=" + netNS,
+		"CNI_IFNAME=" + a.IfName,
+		"CNI_PATH=" + a.BinDir,
+		"PATH=" + path,
+	}
+
+	if err = cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, fmt.Errorf("running plugin %q: %s", t, err)
+		}
+		cniErr := cniError{}
+		if e := json.Unmarshal(stdout.Bytes(), &cniErr); e != nil || cniErr.Msg == "" {
+			return nil, fmt.Errorf(
+				"plugin %q %s: %s: %s", t, command, err, strings.TrimSpace(stderr.String()),
+			)
+		}
+		msg := cniErr.Msg
+		if cniErr.Details != "" {
+			msg += ": " + cniErr.Details
+		}
+		return nil, fmt.Errorf("plugin %q %s: %s (code %d)", t, command, msg, cniErr.Code)
+	}
+
+	if command != "ADD" {
+		return nil, nil
+	}
+	if !json.Valid(stdout.Bytes()) {
+		return nil, fmt.Errorf("plugin %q returned an invalid result: %q", t, stdout.String())
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// loadCNIConf loads the configured network config, converting single plugin configs into a
+// plugin list.
+func loadCNIConf(conf ModelCNI) (list cniConfList, err error) {
+	if conf.ConfFile != "" {
+		return readCNIConf(conf.ConfFile)
+	}
+	if conf.Network == "" {
+		return list, errors.New("either the CNI conf_file or network must be set")
+	}
+
+	confDir := conf.ConfDir
+	if confDir == "" {
+		confDir = DefaultCNIConfDir
+	}
+	files, err := ioutil.ReadDir(confDir)
+	if err != nil {
+		return list, fmt.Errorf("reading CNI conf dir: %s", err)
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		switch filepath.Ext(f.Name()) {
+		case ".conf", ".conflist", ".json":
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// invalid configs of other networks are skipped
+		if list, err = readCNIConf(filepath.Join(confDir, name)); err == nil &&
+			list.Name == conf.Network {
+			return list, nil
+		}
+	}
+
+	return list, fmt.Errorf("CNI network %q not found in %q", conf.Network, confDir)
+}
+
+func readCNIConf(path string) (list cniConfList, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(data, &list); err != nil {
+		return list, fmt.Errorf("parsing CNI conf %q: %s", path, err)
+	}
+	if list.Plugins == nil {
+		// a single plugin config
+		plugin := map[string]interface{}{}
+		if err = json.Unmarshal(data, &plugin); err != nil {
+			return list, fmt.Errorf("parsing CNI conf %q: %s", path, err)
+		}
+		delete(plugin, "name")
+		delete(plugin, "cniVersion")
+		list.Plugins = []map[string]interface{}{plugin}
+	}
+	if list.Name == "" || len(list.Plugins) == 0 {
+		return list, fmt.Errorf("invalid CNI conf %q, name and plugins are required", path)
+	}
+
+	return list, nil
+}
+
+// bindNetNS bind mounts the NS at src on a new file at dst.
+func bindNetNS(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	if err = unix.Mount(src, dst, "", unix.MS_BIND, ""); err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+
+	return nil
+}
+
+// cniVersionAtLeast returns whether the given CNI version is at least major.minor.
+func cniVersionAtLeast(version string, major, minor int) bool {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	vMajor, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	vMinor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+
+	return vMajor > major || vMajor == major && vMinor >= minor
+}
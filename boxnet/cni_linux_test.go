@@ -0,0 +1,294 @@
+package boxnet
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeCNIPlugin records its env and stdin in the calls file of its dir and returns a result
+// with an address of the box and one of the host on ADD.
+const fakeCNIPlugin = `#!/bin/sh
+stdin=$(cat)
+dir=$(dirname "$0")
+printf '%s %s %s %s %s %s\n' "$CNI_COMMAND" "$(basename "$0")" "$CNI_CONTAINERID" \
+	"$CNI_NETNS" "$CNI_IFNAME" "$CNI_PATH" >> "$dir/calls"
+printf '%s\n' "$stdin" >> "$dir/stdin"
+if [ "$CNI_COMMAND" = ADD ]; then
+	echo '{"cniVersion": "1.0.0",
+		"interfaces": [{"name": "cni0"}, {"name": "eth0", "sandbox": "'"$CNI_NETNS"'"}],
+		"ips": [
+			{"address": "10.22.0.1/16", "interface": 0},
+			{"address": "10.22.0.5/16", "gateway": "10.22.0.1", "interface": 1}
+		],
+		"dns": {"nameservers": ["10.22.0.1"], "domain": "cni.test", "search": ["cni.test"]}}'
+fi
+`
+
+const failingCNIPlugin = `#!/bin/sh
+cat > /dev/null
+echo '{"cniVersion": "1.0.0", "code": 11, "msg": "no luck"}'
+exit 1
+`
+
+func writeCNIPlugin(t *testing.T, dir, name, script string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddCNI(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "cni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(binDir)
+	writeCNIPlugin(t, binDir, "fake-a", fakeCNIPlugin)
+	writeCNIPlugin(t, binDir, "fake-b", fakeCNIPlugin)
+
+	confDir := filepath.Join(binDir, "net.d")
+	if err = os.Mkdir(confDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	conf := `{"cniVersion": "1.0.0", "name": "fakenet",
+		"plugins": [{"type": "fake-a", "param": "a"}, {"type": "fake-b"}]}`
+	err = ioutil.WriteFile(filepath.Join(confDir, "10-fake.conflist"), []byte(conf), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nsPID := os.Getpid()
+	netNS := "/proc/" + strconv.Itoa(nsPID) + "/ns/net"
+	a, err := AddCNI(
+		ModelCNI{BinDir: binDir, ConfDir: confDir, Network: "fakenet", IfName: "eth1"},
+		nsPID,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, err := a.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"10.22.0.5"}) {
+		t.Errorf("expected the box address only, got %v", addrs)
+	}
+	dns, err := a.DNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDNS := DNSConf{
+		Nameservers: []string{"10.22.0.1"},
+		Domain:      "cni.test",
+		Search:      []string{"cni.test"},
+	}
+	if !reflect.DeepEqual(dns, expectDNS) {
+		t.Errorf("expected DNS %+v, got %+v", expectDNS, dns)
+	}
+
+	if err = a.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	calls, err := ioutil.ReadFile(filepath.Join(binDir, "calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := " " + a.ContainerID + " " + netNS + " eth1 " + binDir
+	expectCalls := []string{
+		"ADD fake-a" + args,
+		"ADD fake-b" + args,
+		"CHECK fake-a" + args,
+		"CHECK fake-b" + args,
+		"DEL fake-b" + args,
+		"DEL fake-a" + args,
+	}
+	got := strings.Split(strings.TrimSpace(string(calls)), "\n")
+	if !reflect.DeepEqual(got, expectCalls) {
+		t.Errorf("expected calls:\n%s\ngot:\n%s", strings.Join(expectCalls, "\n"), calls)
+	}
+
+	stdin, err := ioutil.ReadFile(filepath.Join(binDir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var confs []map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(string(stdin)))
+	for dec.More() {
+		c := map[string]interface{}{}
+		if err = dec.Decode(&c); err != nil {
+			t.Fatal(err)
+		}
+		confs = append(confs, c)
+	}
+	if len(confs) != len(expectCalls) {
+		t.Fatalf("expected %d plugin configs, got %d", len(expectCalls), len(confs))
+	}
+	if confs[0]["name"] != "fakenet" || confs[0]["cniVersion"] != "1.0.0" ||
+		confs[0]["param"] != "a" {
+		t.Errorf("unexpected config of the first plugin: %+v", confs[0])
+	}
+	if _, ok := confs[0]["prevResult"]; ok {
+		t.Errorf("expected no prevResult on the first ADD: %+v", confs[0])
+	}
+	for i, c := range confs[1:] {
+		if _, ok := c["prevResult"]; !ok {
+			t.Errorf("expected prevResult on call %q: %+v", expectCalls[i+1], c)
+		}
+	}
+}
+
+func TestAddCNIFailure(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "cni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(binDir)
+	writeCNIPlugin(t, binDir, "fake", fakeCNIPlugin)
+	writeCNIPlugin(t, binDir, "failing", failingCNIPlugin)
+
+	confFile := filepath.Join(binDir, "fake.conf")
+	conf := `{"cniVersion": "0.3.1", "name": "fakenet", "type": "fake"}`
+	if err = ioutil.WriteFile(confFile, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a single plugin config, whose version doesn't support CHECK
+	a, err := AddCNI(ModelCNI{BinDir: binDir, ConfFile: confFile}, os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Check(); err == nil {
+		t.Error("expected CHECK to be refused for version 0.3.1")
+	}
+	if err = a.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	conf = `{"cniVersion": "1.0.0", "name": "fakenet",
+		"plugins": [{"type": "fake"}, {"type": "failing"}]}`
+	if err = ioutil.WriteFile(confFile, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = AddCNI(ModelCNI{BinDir: binDir, ConfFile: confFile}, os.Getpid())
+	if err == nil || !strings.Contains(err.Error(), "no luck (code 11)") {
+		t.Fatalf("expected the plugin's error, got: %v", err)
+	}
+
+	calls, err := ioutil.ReadFile(filepath.Join(binDir, "calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	for _, l := range strings.Split(strings.TrimSpace(string(calls)), "\n") {
+		commands = append(commands, strings.Join(strings.Fields(l)[:2], " "))
+	}
+	// the box is deleted from the network once a plugin fails
+	expectCommands := []string{"ADD fake", "DEL fake", "ADD fake", "DEL fake"}
+	if !reflect.DeepEqual(commands, expectCommands) {
+		t.Errorf("expected commands %v, got %v", expectCommands, commands)
+	}
+}
+
+func TestCNIReusedPID(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "cni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(binDir)
+	writeCNIPlugin(t, binDir, "fake", fakeCNIPlugin)
+
+	confFile := filepath.Join(binDir, "fake.conf")
+	conf := `{"cniVersion": "1.0.0", "name": "fakenet", "type": "fake"}`
+	if err = ioutil.WriteFile(confFile, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := AddCNI(ModelCNI{BinDir: binDir, ConfFile: confFile}, os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.NetNSPID != os.Getpid() || a.NetNSStartTime == 0 {
+		t.Errorf("expected the NS process to be recorded, got PID %d started at %d",
+			a.NetNSPID, a.NetNSStartTime)
+	}
+
+	// the box is gone and its PID reused by another process, whose NS must not be given
+	a.NetNSStartTime++
+	if err = a.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	calls, err := ioutil.ReadFile(filepath.Join(binDir, "calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(calls)), "\n")
+	expected := "DEL fake " + a.ContainerID + "  eth0 " + binDir
+	if last := lines[len(lines)-1]; last != expected {
+		t.Errorf("expected DEL without netns %q, got %q", expected, last)
+	}
+}
+
+func TestReleaseCNIMissingPlugin(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "cni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(binDir)
+	writeCNIPlugin(t, binDir, "fake", fakeCNIPlugin)
+
+	confFile := filepath.Join(binDir, "fake.conf")
+	conf := `{"cniVersion": "1.0.0", "name": "fakenet", "type": "fake"}`
+	if err = ioutil.WriteFile(confFile, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	model := ModelCNI{BinDir: binDir, ConfFile: confFile}
+
+	a, err := AddCNI(model, os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(binDir, "fake")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the deletion can still be retried while the box's NS is around
+	if err = Release(Resources{CNI: a}, "box:test"); err == nil {
+		t.Error("expected releasing to fail while the NS is around")
+	}
+	// but not once it's gone
+	a.NetNSStartTime++
+	if err = Release(Resources{CNI: a}, "box:test"); err != nil {
+		t.Errorf("expected the failed deletion to be skipped once the NS is gone: %s", err)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("bind mounting the NS requires root")
+	}
+
+	// the NS kept by a bind mount is released even if the plugins fail
+	writeCNIPlugin(t, binDir, "fake", fakeCNIPlugin)
+	model.NetNSDir = filepath.Join(binDir, "netns")
+	if a, err = AddCNI(model, os.Getpid()); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(binDir, "fake")); err != nil {
+		t.Fatal(err)
+	}
+	if err = Release(Resources{CNI: a}, "box:test"); err != nil {
+		t.Errorf("expected the failed deletion to be skipped once the NS is released: %s", err)
+	}
+	if _, err = os.Stat(a.NetNS); !os.IsNotExist(err) {
+		t.Errorf("expected the NS bind mount to be removed, got %v", err)
+	}
+}
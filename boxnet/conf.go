@@ -5,15 +5,48 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
+	"strings"
 )
 
 // NetConf holds config for interfaces and DNS resolvers.
 type NetConf struct {
+	// Mode is the network mode of the box, defaults to NetModeNone
+	Mode         string                   `json:"mode,omitempty"`
 	Model        map[string]interface{}   `json:"model,omitempty"`
 	LoopbackName string                   `json:"loopback_name,omitempty"`
 	Interfaces   []map[string]interface{} `json:"interfaces,omitempty"`
 	DNS          DNSConf                  `json:"dns,omitempty"`
+	// IPAM allocates the box's addresses when set
+	IPAM *IPAMConf `json:"ipam,omitempty"`
+	// Ports are published on the host with DNAT rules pointing at the box's first IPv4 address
+	Ports []PortMapping `json:"ports,omitempty"`
+	// PortProxy publishes the ports with a userspace proxy instead, which is also the fallback
+	// when the DNAT rules can't be installed
+	PortProxy bool `json:"port_proxy,omitempty"`
+	// IPv6 configures IPv6 in the box's NS, left to the kernel's defaults if unset
+	IPv6 *IPv6Conf `json:"ipv6,omitempty"`
+}
+
+// Network modes of a box.
+const (
+	// NetModeNone gives the box its own NS, with only the loopback interface unless a model or
+	// interfaces are configured
+	NetModeNone = "none"
+	// NetModeHost shares the host's NS with the box
+	NetModeHost = "host"
+	// NetModeBoxPrefix followed by the name of another box, which must be running, joins its NS
+	NetModeBoxPrefix = "box:"
+)
+
+// IPv6Conf configures IPv6 on all the interfaces of the box's NS.
+type IPv6Conf struct {
+	// Disable disables IPv6
+	Disable bool `json:"disable,omitempty"`
+	// AcceptDAD sets the duplicate address detection mode, 0 disabling it so that addresses are
+	// usable right away instead of after the detection completes
+	AcceptDAD *int `json:"accept_dad,omitempty"`
 }
 
 type Model struct {
@@ -22,16 +55,87 @@ type Model struct {
 
 type ModelBridge struct {
 	BrName string `json:"bridge_name"`
+	// Network is the name of a network created with NetworkStore, which sets the fields below
+	// and the ipam config, unless set
+	Network string `json:"network,omitempty"`
+	// the following configure the bridge when it is missing and so, created by the model.
+	// Gateway is the bridge's address in CIDR format, defaulting to the ipam gateway
+	Gateway string `json:"gateway,omitempty"`
+	MTU     int    `json:"mtu,omitempty"`
+	STP     bool   `json:"stp,omitempty"`
+	// Masquerade masquerades the traffic of the gateway's subnet leaving through other
+	// interfaces than the bridge, so that boxes can reach outside networks. The rule is kept
+	// until the network is removed
+	Masquerade bool `json:"masquerade,omitempty"`
+}
+
+// ModelCNI attaches the box to a network set up by CNI plugins, which create its interfaces
+// and so, the netconf can't have any.
+type ModelCNI struct {
+	// BinDir is the dir of the plugin binaries, defaults to DefaultCNIBinDir
+	BinDir string `json:"bin_dir,omitempty"`
+	// ConfFile is the path of the network config, either a single plugin or a plugin list.
+	// Unless set, the config named Network is looked up in ConfDir
+	ConfFile string `json:"conf_file,omitempty"`
+	Network  string `json:"network,omitempty"`
+	// ConfDir defaults to DefaultCNIConfDir
+	ConfDir string `json:"conf_dir,omitempty"`
+	// IfName is the name of the box's interface, defaults to eth0
+	IfName string `json:"if_name,omitempty"`
+	// NetNSDir is a dir where the box's NS is bind mounted, keeping it around until the box is
+	// destroyed, instead of pointing the plugins at /proc/<pid>/ns/net
+	NetNSDir string `json:"netns_dir,omitempty"`
 }
 
 // VethConf holds a config of a single veth pair. Ip and PeerIp holds a CIDR format IP.
 type VethConf struct {
-	Type     string  `json:"type"`
-	Name     string  `json:"name"`
-	PeerName string  `json:"peer_name"`
-	Ip       string  `json:"ip"`
-	PeerIp   string  `json:"peer_ip"`
-	Routes   []Route `json:"routes,omitempty"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	PeerName string `json:"peer_name"`
+	Ip       string `json:"ip"`
+	PeerIp   string `json:"peer_ip"`
+	// Ips and PeerIps are additional addresses of each end, of any family, in CIDR format
+	Ips     []string `json:"ips,omitempty"`
+	PeerIps []string `json:"peer_ips,omitempty"`
+	Routes  []Route  `json:"routes,omitempty"`
+	// MTU of both ends, defaults to the kernel's default or the bridge's one in the bridge model
+	MTU int `json:"mtu,omitempty"`
+}
+
+// MacvlanConf configures a macvlan interface of the box, created on top of a host link so that
+// the box appears on its network with its own MAC address. Ip holds a CIDR format IP.
+type MacvlanConf struct {
+	Type string `json:"type"`
+	// Name of the interface in the box
+	Name string `json:"name"`
+	// Parent is the name of the host link the interface is created on
+	Parent string `json:"parent"`
+	// Mode is one of bridge, private or vepa, defaults to bridge
+	Mode   string  `json:"mode,omitempty"`
+	Ip     string  `json:"ip"`
+	Routes []Route `json:"routes,omitempty"`
+	// Ips are additional addresses, of any family, in CIDR format
+	Ips []string `json:"ips,omitempty"`
+	// MTU defaults to the parent's one
+	MTU int `json:"mtu,omitempty"`
+}
+
+// IpvlanConf configures an ipvlan interface of the box, created on top of a host link and
+// sharing its MAC address. Ip holds a CIDR format IP.
+type IpvlanConf struct {
+	Type string `json:"type"`
+	// Name of the interface in the box
+	Name string `json:"name"`
+	// Parent is the name of the host link the interface is created on
+	Parent string `json:"parent"`
+	// Mode is either l2 or l3, defaults to l2
+	Mode   string  `json:"mode,omitempty"`
+	Ip     string  `json:"ip"`
+	Routes []Route `json:"routes,omitempty"`
+	// Ips are additional addresses, of any family, in CIDR format
+	Ips []string `json:"ips,omitempty"`
+	// MTU defaults to the parent's one
+	MTU int `json:"mtu,omitempty"`
 }
 
 // Route config where Subnet must be in CIDR format.
@@ -45,6 +149,17 @@ type DNSConf struct {
 	Nameservers []string `json:"nameservers,omitempty"`
 	Domain      string   `json:"domain,omitempty"`
 	Search      []string `json:"search,omitempty"`
+	// ExtraHosts are additional entries for the box's hosts file, in the form hostname:ip
+	ExtraHosts []string `json:"extra_hosts,omitempty"`
+	// BridgePeers adds an entry to the box's hosts file for each running box attached to the
+	// same bridge, as of when the box is created
+	BridgePeers bool `json:"bridge_peers,omitempty"`
+}
+
+// HostEntry is a line of a hosts file, mapping an IP to one or more hostnames.
+type HostEntry struct {
+	IP    string   `json:"ip"`
+	Names []string `json:"names"`
 }
 
 var ErrTypeNotDefined = errors.New("interface type not defined")
@@ -96,6 +211,139 @@ func ModelFromConfig(conf map[string]interface{}) (string, error) {
 	return tStr, nil
 }
 
+// Addresses returns the IPs assigned to the box's side of the configured interfaces, as given by
+// the Addresses func of their types.
+func (c *NetConf) Addresses() ([]string, error) {
+	var addrs []string
+	for _, rawConf := range c.Interfaces {
+		conf, t, err := decodeIFace(rawConf)
+		if err != nil {
+			return nil, err
+		}
+		if t.Addresses == nil {
+			continue
+		}
+
+		for _, addr := range t.Addresses(conf) {
+			ip, _, err := net.ParseCIDR(addr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ip of %q: %s", rawConf["name"], err)
+			}
+			addrs = append(addrs, ip.String())
+		}
+	}
+
+	return addrs, nil
+}
+
+// Addrs returns the addresses of the host side end.
+func (c VethConf) Addrs() []string {
+	return joinAddrs(c.Ip, c.Ips)
+}
+
+// PeerAddrs returns the addresses of the box side end.
+func (c VethConf) PeerAddrs() []string {
+	return joinAddrs(c.PeerIp, c.PeerIps)
+}
+
+// joinAddrs returns the given address, if set, followed by the given list of addresses.
+func joinAddrs(addr string, addrs []string) []string {
+	if addr == "" {
+		return addrs
+	}
+	return append([]string{addr}, addrs...)
+}
+
+// SharesNS returns whether the box shares the NS of the host or another box, rather than having
+// its own.
+func (c *NetConf) SharesNS() bool {
+	return c.Mode == NetModeHost || strings.HasPrefix(c.Mode, NetModeBoxPrefix)
+}
+
+// NetBox returns the name of the box whose NS is joined by the box, or an empty string if it
+// doesn't join one.
+func (c *NetConf) NetBox() string {
+	if !strings.HasPrefix(c.Mode, NetModeBoxPrefix) {
+		return ""
+	}
+	return c.Mode[len(NetModeBoxPrefix):]
+}
+
+// CheckMode returns an error if the mode is unknown or, when sharing a NS, the netconf sets
+// anything but the DNS config, since the NS is set up by its owner.
+func (c *NetConf) CheckMode() error {
+	switch {
+	case c.Mode == "" || c.Mode == NetModeNone:
+		return nil
+	case c.Mode == NetModeBoxPrefix:
+		return fmt.Errorf("missing box name in network mode %q", c.Mode)
+	case !c.SharesNS():
+		return fmt.Errorf("unknown network mode %q", c.Mode)
+	}
+
+	if c.Model != nil || len(c.Interfaces) > 0 || c.IPAM != nil || len(c.Ports) > 0 ||
+		c.IPv6 != nil {
+		return fmt.Errorf(
+			"network mode %q can't have a model, interfaces, ipam, ports or ipv6 config", c.Mode,
+		)
+	}
+
+	return nil
+}
+
+// BridgeName returns the name of the bridge the box is attached to, or an empty string if its
+// model doesn't use one.
+func (c *NetConf) BridgeName() string {
+	bridge, _ := c.bridge()
+	return bridge
+}
+
+// NetworkName returns the name of the network the box is attached to, or an empty string if it
+// isn't attached to one.
+func (c *NetConf) NetworkName() string {
+	_, network := c.bridge()
+	return network
+}
+
+// bridge returns the bridge and network the box is attached to, as given by the Bridge func of
+// its model.
+func (c *NetConf) bridge() (bridge, network string) {
+	name, err := ModelFromConfig(c.Model)
+	if err != nil {
+		return
+	}
+	m, ok := lookupModel(name)
+	if !ok || m.Bridge == nil {
+		return
+	}
+	conf, err := m.Decode(c.Model)
+	if err != nil {
+		return
+	}
+
+	return m.Bridge(conf)
+}
+
+// ParseExtraHosts parses hosts in the form hostname:ip into hosts file entries. IPv6 addresses
+// are supported since the hostname can't contain a colon.
+func ParseExtraHosts(hosts []string) ([]HostEntry, error) {
+	entries := make([]HostEntry, 0, len(hosts))
+	for _, h := range hosts {
+		i := strings.Index(h, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid extra host %q, expected hostname:ip", h)
+		}
+
+		ip := net.ParseIP(h[i+1:])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip of extra host %q", h)
+		}
+		entries = append(entries, HostEntry{IP: ip.String(), Names: []string{h[:i]}})
+	}
+
+	return entries, nil
+}
+
 func ConfigFromRawConfig(rawConf map[string]interface{}, dst interface{}) error {
 	jsonConf, err := json.Marshal(rawConf)
 	if err != nil {
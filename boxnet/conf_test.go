@@ -0,0 +1,36 @@
+package boxnet
+
+import (
+	"testing"
+)
+
+func TestNetMode(t *testing.T) {
+	cases := []struct {
+		conf     NetConf
+		sharesNS bool
+		netBox   string
+		valid    bool
+	}{
+		{NetConf{}, false, "", true},
+		{NetConf{Mode: NetModeNone, Interfaces: []map[string]interface{}{{}}}, false, "", true},
+		{NetConf{Mode: NetModeHost}, true, "", true},
+		{NetConf{Mode: NetModeHost, DNS: DNSConf{Domain: "lan"}}, true, "", true},
+		{NetConf{Mode: NetModeHost, Ports: []PortMapping{{BoxPort: 80}}}, true, "", false},
+		{NetConf{Mode: "box:app"}, true, "app", true},
+		{NetConf{Mode: "box:app", Model: map[string]interface{}{}}, true, "app", false},
+		{NetConf{Mode: "box:"}, true, "", false},
+		{NetConf{Mode: "bogus"}, false, "", false},
+	}
+
+	for _, c := range cases {
+		if got := c.conf.SharesNS(); got != c.sharesNS {
+			t.Errorf("mode %q: expected SharesNS %v, got %v", c.conf.Mode, c.sharesNS, got)
+		}
+		if got := c.conf.NetBox(); got != c.netBox {
+			t.Errorf("mode %q: expected NetBox %q, got %q", c.conf.Mode, c.netBox, got)
+		}
+		if err := c.conf.CheckMode(); (err == nil) != c.valid {
+			t.Errorf("mode %q: expected valid %v, got: %v", c.conf.Mode, c.valid, err)
+		}
+	}
+}
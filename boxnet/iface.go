@@ -0,0 +1,29 @@
+package boxnet
+
+import (
+	"github.com/vishvananda/netlink"
+)
+
+type IFacer interface {
+	Down() error
+	Up() error
+	Type() string
+	SetMaster(master netlink.Link) error
+	// Name returns the name of the host side link
+	Name() string
+	// SetAlias sets the alias of the host side link, used to tag it
+	SetAlias(alias string) error
+	// Delete deletes the host side link, along with anything attached to it
+	Delete() error
+}
+
+// NsIFacer is an interface of the box. The ones created on top of a host link, its parent, such
+// as the macvlan and ipvlan ones, only live in the box's NS, leaving nothing behind on the host,
+// while the ones with a host side link, such as veths, implement IFacer as well.
+type NsIFacer interface {
+	// Name returns the name of the interface in the box's NS
+	Name() string
+	Type() string
+	// Delete deletes the interface from the box's NS, if still around
+	Delete() error
+}
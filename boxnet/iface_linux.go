@@ -3,17 +3,9 @@ package boxnet
 import (
 	"runtime"
 
-	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
 )
 
-type IFacer interface {
-	Down() error
-	Up() error
-	Type() string
-	SetMaster(master netlink.Link) error
-}
-
 func ExecuteOnNs(pidns int, f func()) (err error) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
@@ -0,0 +1,384 @@
+package boxnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// last reserved IP of each subnet, allocations start right after it
+	lastReservedFilename = "last_reserved_ip"
+	lockFilename         = ".lock"
+)
+
+// ErrNoFreeAddress is returned when all the addresses of a range are leased.
+var ErrNoFreeAddress = errors.New("no free address")
+
+// IPAMConf configures the allocation of the box's addresses, filling the peer_ip of the veth
+// interfaces which don't have one.
+type IPAMConf struct {
+	// Subnet where addresses are allocated from, in CIDR format
+	Subnet string `json:"subnet"`
+	// Gateway is set as the default route of the boxes, unless the interface has its own routes.
+	// Defaults to the first IP of the subnet, which is never allocated
+	Gateway string `json:"gateway,omitempty"`
+	// RangeStart and RangeEnd limit the allocated addresses, both included. They default to the
+	// first and last usable IPs of the subnet
+	RangeStart string `json:"range_start,omitempty"`
+	RangeEnd   string `json:"range_end,omitempty"`
+}
+
+// ipRange is a parsed IPAMConf.
+type ipRange struct {
+	subnet     *net.IPNet
+	gateway    net.IP
+	start, end net.IP
+}
+
+// IPAM allocates addresses to boxes, keeping a lease of each allocated address in a root dir
+// shared by all the processes using it. Each subnet has a dir with a file per leased address,
+// named after it and holding its owner.
+type IPAM struct {
+	root string
+}
+
+// NewIPAM returns an IPAM keeping its leases in the given root dir, which is created on first
+// use.
+func NewIPAM(root string) *IPAM {
+	return &IPAM{root: root}
+}
+
+// Assign returns a copy of the given config with an address allocated to owner filled in as
+// the IPAMKey of each interface whose type has one, e.g. the peer_ip of veths, unless already
+// set, along with a default route via the gateway if the interface has no routes. Configs
+// without ipam are returned as is. The addresses must be released with Release once no longer
+// used, even if Assign fails.
+func (i *IPAM) Assign(conf *NetConf, owner string) (*NetConf, error) {
+	if conf == nil || conf.IPAM == nil {
+		return conf, nil
+	}
+
+	r, err := conf.IPAM.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid ipam config: %s", err)
+	}
+
+	assigned := *conf
+	assigned.Interfaces = make([]map[string]interface{}, 0, len(conf.Interfaces))
+	for _, rawConf := range conf.Interfaces {
+		_, t, err := decodeIFace(rawConf)
+		if err != nil {
+			return nil, err
+		}
+		if addr, _ := rawConf[t.IPAMKey].(string); t.IPAMKey == "" || addr != "" {
+			assigned.Interfaces = append(assigned.Interfaces, rawConf)
+			continue
+		}
+
+		addr, err := i.allocate(r, owner)
+		if err != nil {
+			return nil, err
+		}
+
+		iface := make(map[string]interface{}, len(rawConf)+2)
+		for k, v := range rawConf {
+			iface[k] = v
+		}
+		iface[t.IPAMKey] = addr.String()
+		if _, ok := rawConf["routes"]; !ok {
+			gw := r.gateway.String()
+			iface["routes"] = []Route{{Subnet: defaultRoute(r.gateway), Gateway: gw}}
+		}
+		assigned.Interfaces = append(assigned.Interfaces, iface)
+	}
+
+	return &assigned, nil
+}
+
+// Release releases all the addresses leased to owner. Releasing an owner without leases is a
+// no-op.
+func (i *IPAM) Release(owner string) error {
+	unlock, err := i.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	subnets, err := ioutil.ReadDir(i.root)
+	if err != nil {
+		return fmt.Errorf("listing subnets: %s", err)
+	}
+
+	for _, s := range subnets {
+		if !s.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(i.root, s.Name())
+		leases, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("listing leases: %s", err)
+		}
+		for _, l := range leases {
+			if l.Name() == lastReservedFilename {
+				continue
+			}
+
+			p := filepath.Join(dir, l.Name())
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				return fmt.Errorf("reading lease: %s", err)
+			}
+			if string(b) != owner {
+				continue
+			}
+			if err = os.Remove(p); err != nil {
+				return fmt.Errorf("releasing lease: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Leases returns the addresses of the given subnet leased to each owner.
+func (i *IPAM) Leases(subnet string) (map[string][]string, error) {
+	_, n, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := i.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	dir := filepath.Join(i.root, subnetDirname(n))
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing leases: %s", err)
+	}
+
+	leases := map[string][]string{}
+	for _, e := range entries {
+		if e.Name() == lastReservedFilename {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("reading lease: %s", err)
+		}
+		leases[string(b)] = append(leases[string(b)], e.Name())
+	}
+
+	return leases, nil
+}
+
+// allocate leases the next free address of the given range to owner, starting right after the
+// last one leased so that addresses aren't reused right after being released.
+func (i *IPAM) allocate(r ipRange, owner string) (addr net.IPNet, err error) {
+	unlock, err := i.lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	dir := filepath.Join(i.root, subnetDirname(r.subnet))
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return addr, fmt.Errorf("creating subnet dir: %s", err)
+	}
+
+	ip := r.start
+	if b, err := ioutil.ReadFile(filepath.Join(dir, lastReservedFilename)); err == nil {
+		last := normalizeIP(net.ParseIP(string(b)))
+		if last != nil && inRange(last, r.start, r.end) && !last.Equal(r.end) {
+			ip = nextIP(last)
+		}
+	}
+
+	for first := ip; ; {
+		if !ip.Equal(r.gateway) {
+			err = leaseIP(dir, ip, owner)
+			if err == nil {
+				return net.IPNet{IP: ip, Mask: r.subnet.Mask}, nil
+			}
+			if !os.IsExist(err) {
+				return addr, fmt.Errorf("leasing %s: %s", ip, err)
+			}
+		}
+
+		if ip.Equal(r.end) {
+			ip = r.start
+		} else {
+			ip = nextIP(ip)
+		}
+		if ip.Equal(first) {
+			return addr, fmt.Errorf("%w in %s", ErrNoFreeAddress, r.subnet)
+		}
+	}
+}
+
+// leaseIP creates the lease of ip in dir, failing if it already exists.
+func leaseIP(dir string, ip net.IP, owner string) error {
+	p := filepath.Join(dir, ip.String())
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(owner)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(p)
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, lastReservedFilename), []byte(ip.String()), 0644)
+}
+
+// lock takes an exclusive lock on the IPAM, shared by all processes using it.
+func (i *IPAM) lock() (unlock func(), err error) {
+	if err = os.MkdirAll(i.root, 0755); err != nil {
+		return nil, fmt.Errorf("creating ipam dir: %s", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(i.root, lockFilename), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening ipam lock: %s", err)
+	}
+
+	if err = unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking ipam: %s", err)
+	}
+
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// GatewayAddr returns the gateway's address in CIDR format, with the subnet's mask.
+func (c IPAMConf) GatewayAddr() (string, error) {
+	r, err := c.parse()
+	if err != nil {
+		return "", err
+	}
+
+	addr := net.IPNet{IP: r.gateway, Mask: r.subnet.Mask}
+	return addr.String(), nil
+}
+
+func (c IPAMConf) parse() (r ipRange, err error) {
+	_, r.subnet, err = net.ParseCIDR(c.Subnet)
+	if err != nil {
+		return
+	}
+	r.subnet.IP = normalizeIP(r.subnet.IP)
+
+	first := nextIP(r.subnet.IP)
+	last := lastIP(r.subnet)
+	if r.subnet.IP.To4() != nil {
+		// the broadcast address
+		last = prevIP(last)
+	}
+	if !inRange(first, r.subnet.IP, last) {
+		return r, fmt.Errorf("subnet %s too small", c.Subnet)
+	}
+
+	parse := func(s string, def net.IP) (net.IP, error) {
+		if s == "" {
+			return def, nil
+		}
+		ip := normalizeIP(net.ParseIP(s))
+		if ip == nil || !inRange(ip, first, last) {
+			return nil, fmt.Errorf("%q isn't a usable IP of %s", s, c.Subnet)
+		}
+		return ip, nil
+	}
+
+	if r.gateway, err = parse(c.Gateway, first); err != nil {
+		return
+	}
+	if r.start, err = parse(c.RangeStart, first); err != nil {
+		return
+	}
+	if r.end, err = parse(c.RangeEnd, last); err != nil {
+		return
+	}
+	if !inRange(r.start, r.start, r.end) {
+		return r, fmt.Errorf("range start %s after range end %s", r.start, r.end)
+	}
+
+	return r, nil
+}
+
+// subnetDirname returns the name of the dir with the leases of the given subnet.
+func subnetDirname(n *net.IPNet) string {
+	return strings.Replace(n.String(), "/", "-", 1)
+}
+
+// defaultRoute returns the default route subnet for the family of the given IP.
+func defaultRoute(ip net.IP) string {
+	if ip.To4() != nil {
+		return "0.0.0.0/0"
+	}
+	return "::/0"
+}
+
+// normalizeIP returns IPv4 addresses in their 4 bytes form, so that they match their masks.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func inRange(ip, start, end net.IP) bool {
+	ip = ip.To16()
+	return bytes.Compare(ip, start.To16()) >= 0 && bytes.Compare(ip, end.To16()) <= 0
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP(nil), ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func prevIP(ip net.IP) net.IP {
+	prev := append(net.IP(nil), ip...)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// lastIP returns the last IP of the given subnet.
+func lastIP(n *net.IPNet) net.IP {
+	last := append(net.IP(nil), n.IP...)
+	for i := range last {
+		last[i] |= ^n.Mask[i]
+	}
+	return last
+}
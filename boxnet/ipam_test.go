@@ -0,0 +1,179 @@
+package boxnet
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestIPAMAssign(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ipam := NewIPAM(tmp)
+	conf := &NetConf{
+		Interfaces: []map[string]interface{}{
+			{"type": "veth", "name": "veth1", "peer_name": "eth0"},
+			{"type": "veth", "name": "veth2", "peer_name": "eth1", "peer_ip": "10.1.0.2/24"},
+		},
+		IPAM: &IPAMConf{Subnet: "10.0.0.0/29"},
+	}
+
+	assigned, err := ipam.Assign(conf, "box1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := conf.Interfaces[0]["peer_ip"]; ok {
+		t.Error("expected the given config to be left untouched")
+	}
+
+	cfg := VethConf{}
+	if err = ConfigFromRawConfig(assigned.Interfaces[0], &cfg); err != nil {
+		t.Fatal(err)
+	}
+	// the first IP is the gateway
+	if cfg.PeerIp != "10.0.0.2/29" {
+		t.Errorf("expected peer ip 10.0.0.2/29, got %q", cfg.PeerIp)
+	}
+	expectRoutes := []Route{{Subnet: "0.0.0.0/0", Gateway: "10.0.0.1"}}
+	if !reflect.DeepEqual(cfg.Routes, expectRoutes) {
+		t.Errorf("expected routes %+v, got %+v", expectRoutes, cfg.Routes)
+	}
+	if assigned.Interfaces[1]["peer_ip"] != "10.1.0.2/24" {
+		t.Errorf("expected configured peer ip to be kept, got %v", assigned.Interfaces[1]["peer_ip"])
+	}
+
+	// 10.0.0.3 to 10.0.0.6 are left
+	for _, owner := range []string{"box2", "box3", "box4", "box5"} {
+		if _, err = ipam.Assign(conf, owner); err != nil {
+			t.Fatalf("assigning to %s: %s", owner, err)
+		}
+	}
+	if _, err = ipam.Assign(conf, "box6"); !errors.Is(err, ErrNoFreeAddress) {
+		t.Fatalf("expected ErrNoFreeAddress, got: %v", err)
+	}
+
+	if err = ipam.Release("box1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ipam.Release("unknown"); err != nil {
+		t.Fatalf("expected releasing an unknown owner to be a no-op, got: %s", err)
+	}
+
+	assigned, err = ipam.Assign(conf, "box6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assigned.Interfaces[0]["peer_ip"] != "10.0.0.2/29" {
+		t.Errorf("expected the released ip to be reused, got %v", assigned.Interfaces[0]["peer_ip"])
+	}
+
+	leases, err := ipam.Leases("10.0.0.0/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLeases := map[string][]string{
+		"box2": {"10.0.0.3"},
+		"box3": {"10.0.0.4"},
+		"box4": {"10.0.0.5"},
+		"box5": {"10.0.0.6"},
+		"box6": {"10.0.0.2"},
+	}
+	if !reflect.DeepEqual(leases, expectLeases) {
+		t.Errorf("expected leases %v, got %v", expectLeases, leases)
+	}
+}
+
+func TestIPAMRange(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ipam := NewIPAM(tmp)
+	conf := &NetConf{
+		Interfaces: []map[string]interface{}{{"type": "veth", "name": "veth1"}},
+		IPAM: &IPAMConf{
+			Subnet:     "192.168.0.0/24",
+			Gateway:    "192.168.0.254",
+			RangeStart: "192.168.0.10",
+			RangeEnd:   "192.168.0.11",
+		},
+	}
+
+	for _, expect := range []string{"192.168.0.10/24", "192.168.0.11/24"} {
+		assigned, err := ipam.Assign(conf, expect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assigned.Interfaces[0]["peer_ip"] != expect {
+			t.Errorf("expected peer ip %s, got %v", expect, assigned.Interfaces[0]["peer_ip"])
+		}
+	}
+	if _, err = ipam.Assign(conf, "full"); !errors.Is(err, ErrNoFreeAddress) {
+		t.Errorf("expected ErrNoFreeAddress, got: %v", err)
+	}
+
+	invalid := []IPAMConf{
+		{Subnet: "192.168.0.0"},
+		{Subnet: "192.168.0.0/24", Gateway: "192.168.1.1"},
+		{Subnet: "192.168.0.0/24", RangeStart: "192.168.0.20", RangeEnd: "192.168.0.10"},
+		{Subnet: "192.168.0.0/24", RangeEnd: "192.168.0.255"},
+		{Subnet: "192.168.0.1/32"},
+	}
+	for _, c := range invalid {
+		c := c
+		conf.IPAM = &c
+		if _, err = ipam.Assign(conf, "invalid"); err == nil {
+			t.Errorf("expected %+v to be invalid", c)
+		}
+	}
+}
+
+func TestIPAMIPv6(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ipam := NewIPAM(tmp)
+	conf := &NetConf{
+		Interfaces: []map[string]interface{}{
+			{"type": "veth", "name": "veth1", "peer_ips": []string{"10.0.0.2/24"}},
+		},
+		IPAM: &IPAMConf{Subnet: "fd00::/126"},
+	}
+
+	assigned, err := ipam.Assign(conf, "box1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := VethConf{}
+	if err = ConfigFromRawConfig(assigned.Interfaces[0], &cfg); err != nil {
+		t.Fatal(err)
+	}
+	expectAddrs := []string{"fd00::2/126", "10.0.0.2/24"}
+	if !reflect.DeepEqual(cfg.PeerAddrs(), expectAddrs) {
+		t.Errorf("expected peer addresses %v, got %v", expectAddrs, cfg.PeerAddrs())
+	}
+	expectRoutes := []Route{{Subnet: "::/0", Gateway: "fd00::1"}}
+	if !reflect.DeepEqual(cfg.Routes, expectRoutes) {
+		t.Errorf("expected routes %+v, got %+v", expectRoutes, cfg.Routes)
+	}
+
+	// without a broadcast address, the last IP is usable
+	if _, err = ipam.Assign(conf, "box2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ipam.Assign(conf, "box3"); !errors.Is(err, ErrNoFreeAddress) {
+		t.Fatalf("expected ErrNoFreeAddress, got: %v", err)
+	}
+}
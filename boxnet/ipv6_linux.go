@@ -0,0 +1,59 @@
+package boxnet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const ipv6ConfDir = "/proc/sys/net/ipv6/conf"
+
+// ConfigureIPv6 applies the given config to the NS of the box with the given NS PID, setting
+// both the values of the interfaces already there and the defaults of the ones moved in later.
+// Hence, it should be applied before setting up the box's interfaces.
+func ConfigureIPv6(conf IPv6Conf, nsPID int) error {
+	var sysctlErr error
+	err := ExecuteOnNs(nsPID, func() {
+		sysctlErr = conf.apply()
+	})
+	if err != nil {
+		return fmt.Errorf("entering box NS: %s", err)
+	}
+
+	return sysctlErr
+}
+
+// apply writes the sysctls of the config, from the box's NS.
+func (c IPv6Conf) apply() error {
+	var sysctls [][2]string
+	if c.Disable {
+		sysctls = append(sysctls, [2]string{"disable_ipv6", "1"})
+	}
+	if c.AcceptDAD != nil {
+		sysctls = append(sysctls, [2]string{"accept_dad", strconv.Itoa(*c.AcceptDAD)})
+	}
+	if len(sysctls) == 0 {
+		return nil
+	}
+
+	if _, err := os.Stat(ipv6ConfDir); os.IsNotExist(err) {
+		if c.AcceptDAD == nil {
+			// IPv6 is disabled on the whole host
+			return nil
+		}
+		return fmt.Errorf("IPv6 not supported by the kernel")
+	}
+
+	for _, dev := range []string{"all", "default"} {
+		for _, s := range sysctls {
+			p := filepath.Join(ipv6ConfDir, dev, s[0])
+			if err := ioutil.WriteFile(p, []byte(s[1]), 0644); err != nil {
+				return fmt.Errorf("setting %s: %s", p, err)
+			}
+		}
+	}
+
+	return nil
+}
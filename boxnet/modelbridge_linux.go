@@ -2,61 +2,152 @@ package boxnet
 
 import (
 	"fmt"
-
-	"github.com/vishvananda/netlink"
+	"net"
 )
 
 type Bridger interface {
+	// IFaces returns the interfaces attached to the bridge
+	IFaces() []IFacer
+	// Close detaches the box from the bridge, deleting its interfaces
+	Close() error
 }
 
 type bridgeModel struct {
 	BrName string
 	NsPID  int
-	IFaces []IFacer
+	ifaces []IFacer
+	// nsIfaces are the box's interfaces not attached to the bridge
+	nsIfaces []NsIFacer
+	// masquerade is set when the bridge's masquerade rule isn't owned by a network
+	masquerade bool
 }
 
 var _ Bridger = (*bridgeModel)(nil)
+var _ ResourceModeler = (*bridgeModel)(nil)
+
+// newBridgeNetModel is the constructor of the built-in bridge model.
+func newBridgeNetModel(conf interface{}, netConf *NetConf, nsPID int) (Modeler, error) {
+	cfg := *conf.(*ModelBridge)
+	if cfg.Gateway == "" && netConf.IPAM != nil {
+		// the bridge, if created, holds the gateway of the boxes
+		gw, err := netConf.IPAM.GatewayAddr()
+		if err != nil {
+			return nil, fmt.Errorf("invalid ipam config: %s", err)
+		}
+		cfg.Gateway = gw
+	}
+
+	b, err := NewBridgeModel(cfg, nsPID, netConf.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
 
-func NewBridgeModel(brName string, nsPID int, ifsConfig []map[string]interface{}) (Bridger, error) {
-	brLink, err := netlink.LinkByName(brName)
+// NewBridgeModel attaches the box with the given NS PID to the configured bridge, creating it
+// if missing.
+func NewBridgeModel(
+	conf ModelBridge,
+	nsPID int,
+	ifsConfig []map[string]interface{},
+) (
+	b Bridger,
+	err error,
+) {
+	brLink, _, err := EnsureBridge(
+		BridgeConf{Name: conf.BrName, Gateway: conf.Gateway, MTU: conf.MTU, STP: conf.STP},
+	)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get bridge interface %q: %s", brName, err)
+		return nil, fmt.Errorf("unable to get bridge interface %q: %s", conf.BrName, err)
 	}
 
 	var ifaces []IFacer
+	var nsIfaces []NsIFacer
+	defer func() {
+		if err != nil {
+			for _, iface := range ifaces {
+				_ = iface.Delete()
+			}
+			for _, iface := range nsIfaces {
+				_ = iface.Delete()
+			}
+		}
+	}()
 	for _, rawConf := range ifsConfig {
-		t, err := TypeFromConfig(rawConf)
+		conf, t, err := decodeIFace(rawConf)
 		if err != nil {
-			return nil, fmt.Errorf("unable to get iface type: %s", err)
+			return nil, err
+		}
+		if cfg, ok := conf.(*VethConf); ok && cfg.MTU == 0 {
+			cfg.MTU = brLink.Attrs().MTU
 		}
 
-		var iFace IFacer
-		switch t {
-		case "veth":
-			cfg := VethConf{}
-			err := ConfigFromRawConfig(rawConf, &cfg)
-			if err != nil {
-				return nil, fmt.Errorf("parsing iface config: %+v ** %s", rawConf, err)
-			}
+		iface, err := t.New(conf, nsPID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to attach iface to NS PID %d: %s", nsPID, err)
+		}
+		hostIface, ok := iface.(IFacer)
+		if !ok {
+			// not attached to the bridge, but set up along with the ones attached
+			nsIfaces = append(nsIfaces, iface)
+			continue
+		}
 
-			iFace, err = AttachVeth(cfg, nsPID)
-			if err != nil {
-				return nil, fmt.Errorf("unable to attach veth to NS PID %d: %s", nsPID, err)
-			}
-			err = iFace.SetMaster(brLink)
-			if err != nil {
-				return nil, fmt.Errorf("unable to set master to %q: %s", cfg.Name, err)
-			}
-		default:
-			return nil, fmt.Errorf("unsupported iface type: %s", t)
+		err = hostIface.SetMaster(brLink)
+		if err != nil {
+			_ = hostIface.Delete()
+			return nil, fmt.Errorf("unable to set master to %q: %s", hostIface.Name(), err)
 		}
+		ifaces = append(ifaces, hostIface)
+	}
 
-		ifaces = append(ifaces, iFace)
+	// only once the box is attached, since the rule of a bridge without links attached is taken
+	// as unused and deleted, e.g. by a concurrent net gc
+	if conf.Masquerade {
+		_, subnet, err := net.ParseCIDR(conf.Gateway)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway %q for masquerade: %s", conf.Gateway, err)
+		}
+		err = EnsureMasquerade(subnet, conf.BrName, NATTag(conf.Network, conf.BrName))
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &bridgeModel{
-		BrName: brName,
-		NsPID:  nsPID,
-		IFaces: ifaces,
+		BrName:     conf.BrName,
+		NsPID:      nsPID,
+		ifaces:     ifaces,
+		nsIfaces:   nsIfaces,
+		masquerade: conf.Masquerade && conf.Network == "",
 	}, nil
 }
+
+func (b *bridgeModel) IFaces() []IFacer {
+	return b.ifaces
+}
+
+// Resources returns the bridge whose masquerade rule, unless owned by a network, must be deleted
+// once no longer used.
+func (b *bridgeModel) Resources() Resources {
+	if !b.masquerade {
+		return Resources{}
+	}
+	return Resources{Masquerade: b.BrName}
+}
+
+func (b *bridgeModel) Close() error {
+	for _, iface := range b.ifaces {
+		if err := iface.Delete(); err != nil {
+			return fmt.Errorf("deleting iface %q: %s", iface.Name(), err)
+		}
+	}
+	for _, iface := range b.nsIfaces {
+		if err := iface.Delete(); err != nil {
+			return fmt.Errorf("deleting iface %q: %s", iface.Name(), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package boxnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// NATTag returns the tag of the NAT rules of the given network, or of the given bridge if it
+// wasn't created by a network.
+func NATTag(network, bridge string) string {
+	if network != "" {
+		return "box:network:" + network
+	}
+	return "box:bridge:" + bridge
+}
+
+// EnsureMasquerade installs a rule masquerading the traffic from subnet leaving through any
+// interface but the given bridge, tagged with tag, unless a rule with the same tag exists.
+func EnsureMasquerade(subnet *net.IPNet, bridge, tag string) error {
+	ip := subnet.IP.To4()
+	if ip == nil {
+		return errors.New("only IPv4 subnets are supported")
+	}
+
+	c, err := newNFTConn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	exists, err := c.hasRule(unix.NFPROTO_IPV4, postroutingChain, tag)
+	if err != nil {
+		return fmt.Errorf("listing nat rules: %s", err)
+	}
+	if exists {
+		return nil
+	}
+
+	// ip saddr <subnet> oifname != <bridge> masquerade
+	err = c.addRule(
+		unix.NFPROTO_IPV4,
+		postroutingChain,
+		tag,
+		exprPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, 12, 4),
+		exprMask(subnet.Mask),
+		exprCmp(unix.NFT_CMP_EQ, ip.Mask(subnet.Mask)),
+		exprMeta(unix.NFT_META_OIFNAME),
+		exprCmp(unix.NFT_CMP_NEQ, ifname(bridge)),
+		exprMasq(),
+	)
+	if err != nil {
+		return fmt.Errorf("adding masquerade rule: %s", err)
+	}
+
+	return nil
+}
+
+// ReleaseMasquerade deletes the masquerade rule of the given bridge, not created by a network,
+// unless it's still used, i.e. the bridge exists and has links attached to it.
+func ReleaseMasquerade(bridge string) error {
+	br, err := netlink.LinkByName(bridge)
+	if _, ok := err.(netlink.LinkNotFoundError); err != nil && !ok {
+		return fmt.Errorf("getting bridge %q: %s", bridge, err)
+	}
+
+	if err == nil {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return fmt.Errorf("listing links: %s", err)
+		}
+		for _, l := range links {
+			if l.Attrs().MasterIndex == br.Attrs().Index {
+				return nil
+			}
+		}
+	}
+
+	return DeleteNATRules(NATTag("", bridge))
+}
+
+// NATTags returns the tags, starting with prefix, of the NAT rules installed, if any. No tags
+// are returned if nftables isn't supported by the kernel.
+func NATTags(prefix string) ([]string, error) {
+	c, err := newNFTConn()
+	if errors.Is(err, unix.EPROTONOSUPPORT) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	seen := map[string]bool{}
+	var tags []string
+	for _, ch := range nftChains {
+		rules, err := c.rules(unix.NFPROTO_IPV4, ch)
+		if err != nil {
+			return nil, fmt.Errorf("listing nat rules: %s", err)
+		}
+		for _, r := range rules {
+			if strings.HasPrefix(r.tag, prefix) && !seen[r.tag] {
+				seen[r.tag] = true
+				tags = append(tags, r.tag)
+			}
+		}
+	}
+
+	return tags, nil
+}
+
+// AddDNAT installs the rules translating the destination of the traffic to the host port of
+// the given mapping, coming from outside or from the host itself, to the box port at boxIP.
+// The rules are tagged with tag, to be deleted with DeleteNATRules, even if AddDNAT fails.
+// Traffic to the loopback addresses isn't translated, so they can't be given as host address.
+func AddDNAT(m PortMapping, boxIP net.IP, tag string) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	if m.HostIP != "" && net.ParseIP(m.HostIP).IsLoopback() {
+		return fmt.Errorf("loopback host address %s can't be translated", m.HostIP)
+	}
+	ip := boxIP.To4()
+	if ip == nil {
+		return fmt.Errorf("box address %s isn't IPv4", boxIP)
+	}
+
+	// [ip daddr <host ip> | ip daddr != 127.0.0.0/8 fib daddr type local] meta l4proto <proto>
+	// th dport <host port> dnat to <box ip>:<box port>
+	var exprs [][]byte
+	if m.HostIP != "" {
+		exprs = append(
+			exprs,
+			exprPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, 16, 4),
+			exprCmp(unix.NFT_CMP_EQ, net.ParseIP(m.HostIP).To4()),
+		)
+	} else {
+		rtnLocal := make([]byte, 4)
+		nl.NativeEndian().PutUint32(rtnLocal, unix.RTN_LOCAL)
+		loopback := net.IPv4(127, 0, 0, 0).To4()
+		exprs = append(
+			exprs,
+			exprPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, 16, 4),
+			exprMask(net.IPv4Mask(255, 0, 0, 0)),
+			exprCmp(unix.NFT_CMP_NEQ, loopback),
+			exprFibAddrType(),
+			exprCmp(unix.NFT_CMP_EQ, rtnLocal),
+		)
+	}
+	proto := byte(unix.IPPROTO_TCP)
+	if m.protocol() == "udp" {
+		proto = unix.IPPROTO_UDP
+	}
+	exprs = append(
+		exprs,
+		exprMeta(unix.NFT_META_L4PROTO),
+		exprCmp(unix.NFT_CMP_EQ, []byte{proto}),
+		exprPayload(unix.NFT_PAYLOAD_TRANSPORT_HEADER, 2, 2),
+		exprCmp(unix.NFT_CMP_EQ, be16(uint16(m.HostPort))),
+		exprImmediate(unix.NFT_REG_1, ip),
+		exprImmediate(unix.NFT_REG_2, be16(uint16(m.BoxPort))),
+		exprDNAT(),
+	)
+
+	c, err := newNFTConn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for _, ch := range []nftChain{preroutingChain, outputChain} {
+		if err = c.addRule(unix.NFPROTO_IPV4, ch, tag, exprs...); err != nil {
+			return fmt.Errorf("adding dnat rule: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// DeleteNATRules deletes all the NAT rules tagged with tag.
+func DeleteNATRules(tag string) error {
+	c, err := newNFTConn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err = c.deleteRules(unix.NFPROTO_IPV4, tag); err != nil {
+		return fmt.Errorf("deleting nat rules: %s", err)
+	}
+
+	return nil
+}
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+// ifname returns the given interface name as the kernel compares it, padded with null bytes.
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
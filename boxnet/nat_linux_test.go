@@ -0,0 +1,147 @@
+package boxnet
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// setAddr sets the given address on the link with the given name and brings it up.
+func setAddr(t *testing.T, name, cidr string) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cidr != "" {
+		addr, err := netlink.ParseAddr(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = netlink.AddrAdd(link, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveEcho listens on addr, in the NS of the given PID, echoing back what's received by the
+// first conn accepted. The listener is closed once the test ends.
+func serveEcho(t *testing.T, nsPID int, addr string) {
+	var l net.Listener
+	onNs(t, nsPID, func() {
+		var err error
+		if l, err = net.Listen("tcp4", addr); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = io.Copy(c, c)
+	}()
+}
+
+// echo sends a message to addr, expecting it back.
+func echo(t *testing.T, addr string) {
+	c, err := net.DialTimeout("tcp4", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err = c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("expected echo of ping, got %q", buf)
+	}
+}
+
+func TestAddDNAT(t *testing.T) {
+	withTestNs(t, func(nsPID int) {
+		peer, err := netlink.LinkByName("eth0p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = netlink.LinkSetNsPid(peer, nsPID); err != nil {
+			t.Fatal(err)
+		}
+		setAddr(t, "lo", "")
+		setAddr(t, "eth0", "10.99.0.1/24")
+		onNs(t, nsPID, func() { setAddr(t, "eth0p", "10.99.0.2/24") })
+		serveEcho(t, nsPID, "10.99.0.2:80")
+
+		tag := Tag("/work/a")
+		m := PortMapping{HostPort: 8080, BoxPort: 80}
+		if err = AddDNAT(m, net.ParseIP("10.99.0.2"), tag); err != nil {
+			t.Fatal(err)
+		}
+		for _, ch := range []nftChain{preroutingChain, outputChain} {
+			if tags := ruleTags(t, ch); len(tags) != 1 || tags[0] != tag {
+				t.Errorf("expected a rule tagged %s in %s, got %v", tag, ch.name, tags)
+			}
+		}
+
+		// from the host itself, to one of its addresses
+		echo(t, "10.99.0.1:8080")
+
+		// the loopback address isn't translated so, nothing listens on it
+		_, err = net.DialTimeout("tcp4", "127.0.0.1:8080", time.Second)
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Errorf("expected loopback conn to be refused, got %v", err)
+		}
+		err = AddDNAT(PortMapping{HostIP: "127.0.0.1", HostPort: 8081, BoxPort: 80}, nil, tag)
+		if err == nil {
+			t.Error("expected loopback host address to be rejected")
+		}
+
+		if err = DeleteNATRules(tag); err != nil {
+			t.Fatal(err)
+		}
+		if tags, err := NATTags(""); err != nil || len(tags) != 0 {
+			t.Errorf("expected rules to be deleted, got %v, %v", tags, err)
+		}
+		if _, err = net.DialTimeout("tcp4", "10.99.0.1:8080", time.Second); err == nil {
+			t.Error("expected port to be unpublished")
+		}
+	})
+}
+
+func TestPortProxy(t *testing.T) {
+	withTestNs(t, func(nsPID int) {
+		setAddr(t, "lo", "")
+		onNs(t, nsPID, func() { setAddr(t, "lo", "") })
+		serveEcho(t, nsPID, "127.0.0.1:80")
+
+		p, err := NewPortProxy(PortMapping{HostIP: "127.0.0.1", HostPort: 8080, BoxPort: 80}, nsPID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, "127.0.0.1:8080")
+
+		if err = p.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_, err = net.DialTimeout("tcp4", "127.0.0.1:8080", time.Second)
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Errorf("expected conn to a closed proxy to be refused, got %v", err)
+		}
+	})
+}
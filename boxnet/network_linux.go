@@ -0,0 +1,286 @@
+package boxnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// max length of a link name, without the terminating null byte
+const maxLinkNameLen = unix.IFNAMSIZ - 1
+
+var (
+	// ErrNetworkNotFound is returned when a network doesn't exist.
+	ErrNetworkNotFound = errors.New("network not found")
+	// ErrNetworkExists is returned when creating a network whose name is already taken.
+	ErrNetworkExists = errors.New("network exists")
+	// ErrInvalidNetworkName is returned when a network name can't be used as a file name.
+	ErrInvalidNetworkName = errors.New("invalid network name")
+)
+
+// Network is a named bridge network, which boxes are attached to by setting its name as the
+// network of the bridge model.
+type Network struct {
+	Name string `json:"name"`
+	// Bridge is the name of the network's bridge, defaults to box-<name>
+	Bridge string `json:"bridge"`
+	// Subnet and Gateway configure the IPAM of the boxes attached to the network, the gateway
+	// being the bridge's address
+	Subnet  string `json:"subnet"`
+	Gateway string `json:"gateway,omitempty"`
+	MTU     int    `json:"mtu,omitempty"`
+	STP     bool   `json:"stp,omitempty"`
+	// Masquerade masquerades the traffic of the subnet leaving through other interfaces
+	Masquerade bool      `json:"masquerade,omitempty"`
+	Created    time.Time `json:"created"`
+}
+
+// NetworkStore keeps networks in a root dir, each in a JSON file named after it.
+type NetworkStore struct {
+	root string
+}
+
+// NewNetworkStore returns a store kept in the given root dir, which is created on first use.
+func NewNetworkStore(root string) *NetworkStore {
+	return &NetworkStore{root: root}
+}
+
+// Create creates the given network along with its bridge, which must not exist, returning it
+// with its defaults set.
+func (s *NetworkStore) Create(n Network) (_ Network, err error) {
+	if err = validateNetworkName(n.Name); err != nil {
+		return
+	}
+
+	if n.Bridge == "" {
+		n.Bridge = "box-" + n.Name
+	}
+	if len(n.Bridge) > maxLinkNameLen {
+		return n, fmt.Errorf("bridge name %q longer than %d chars", n.Bridge, maxLinkNameLen)
+	}
+
+	ipam := n.ipamConf()
+	if n.Gateway, err = ipam.GatewayAddr(); err != nil {
+		return n, fmt.Errorf("invalid subnet: %s", err)
+	}
+	// keep only the IP, the mask is the subnet's one
+	n.Gateway = n.Gateway[:strings.Index(n.Gateway, "/")]
+	n.Created = time.Now()
+
+	unlock, err := s.lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	p := s.path(n.Name)
+	if _, err = os.Stat(p); err == nil {
+		return n, fmt.Errorf("%w: %s", ErrNetworkExists, n.Name)
+	}
+
+	_, created, err := EnsureBridge(n.bridgeConf())
+	if err != nil {
+		return
+	}
+	if !created {
+		return n, fmt.Errorf("bridge %q exists", n.Bridge)
+	}
+	defer func() {
+		if err != nil {
+			_ = DeleteNATRules(NATTag(n.Name, n.Bridge))
+			_ = DeleteBridge(n.Bridge)
+		}
+	}()
+
+	if n.Masquerade {
+		_, subnet, _ := net.ParseCIDR(n.Subnet)
+		if err = EnsureMasquerade(subnet, n.Bridge, NATTag(n.Name, n.Bridge)); err != nil {
+			return
+		}
+	}
+
+	return n, s.save(n)
+}
+
+// Get returns the network with the given name.
+func (s *NetworkStore) Get(name string) (n Network, err error) {
+	if err = validateNetworkName(name); err != nil {
+		return
+	}
+
+	return s.load(name)
+}
+
+// List returns all the networks in the store, sorted by name.
+func (s *NetworkStore) List() ([]Network, error) {
+	entries, err := ioutil.ReadDir(s.root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing networks: %s", err)
+	}
+
+	var list []Network
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		n, err := s.load(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list, nil
+}
+
+// Remove removes the network with the given name, deleting its bridge. The caller must make
+// sure no boxes are attached to it.
+func (s *NetworkStore) Remove(name string) error {
+	if err := validateNetworkName(name); err != nil {
+		return err
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	n, err := s.load(name)
+	if err != nil {
+		return err
+	}
+
+	if err = DeleteNATRules(NATTag(n.Name, n.Bridge)); err != nil {
+		return err
+	}
+	if err = DeleteBridge(n.Bridge); err != nil {
+		return fmt.Errorf("deleting bridge: %s", err)
+	}
+
+	return os.Remove(s.path(name))
+}
+
+// Resolve returns a copy of the given config with the network of its bridge model, if any,
+// resolved to its bridge and its config, which fills in the ipam config unless already set.
+func (s *NetworkStore) Resolve(conf *NetConf) (*NetConf, error) {
+	if conf == nil {
+		return conf, nil
+	}
+	name := conf.NetworkName()
+	if name == "" {
+		return conf, nil
+	}
+
+	n, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := *conf
+	resolved.Model = make(map[string]interface{}, len(conf.Model)+5)
+	for k, v := range conf.Model {
+		resolved.Model[k] = v
+	}
+	resolved.Model["bridge_name"] = n.Bridge
+	resolved.Model["gateway"] = n.bridgeConf().Gateway
+	resolved.Model["mtu"] = n.MTU
+	resolved.Model["stp"] = n.STP
+	resolved.Model["masquerade"] = n.Masquerade
+	if resolved.IPAM == nil {
+		ipam := n.ipamConf()
+		resolved.IPAM = &ipam
+	}
+
+	return &resolved, nil
+}
+
+func (n Network) ipamConf() IPAMConf {
+	return IPAMConf{Subnet: n.Subnet, Gateway: n.Gateway}
+}
+
+func (n Network) bridgeConf() BridgeConf {
+	gw, _ := n.ipamConf().GatewayAddr()
+	return BridgeConf{Name: n.Bridge, Gateway: gw, MTU: n.MTU, STP: n.STP}
+}
+
+func (s *NetworkStore) path(name string) string {
+	return filepath.Join(s.root, name+".json")
+}
+
+func (s *NetworkStore) load(name string) (n Network, err error) {
+	b, err := ioutil.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return n, fmt.Errorf("%w: %s", ErrNetworkNotFound, name)
+	}
+	if err != nil {
+		return n, fmt.Errorf("reading network: %s", err)
+	}
+
+	if err = json.Unmarshal(b, &n); err != nil {
+		return n, fmt.Errorf("parsing network: %s", err)
+	}
+
+	return n, nil
+}
+
+func (s *NetworkStore) save(n Network) error {
+	b, err := json.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	p := s.path(n.Name)
+	tmp := p + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p)
+}
+
+// lock takes an exclusive lock on the store, shared by all processes using it.
+func (s *NetworkStore) lock() (unlock func(), err error) {
+	if err = os.MkdirAll(s.root, 0755); err != nil {
+		return nil, fmt.Errorf("creating store dir: %s", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.root, lockFilename), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening store lock: %s", err)
+	}
+
+	if err = unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking store: %s", err)
+	}
+
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// validateNetworkName checks that the given network name can be used as its file name.
+func validateNetworkName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "/") {
+		return fmt.Errorf("%w: %q", ErrInvalidNetworkName, name)
+	}
+
+	return nil
+}
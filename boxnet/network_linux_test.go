@@ -0,0 +1,231 @@
+package boxnet
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestNetworkResolve(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "networks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	s := NewNetworkStore(tmp)
+	if err = os.MkdirAll(tmp, 0755); err != nil {
+		t.Fatal(err)
+	}
+	n := Network{
+		Name:    "net1",
+		Bridge:  "box-net1",
+		Subnet:  "10.1.0.0/24",
+		Gateway: "10.1.0.1",
+		MTU:     1400,
+	}
+	if err = s.save(n); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &NetConf{Model: map[string]interface{}{"type": "bridge", "network": "net1"}}
+	resolved, err := s.Resolve(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := conf.Model["bridge_name"]; ok {
+		t.Error("expected the given config to be left untouched")
+	}
+
+	model := ModelBridge{}
+	if err = ConfigFromRawConfig(resolved.Model, &model); err != nil {
+		t.Fatal(err)
+	}
+	expect := ModelBridge{BrName: "box-net1", Network: "net1", Gateway: "10.1.0.1/24", MTU: 1400}
+	if model != expect {
+		t.Errorf("expected model %+v, got %+v", expect, model)
+	}
+	expectIPAM := &IPAMConf{Subnet: "10.1.0.0/24", Gateway: "10.1.0.1"}
+	if !reflect.DeepEqual(resolved.IPAM, expectIPAM) {
+		t.Errorf("expected ipam %+v, got %+v", expectIPAM, resolved.IPAM)
+	}
+
+	conf.Model["network"] = "unknown"
+	if _, err = s.Resolve(conf); !errors.Is(err, ErrNetworkNotFound) {
+		t.Errorf("expected ErrNetworkNotFound, got: %v", err)
+	}
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "net1" {
+		t.Errorf("expected net1 to be listed, got %+v", list)
+	}
+
+	_, err = s.Create(Network{Name: ".hidden", Subnet: "10.2.0.0/24"})
+	if !errors.Is(err, ErrInvalidNetworkName) {
+		t.Errorf("expected ErrInvalidNetworkName, got: %v", err)
+	}
+	if _, err = s.Create(Network{Name: "net2", Bridge: "a-very-long-bridge"}); err == nil {
+		t.Error("expected bridge names longer than 15 chars to be rejected")
+	}
+}
+
+// withTestSysfs points sysClassNetDir to a sysfs mounted from the calling thread's NS, for the
+// duration of f.
+func withTestSysfs(t *testing.T, f func()) {
+	dir, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = unix.Mount("sysfs", dir, "sysfs", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Unmount(dir, unix.MNT_DETACH)
+
+	orig := sysClassNetDir
+	sysClassNetDir = filepath.Join(dir, "class/net")
+	defer func() { sysClassNetDir = orig }()
+
+	f()
+}
+
+func readSysctl(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func TestEnsureBridge(t *testing.T) {
+	withTestNs(t, func(int) {
+		withTestSysfs(t, func() {
+			if err := ioutil.WriteFile(ipForwardPath, []byte("0"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			conf := BridgeConf{Name: "br-test", Gateway: "10.3.0.1/24", MTU: 1400, STP: true}
+			_, created, err := EnsureBridge(conf)
+			if err != nil || !created {
+				t.Fatalf("expected the bridge to be created, got %t, %v", created, err)
+			}
+
+			br, err := netlink.LinkByName("br-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if br.Type() != "bridge" || br.Attrs().MTU != 1400 ||
+				br.Attrs().Flags&net.FlagUp == 0 {
+				t.Errorf("expected an up bridge with MTU 1400, got %s %+v", br.Type(), br.Attrs())
+			}
+			checkAddr(t, br, "10.3.0.1/24", false)
+			stp := filepath.Join(sysClassNetDir, "br-test/bridge/stp_state")
+			if state := readSysctl(t, stp); state != "1" {
+				t.Errorf("expected stp to be enabled, got %s", state)
+			}
+			if fwd := readSysctl(t, ipForwardPath); fwd != "1" {
+				t.Errorf("expected ip forwarding to be enabled, got %s", fwd)
+			}
+
+			// existing bridges are left as they are
+			link, created, err := EnsureBridge(BridgeConf{Name: "br-test", MTU: 1500})
+			if err != nil || created || link.Attrs().Index != br.Attrs().Index {
+				t.Errorf("expected the existing bridge, got %t, %v", created, err)
+			}
+			if link.Attrs().MTU != 1400 {
+				t.Errorf("expected the MTU of the existing bridge to be kept, got %d",
+					link.Attrs().MTU)
+			}
+
+			if _, _, err = EnsureBridge(BridgeConf{Name: "eth0"}); err == nil {
+				t.Error("expected links other than bridges to be refused")
+			}
+
+			if err = DeleteBridge("br-test"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = netlink.LinkByName("br-test"); err == nil {
+				t.Error("expected the bridge to be deleted")
+			}
+		})
+	})
+}
+
+func TestNetworkCreateRemove(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "networks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	withTestNs(t, func(int) {
+		s := NewNetworkStore(tmp)
+		n, err := s.Create(
+			Network{Name: "net1", Subnet: "10.4.0.0/24", MTU: 1400, Masquerade: true},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Bridge != "box-net1" || n.Gateway != "10.4.0.1" || n.Created.IsZero() {
+			t.Errorf("expected the network defaults to be set, got %+v", n)
+		}
+		if got, err := s.Get("net1"); err != nil || got.Bridge != n.Bridge ||
+			got.Gateway != n.Gateway || !got.Masquerade {
+			t.Errorf("expected the network to be saved, got %+v, %v", got, err)
+		}
+
+		br, err := netlink.LinkByName("box-net1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if br.Attrs().MTU != 1400 {
+			t.Errorf("expected bridge MTU 1400, got %d", br.Attrs().MTU)
+		}
+		checkAddr(t, br, "10.4.0.1/24", false)
+		tag := NATTag("net1", "box-net1")
+		if tags := ruleTags(t, postroutingChain); !reflect.DeepEqual(tags, []string{tag}) {
+			t.Errorf("expected the masquerade rule %s, got %v", tag, tags)
+		}
+
+		_, err = s.Create(Network{Name: "net1", Subnet: "10.5.0.0/24"})
+		if !errors.Is(err, ErrNetworkExists) {
+			t.Errorf("expected ErrNetworkExists, got %v", err)
+		}
+		// bridges not created by the network are refused
+		_, err = s.Create(Network{Name: "net2", Bridge: "box-net1", Subnet: "10.5.0.0/24"})
+		if err == nil {
+			t.Error("expected an existing bridge to be refused")
+		}
+		if _, err = s.Get("net2"); !errors.Is(err, ErrNetworkNotFound) {
+			t.Errorf("expected the refused network not to be saved, got %v", err)
+		}
+		if _, err = netlink.LinkByName("box-net1"); err != nil {
+			t.Errorf("expected the bridge of net1 to be left alone: %s", err)
+		}
+
+		if err = s.Remove("net1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = netlink.LinkByName("box-net1"); err == nil {
+			t.Error("expected the bridge to be deleted")
+		}
+		if tags := ruleTags(t, postroutingChain); len(tags) != 0 {
+			t.Errorf("expected the masquerade rule to be deleted, got %v", tags)
+		}
+		if _, err = s.Get("net1"); !errors.Is(err, ErrNetworkNotFound) {
+			t.Errorf("expected ErrNetworkNotFound once removed, got %v", err)
+		}
+	})
+}
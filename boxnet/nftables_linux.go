@@ -0,0 +1,496 @@
+package boxnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// A minimal nftables client talking netlink to the kernel, just enough to manage the NAT rules
+// of boxes, which live in their own table so that they don't clash with the host's rules.
+
+// nftTable is the table holding the rules of boxes, in each of the families used.
+const nftTable = "box"
+
+// udataComment is the type of the userdata TLV holding a rule comment, as nft shows it.
+const udataComment = 0
+
+// maxTagLen is the max length of a rule's tag, whose comment, with its TLV header and trailing
+// null byte, must fit in the kernel's max rule userdata length.
+const maxTagLen = 256 - 2 - 1
+
+// nftChain is a base chain of the box table.
+type nftChain struct {
+	name     string
+	typ      string
+	hook     uint32
+	priority int32
+}
+
+var (
+	postroutingChain = nftChain{"postrouting", "nat", unix.NF_INET_POST_ROUTING, 100}
+	preroutingChain  = nftChain{"prerouting", "nat", unix.NF_INET_PRE_ROUTING, -100}
+	outputChain      = nftChain{"output", "nat", unix.NF_INET_LOCAL_OUT, -100}
+	nftChains        = []nftChain{postroutingChain, preroutingChain, outputChain}
+)
+
+// nftRule is a rule of the box table.
+type nftRule struct {
+	handle uint64
+	// tag identifies the owner of the rule, stored as its comment
+	tag string
+}
+
+type nftMsg struct {
+	typ    uint16
+	flags  uint16
+	family uint8
+	attrs  []byte
+}
+
+type nftConn struct {
+	fd  int
+	seq uint32
+}
+
+func newNFTConn() (*nftConn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, fmt.Errorf("opening netfilter socket: %w", err)
+	}
+
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("binding netfilter socket: %s", err)
+	}
+
+	return &nftConn{fd: fd}, nil
+}
+
+func (c *nftConn) Close() error {
+	return unix.Close(c.fd)
+}
+
+// ensureChain creates the box table, in the given family, and the given chain, unless they
+// already exist.
+func (c *nftConn) ensureChain(family uint8, ch nftChain) error {
+	table := nftMsg{
+		typ:    unix.NFT_MSG_NEWTABLE,
+		flags:  unix.NLM_F_CREATE,
+		family: family,
+		attrs:  strAttr(unix.NFTA_TABLE_NAME, nftTable),
+	}
+
+	hook := nestedAttr(
+		unix.NFTA_CHAIN_HOOK,
+		be32Attr(unix.NFTA_HOOK_HOOKNUM, ch.hook),
+		be32Attr(unix.NFTA_HOOK_PRIORITY, uint32(ch.priority)),
+	)
+	chain := nftMsg{
+		typ:    unix.NFT_MSG_NEWCHAIN,
+		flags:  unix.NLM_F_CREATE,
+		family: family,
+		attrs: concat(
+			strAttr(unix.NFTA_CHAIN_TABLE, nftTable),
+			strAttr(unix.NFTA_CHAIN_NAME, ch.name),
+			hook,
+			strAttr(unix.NFTA_CHAIN_TYPE, ch.typ),
+		),
+	}
+
+	return c.batch(table, chain)
+}
+
+// rules returns the rules of the given chain of the box table, in the given family.
+func (c *nftConn) rules(family uint8, ch nftChain) ([]nftRule, error) {
+	msgs, err := c.dump(nftMsg{
+		typ:    unix.NFT_MSG_GETRULE,
+		family: family,
+		attrs: concat(
+			strAttr(unix.NFTA_RULE_TABLE, nftTable),
+			strAttr(unix.NFTA_RULE_CHAIN, ch.name),
+		),
+	})
+	if errors.Is(err, unix.ENOENT) {
+		// the table or chain don't exist
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []nftRule
+	for _, m := range msgs {
+		attrs, err := nl.ParseRouteAttr(m)
+		if err != nil {
+			return nil, fmt.Errorf("parsing rule: %s", err)
+		}
+
+		r := nftRule{}
+		for _, a := range attrs {
+			switch a.Attr.Type &^ unix.NLA_F_NESTED {
+			case unix.NFTA_RULE_HANDLE:
+				r.handle = binary.BigEndian.Uint64(a.Value)
+			case unix.NFTA_RULE_USERDATA:
+				r.tag = parseComment(a.Value)
+			}
+		}
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// addRule appends a rule made of the given expressions to the given chain of the box table, in
+// the given family, tagged with tag.
+func (c *nftConn) addRule(family uint8, ch nftChain, tag string, exprs ...[]byte) error {
+	if len(tag) > maxTagLen {
+		return fmt.Errorf("tag %q longer than %d chars", tag, maxTagLen)
+	}
+	if err := c.ensureChain(family, ch); err != nil {
+		return err
+	}
+
+	comment := append([]byte(tag), 0)
+	udata := append([]byte{udataComment, byte(len(comment))}, comment...)
+	return c.batch(nftMsg{
+		typ:    unix.NFT_MSG_NEWRULE,
+		flags:  unix.NLM_F_CREATE | unix.NLM_F_APPEND,
+		family: family,
+		attrs: concat(
+			strAttr(unix.NFTA_RULE_TABLE, nftTable),
+			strAttr(unix.NFTA_RULE_CHAIN, ch.name),
+			nestedAttr(unix.NFTA_RULE_EXPRESSIONS, exprs...),
+			attr(unix.NFTA_RULE_USERDATA, udata),
+		),
+	})
+}
+
+// hasRule returns whether the given chain of the box table, in the given family, has a rule
+// tagged with tag.
+func (c *nftConn) hasRule(family uint8, ch nftChain, tag string) (bool, error) {
+	rules, err := c.rules(family, ch)
+	if err != nil {
+		return false, err
+	}
+
+	for _, r := range rules {
+		if r.tag == tag {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// deleteRules deletes the rules of the box table tagged with tag, in the given family.
+func (c *nftConn) deleteRules(family uint8, tag string) error {
+	var msgs []nftMsg
+	for _, ch := range nftChains {
+		rules, err := c.rules(family, ch)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range rules {
+			if r.tag != tag {
+				continue
+			}
+
+			handle := make([]byte, 8)
+			binary.BigEndian.PutUint64(handle, r.handle)
+			msgs = append(msgs, nftMsg{
+				typ:    unix.NFT_MSG_DELRULE,
+				family: family,
+				attrs: concat(
+					strAttr(unix.NFTA_RULE_TABLE, nftTable),
+					strAttr(unix.NFTA_RULE_CHAIN, ch.name),
+					attr(unix.NFTA_RULE_HANDLE, handle),
+				),
+			})
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	return c.batch(msgs...)
+}
+
+// batch sends the given messages in a single transaction, waiting for all of them to be
+// acknowledged.
+func (c *nftConn) batch(msgs ...nftMsg) error {
+	subsys := make([]byte, 2)
+	binary.BigEndian.PutUint16(subsys, unix.NFNL_SUBSYS_NFTABLES)
+
+	var buf []byte
+	buf = append(buf, c.encode(unix.NFNL_MSG_BATCH_BEGIN, unix.NLM_F_REQUEST, 0, subsys, nil)...)
+	first := c.seq + 1
+	for _, m := range msgs {
+		typ := uint16(unix.NFNL_SUBSYS_NFTABLES<<8) | m.typ
+		flags := unix.NLM_F_REQUEST | unix.NLM_F_ACK | m.flags
+		buf = append(buf, c.encode(typ, flags, m.family, nil, m.attrs)...)
+	}
+	buf = append(buf, c.encode(unix.NFNL_MSG_BATCH_END, unix.NLM_F_REQUEST, 0, subsys, nil)...)
+
+	if err := c.send(buf); err != nil {
+		return err
+	}
+
+	for acked := 0; acked < len(msgs); {
+		replies, err := c.receive()
+		if err != nil {
+			return err
+		}
+
+		for _, r := range replies {
+			if r.Header.Seq < first || r.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if err = replyError(r); err != nil {
+				return err
+			}
+			acked++
+		}
+	}
+
+	return nil
+}
+
+// dump sends the given get message as a dump request, returning the attributes of each of the
+// messages received.
+func (c *nftConn) dump(m nftMsg) ([][]byte, error) {
+	typ := uint16(unix.NFNL_SUBSYS_NFTABLES<<8) | m.typ
+	buf := c.encode(typ, unix.NLM_F_REQUEST|unix.NLM_F_DUMP, m.family, nil, m.attrs)
+	if err := c.send(buf); err != nil {
+		return nil, err
+	}
+	seq := c.seq
+
+	var msgs [][]byte
+	for {
+		replies, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range replies {
+			if r.Header.Seq != seq {
+				continue
+			}
+			switch r.Header.Type {
+			case unix.NLMSG_DONE:
+				return msgs, nil
+			case unix.NLMSG_ERROR:
+				if err = replyError(r); err != nil {
+					return nil, err
+				}
+			default:
+				// skip the nfgenmsg header
+				msgs = append(msgs, r.Data[4:])
+			}
+		}
+	}
+}
+
+func (c *nftConn) send(buf []byte) error {
+	err := unix.Sendto(c.fd, buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return fmt.Errorf("sending to netfilter: %s", err)
+	}
+
+	return nil
+}
+
+func (c *nftConn) receive() ([]syscall.NetlinkMessage, error) {
+	buf := make([]byte, unix.Getpagesize()*8)
+	n, _, err := unix.Recvfrom(c.fd, buf, 0)
+	if err != nil {
+		return nil, fmt.Errorf("receiving from netfilter: %s", err)
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return nil, fmt.Errorf("parsing netfilter reply: %s", err)
+	}
+
+	return msgs, nil
+}
+
+// encode encodes a netfilter message, with a nfgenmsg header, with the next sequence number.
+func (c *nftConn) encode(typ, flags uint16, family uint8, resID, attrs []byte) []byte {
+	c.seq++
+	if resID == nil {
+		resID = []byte{0, 0}
+	}
+
+	l := unix.SizeofNlMsghdr + 4 + len(attrs)
+	b := make([]byte, unix.SizeofNlMsghdr, l)
+	ne := nl.NativeEndian()
+	ne.PutUint32(b[0:4], uint32(l))
+	ne.PutUint16(b[4:6], typ)
+	ne.PutUint16(b[6:8], flags)
+	ne.PutUint32(b[8:12], c.seq)
+	b = append(b, family, unix.NFNETLINK_V0)
+	b = append(b, resID...)
+
+	return append(b, attrs...)
+}
+
+// replyError returns the error carried by the given netlink error message, if any.
+func replyError(m syscall.NetlinkMessage) error {
+	if len(m.Data) < 4 {
+		return errors.New("short netlink error message")
+	}
+
+	if errno := int32(nl.NativeEndian().Uint32(m.Data[0:4])); errno != 0 {
+		return unix.Errno(-errno)
+	}
+
+	return nil
+}
+
+// parseComment returns the comment in the given rule userdata, if any.
+func parseComment(udata []byte) string {
+	for len(udata) >= 2 {
+		typ, l := udata[0], int(udata[1])
+		if len(udata) < 2+l {
+			break
+		}
+		if typ == udataComment && l > 0 {
+			return string(udata[2 : 2+l-1])
+		}
+		udata = udata[2+l:]
+	}
+
+	return ""
+}
+
+// expression builders, each returning a list element of the expressions of a rule. Registers
+// are NFT_REG_1 unless stated otherwise, enough for the simple rules built.
+
+func expr(name string, data ...[]byte) []byte {
+	attrs := strAttr(unix.NFTA_EXPR_NAME, name)
+	if len(data) > 0 {
+		attrs = append(attrs, nestedAttr(unix.NFTA_EXPR_DATA, data...)...)
+	}
+
+	return nestedAttr(unix.NFTA_LIST_ELEM, attrs)
+}
+
+// exprPayload loads length bytes at offset of the given header into the register.
+func exprPayload(base, offset, length uint32) []byte {
+	return expr(
+		"payload",
+		be32Attr(unix.NFTA_PAYLOAD_DREG, unix.NFT_REG_1),
+		be32Attr(unix.NFTA_PAYLOAD_BASE, base),
+		be32Attr(unix.NFTA_PAYLOAD_OFFSET, offset),
+		be32Attr(unix.NFTA_PAYLOAD_LEN, length),
+	)
+}
+
+// exprMask masks the register with mask.
+func exprMask(mask []byte) []byte {
+	return expr(
+		"bitwise",
+		be32Attr(unix.NFTA_BITWISE_SREG, unix.NFT_REG_1),
+		be32Attr(unix.NFTA_BITWISE_DREG, unix.NFT_REG_1),
+		be32Attr(unix.NFTA_BITWISE_LEN, uint32(len(mask))),
+		nestedAttr(unix.NFTA_BITWISE_MASK, attr(unix.NFTA_DATA_VALUE, mask)),
+		nestedAttr(unix.NFTA_BITWISE_XOR, attr(unix.NFTA_DATA_VALUE, make([]byte, len(mask)))),
+	)
+}
+
+// exprCmp compares the register with data, breaking the rule unless op holds.
+func exprCmp(op uint32, data []byte) []byte {
+	return expr(
+		"cmp",
+		be32Attr(unix.NFTA_CMP_SREG, unix.NFT_REG_1),
+		be32Attr(unix.NFTA_CMP_OP, op),
+		nestedAttr(unix.NFTA_CMP_DATA, attr(unix.NFTA_DATA_VALUE, data)),
+	)
+}
+
+// exprMeta loads the given meta key into the register.
+func exprMeta(key uint32) []byte {
+	return expr(
+		"meta",
+		be32Attr(unix.NFTA_META_DREG, unix.NFT_REG_1),
+		be32Attr(unix.NFTA_META_KEY, key),
+	)
+}
+
+func exprMasq() []byte {
+	return expr("masq")
+}
+
+// exprFibAddrType loads the route type of the destination address into the register.
+func exprFibAddrType() []byte {
+	return expr(
+		"fib",
+		be32Attr(unix.NFTA_FIB_DREG, unix.NFT_REG_1),
+		be32Attr(unix.NFTA_FIB_RESULT, unix.NFT_FIB_RESULT_ADDRTYPE),
+		be32Attr(unix.NFTA_FIB_FLAGS, unix.NFTA_FIB_F_DADDR),
+	)
+}
+
+// exprImmediate loads data into the given register.
+func exprImmediate(reg uint32, data []byte) []byte {
+	return expr(
+		"immediate",
+		be32Attr(unix.NFTA_IMMEDIATE_DREG, reg),
+		nestedAttr(unix.NFTA_IMMEDIATE_DATA, attr(unix.NFTA_DATA_VALUE, data)),
+	)
+}
+
+// exprDNAT translates the destination to the IPv4 address in NFT_REG_1 and the port in
+// NFT_REG_2.
+func exprDNAT() []byte {
+	return expr(
+		"nat",
+		be32Attr(unix.NFTA_NAT_TYPE, unix.NFT_NAT_DNAT),
+		be32Attr(unix.NFTA_NAT_FAMILY, unix.NFPROTO_IPV4),
+		be32Attr(unix.NFTA_NAT_REG_ADDR_MIN, unix.NFT_REG_1),
+		be32Attr(unix.NFTA_NAT_REG_PROTO_MIN, unix.NFT_REG_2),
+	)
+}
+
+func attr(typ uint16, data []byte) []byte {
+	l := unix.SizeofNlAttr + len(data)
+	b := make([]byte, unix.SizeofNlAttr, nlaAlign(l))
+	nl.NativeEndian().PutUint16(b[0:2], uint16(l))
+	nl.NativeEndian().PutUint16(b[2:4], typ)
+	b = append(b, data...)
+
+	return append(b, make([]byte, nlaAlign(l)-l)...)
+}
+
+func nestedAttr(typ uint16, attrs ...[]byte) []byte {
+	return attr(typ|unix.NLA_F_NESTED, concat(attrs...))
+}
+
+func strAttr(typ uint16, s string) []byte {
+	return attr(typ, append([]byte(s), 0))
+}
+
+func be32Attr(typ uint16, v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return attr(typ, b)
+}
+
+func concat(bs ...[]byte) []byte {
+	var b []byte
+	for _, p := range bs {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func nlaAlign(l int) int {
+	return (l + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+}
@@ -0,0 +1,72 @@
+package boxnet
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// ruleTags returns the tags of the rules in the given chain of the box table.
+func ruleTags(t *testing.T, ch nftChain) (tags []string) {
+	c, err := newNFTConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	rules, err := c.rules(unix.NFPROTO_IPV4, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rules {
+		tags = append(tags, r.tag)
+	}
+
+	return tags
+}
+
+func TestNFTRules(t *testing.T) {
+	withTestNs(t, func(int) {
+		if tags := ruleTags(t, postroutingChain); len(tags) != 0 {
+			t.Fatalf("expected no rules without the table, got %v", tags)
+		}
+
+		_, subnet, _ := net.ParseCIDR("10.88.0.0/16")
+		for _, tag := range []string{"box:bridge:a", "box:bridge:b", "box:bridge:a"} {
+			if err := EnsureMasquerade(subnet, "br0", tag); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tags := ruleTags(t, postroutingChain)
+		if strings.Join(tags, ",") != "box:bridge:a,box:bridge:b" {
+			t.Errorf("expected a rule for each tag, got %v", tags)
+		}
+
+		c, err := newNFTConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err = c.deleteRules(unix.NFPROTO_IPV4, "box:bridge:a"); err != nil {
+			t.Fatal(err)
+		}
+		if tags = ruleTags(t, postroutingChain); len(tags) != 1 || tags[0] != "box:bridge:b" {
+			t.Errorf("expected only the rule tagged b to be left, got %v", tags)
+		}
+
+		// the tag is stored in the rule's comment, whose length is limited
+		long := "box:" + strings.Repeat("x", maxTagLen-4)
+		if err = c.addRule(unix.NFPROTO_IPV4, postroutingChain, long, exprMasq()); err != nil {
+			t.Fatal(err)
+		}
+		if tags = ruleTags(t, postroutingChain); len(tags) != 2 || tags[1] != long {
+			t.Errorf("expected the long tag to be kept, got %v", tags)
+		}
+		err = c.addRule(unix.NFPROTO_IPV4, postroutingChain, long+"x", exprMasq())
+		if err == nil {
+			t.Error("expected a tag longer than the max to be rejected")
+		}
+	})
+}
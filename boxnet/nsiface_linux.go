@@ -0,0 +1,203 @@
+package boxnet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+)
+
+// nsIFaceConf is the config shared by all the NsIFacer types.
+type nsIFaceConf struct {
+	name   string
+	parent string
+	addrs  []string
+	routes []Route
+	mtu    int
+}
+
+type nsIface struct {
+	name  string
+	typ   string
+	nsPID int
+}
+
+var _ NsIFacer = (*nsIface)(nil)
+
+var macvlanModes = map[string]netlink.MacvlanMode{
+	"":        netlink.MACVLAN_MODE_BRIDGE,
+	"bridge":  netlink.MACVLAN_MODE_BRIDGE,
+	"private": netlink.MACVLAN_MODE_PRIVATE,
+	"vepa":    netlink.MACVLAN_MODE_VEPA,
+}
+
+var ipvlanModes = map[string]netlink.IPVlanMode{
+	"":   netlink.IPVLAN_MODE_L2,
+	"l2": netlink.IPVLAN_MODE_L2,
+	"l3": netlink.IPVLAN_MODE_L3,
+}
+
+// MacvlanFromConfig creates a macvlan interface in the NS of the box with the given NS PID.
+func MacvlanFromConfig(conf MacvlanConf, nsPID int) (NsIFacer, error) {
+	mode, ok := macvlanModes[conf.Mode]
+	if !ok {
+		return nil, fmt.Errorf("unknown macvlan mode %q", conf.Mode)
+	}
+
+	return newNsIFace(
+		&netlink.Macvlan{Mode: mode},
+		nsIFaceConf{conf.Name, conf.Parent, joinAddrs(conf.Ip, conf.Ips), conf.Routes, conf.MTU},
+		nsPID,
+	)
+}
+
+// IpvlanFromConfig creates an ipvlan interface in the NS of the box with the given NS PID.
+func IpvlanFromConfig(conf IpvlanConf, nsPID int) (NsIFacer, error) {
+	mode, ok := ipvlanModes[conf.Mode]
+	if !ok {
+		return nil, fmt.Errorf("unknown ipvlan mode %q", conf.Mode)
+	}
+
+	return newNsIFace(
+		&netlink.IPVlan{Mode: mode},
+		nsIFaceConf{conf.Name, conf.Parent, joinAddrs(conf.Ip, conf.Ips), conf.Routes, conf.MTU},
+		nsPID,
+	)
+}
+
+// newNsIFace creates the given link on top of its parent and moves it to the NS of the box
+// with the given NS PID, where it is renamed, configured and brought up.
+func newNsIFace(link netlink.Link, conf nsIFaceConf, nsPID int) (_ NsIFacer, err error) {
+	parent, err := netlink.LinkByName(conf.parent)
+	if err != nil {
+		return nil, fmt.Errorf("getting parent link %q: %s", conf.parent, err)
+	}
+
+	// the link is created with a temporary name since the box's one may be taken on the host
+	tmpName, err := tmpLinkName()
+	if err != nil {
+		return nil, err
+	}
+	la := link.Attrs()
+	la.Name = tmpName
+	la.ParentIndex = parent.Attrs().Index
+	la.MTU = conf.mtu
+	if err = netlink.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("creating %s link: %s", link.Type(), err)
+	}
+
+	if err = netlink.LinkSetNsPid(link, nsPID); err != nil {
+		_ = netlink.LinkDel(link)
+		return nil, fmt.Errorf("moving link to ns %d: %s", nsPID, err)
+	}
+
+	iface := &nsIface{name: tmpName, typ: link.Type(), nsPID: nsPID}
+	defer func() {
+		if err != nil {
+			_ = iface.Delete()
+		}
+	}()
+
+	var setupErr error
+	if err = ExecuteOnNs(nsPID, func() { setupErr = iface.setup(conf) }); err == nil {
+		err = setupErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("setting up %s %q: %s", iface.typ, conf.name, err)
+	}
+
+	return iface, nil
+}
+
+// setup renames the interface to its configured name, sets its address, brings it up and sets
+// its routes. It must be called from the box's NS.
+func (i *nsIface) setup(conf nsIFaceConf) error {
+	link, err := netlink.LinkByName(i.name)
+	if err != nil {
+		return err
+	}
+
+	if err = netlink.LinkSetName(link, conf.name); err != nil {
+		return fmt.Errorf("renaming link: %s", err)
+	}
+	i.name = conf.name
+
+	for _, a := range conf.addrs {
+		addr, err := netlink.ParseAddr(a)
+		if err != nil {
+			return fmt.Errorf("unable to parse configured IP %q: %s", a, err)
+		}
+		if err = netlink.AddrAdd(link, addr); err != nil {
+			return fmt.Errorf("setting address %q: %s", a, err)
+		}
+	}
+
+	if err = netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("setting link up: %s", err)
+	}
+
+	for _, route := range conf.routes {
+		_, dst, err := net.ParseCIDR(route.Subnet)
+		if err != nil {
+			return fmt.Errorf("parsing route subnet %+v: %s", route.Subnet, err)
+		}
+
+		err = netlink.RouteAdd(
+			&netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Dst:       dst,
+				Gw:        net.ParseIP(route.Gateway),
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("adding route to %s: %s", route.Subnet, err)
+		}
+	}
+
+	return nil
+}
+
+func (i *nsIface) Name() string {
+	return i.name
+}
+
+func (i *nsIface) Type() string {
+	return i.typ
+}
+
+func (i *nsIface) Delete() error {
+	var delErr error
+	err := ExecuteOnNs(i.nsPID, func() {
+		link, err := netlink.LinkByName(i.name)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return
+		}
+		if err != nil {
+			delErr = err
+			return
+		}
+		delErr = netlink.LinkDel(link)
+	})
+	if os.IsNotExist(err) {
+		// the box's NS is gone, along with the interface
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return delErr
+}
+
+// tmpLinkName returns a random link name.
+func tmpLinkName() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating link name: %s", err)
+	}
+
+	return "box" + hex.EncodeToString(b), nil
+}
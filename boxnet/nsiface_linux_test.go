@@ -0,0 +1,169 @@
+package boxnet
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/cprates/box/internal/nettest"
+
+	"github.com/vishvananda/netlink"
+)
+
+// withTestNs runs f with the calling thread in a throwaway NS standing for the host, with a
+// veth named eth0 to be used as parent, passing it the NS PID of a process standing for the
+// box. The test is skipped unless run as root.
+func withTestNs(t *testing.T, f func(nsPID int)) {
+	nettest.WithHostNs(t, func() {
+		nettest.AddLink(t, "eth0", "")
+
+		// forked from this thread, so the process starts in the host NS before getting its own
+		box := exec.Command("sleep", "60")
+		box.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+		if err := box.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = box.Process.Kill()
+			_ = box.Wait()
+		}()
+
+		f(box.Process.Pid)
+	})
+}
+
+// onNs runs f in the NS of the given PID, failing the test if it can't be entered.
+func onNs(t *testing.T, nsPID int, f func()) {
+	if err := ExecuteOnNs(nsPID, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMacvlanFromConfig(t *testing.T) {
+	withTestNs(t, func(nsPID int) {
+		iface, err := MacvlanFromConfig(
+			MacvlanConf{
+				Name:   "eth0",
+				Parent: "eth0",
+				Mode:   "private",
+				Ip:     "10.10.0.2/24",
+				Routes: []Route{{Subnet: "0.0.0.0/0", Gateway: "10.10.0.1"}},
+			},
+			nsPID,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		onNs(t, nsPID, func() {
+			link, err := netlink.LinkByName("eth0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			mv, ok := link.(*netlink.Macvlan)
+			if !ok {
+				t.Fatalf("expected a macvlan, got %s", link.Type())
+			}
+			if mv.Mode != netlink.MACVLAN_MODE_PRIVATE {
+				t.Errorf("expected private mode, got %d", mv.Mode)
+			}
+			checkLinkConf(t, link, "10.10.0.2/24", "10.10.0.1")
+		})
+
+		// the host is left untouched, besides the parent
+		links, err := netlink.LinkList()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range links {
+			if name := l.Attrs().Name; name != "lo" && name != "eth0" && name != "eth0p" {
+				t.Errorf("unexpected host link %q", name)
+			}
+		}
+
+		if err = iface.Delete(); err != nil {
+			t.Fatal(err)
+		}
+		onNs(t, nsPID, func() {
+			if _, err := netlink.LinkByName("eth0"); err == nil {
+				t.Error("expected the macvlan to be deleted")
+			}
+		})
+
+		_, err = MacvlanFromConfig(MacvlanConf{Name: "eth1", Parent: "eth0", Mode: "l3"}, nsPID)
+		if err == nil {
+			t.Error("expected an invalid mode to fail")
+		}
+		_, err = MacvlanFromConfig(MacvlanConf{Name: "eth1", Parent: "missing"}, nsPID)
+		if err == nil {
+			t.Error("expected a missing parent to fail")
+		}
+	})
+}
+
+func TestIpvlanFromConfig(t *testing.T) {
+	withTestNs(t, func(nsPID int) {
+		iface, err := IFaceFromConfig(
+			map[string]interface{}{
+				"type":   "ipvlan",
+				"name":   "eth0",
+				"parent": "eth0",
+				"mode":   "l3",
+				"ip":     "10.10.0.2/24",
+				"routes": []Route{{Subnet: "10.20.0.0/16", Gateway: "10.10.0.1"}},
+			},
+			nsPID,
+		)
+		if err != nil && strings.Contains(err.Error(), "not supported") {
+			t.Skip("ipvlan not supported by the kernel")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer iface.Delete()
+
+		onNs(t, nsPID, func() {
+			link, err := netlink.LinkByName("eth0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			iv, ok := link.(*netlink.IPVlan)
+			if !ok {
+				t.Fatalf("expected an ipvlan, got %s", link.Type())
+			}
+			if iv.Mode != netlink.IPVLAN_MODE_L3 {
+				t.Errorf("expected l3 mode, got %d", iv.Mode)
+			}
+			checkLinkConf(t, link, "10.10.0.2/24", "10.10.0.1")
+		})
+	})
+}
+
+// checkLinkConf checks that the given link is up, with the given address and a route via gw.
+func checkLinkConf(t *testing.T, link netlink.Link, addr, gw string) {
+	t.Helper()
+
+	if link.Attrs().Flags&syscall.IFF_UP == 0 {
+		t.Error("expected the link to be up")
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].IPNet.String() != addr {
+		t.Errorf("expected address %s, got %v", addr, addrs)
+	}
+
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range routes {
+		if r.Gw.String() == gw {
+			return
+		}
+	}
+	t.Errorf("expected a route via %s, got %v", gw, routes)
+}
@@ -0,0 +1,93 @@
+package boxnet
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PortMapping publishes a port of the box on a port of the host.
+type PortMapping struct {
+	// HostIP limits the published port to an address of the host, defaults to all of them
+	HostIP   string `json:"host_ip,omitempty"`
+	HostPort int    `json:"host_port"`
+	BoxPort  int    `json:"box_port"`
+	// Protocol is either tcp or udp, defaults to tcp
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// PublishedPort is a port mapping published for a box.
+type PublishedPort struct {
+	PortMapping
+	// BoxIP is the address of the box the DNAT rules point at, unset if proxied
+	BoxIP string `json:"box_ip,omitempty"`
+	// Proxy is set if the port is published by a userspace proxy instead of DNAT rules
+	Proxy bool `json:"proxy,omitempty"`
+}
+
+// ParsePortMapping parses a port mapping in the form [host_ip:]host_port:box_port[/protocol],
+// e.g. 8080:80/tcp.
+func ParsePortMapping(s string) (m PortMapping, err error) {
+	ports := s
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		ports, m.Protocol = s[:i], s[i+1:]
+	}
+
+	parts := strings.Split(ports, ":")
+	switch len(parts) {
+	case 2:
+	case 3:
+		m.HostIP = parts[0]
+		parts = parts[1:]
+	default:
+		return m, fmt.Errorf("invalid port mapping %q", s)
+	}
+
+	if m.HostPort, err = strconv.Atoi(parts[0]); err != nil {
+		return m, fmt.Errorf("invalid host port %q", parts[0])
+	}
+	if m.BoxPort, err = strconv.Atoi(parts[1]); err != nil {
+		return m, fmt.Errorf("invalid box port %q", parts[1])
+	}
+
+	return m, m.validate()
+}
+
+// String returns the mapping in the form accepted by ParsePortMapping.
+func (m PortMapping) String() string {
+	s := fmt.Sprintf("%d:%d/%s", m.HostPort, m.BoxPort, m.protocol())
+	if m.HostIP != "" {
+		s = m.HostIP + ":" + s
+	}
+	return s
+}
+
+func (m PortMapping) validate() error {
+	if m.HostIP != "" && net.ParseIP(m.HostIP).To4() == nil {
+		return fmt.Errorf("invalid host IPv4 %q", m.HostIP)
+	}
+	if m.HostPort < 1 || m.HostPort > 65535 {
+		return fmt.Errorf("host port %d out of range", m.HostPort)
+	}
+	if m.BoxPort < 1 || m.BoxPort > 65535 {
+		return fmt.Errorf("box port %d out of range", m.BoxPort)
+	}
+	if p := m.protocol(); p != "tcp" && p != "udp" {
+		return fmt.Errorf("unsupported protocol %q", m.Protocol)
+	}
+
+	return nil
+}
+
+func (m PortMapping) protocol() string {
+	if m.Protocol == "" {
+		return "tcp"
+	}
+	return m.Protocol
+}
+
+// hostAddr returns the host address the mapping listens on.
+func (m PortMapping) hostAddr() string {
+	return net.JoinHostPort(m.HostIP, strconv.Itoa(m.HostPort))
+}
@@ -0,0 +1,41 @@
+package boxnet
+
+import (
+	"testing"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	valid := map[string]PortMapping{
+		"8080:80":              {HostPort: 8080, BoxPort: 80},
+		"8080:80/tcp":          {HostPort: 8080, BoxPort: 80, Protocol: "tcp"},
+		"5353:53/udp":          {HostPort: 5353, BoxPort: 53, Protocol: "udp"},
+		"127.0.0.1:8080:80":    {HostIP: "127.0.0.1", HostPort: 8080, BoxPort: 80},
+		"10.0.0.1:443:443/tcp": {HostIP: "10.0.0.1", HostPort: 443, BoxPort: 443, Protocol: "tcp"},
+	}
+	for s, expect := range valid {
+		m, err := ParsePortMapping(s)
+		if err != nil {
+			t.Errorf("parsing %q: %s", s, err)
+			continue
+		}
+		if m != expect {
+			t.Errorf("parsing %q: expected %+v, got %+v", s, expect, m)
+		}
+	}
+
+	invalid := []string{
+		"80",
+		"a:80",
+		"8080:b",
+		"0:80",
+		"8080:65536",
+		"8080:80/sctp",
+		"::1:8080:80",
+		"host:8080:80",
+	}
+	for _, s := range invalid {
+		if _, err := ParsePortMapping(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
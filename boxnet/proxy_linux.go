@@ -0,0 +1,237 @@
+package boxnet
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	proxyDialTimeout = 5 * time.Second
+	// how long a UDP flow is kept without traffic from the box before dropping it
+	proxyUDPIdleTimeout = 90 * time.Second
+	maxDatagramSize     = 65507
+)
+
+// PortProxy publishes a port of a box with a userspace proxy, listening on the host and
+// forwarding to the box's loopback address. Connections to the box are dialed from its NS, so
+// the box needs no address reachable from the host, but the proxy only lives as long as the
+// process running it.
+type PortProxy struct {
+	mapping PortMapping
+	nsPID   int
+
+	listener   net.Listener
+	packetConn net.PacketConn
+
+	lock sync.Mutex
+	// open conns, closed along with the proxy
+	conns map[net.Conn]struct{}
+	// conns to the box of each UDP client, by client address
+	flows  map[string]net.Conn
+	closed bool
+}
+
+// NewPortProxy starts a proxy publishing the given mapping for the box with the given NS PID.
+func NewPortProxy(m PortMapping, nsPID int) (p *PortProxy, err error) {
+	if err = m.validate(); err != nil {
+		return
+	}
+
+	p = &PortProxy{
+		mapping: m,
+		nsPID:   nsPID,
+		conns:   map[net.Conn]struct{}{},
+		flows:   map[string]net.Conn{},
+	}
+	if m.protocol() == "udp" {
+		if p.packetConn, err = net.ListenPacket("udp4", m.hostAddr()); err != nil {
+			return nil, err
+		}
+		go p.serveUDP()
+		return p, nil
+	}
+
+	if p.listener, err = net.Listen("tcp4", m.hostAddr()); err != nil {
+		return nil, err
+	}
+	go p.serveTCP()
+
+	return p, nil
+}
+
+// Close stops the proxy, closing all its connections.
+func (p *PortProxy) Close() (err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	if p.listener != nil {
+		err = p.listener.Close()
+	} else {
+		err = p.packetConn.Close()
+	}
+	for c := range p.conns {
+		_ = c.Close()
+	}
+
+	return
+}
+
+func (p *PortProxy) serveTCP() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		go p.proxyTCP(conn)
+	}
+}
+
+func (p *PortProxy) proxyTCP(client net.Conn) {
+	defer client.Close()
+	if !p.track(client) {
+		return
+	}
+	defer p.untrack(client)
+
+	box, err := p.dial()
+	if err != nil {
+		return
+	}
+	defer box.Close()
+	if !p.track(box) {
+		return
+	}
+	defer p.untrack(box)
+
+	done := make(chan struct{})
+	go func() {
+		copyHalf(box, client)
+		close(done)
+	}()
+	copyHalf(client, box)
+	<-done
+}
+
+// copyHalf copies from src to dst, closing the write side of dst once src is drained so that
+// the peer gets EOF while the other direction is still open.
+func copyHalf(dst, src net.Conn) {
+	_, _ = io.Copy(dst, src)
+	if c, ok := dst.(*net.TCPConn); ok {
+		_ = c.CloseWrite()
+		return
+	}
+	_ = dst.Close()
+}
+
+func (p *PortProxy) serveUDP() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := p.packetConn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		box, err := p.udpFlow(client)
+		if err != nil {
+			// the datagram is dropped
+			continue
+		}
+		_, _ = box.Write(buf[:n])
+	}
+}
+
+// udpFlow returns the conn to the box of the given client, dialing it if there is none.
+func (p *PortProxy) udpFlow(client net.Addr) (net.Conn, error) {
+	p.lock.Lock()
+	box, ok := p.flows[client.String()]
+	p.lock.Unlock()
+	if ok {
+		return box, nil
+	}
+
+	box, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	if !p.track(box) {
+		box.Close()
+		return nil, io.ErrClosedPipe
+	}
+	p.lock.Lock()
+	p.flows[client.String()] = box
+	p.lock.Unlock()
+
+	go func() {
+		defer func() {
+			p.lock.Lock()
+			delete(p.flows, client.String())
+			p.lock.Unlock()
+			p.untrack(box)
+			box.Close()
+		}()
+
+		buf := make([]byte, maxDatagramSize)
+		for {
+			_ = box.SetReadDeadline(time.Now().Add(proxyUDPIdleTimeout))
+			n, err := box.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err = p.packetConn.WriteTo(buf[:n], client); err != nil {
+				return
+			}
+		}
+	}()
+
+	return box, nil
+}
+
+// dial dials the box port from the box's NS.
+func (p *PortProxy) dial() (conn net.Conn, err error) {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(p.mapping.BoxPort))
+	nsErr := ExecuteOnNs(p.nsPID, func() {
+		conn, err = net.DialTimeout(p.mapping.protocol()+"4", addr, proxyDialTimeout)
+	})
+	if nsErr != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, nsErr
+	}
+
+	return
+}
+
+// track adds the given conn to the ones closed along with the proxy, unless already closed.
+func (p *PortProxy) track(c net.Conn) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return false
+	}
+	p.conns[c] = struct{}{}
+
+	return true
+}
+
+func (p *PortProxy) untrack(c net.Conn) {
+	p.lock.Lock()
+	delete(p.conns, c)
+	p.lock.Unlock()
+}
@@ -0,0 +1,188 @@
+package boxnet
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Modeler is a network setup of a box created by a network model.
+type Modeler interface {
+	// IFaces returns the interfaces of the box with a host side link, which are tagged and
+	// deleted along with the box
+	IFaces() []IFacer
+	// Close deletes all the interfaces of the box created by the model
+	Close() error
+}
+
+// NetModel is a network model, registered with RegisterModel, set up for the boxes whose
+// netconf has a model of its type.
+type NetModel struct {
+	// Decode decodes the raw config of the model into the typed config passed to New
+	Decode func(rawConf map[string]interface{}) (interface{}, error)
+	// New sets up the network of the box with the given NS PID with the decoded model config.
+	// The whole netconf is given as well, since the model is in charge of its interfaces
+	New func(conf interface{}, netConf *NetConf, nsPID int) (Modeler, error)
+	// Bridge returns the bridge the box is attached to by the model with the decoded config,
+	// along with the network which created it, if any. Unset for models not using a bridge
+	Bridge func(conf interface{}) (bridge, network string)
+}
+
+// IFaceType is an interface type, registered with RegisterIFaceType, created for each
+// interface of its type in the netconf of a box.
+type IFaceType struct {
+	// Decode decodes the raw config of the interface into the typed config passed to New
+	Decode func(rawConf map[string]interface{}) (interface{}, error)
+	// New creates the interface with the decoded config in the NS of the box with the given NS
+	// PID. Types with a host side link must return an IFacer, so that the link can be tagged and
+	// attached to a bridge
+	New func(conf interface{}, nsPID int) (NsIFacer, error)
+	// Addresses returns the addresses, in CIDR format, of the box side of the interface with the
+	// decoded config. Unset for types without addresses
+	Addresses func(conf interface{}) []string
+	// IPAMKey is the key of the raw config set to the box side address allocated by the IPAM,
+	// unless already set. Unset for types not getting addresses from the IPAM
+	IPAMKey string
+}
+
+// registry holds the registered models and interface types, the built-in ones included. Their
+// constructors, setting up the links, are only available on linux, where they are set on init.
+var registry = struct {
+	lock       sync.RWMutex
+	models     map[string]NetModel
+	ifaceTypes map[string]IFaceType
+}{
+	models: map[string]NetModel{
+		"bridge": {
+			Decode: func(rawConf map[string]interface{}) (interface{}, error) {
+				cfg := &ModelBridge{}
+				return cfg, ConfigFromRawConfig(rawConf, cfg)
+			},
+			Bridge: func(conf interface{}) (bridge, network string) {
+				cfg := conf.(*ModelBridge)
+				return cfg.BrName, cfg.Network
+			},
+		},
+		"cni": {
+			Decode: func(rawConf map[string]interface{}) (interface{}, error) {
+				cfg := &ModelCNI{}
+				return cfg, ConfigFromRawConfig(rawConf, cfg)
+			},
+		},
+	},
+	ifaceTypes: map[string]IFaceType{
+		"veth": {
+			Decode: func(rawConf map[string]interface{}) (interface{}, error) {
+				cfg := &VethConf{}
+				return cfg, ConfigFromRawConfig(rawConf, cfg)
+			},
+			Addresses: func(conf interface{}) []string {
+				return conf.(*VethConf).PeerAddrs()
+			},
+			IPAMKey: "peer_ip",
+		},
+		"macvlan": {
+			Decode: func(rawConf map[string]interface{}) (interface{}, error) {
+				cfg := &MacvlanConf{}
+				return cfg, ConfigFromRawConfig(rawConf, cfg)
+			},
+			Addresses: func(conf interface{}) []string {
+				cfg := conf.(*MacvlanConf)
+				return joinAddrs(cfg.Ip, cfg.Ips)
+			},
+		},
+		"ipvlan": {
+			Decode: func(rawConf map[string]interface{}) (interface{}, error) {
+				cfg := &IpvlanConf{}
+				return cfg, ConfigFromRawConfig(rawConf, cfg)
+			},
+			Addresses: func(conf interface{}) []string {
+				cfg := conf.(*IpvlanConf)
+				return joinAddrs(cfg.Ip, cfg.Ips)
+			},
+		},
+	},
+}
+
+// RegisterModel registers a network model with the given name, the type set in the netconf to
+// use it, replacing any model registered with the same name, built-in ones included.
+func RegisterModel(name string, m NetModel) {
+	registry.lock.Lock()
+	registry.models[name] = m
+	registry.lock.Unlock()
+}
+
+// RegisterIFaceType registers an interface type with the given name, the type set in the
+// netconf to use it, replacing any type registered with the same name, built-in ones included.
+func RegisterIFaceType(name string, t IFaceType) {
+	registry.lock.Lock()
+	registry.ifaceTypes[name] = t
+	registry.lock.Unlock()
+}
+
+// NewModel sets up the network of the box with the given NS PID with the model of netConf.
+func NewModel(netConf *NetConf, nsPID int) (Modeler, error) {
+	name, err := ModelFromConfig(netConf.Model)
+	if err != nil {
+		return nil, fmt.Errorf("getting model type: %w", err)
+	}
+
+	m, ok := lookupModel(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown model type %q", name)
+	}
+	if m.New == nil {
+		return nil, fmt.Errorf("model type %q isn't supported on this platform", name)
+	}
+
+	conf, err := m.Decode(netConf.Model)
+	if err != nil {
+		return nil, fmt.Errorf("parsing model config: %+v ** %s", netConf.Model, err)
+	}
+
+	return m.New(conf, netConf, nsPID)
+}
+
+// lookupModel returns the model registered with the given name, if any.
+func lookupModel(name string) (m NetModel, ok bool) {
+	registry.lock.RLock()
+	m, ok = registry.models[name]
+	registry.lock.RUnlock()
+
+	return
+}
+
+// IFaceFromConfig creates the interface with the given raw config in the NS of the box with
+// the given NS PID.
+func IFaceFromConfig(rawConf map[string]interface{}, nsPID int) (NsIFacer, error) {
+	conf, t, err := decodeIFace(rawConf)
+	if err != nil {
+		return nil, err
+	}
+	if t.New == nil {
+		return nil, fmt.Errorf("iface type %q isn't supported on this platform", rawConf["type"])
+	}
+
+	return t.New(conf, nsPID)
+}
+
+// decodeIFace returns the decoded config of the interface with the given raw config, along
+// with its type.
+func decodeIFace(rawConf map[string]interface{}) (conf interface{}, t IFaceType, err error) {
+	name, err := TypeFromConfig(rawConf)
+	if err != nil {
+		return nil, t, fmt.Errorf("getting iface type: %w", err)
+	}
+
+	registry.lock.RLock()
+	t, ok := registry.ifaceTypes[name]
+	registry.lock.RUnlock()
+	if !ok {
+		return nil, t, fmt.Errorf("unsupported iface type: %s", name)
+	}
+
+	if conf, err = t.Decode(rawConf); err != nil {
+		return nil, t, fmt.Errorf("parsing iface config: %+v ** %s", rawConf, err)
+	}
+
+	return conf, t, nil
+}
@@ -0,0 +1,33 @@
+package boxnet
+
+// init sets the constructors of the built-in models and interface types.
+func init() {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	bridge := registry.models["bridge"]
+	bridge.New = newBridgeNetModel
+	registry.models["bridge"] = bridge
+
+	cni := registry.models["cni"]
+	cni.New = newCNINetModel
+	registry.models["cni"] = cni
+
+	veth := registry.ifaceTypes["veth"]
+	veth.New = func(conf interface{}, nsPID int) (NsIFacer, error) {
+		return AttachVeth(*conf.(*VethConf), nsPID)
+	}
+	registry.ifaceTypes["veth"] = veth
+
+	macvlan := registry.ifaceTypes["macvlan"]
+	macvlan.New = func(conf interface{}, nsPID int) (NsIFacer, error) {
+		return MacvlanFromConfig(*conf.(*MacvlanConf), nsPID)
+	}
+	registry.ifaceTypes["macvlan"] = macvlan
+
+	ipvlan := registry.ifaceTypes["ipvlan"]
+	ipvlan.New = func(conf interface{}, nsPID int) (NsIFacer, error) {
+		return IpvlanFromConfig(*conf.(*IpvlanConf), nsPID)
+	}
+	registry.ifaceTypes["ipvlan"] = ipvlan
+}
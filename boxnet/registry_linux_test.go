@@ -0,0 +1,134 @@
+package boxnet
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+type fakeModel struct {
+	conf  *fakeModelConf
+	nsPID int
+}
+
+type fakeModelConf struct {
+	Param string `json:"param"`
+}
+
+func (m *fakeModel) IFaces() []IFacer {
+	return nil
+}
+
+func (m *fakeModel) Close() error {
+	return nil
+}
+
+func TestRegisterModel(t *testing.T) {
+	RegisterModel("fake", NetModel{
+		Decode: func(rawConf map[string]interface{}) (interface{}, error) {
+			cfg := &fakeModelConf{}
+			return cfg, ConfigFromRawConfig(rawConf, cfg)
+		},
+		New: func(conf interface{}, netConf *NetConf, nsPID int) (Modeler, error) {
+			if netConf.LoopbackName != "lo" {
+				return nil, errors.New("netconf not given")
+			}
+			return &fakeModel{conf: conf.(*fakeModelConf), nsPID: nsPID}, nil
+		},
+	})
+
+	netConf := &NetConf{
+		Model:        map[string]interface{}{"type": "fake", "param": "val1"},
+		LoopbackName: "lo",
+	}
+	m, err := NewModel(netConf, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake, ok := m.(*fakeModel)
+	if !ok {
+		t.Fatalf("expected the fake model, got %T", m)
+	}
+	if fake.conf.Param != "val1" || fake.nsPID != 42 {
+		t.Errorf("unexpected model config %+v or NS PID %d", fake.conf, fake.nsPID)
+	}
+
+	netConf.Model["type"] = "missing"
+	if _, err = NewModel(netConf, 42); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("expected an unknown model error, got: %v", err)
+	}
+}
+
+func TestIFaceFromConfigUnsupported(t *testing.T) {
+	_, err := IFaceFromConfig(map[string]interface{}{"type": "missing"}, 42)
+	if err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("expected an unsupported iface type error, got: %v", err)
+	}
+
+	_, err = IFaceFromConfig(map[string]interface{}{"name": "eth0"}, 42)
+	if !errors.Is(err, ErrTypeNotDefined) {
+		t.Errorf("expected ErrTypeNotDefined, got: %v", err)
+	}
+}
+
+func TestRegisterIFaceTypeHooks(t *testing.T) {
+	type fakeIFaceConf struct {
+		Addr string `json:"addr"`
+	}
+	RegisterIFaceType("fakeiface", IFaceType{
+		Decode: func(rawConf map[string]interface{}) (interface{}, error) {
+			cfg := &fakeIFaceConf{}
+			return cfg, ConfigFromRawConfig(rawConf, cfg)
+		},
+		New: func(interface{}, int) (NsIFacer, error) {
+			return nil, errors.New("not created")
+		},
+		Addresses: func(conf interface{}) []string {
+			return joinAddrs(conf.(*fakeIFaceConf).Addr, nil)
+		},
+		IPAMKey: "addr",
+	})
+	RegisterModel("fakebridge", NetModel{
+		Decode: func(rawConf map[string]interface{}) (interface{}, error) {
+			cfg := &fakeModelConf{}
+			return cfg, ConfigFromRawConfig(rawConf, cfg)
+		},
+		Bridge: func(conf interface{}) (bridge, network string) {
+			return conf.(*fakeModelConf).Param, "fakenet"
+		},
+	})
+
+	tmp, err := ioutil.TempDir("", "ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ipam := NewIPAM(tmp)
+	netConf, err := ipam.Assign(&NetConf{
+		Model: map[string]interface{}{"type": "fakebridge", "param": "br1"},
+		Interfaces: []map[string]interface{}{
+			{"type": "fakeiface"},
+			{"type": "fakeiface", "addr": "10.2.0.9/24"},
+		},
+		IPAM: &IPAMConf{Subnet: "10.2.0.0/24"},
+	}, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, err := netConf.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(addrs, ",") != "10.2.0.2,10.2.0.9" {
+		t.Errorf("expected the assigned and the configured addresses, got %v", addrs)
+	}
+	if netConf.BridgeName() != "br1" || netConf.NetworkName() != "fakenet" {
+		t.Errorf("expected bridge br1 of fakenet, got %q of %q",
+			netConf.BridgeName(), netConf.NetworkName())
+	}
+}
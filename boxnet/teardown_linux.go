@@ -0,0 +1,112 @@
+package boxnet
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// Resources are the host side resources created to set up the network of a box. They must be
+// released once the box is gone since, unlike the ones living in its NS, the kernel only deletes
+// them along with the NS, which may outlive the box if held open by someone else.
+type Resources struct {
+	// Links are the names of the host side links, tagged with the box's tag as their alias
+	Links []string `json:"links,omitempty"`
+	// Ports are the published ports, whose DNAT rules are tagged with the box's tag as well
+	Ports []PublishedPort `json:"ports,omitempty"`
+	// CNI is the attachment to a CNI network, deleted by running the plugins
+	CNI *CNIAttachment `json:"cni,omitempty"`
+	// Masquerade is the bridge, not created by a network, whose masquerade rule is deleted once
+	// no boxes are attached to it
+	Masquerade string `json:"masquerade,omitempty"`
+}
+
+// ResourceModeler is a Modeler with host side resources other than the links of its
+// interfaces, recorded in the box's state and released along with the box.
+type ResourceModeler interface {
+	Modeler
+	Resources() Resources
+}
+
+// Tag returns the tag of the host side resources of the box with the given dir, set as the
+// alias of its links. The box's dir is used since box names are only unique within a workdir.
+func Tag(boxDir string) string {
+	return "box:" + boxDir
+}
+
+// Release deletes the given resources tagged with tag, skipping the ones already gone or no
+// longer tagged with it, which happens when their names are reused after being deleted. Once the
+// box's NS is gone, failing to delete it from its CNI network, e.g. because a plugin was
+// removed, is only logged, since it can't be retried with the NS and would otherwise keep the
+// box from ever being released.
+func Release(res Resources, tag string) error {
+	for _, name := range res.Links {
+		if err := DeleteLink(name, tag); err != nil {
+			return err
+		}
+	}
+
+	if res.Masquerade != "" {
+		if err := ReleaseMasquerade(res.Masquerade); err != nil {
+			return err
+		}
+	}
+
+	if res.CNI != nil {
+		if err := res.CNI.Delete(); err != nil {
+			if res.CNI.netNS() != "" {
+				return fmt.Errorf("deleting from CNI network: %s", err)
+			}
+			log.Warnf("deleting %s from CNI network: %s", tag, err)
+		}
+	}
+
+	for _, p := range res.Ports {
+		if !p.Proxy {
+			return DeleteNATRules(tag)
+		}
+	}
+
+	return nil
+}
+
+// DeleteLink deletes the host link with the given name if still tagged with tag.
+func DeleteLink(name, tag string) error {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting link %q: %s", name, err)
+	}
+
+	if link.Attrs().Alias != tag {
+		return nil
+	}
+
+	if err = netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("deleting link %q: %s", name, err)
+	}
+
+	return nil
+}
+
+// TaggedLinks returns the names of the host links tagged with a tag starting with prefix,
+// grouped by tag.
+func TaggedLinks(prefix string) (map[string][]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("listing links: %s", err)
+	}
+
+	tagged := map[string][]string{}
+	for _, l := range links {
+		if alias := l.Attrs().Alias; strings.HasPrefix(alias, prefix) {
+			tagged[alias] = append(tagged[alias], l.Attrs().Name)
+		}
+	}
+
+	return tagged, nil
+}
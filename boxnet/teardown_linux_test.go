@@ -0,0 +1,113 @@
+package boxnet
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cprates/box/internal/nettest"
+
+	"github.com/vishvananda/netlink"
+)
+
+// linkExists returns whether the link with the given name exists.
+func linkExists(t *testing.T, name string) bool {
+	_, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+func TestTaggedLinks(t *testing.T) {
+	withTestNs(t, func(int) {
+		nettest.AddLink(t, "a0", Tag("/work/a"))
+		nettest.AddLink(t, "a1", Tag("/work/a"))
+		nettest.AddLink(t, "b0", Tag("/work/b"))
+		nettest.AddLink(t, "c0", Tag("/other/c"))
+		nettest.AddLink(t, "d0", "")
+
+		tagged, err := TaggedLinks(Tag("/work/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, links := range tagged {
+			sort.Strings(links)
+		}
+
+		expected := map[string][]string{
+			Tag("/work/a"): {"a0", "a1"},
+			Tag("/work/b"): {"b0"},
+		}
+		if !reflect.DeepEqual(tagged, expected) {
+			t.Errorf("expected %v, got %v", expected, tagged)
+		}
+	})
+}
+
+func TestRelease(t *testing.T) {
+	withTestNs(t, func(int) {
+		tag := Tag("/work/a")
+		nettest.AddLink(t, "a0", tag)
+		// a link whose name was reused by someone else once deleted
+		nettest.AddLink(t, "a1", Tag("/work/b"))
+
+		res := Resources{Links: []string{"a0", "a1", "gone"}}
+		if err := Release(res, tag); err != nil {
+			t.Fatal(err)
+		}
+
+		if linkExists(t, "a0") {
+			t.Error("expected tagged link to be deleted")
+		}
+		if !linkExists(t, "a1") {
+			t.Error("expected link tagged by another box to be kept")
+		}
+
+		// releasing again is a noop
+		if err := Release(res, tag); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestReleaseMasquerade(t *testing.T) {
+	withTestNs(t, func(int) {
+		br, _, err := EnsureBridge(BridgeConf{Name: "br0", Gateway: "10.88.0.1/16"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, subnet, _ := net.ParseCIDR("10.88.0.0/16")
+		if err = EnsureMasquerade(subnet, "br0", NATTag("", "br0")); err != nil {
+			t.Fatal(err)
+		}
+		nettest.AddLink(t, "a0", Tag("/work/a"))
+		a0, err := netlink.LinkByName("a0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = netlink.LinkSetMaster(a0, br); err != nil {
+			t.Fatal(err)
+		}
+
+		// kept while other boxes use the bridge
+		if err = ReleaseMasquerade("br0"); err != nil {
+			t.Fatal(err)
+		}
+		if tags, _ := NATTags(NATTag("", "")); len(tags) != 1 {
+			t.Errorf("expected masquerade rule to be kept, got %v", tags)
+		}
+
+		res := Resources{Links: []string{"a0"}, Masquerade: "br0"}
+		if err = Release(res, Tag("/work/a")); err != nil {
+			t.Fatal(err)
+		}
+		if tags, _ := NATTags(NATTag("", "")); len(tags) != 0 {
+			t.Errorf("expected masquerade rule to be deleted, got %v", tags)
+		}
+	})
+}
@@ -19,15 +19,16 @@ type Vether interface {
 }
 
 type veth struct {
-	link    netlink.Veth
-	peerIdx int
+	link netlink.Veth
 }
 
 var _ Vether = (*veth)(nil)
 
-func NewVeth(name, peerName string) (Vether, error) {
+// NewVeth creates a veth pair with the given names. Both ends use the given MTU, unless 0.
+func NewVeth(name, peerName string, mtu int) (Vether, error) {
 	la := netlink.NewLinkAttrs()
 	la.Name = name
+	la.MTU = mtu
 
 	link := netlink.Veth{
 		LinkAttrs: la,
@@ -42,8 +43,8 @@ func NewVeth(name, peerName string) (Vether, error) {
 	return veth{link: link}, nil
 }
 
-func VethFromConfig(conf VethConf, nsPID int) (Vether, error) {
-	iface, err := NewVeth(conf.Name, conf.PeerName)
+func VethFromConfig(conf VethConf, nsPID int) (_ Vether, err error) {
+	iface, err := NewVeth(conf.Name, conf.PeerName, conf.MTU)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create new veth: %s", err)
 	}
@@ -53,7 +54,6 @@ func VethFromConfig(conf VethConf, nsPID int) (Vether, error) {
 		return nil, fmt.Errorf("unable to get link by name %q: %s", conf.PeerName, err)
 	}
 	pl := iface.(veth)
-	pl.peerIdx = peerLink.Attrs().Index
 
 	err = iface.SetPeerNsByPid(nsPID)
 	if err != nil {
@@ -63,27 +63,49 @@ func VethFromConfig(conf VethConf, nsPID int) (Vether, error) {
 		_ = netlink.LinkDel(peerLink)
 		return nil, fmt.Errorf("unable to move peer iface to ns %d: %s", nsPID, err)
 	}
+	// from here on the veth only goes away with the NS, which may be held by someone else
+	defer func() {
+		if err != nil {
+			_ = pl.Delete()
+		}
+	}()
 
-	ip, netIP, err := net.ParseCIDR(conf.Ip)
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse configured IP %q: %s", conf.Ip, err)
-	}
+	// the host side doesn't need an address when attached to a bridge
+	for _, addr := range conf.Addrs() {
+		ip, netIP, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse configured IP %q: %s", addr, err)
+		}
 
-	err = iface.SetAddr(net.IPNet{IP: ip, Mask: netIP.Mask})
-	if err != nil {
-		return nil, fmt.Errorf("unable to set peer iface addr: %s", err)
+		err = iface.SetAddr(net.IPNet{IP: ip, Mask: netIP.Mask})
+		if err != nil {
+			return nil, fmt.Errorf("unable to set iface addr %q: %s", addr, err)
+		}
 	}
 
-	peerIP, peerNetIP, err := net.ParseCIDR(conf.PeerIp)
+	var peerAddrs []net.IPNet
+	for _, addr := range conf.PeerAddrs() {
+		peerIP, peerNetIP, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse configured peer IP %q: %s", addr, err)
+		}
+		peerAddrs = append(peerAddrs, net.IPNet{IP: peerIP, Mask: peerNetIP.Mask})
+	}
+	var peerErr error
 	err = ExecuteOnNs(
 		nsPID,
 		func() {
-			if e := iface.SetPeerAddr(net.IPNet{IP: peerIP, Mask: peerNetIP.Mask}); e != nil {
-				panic(e)
+			for _, addr := range peerAddrs {
+				if peerErr = iface.SetPeerAddr(addr); peerErr != nil {
+					peerErr = fmt.Errorf("%s: %s", addr.String(), peerErr)
+					return
+				}
 			}
-
 		},
 	)
+	if err == nil {
+		err = peerErr
+	}
 	if err != nil {
 		return nil, fmt.Errorf("unable to set peer address: %s", err)
 	}
@@ -93,15 +115,10 @@ func VethFromConfig(conf VethConf, nsPID int) (Vether, error) {
 		return nil, fmt.Errorf("unable to set iface up: %s", err)
 	}
 
-	err = ExecuteOnNs(
-		nsPID,
-		func() {
-			if e := iface.PeerUp(); e != nil {
-				panic(e)
-			}
-
-		},
-	)
+	err = ExecuteOnNs(nsPID, func() { peerErr = iface.PeerUp() })
+	if err == nil {
+		err = peerErr
+	}
 	if err != nil {
 		return nil, fmt.Errorf("unable to set peer iface up: %s", err)
 	}
@@ -109,11 +126,16 @@ func VethFromConfig(conf VethConf, nsPID int) (Vether, error) {
 	return iface, nil
 }
 
-func AttachVeth(cfg VethConf, nsPID int) (Vether, error) {
+func AttachVeth(cfg VethConf, nsPID int) (_ Vether, err error) {
 	iface, err := VethFromConfig(cfg, nsPID)
 	if err != nil {
 		return nil, fmt.Errorf("setting up iface %q: %s", cfg.Name, err)
 	}
+	defer func() {
+		if err != nil {
+			_ = iface.Delete()
+		}
+	}()
 
 	if err = iface.Up(); err != nil {
 		return nil, fmt.Errorf("setting iface up %q: %s", cfg.Name, err)
@@ -170,6 +192,27 @@ func (v veth) SetMaster(master netlink.Link) error {
 	return netlink.LinkSetMaster(&v.link, master)
 }
 
+func (v veth) Name() string {
+	return v.link.Name
+}
+
+func (v veth) SetAlias(alias string) error {
+	return netlink.LinkSetAlias(&v.link, alias)
+}
+
+// Delete deletes the host side link which, being a veth, deletes its peer as well.
+func (v veth) Delete() error {
+	link, err := netlink.LinkByName(v.link.Name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return netlink.LinkDel(link)
+}
+
 func (v veth) PeerDown() error {
 	peerLink, err := netlink.LinkByName(v.link.PeerName)
 	if err != nil {
@@ -232,7 +275,14 @@ func (v veth) SetPeerNsByPid(nspid int) (err error) {
 	return nil
 }
 
+// SetRoutes sets the given routes through the peer, of any family. It must be called from the
+// peer's NS.
 func (v veth) SetRoutes(routes []Route) error {
+	peerLink, err := netlink.LinkByName(v.link.PeerName)
+	if err != nil {
+		return err
+	}
+
 	for _, route := range routes {
 		_, dst, err := net.ParseCIDR(route.Subnet)
 		if err != nil {
@@ -242,7 +292,7 @@ func (v veth) SetRoutes(routes []Route) error {
 
 		err = netlink.RouteAdd(
 			&netlink.Route{
-				LinkIndex: v.peerIdx,
+				LinkIndex: peerLink.Attrs().Index,
 				Dst:       dst,
 				Gw:        gw,
 			},
@@ -0,0 +1,157 @@
+package boxnet
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestAttachVethDualStack(t *testing.T) {
+	withTestNs(t, func(nsPID int) {
+		dad := 0
+		if err := ConfigureIPv6(IPv6Conf{AcceptDAD: &dad}, nsPID); err != nil {
+			t.Fatal(err)
+		}
+
+		iface, err := AttachVeth(
+			VethConf{
+				Name:     "vh0",
+				PeerName: "vb0",
+				Ips:      []string{"10.10.0.1/24", "fd00::1/64"},
+				PeerIp:   "10.10.0.2/24",
+				PeerIps:  []string{"fd00::2/64"},
+				Routes: []Route{
+					{Subnet: "0.0.0.0/0", Gateway: "10.10.0.1"},
+					{Subnet: "::/0", Gateway: "fd00::1"},
+				},
+			},
+			nsPID,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer iface.Delete()
+
+		host, err := netlink.LinkByName("vh0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAddr(t, host, "fd00::1/64", false)
+
+		onNs(t, nsPID, func() {
+			peer, err := netlink.LinkByName("vb0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkAddr(t, peer, "10.10.0.2/24", false)
+			// with DAD disabled, the address is usable right away
+			checkAddr(t, peer, "fd00::2/64", true)
+
+			routes, err := netlink.RouteList(peer, netlink.FAMILY_V6)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, r := range routes {
+				if r.Dst == nil && r.Gw.String() == "fd00::1" {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("expected an IPv6 default route via fd00::1, got %v", routes)
+			}
+		})
+	})
+}
+
+func TestAttachVethIPv6Disabled(t *testing.T) {
+	withTestNs(t, func(nsPID int) {
+		if err := ConfigureIPv6(IPv6Conf{Disable: true}, nsPID); err != nil {
+			t.Fatal(err)
+		}
+
+		// failing to set an address of the box side is reported instead of crashing
+		_, err := AttachVeth(
+			VethConf{
+				Name:     "vh0",
+				PeerName: "vb0",
+				PeerIp:   "10.10.0.2/24",
+				PeerIps:  []string{"fd00::2/64"},
+			},
+			nsPID,
+		)
+		if err == nil || !strings.Contains(err.Error(), "fd00::2/64") {
+			t.Fatalf("expected setting the IPv6 peer address to fail, got %v", err)
+		}
+		if _, err = netlink.LinkByName("vh0"); err == nil {
+			t.Error("expected the veth to be deleted")
+		}
+	})
+}
+
+func TestConfigureIPv6Disable(t *testing.T) {
+	withTestNs(t, func(nsPID int) {
+		if err := ConfigureIPv6(IPv6Conf{Disable: true}, nsPID); err != nil {
+			t.Fatal(err)
+		}
+
+		onNs(t, nsPID, func() {
+			for _, dev := range []string{"all", "default", "lo"} {
+				b, err := ioutil.ReadFile(ipv6ConfDir + "/" + dev + "/disable_ipv6")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.TrimSpace(string(b)) != "1" {
+					t.Errorf("expected IPv6 to be disabled on %s, got %q", dev, b)
+				}
+			}
+		})
+
+		// the host is left untouched
+		b, err := ioutil.ReadFile(ipv6ConfDir + "/default/disable_ipv6")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(b)) != "0" {
+			t.Errorf("expected IPv6 to be enabled on the host, got %q", b)
+		}
+	})
+}
+
+// checkAddr checks that the given link has the given address, not tentative if usable is set.
+func checkAddr(t *testing.T, link netlink.Link, addr string, usable bool) {
+	t.Helper()
+
+	// even without DAD, the tentative flag is cleared asynchronously once the link is up, but
+	// way before the detection would complete, which takes at least a second
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var found *netlink.Addr
+		for i, a := range addrs {
+			if a.IPNet.String() == addr {
+				found = &addrs[i]
+				break
+			}
+		}
+		switch {
+		case found == nil:
+			t.Errorf("expected address %s on %s, got %v", addr, link.Attrs().Name, addrs)
+			return
+		case !usable || found.Flags&unix.IFA_F_TENTATIVE == 0:
+			return
+		case time.Now().After(deadline):
+			t.Errorf("expected address %s to be usable, got it tentative", addr)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cprates/box/image"
+)
+
+// splitCpArg splits a cp argument in the form [boxname:]path. Paths with a / before the first
+// colon are host paths.
+func splitCpArg(arg string) (boxName, p string) {
+	i := strings.Index(arg, ":")
+	if i > 0 && !strings.Contains(arg[:i], "/") {
+		return arg[:i], arg[i+1:]
+	}
+
+	return "", arg
+}
+
+// copyFiles copies the src file or dir to dst, where exactly one of them is in a box, in the
+// form boxname:path.
+func copyFiles(src, dst string) error {
+	srcBox, srcPath := splitCpArg(src)
+	dstBox, dstPath := splitCpArg(dst)
+	if (srcBox == "") == (dstBox == "") {
+		return errors.New("exactly one of source and destination must be in a box")
+	}
+
+	c := newManager()
+	pr, pw := io.Pipe()
+	if srcBox != "" {
+		go func() {
+			pw.CloseWithError(c.CopyFrom(srcBox, srcPath, pw))
+		}()
+
+		// the host destination is the root, so that the box's symlinks can't point out of it
+		dstPath, err := filepath.Abs(dstPath)
+		if err != nil {
+			return err
+		}
+		root, p := dstPath, "/"
+		if fi, err := os.Stat(dstPath); err != nil || !fi.IsDir() {
+			root, p = filepath.Dir(dstPath), filepath.Base(dstPath)
+		}
+
+		err = image.ExtractTree(root, p, pr)
+		pr.CloseWithError(err)
+		return err
+	}
+
+	srcPath, err := filepath.Abs(srcPath)
+	if err != nil {
+		return err
+	}
+	go func() {
+		pw.CloseWithError(image.WriteTree(pw, srcPath, filepath.Base(srcPath)))
+	}()
+
+	err = c.CopyTo(dstBox, dstPath, pr)
+	pr.CloseWithError(err)
+	return err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cprates/box/image"
+	"github.com/cprates/box/spec"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func printImageHelp() {
+	fmt.Println(
+		"Usage: box [-flags] image unpack [-ref name:tag] [-layers] image dir\n" +
+			"       box [-flags] image import [-ref name:tag] image name[:tag]\n" +
+			"       box [-flags] image {list|ls}\n" +
+			"       box [-flags] image rm name[:tag]...\n" +
+			"       box [-flags] image prune",
+	)
+}
+
+// imageCmd runs the image action with the given args.
+func imageCmd(args []string) {
+	if len(args) < 1 {
+		printImageHelp()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "unpack":
+		fs := flag.NewFlagSet("unpack", flag.ExitOnError)
+		ref := fs.String("ref", "", "Name or tag of the image to unpack, if there are several")
+		layers := fs.Bool(
+			"layers",
+			false,
+			"Unpack each layer to its own dir, to be stacked with an overlay",
+		)
+		_ = fs.Parse(args[1:])
+		if fs.NArg() < 2 {
+			printImageHelp()
+			os.Exit(1)
+		}
+
+		if err := unpackImage(fs.Arg(0), fs.Arg(1), *ref, *layers); err != nil {
+			log.Fatalln("Failed to unpack image:", err)
+		}
+	case "import":
+		fs := flag.NewFlagSet("import", flag.ExitOnError)
+		ref := fs.String("ref", "", "Name or tag of the image to import, if there are several")
+		_ = fs.Parse(args[1:])
+		if fs.NArg() < 2 {
+			printImageHelp()
+			os.Exit(1)
+		}
+
+		si, err := newManager().Images().Import(fs.Arg(0), *ref, fs.Arg(1))
+		if err != nil {
+			log.Fatalln("Failed to import image:", err)
+		}
+		fmt.Println(si.Name, si.ID)
+	case "list", "ls":
+		images, err := newManager().Images().List()
+		if err != nil {
+			log.Fatalln("Failed to list images:", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tID\tLAYERS\tIMPORTED")
+		for _, si := range images {
+			fmt.Fprintf(
+				w, "%s\t%s\t%d\t%s\n",
+				si.Name, shortID(si.ID), len(si.Layers), si.Created.Format(time.RFC3339),
+			)
+		}
+		_ = w.Flush()
+	case "rm":
+		if len(args) < 2 {
+			printImageHelp()
+			os.Exit(1)
+		}
+
+		store := newManager().Images()
+		for _, name := range args[1:] {
+			if err := store.Remove(name); err != nil {
+				log.Fatalln("Failed to remove image:", err)
+			}
+		}
+	case "prune":
+		removed, err := newManager().PruneImages()
+		if err != nil {
+			log.Fatalln("Failed to prune images:", err)
+		}
+		for _, p := range removed {
+			fmt.Println("Removed", p)
+		}
+	default:
+		printImageHelp()
+		os.Exit(1)
+	}
+}
+
+// shortID returns the first 12 chars of the hex part of the given digest.
+func shortID(digest string) string {
+	if i := strings.Index(digest, ":"); i != -1 {
+		digest = digest[i+1:]
+	}
+	if len(digest) > 12 {
+		digest = digest[:12]
+	}
+
+	return digest
+}
+
+// unpackImage unpacks the image in src to dir, either to a rootfs or to a layers dir, and
+// writes a spec to run it to dir's config.json.
+func unpackImage(src, dir, ref string, layers bool) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	img, err := image.Open(src, ref)
+	if err != nil {
+		return fmt.Errorf("opening image: %s", err)
+	}
+	defer img.Close()
+
+	root := spec.Root{}
+	if layers {
+		root.Layers, err = img.UnpackLayers(filepath.Join(dir, "layers"))
+	} else {
+		root.Path = filepath.Join(dir, "rootfs")
+		err = img.Unpack(root.Path)
+	}
+	if err != nil {
+		return err
+	}
+
+	sp, err := img.Spec(root)
+	if err != nil {
+		return fmt.Errorf("generating spec: %s", err)
+	}
+
+	b, err := json.MarshalIndent(sp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, "config.json"), b, 0644)
+}
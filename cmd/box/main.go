@@ -1,15 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cprates/box"
 	"github.com/cprates/box/bootstrap"
+	"github.com/cprates/box/boxlog"
 	"github.com/cprates/box/boxnet"
 	"github.com/cprates/box/spec"
 
@@ -28,9 +32,16 @@ var defaultIO = box.ProcessIO{
 }
 
 var (
-	configFile  string
-	netconfFile string
-	workdir     string
+	configFile    string
+	netconfFile   string
+	workdir       string
+	consoleSocket string
+	overlay       bool
+	keepUpper     bool
+	imageRoot     string
+	diskQuota     string
+	tmpSize       string
+	shmSize       string
 )
 
 func init() {
@@ -39,6 +50,33 @@ func init() {
 	flag.StringVar(&configFile, "spec", "config.json", "Path to the spec file")
 	flag.StringVar(&netconfFile, "netconf", "netconf.json", "Path to the file with network config")
 	flag.StringVar(&workdir, "workdir", wd, "Absolute path where to store created boxes")
+	flag.StringVar(
+		&consoleSocket,
+		"console-socket",
+		"",
+		"Path to a unix socket that receives the pty master of boxes with a terminal",
+	)
+	flag.StringVar(
+		&imageRoot,
+		"image-root",
+		"",
+		"Absolute path of the image store (defaults to the .images dir in the workdir)",
+	)
+	flag.BoolVar(&overlay, "overlay", false, "Use an overlay on top of the spec's rootfs")
+	flag.StringVar(
+		&diskQuota,
+		"disk-quota",
+		"",
+		"Max size of the changes done by boxes to their overlay rootfs, e.g. 1g",
+	)
+	flag.StringVar(&tmpSize, "tmp-size", "", "Size of the boxes' /tmp, e.g. 64m")
+	flag.StringVar(&shmSize, "shm-size", "", "Size of the boxes' /dev/shm, e.g. 64m")
+	flag.BoolVar(
+		&keepUpper,
+		"keep-upper",
+		false,
+		"Keep the overlay's upper layer of destroyed boxes in the workdir's .layers dir",
+	)
 
 	log.StandardLogger().SetNoLock()
 	if os.Getenv("BOX_DEBUG") == "1" {
@@ -60,11 +98,99 @@ func init() {
 	)
 }
 
+func newManager() box.Interface {
+	if imageRoot != "" {
+		return box.New(workdir, box.WithImageRoot(imageRoot))
+	}
+
+	return box.New(workdir)
+}
+
 func printHelp() {
-	fmt.Println("Usage: box [-flags] {create|start|run|destroy} boxname\nFlags:")
+	fmt.Println(
+		"Usage: box [-flags] {create|start|run|attach|wait|logs|export|inspect|stats|destroy}\n" +
+			"                 boxname\n" +
+			"       box [-flags] {create|run} [-p [ip:]hostport:boxport[/proto]]...\n" +
+			"                 [-net {none|host|box:name}] boxname\n" +
+			"       box [-flags] port boxname\n" +
+			"       box [-flags] commit [-ref tag] boxname layout\n" +
+			"       box [-flags] cp {boxname:path hostpath|hostpath boxname:path}\n" +
+			"       box [-flags] image {unpack|import|list|rm|prune} ...\n" +
+			"       box [-flags] volume {create|list|rm|inspect} ...\n" +
+			"       box [-flags] network {create|list|rm|inspect} ...\n" +
+			"       box [-flags] net {gc|check boxname}\nFlags:",
+	)
 	flag.PrintDefaults()
 }
 
+// sizeOptions returns the box options for the size flags which are set.
+func sizeOptions() (opts []box.BoxOption) {
+	sizes := map[string]int64{}
+	for flagName, value := range map[string]string{
+		"disk-quota": diskQuota,
+		"tmp-size":   tmpSize,
+		"shm-size":   shmSize,
+	} {
+		if value == "" {
+			continue
+		}
+		size, err := parseSize(value)
+		if err != nil {
+			log.Fatalf("Invalid -%s: %s", flagName, err)
+		}
+		sizes[flagName] = size
+	}
+
+	if sizes["disk-quota"] > 0 {
+		opts = append(opts, box.WithDiskQuota(sizes["disk-quota"]))
+	}
+	if sizes["tmp-size"] > 0 || sizes["shm-size"] > 0 {
+		opts = append(opts, box.WithTmpfsSizes(sizes["tmp-size"], sizes["shm-size"]))
+	}
+
+	return
+}
+
+// parseDetachKeys parses a comma separated list of keys, either in the form ctrl-<key> or a
+// single character, e.g. "ctrl-p,ctrl-q".
+func parseDetachKeys(keys string) ([]byte, error) {
+	var seq []byte
+	for _, k := range strings.Split(keys, ",") {
+		k = strings.TrimSpace(k)
+		switch {
+		case len(k) == 1:
+			seq = append(seq, k[0])
+		case strings.HasPrefix(k, "ctrl-") && len(k) == 6:
+			c := k[5]
+			switch {
+			case c >= 'a' && c <= 'z':
+				seq = append(seq, c-'a'+1)
+			case c >= '@' && c <= '_':
+				seq = append(seq, c-'@')
+			default:
+				return nil, fmt.Errorf("unsupported key %q", k)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported key %q", k)
+		}
+	}
+
+	return seq, nil
+}
+
+// parseSince parses either a RFC3339 timestamp or a duration relative to now.
+func parseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339, since)
+}
+
 func main() {
 	flag.Parse()
 
@@ -73,13 +199,26 @@ func main() {
 		os.Exit(1)
 	}
 
-	if len(flag.Args()) < 2 && flag.Args()[actionIdx] != "bootstrap" {
+	if len(flag.Args()) < 2 &&
+		flag.Args()[actionIdx] != "bootstrap" &&
+		flag.Args()[actionIdx] != "shim" &&
+		flag.Args()[actionIdx] != "copy" {
 		printHelp()
 		os.Exit(1)
 	}
 
 	switch flag.Args()[actionIdx] {
 	case "create":
+		fs := flag.NewFlagSet("create", flag.ExitOnError)
+		var ports portFlags
+		fs.Var(&ports, "p", "Publish a box port on the host, e.g. 8080:80/tcp (repeatable)")
+		netMode := fs.String("net", "", "Network mode, one of none, host or box:<name>")
+		_ = fs.Parse(flag.Args()[1:])
+		if fs.NArg() < 1 {
+			printHelp()
+			os.Exit(1)
+		}
+
 		sp, err := spec.LoadFromFile(configFile)
 		if err != nil {
 			log.Fatalln("Failed to load spec:", err)
@@ -90,14 +229,34 @@ func main() {
 		if err != nil {
 			log.Fatalln("Failed to load netconf:", err)
 		}
+		netConf.Ports = append(netConf.Ports, ports...)
+		if *netMode != "" {
+			netConf.Mode = *netMode
+		}
 
-		c := box.New(workdir)
-		_, err = c.Create(flag.Args()[boxNameIdx], defaultIO, sp, box.WithNetwork(netConf))
+		opts := []box.BoxOption{
+			box.WithNetwork(netConf),
+			box.WithShim(),
+			box.WithLogFile(""),
+			box.WithAttach(),
+		}
+		if consoleSocket != "" {
+			opts = append(opts, box.WithConsoleSocket(consoleSocket))
+		}
+		if overlay {
+			opts = append(opts, box.WithOverlay(keepUpper))
+		}
+		opts = append(opts, sizeOptions()...)
+
+		// the box's output goes to its log file so, the shim doesn't need to hold on to this
+		// process' stdio
+		c := newManager()
+		_, err = c.Create(fs.Arg(0), box.ProcessIO{}, sp, opts...)
 		if err != nil {
 			log.Fatalln("Failed to create box: ", err)
 		}
 	case "start":
-		c := box.New(workdir)
+		c := newManager()
 		b, err := c.Load(flag.Args()[boxNameIdx], defaultIO)
 		if err != nil {
 			log.Fatalln("Failed to load box:", err)
@@ -106,6 +265,16 @@ func main() {
 			log.Fatalln("Failed to start box:", err)
 		}
 	case "run":
+		fs := flag.NewFlagSet("run", flag.ExitOnError)
+		var ports portFlags
+		fs.Var(&ports, "p", "Publish a box port on the host, e.g. 8080:80/tcp (repeatable)")
+		netMode := fs.String("net", "", "Network mode, one of none, host or box:<name>")
+		_ = fs.Parse(flag.Args()[1:])
+		if fs.NArg() < 1 {
+			printHelp()
+			os.Exit(1)
+		}
+
 		sp, err := spec.LoadFromFile(configFile)
 		if err != nil {
 			log.Fatalln("Failed to load spec:", err)
@@ -115,18 +284,167 @@ func main() {
 		if err != nil {
 			log.Fatalln("Failed to load netconf:", err)
 		}
+		netConf.Ports = append(netConf.Ports, ports...)
+		if *netMode != "" {
+			netConf.Mode = *netMode
+		}
 
-		c := box.New(workdir)
-		err = c.Run(flag.Args()[boxNameIdx], defaultIO, sp, box.WithNetwork(netConf))
+		opts := []box.BoxOption{box.WithNetwork(netConf)}
+		if overlay {
+			opts = append(opts, box.WithOverlay(keepUpper))
+		}
+		opts = append(opts, sizeOptions()...)
+
+		c := newManager()
+		err = c.Run(fs.Arg(0), defaultIO, sp, opts...)
 		if err != nil {
 			log.Fatalln("Failed to run box:", err)
 		}
+	case "wait":
+		c := newManager()
+		code, err := c.Wait(flag.Args()[boxNameIdx])
+		if err != nil {
+			log.Fatalln("Failed to wait for box:", err)
+		}
+		os.Exit(code)
+	case "attach":
+		fs := flag.NewFlagSet("attach", flag.ExitOnError)
+		readOnly := fs.Bool("read-only", false, "Attach only to the box's output")
+		detachKeys := fs.String(
+			"detach-keys",
+			"ctrl-p,ctrl-q",
+			"Key sequence to detach from the box, e.g. ctrl-p,ctrl-q",
+		)
+		_ = fs.Parse(flag.Args()[1:])
+		if fs.NArg() < 1 {
+			printHelp()
+			os.Exit(1)
+		}
+
+		keys, err := parseDetachKeys(*detachKeys)
+		if err != nil {
+			log.Fatalln("Invalid detach keys:", err)
+		}
+
+		c := newManager()
+		err = c.Attach(
+			fs.Arg(0),
+			defaultIO,
+			box.AttachOptions{ReadOnly: *readOnly, DetachKeys: keys},
+		)
+		if err == box.ErrDetached {
+			fmt.Fprintln(os.Stderr, "\r\nDetached from box", fs.Arg(0))
+			return
+		}
+		if err != nil {
+			log.Fatalln("Failed to attach to box:", err)
+		}
+	case "logs":
+		fs := flag.NewFlagSet("logs", flag.ExitOnError)
+		follow := fs.Bool("follow", false, "Keep printing new log entries until the box exits")
+		since := fs.String(
+			"since",
+			"",
+			"Only print entries since a RFC3339 timestamp or a relative duration (e.g. 10m)",
+		)
+		tail := fs.Int("tail", -1, "Number of entries to print from the end of the log (all if < 0)")
+		_ = fs.Parse(flag.Args()[1:])
+		if fs.NArg() < 1 {
+			printHelp()
+			os.Exit(1)
+		}
+
+		sinceT, err := parseSince(*since)
+		if err != nil {
+			log.Fatalln("Invalid since:", err)
+		}
+
+		c := newManager()
+		err = c.Logs(
+			fs.Arg(0),
+			os.Stdout,
+			os.Stderr,
+			boxlog.ReadOptions{Follow: *follow, Since: sinceT, Tail: *tail},
+		)
+		if err != nil {
+			log.Fatalln("Failed to read logs:", err)
+		}
+	case "export":
+		fs := flag.NewFlagSet("export", flag.ExitOnError)
+		upper := fs.Bool("upper", false, "Export only the box's overlay upper layer")
+		_ = fs.Parse(flag.Args()[1:])
+		if fs.NArg() < 1 {
+			printHelp()
+			os.Exit(1)
+		}
+
+		c := newManager()
+		err := c.Export(fs.Arg(0), os.Stdout, box.ExportOptions{UpperOnly: *upper})
+		if err != nil {
+			log.Fatalln("Failed to export box:", err)
+		}
+	case "cp":
+		if len(flag.Args()) < 3 {
+			printHelp()
+			os.Exit(1)
+		}
+
+		if err := copyFiles(flag.Args()[1], flag.Args()[2]); err != nil {
+			log.Fatalln("Failed to copy:", err)
+		}
+	case "commit":
+		fs := flag.NewFlagSet("commit", flag.ExitOnError)
+		ref := fs.String("ref", "latest", "Name of the image in the OCI image layout")
+		_ = fs.Parse(flag.Args()[1:])
+		if fs.NArg() < 2 {
+			printHelp()
+			os.Exit(1)
+		}
+
+		c := newManager()
+		digest, err := c.Commit(fs.Arg(0), fs.Arg(1), *ref)
+		if err != nil {
+			log.Fatalln("Failed to commit box:", err)
+		}
+		fmt.Println(digest)
 	case "destroy":
-		c := box.New(workdir)
+		c := newManager()
 		err := c.Destroy(flag.Args()[boxNameIdx])
 		if err != nil {
 			log.Fatalln("Failed to destroy box:", err)
 		}
+	case "inspect":
+		info, err := newManager().Inspect(flag.Args()[boxNameIdx])
+		if err != nil {
+			log.Fatalln("Failed to inspect box:", err)
+		}
+
+		b, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			log.Fatalln("Failed to inspect box:", err)
+		}
+		fmt.Println(string(b))
+	case "stats":
+		stats, err := newManager().Stats(flag.Args()[boxNameIdx])
+		if err != nil {
+			log.Fatalln("Failed to get box stats:", err)
+		}
+
+		b, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			log.Fatalln("Failed to get box stats:", err)
+		}
+		fmt.Println(string(b))
+	case "image":
+		imageCmd(flag.Args()[1:])
+	case "volume":
+		volumeCmd(flag.Args()[1:])
+	case "network":
+		networkCmd(flag.Args()[1:])
+	case "net":
+		netCmd(flag.Args()[1:])
+	case "port":
+		portCmd(flag.Args()[boxNameIdx])
 	case "bootstrap":
 		log.Debugln("Bootstrapping box...")
 		if err := bootstrap.Boot(
@@ -136,6 +454,26 @@ func main() {
 			os.Exit(1)
 		}
 		panic("should never reach this far!")
+	case "shim":
+		if err := box.Shim(
+			os.Getenv("BOX_SHIM_CONFIG_FD"),
+			os.Getenv("BOX_SHIM_SYNC_FD"),
+		); err != nil {
+			log.Errorln("Shim failed:", err)
+			os.Exit(1)
+		}
+	case "copy":
+		if err := box.CopyHelper(
+			os.Getenv("BOX_COPY_PID"),
+			os.Getenv("BOX_COPY_START"),
+			os.Getenv("BOX_COPY_OP"),
+			os.Getenv("BOX_COPY_PATH"),
+			os.Getenv("BOX_COPY_NAME"),
+		); err != nil {
+			// read by the manager as the error of the copy
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	default:
 		printHelp()
 		os.Exit(1)
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseDetachKeys(t *testing.T) {
+	tests := []struct {
+		keys   string
+		seq    []byte
+		failed bool
+	}{
+		{keys: "ctrl-p,ctrl-q", seq: []byte{0x10, 0x11}},
+		{keys: "ctrl-a", seq: []byte{0x01}},
+		{keys: "ctrl-@,ctrl-[,ctrl-_", seq: []byte{0x00, 0x1b, 0x1f}},
+		{keys: "q", seq: []byte{'q'}},
+		{keys: " ctrl-x , y ", seq: []byte{0x18, 'y'}},
+		{keys: "ctrl-P", seq: []byte{0x10}},
+		{keys: "", failed: true},
+		{keys: "ctrl-", failed: true},
+		{keys: "ctrl-1", failed: true},
+		{keys: "ctrl-pq", failed: true},
+		{keys: "ab", failed: true},
+		{keys: "ctrl-p,", failed: true},
+	}
+
+	for _, tt := range tests {
+		seq, err := parseDetachKeys(tt.keys)
+		if tt.failed {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tt.keys, seq)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(seq, tt.seq) {
+			t.Errorf("%q: expected %v, got %v, %v", tt.keys, tt.seq, seq, err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func printNetHelp() {
+	fmt.Println("Usage: box [-flags] net {gc|check boxname}")
+}
+
+// netCmd runs the net action with the given args.
+func netCmd(args []string) {
+	if len(args) < 1 {
+		printNetHelp()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "gc":
+		removed, err := newManager().NetGC()
+		if err != nil {
+			log.Fatalln("Failed to clean up network:", err)
+		}
+		for _, l := range removed {
+			fmt.Println("Removed link", l)
+		}
+	case "check":
+		if len(args) != 2 {
+			printNetHelp()
+			os.Exit(1)
+		}
+		if err := newManager().NetCheck(args[1]); err != nil {
+			log.Fatalln("Network check failed:", err)
+		}
+	default:
+		printNetHelp()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cprates/box/boxnet"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func printNetworkHelp() {
+	fmt.Println(
+		"Usage: box [-flags] network create -subnet cidr [-gateway ip] [-bridge name] " +
+			"[-mtu mtu] [-stp] [-masquerade] name\n" +
+			"       box [-flags] network {list|ls}\n" +
+			"       box [-flags] network rm name...\n" +
+			"       box [-flags] network inspect name",
+	)
+}
+
+// networkCmd runs the network action with the given args.
+func networkCmd(args []string) {
+	if len(args) < 1 {
+		printNetworkHelp()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("create", flag.ExitOnError)
+		subnet := fs.String("subnet", "", "Subnet of the network in CIDR format, e.g. 10.1.0.0/16")
+		gateway := fs.String("gateway", "", "Gateway of the network, defaults to its first IP")
+		bridge := fs.String("bridge", "", "Name of the network's bridge, defaults to box-<name>")
+		mtu := fs.Int("mtu", 0, "MTU of the network's bridge")
+		stp := fs.Bool("stp", false, "Enable STP on the network's bridge")
+		masquerade := fs.Bool("masquerade", false, "Masquerade the traffic leaving the network")
+		_ = fs.Parse(args[1:])
+		if fs.NArg() < 1 || *subnet == "" {
+			printNetworkHelp()
+			os.Exit(1)
+		}
+
+		n, err := newManager().Networks().Create(boxnet.Network{
+			Name:       fs.Arg(0),
+			Bridge:     *bridge,
+			Subnet:     *subnet,
+			Gateway:    *gateway,
+			MTU:        *mtu,
+			STP:        *stp,
+			Masquerade: *masquerade,
+		})
+		if err != nil {
+			log.Fatalln("Failed to create network:", err)
+		}
+		fmt.Println(n.Name)
+	case "list", "ls":
+		networks, err := newManager().Networks().List()
+		if err != nil {
+			log.Fatalln("Failed to list networks:", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tBRIDGE\tSUBNET\tGATEWAY\tCREATED")
+		for _, n := range networks {
+			fmt.Fprintf(
+				w, "%s\t%s\t%s\t%s\t%s\n",
+				n.Name, n.Bridge, n.Subnet, n.Gateway, n.Created.Format(time.RFC3339),
+			)
+		}
+		_ = w.Flush()
+	case "rm":
+		if len(args) < 2 {
+			printNetworkHelp()
+			os.Exit(1)
+		}
+
+		m := newManager()
+		for _, name := range args[1:] {
+			if err := m.RemoveNetwork(name); err != nil {
+				log.Fatalln("Failed to remove network:", err)
+			}
+		}
+	case "inspect":
+		if len(args) < 2 {
+			printNetworkHelp()
+			os.Exit(1)
+		}
+
+		n, err := newManager().Networks().Get(args[1])
+		if err != nil {
+			log.Fatalln("Failed to inspect network:", err)
+		}
+
+		b, err := json.MarshalIndent(n, "", "  ")
+		if err != nil {
+			log.Fatalln("Failed to inspect network:", err)
+		}
+		fmt.Println(string(b))
+	default:
+		printNetworkHelp()
+		os.Exit(1)
+	}
+}
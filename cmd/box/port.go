@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cprates/box/boxnet"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// portFlags collects the port mappings given with repeated -p flags.
+type portFlags []boxnet.PortMapping
+
+func (p *portFlags) String() string {
+	s := make([]string, 0, len(*p))
+	for _, m := range *p {
+		s = append(s, m.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (p *portFlags) Set(value string) error {
+	m, err := boxnet.ParsePortMapping(value)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, m)
+
+	return nil
+}
+
+// portCmd prints the ports published by the box with the given name.
+func portCmd(name string) {
+	ports, err := newManager().Ports(name)
+	if err != nil {
+		log.Fatalln("Failed to get ports:", err)
+	}
+
+	for _, p := range ports {
+		hostIP := p.HostIP
+		if hostIP == "" {
+			hostIP = "0.0.0.0"
+		}
+		via := "dnat"
+		if p.Proxy {
+			via = "proxy"
+		}
+		proto := p.Protocol
+		if proto == "" {
+			proto = "tcp"
+		}
+		fmt.Printf("%d/%s -> %s:%d (%s)\n", p.BoxPort, proto, hostIP, p.HostPort, via)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cprates/box/volume"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func printVolumeHelp() {
+	fmt.Println(
+		"Usage: box [-flags] volume create [-driver dir|tmpfs|loop] [-size size] name\n" +
+			"       box [-flags] volume {list|ls}\n" +
+			"       box [-flags] volume rm name...\n" +
+			"       box [-flags] volume inspect name",
+	)
+}
+
+// volumeCmd runs the volume action with the given args.
+func volumeCmd(args []string) {
+	if len(args) < 1 {
+		printVolumeHelp()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("create", flag.ExitOnError)
+		driver := fs.String("driver", volume.DriverDir, "Volume driver: dir, tmpfs or loop")
+		size := fs.String("size", "", "Max size of the volume, e.g. 512m or 1g")
+		_ = fs.Parse(args[1:])
+		if fs.NArg() < 1 {
+			printVolumeHelp()
+			os.Exit(1)
+		}
+
+		opts := volume.Options{Driver: *driver}
+		if *size != "" {
+			var err error
+			if opts.Size, err = parseSize(*size); err != nil {
+				log.Fatalln("Invalid size:", err)
+			}
+		}
+
+		v, err := newManager().Volumes().Create(fs.Arg(0), opts)
+		if err != nil {
+			log.Fatalln("Failed to create volume:", err)
+		}
+		fmt.Println(v.Name)
+	case "list", "ls":
+		volumes, err := newManager().Volumes().List()
+		if err != nil {
+			log.Fatalln("Failed to list volumes:", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tDRIVER\tSIZE\tUSERS\tCREATED")
+		for _, v := range volumes {
+			size := "-"
+			if v.Size > 0 {
+				size = strconv.FormatInt(v.Size, 10)
+			}
+			fmt.Fprintf(
+				w, "%s\t%s\t%s\t%d\t%s\n",
+				v.Name, v.Driver, size, len(v.Users), v.Created.Format(time.RFC3339),
+			)
+		}
+		_ = w.Flush()
+	case "rm":
+		if len(args) < 2 {
+			printVolumeHelp()
+			os.Exit(1)
+		}
+
+		store := newManager().Volumes()
+		for _, name := range args[1:] {
+			if err := store.Remove(name); err != nil {
+				log.Fatalln("Failed to remove volume:", err)
+			}
+		}
+	case "inspect":
+		if len(args) < 2 {
+			printVolumeHelp()
+			os.Exit(1)
+		}
+
+		v, err := newManager().Volumes().Get(args[1])
+		if err != nil {
+			log.Fatalln("Failed to inspect volume:", err)
+		}
+
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			log.Fatalln("Failed to inspect volume:", err)
+		}
+		fmt.Println(string(b))
+	default:
+		printVolumeHelp()
+		os.Exit(1)
+	}
+}
+
+// parseSize parses a size in bytes, optionally suffixed with k, m or g, in powers of 1024.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		mult = 1 << 10
+	case "m":
+		mult = 1 << 20
+	case "g":
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative size %d", n)
+	}
+
+	return n * mult, nil
+}
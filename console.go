@@ -0,0 +1,182 @@
+package box
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+
+	"golang.org/x/sys/unix"
+)
+
+// receiveConsole reads the pty master sent by the bootstrap process through the given socket.
+func receiveConsole(socket *os.File) (*os.File, error) {
+	name := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := unix.Recvmsg(int(socket.Fd()), name, oob, unix.MSG_CMSG_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 && oobn == 0 {
+		return nil, fmt.Errorf("box process closed the console socket")
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, fmt.Errorf("parsing control message: %s", err)
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("expected a single control message, got %d", len(msgs))
+	}
+
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing unix rights: %s", err)
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			_ = unix.Close(fd)
+		}
+		return nil, fmt.Errorf("expected a single fd, got %d", len(fds))
+	}
+
+	return os.NewFile(uintptr(fds[0]), string(name[:n])), nil
+}
+
+// sendConsole sends the pty master to the unix socket listening at path, following the same
+// protocol as runC's --console-socket.
+func sendConsole(path string, master *os.File) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("connecting to console socket %q: %s", path, err)
+	}
+	defer conn.Close()
+
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("console socket %q is not a unix socket", path)
+	}
+
+	oob := unix.UnixRights(int(master.Fd()))
+	_, _, err = uc.WriteMsgUnix([]byte(master.Name()), oob, nil)
+	return err
+}
+
+// proxyConsole copies data between the box's console and its ProcessIO. If raw is set and In
+// is a terminal, it is put in raw mode and its window size is kept in sync with the console
+// until the box exits. The returned channel is closed once all the output is copied.
+func (b *boxInternal) proxyConsole(raw bool) (done <-chan struct{}, err error) {
+	console := b.childProcess.console
+	pio := b.childProcess.io
+
+	restore := func() {}
+	if raw && pio.In != nil && isTerminal(pio.In) {
+		restore, err = setRawTerminal(int(pio.In.Fd()))
+		if err != nil {
+			return nil, fmt.Errorf("setting terminal in raw mode: %s", err)
+		}
+	}
+
+	outDone := make(chan struct{})
+	if raw && pio.In != nil && isTerminal(pio.In) {
+		go resizeOnSignal(pio.In, console, outDone)
+	}
+
+	if pio.In != nil {
+		go func() {
+			_, _ = io.Copy(console, pio.In)
+		}()
+	}
+
+	var out []io.Writer
+	if pio.Out != nil {
+		out = append(out, pio.Out)
+	}
+	var logStream io.WriteCloser
+	if b.childProcess.logger != nil {
+		logStream = b.childProcess.logger.Stream("stdout")
+		out = append(out, logStream)
+	}
+
+	go func() {
+		defer close(outDone)
+		defer restore()
+		// the copy ends with EIO as soon as the last process holding the slave exits
+		_, _ = io.Copy(io.MultiWriter(out...), console)
+		if logStream != nil {
+			logStream.Close()
+		}
+	}()
+
+	return outDone, nil
+}
+
+func resizeOnSignal(from, to *os.File, done <-chan struct{}) {
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, unix.SIGWINCH)
+	defer signal.Stop(winch)
+
+	_ = copyWinsize(from, to)
+	for {
+		select {
+		case <-winch:
+			_ = copyWinsize(from, to)
+		case <-done:
+			return
+		}
+	}
+}
+
+func copyWinsize(from, to *os.File) error {
+	ws, err := unix.IoctlGetWinsize(int(from.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return err
+	}
+
+	return unix.IoctlSetWinsize(int(to.Fd()), unix.TIOCSWINSZ, ws)
+}
+
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// setRawTerminal puts the terminal referred by fd in raw mode, as cfmakeraw(3) does, returning
+// a function to restore its previous state.
+func setRawTerminal(fd int) (restore func(), err error) {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return
+	}
+	old := *termios
+
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP |
+		unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+
+	if err = unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		return
+	}
+
+	restore = func() {
+		_ = unix.IoctlSetTermios(fd, unix.TCSETS, &old)
+	}
+	return
+}
+
+func newConsoleSocketPair() (parent, child *os.File, err error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+
+	parent = os.NewFile(uintptr(fds[0]), "consoleSocket-parent")
+	child = os.NewFile(uintptr(fds[1]), "consoleSocket-child")
+	return
+}
@@ -0,0 +1,103 @@
+package box
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// checkConsole checks that console is the write end of the pipe read by r.
+func checkConsole(t *testing.T, console *os.File, r *os.File) {
+	if _, err := console.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	console.Close()
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "hello" {
+		t.Errorf("expected the received console to be the sent one, got %q, %v", b, err)
+	}
+}
+
+func TestReceiveConsole(t *testing.T) {
+	parent, child, err := newConsoleSocketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.Close()
+
+	// a pipe stands for the pty, whose write end is sent as the bootstrap process does
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	oob := unix.UnixRights(int(w.Fd()))
+	if err = unix.Sendmsg(int(child.Fd()), []byte("/dev/pts/3"), oob, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	console, err := receiveConsole(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if console.Name() != "/dev/pts/3" {
+		t.Errorf("expected the console to be named after its slave, got %q", console.Name())
+	}
+	checkConsole(t, console, r)
+
+	child.Close()
+	_, err = receiveConsole(parent)
+	if err == nil || !strings.Contains(err.Error(), "closed the console socket") {
+		t.Errorf("expected an error once the socket is closed, got %v", err)
+	}
+}
+
+func TestSendConsole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "console.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err = sendConsole(path, w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	socket, err := conn.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	console, err := receiveConsole(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if console.Name() != w.Name() {
+		t.Errorf("expected the console to be named %q, got %q", w.Name(), console.Name())
+	}
+	checkConsole(t, console, r)
+}
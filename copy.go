@@ -0,0 +1,175 @@
+package box
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/cprates/box/image"
+	"github.com/cprates/box/system"
+
+	"golang.org/x/sys/unix"
+)
+
+// Operations run by the copy helper on the rootfs of a running box.
+const (
+	copyOpFrom   = "from"
+	copyOpTo     = "to"
+	copyOpExport = "export"
+)
+
+// CopyFrom writes the file or dir in the given path of the box with the given name to w, as a
+// tarball with it at its root. The path is resolved as seen by the box, including its mounts.
+func (m *manager) CopyFrom(name, src string, w io.Writer) (err error) {
+	state, err := m.loadStateFromName(name)
+	if err != nil {
+		return fmt.Errorf("unable to load state: %s", err)
+	}
+
+	src = path.Clean("/" + src)
+	// the box's root is named after the box
+	base := path.Base(src)
+	if base == "/" {
+		base = name
+	}
+
+	if boxAlive(state) {
+		return copyOnBox(state, copyOpFrom, src, base, nil, w)
+	}
+
+	rootFs, release, err := mergedRootFs(state)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := release(); err == nil {
+			err = e
+		}
+	}()
+
+	return copyFromRootFs(w, rootFs, src, base)
+}
+
+// copyFromRootFs writes the file or dir in the path src of rootFs to w, named name.
+func copyFromRootFs(w io.Writer, rootFs, src, name string) error {
+	p, err := system.SecureJoin(rootFs, src)
+	if err != nil {
+		return fmt.Errorf("resolving %q: %s", src, err)
+	}
+
+	if err = image.WriteTree(w, p, name); err != nil {
+		return fmt.Errorf("copying %q: %s", src, err)
+	}
+
+	return nil
+}
+
+// CopyTo extracts the given tarball, which must have a single file or dir at its root, to the
+// given path of the box with the given name: into it if it is a dir, or as it otherwise. The
+// path is resolved as seen by the box, including its mounts, and symlinks can't point out of
+// the box's rootfs.
+func (m *manager) CopyTo(name, dst string, r io.Reader) (err error) {
+	state, err := m.loadStateFromName(name)
+	if err != nil {
+		return fmt.Errorf("unable to load state: %s", err)
+	}
+
+	if boxAlive(state) {
+		return copyOnBox(state, copyOpTo, dst, "", r, nil)
+	}
+	if state.BoxConfig.Overlay {
+		return errors.New("the rootfs of stopped boxes with an overlay is read-only")
+	}
+
+	rootFs, release, err := mergedRootFs(state)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := release(); err == nil {
+			err = e
+		}
+	}()
+
+	return image.ExtractTree(rootFs, dst, r)
+}
+
+// copyOnBox runs the given copy operation on the rootfs of the running box with the given
+// state, in a helper process chrooted to it, so that all paths are resolved inside the box even
+// if it changes them meanwhile. Resolving them from the host through /proc/<pid>/root would
+// follow absolute symlinks, swapped in by the box after checking them, out of its rootfs. The
+// tarball read or written by the operation is streamed through r or w.
+func copyOnBox(s *state, op, p, name string, r io.Reader, w io.Writer) error {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("/proc/self/exe", "copy")
+	cmd.Stdin = r
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+	cmd.Env = []string{
+		"BOX_COPY_PID=" + strconv.Itoa(s.BoxPID),
+		"BOX_COPY_START=" + strconv.FormatUint(s.ProcessStartClockTicks, 10),
+		"BOX_COPY_OP=" + op,
+		"BOX_COPY_PATH=" + p,
+		"BOX_COPY_NAME=" + name,
+	}
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("running copy helper: %s", err)
+	}
+
+	return nil
+}
+
+// CopyHelper runs a copy operation on the rootfs of a running box, chrooted to it, streaming
+// the tarball read or written through stdin or stdout. It must be run by the executable using
+// the manager when started with the "copy" argument, with the BOX_COPY_* env vars as arguments.
+func CopyHelper(pid, startTicks, op, p, name string) (err error) {
+	boxPID, err := strconv.Atoi(pid)
+	if err != nil {
+		return fmt.Errorf("invalid box pid %q", pid)
+	}
+	ticks, err := strconv.ParseUint(startTicks, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid box start time %q", startTicks)
+	}
+
+	root, err := os.Open(fmt.Sprintf("/proc/%d/root", boxPID))
+	if err != nil {
+		return fmt.Errorf("opening box root: %s", err)
+	}
+	defer root.Close()
+	// the root is only known to be the box's if its process is still the same once opened
+	if stat, err := system.Stat(boxPID); err != nil || stat.StartTime != ticks {
+		return errors.New("box is no longer running")
+	}
+
+	if err = unix.Fchdir(int(root.Fd())); err != nil {
+		return fmt.Errorf("changing to box root: %s", err)
+	}
+	if err = unix.Chroot("."); err != nil {
+		return fmt.Errorf("chrooting to box root: %s", err)
+	}
+	if err = unix.Chdir("/"); err != nil {
+		return fmt.Errorf("changing to box root: %s", err)
+	}
+
+	switch op {
+	case copyOpFrom:
+		return copyFromRootFs(os.Stdout, "/", p, name)
+	case copyOpTo:
+		return image.ExtractTree("/", p, os.Stdin)
+	case copyOpExport:
+		return image.WriteTree(os.Stdout, "/", "")
+	default:
+		return fmt.Errorf("unknown copy operation %q", op)
+	}
+}
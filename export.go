@@ -0,0 +1,162 @@
+package box
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/cprates/box/image"
+
+	"golang.org/x/sys/unix"
+)
+
+// ExportOptions configures how a box's rootfs is exported.
+type ExportOptions struct {
+	// UpperOnly exports only the changes done to the rootfs of a box with an overlay, i.e. its
+	// upper layer, with whiteouts for the removed files
+	UpperOnly bool
+}
+
+// Export writes the rootfs of the box with the given name to w, as a tarball. The mounts done
+// in the box, such as /proc, are written as empty dirs.
+func (m *manager) Export(name string, w io.Writer, opts ExportOptions) (err error) {
+	state, err := m.loadStateFromName(name)
+	if err != nil {
+		return fmt.Errorf("unable to load state: %s", err)
+	}
+
+	cfg := state.BoxConfig
+	if opts.UpperOnly {
+		if !cfg.Overlay {
+			return errors.New("box doesn't have an overlay rootfs")
+		}
+		return image.WriteLayer(w, cfg.RootFsUpperdir)
+	}
+
+	if boxAlive(state) {
+		return copyOnBox(state, copyOpExport, "", "", nil, w)
+	}
+
+	rootFs, release, err := mergedRootFs(state)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := release(); err == nil {
+			err = e
+		}
+	}()
+
+	// not a layer, so that device nodes aren't taken as overlay whiteouts
+	return image.WriteTree(w, rootFs, "")
+}
+
+// Commit adds the rootfs of the box with the given name, which must have an overlay, to the OCI
+// image layout in the given dir, as an image named ref. The image is made of the box's lower
+// layers with its upper layer on top, and runs the box's entry point. Returns the digest of the
+// image's manifest.
+func (m *manager) Commit(name, layout, ref string) (digest string, err error) {
+	state, err := m.loadStateFromName(name)
+	if err != nil {
+		return "", fmt.Errorf("unable to load state: %s", err)
+	}
+
+	cfg := state.BoxConfig
+	if !cfg.Overlay {
+		return "", errors.New("box doesn't have an overlay rootfs")
+	}
+	if ref == "" {
+		ref = "latest"
+	}
+
+	if cfg.RootFsFile != "" {
+		var release func() error
+		if release, err = mountRootFsFile(cfg); err != nil {
+			return
+		}
+		defer func() {
+			if e := release(); err == nil {
+				err = e
+			}
+		}()
+	}
+
+	layers := make([]string, 0, len(cfg.RootFsLowerdirs)+1)
+	for i := len(cfg.RootFsLowerdirs) - 1; i >= 0; i-- {
+		layers = append(layers, cfg.RootFsLowerdirs[i])
+	}
+	layers = append(layers, cfg.RootFsUpperdir)
+
+	imgCfg := image.Config{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		Config: image.RunConfig{
+			User:       strconv.Itoa(int(cfg.UID)) + ":" + strconv.Itoa(int(cfg.GID)),
+			Env:        cfg.EnvVars,
+			Cmd:        append([]string{cfg.EntryPoint}, cfg.EntryPointArgs...),
+			WorkingDir: cfg.Cwd,
+		},
+	}
+
+	digest, err = image.AddToLayout(layout, ref, imgCfg, layers)
+	if err != nil {
+		return "", fmt.Errorf("adding image to layout: %s", err)
+	}
+
+	return digest, nil
+}
+
+// mergedRootFs returns the path of the rootfs of the stopped box with the given state. Its
+// overlay and rootfs file, if any, are mounted read-only until release is called. The rootfs of
+// running boxes is only accessed through copyOnBox.
+func mergedRootFs(s *state) (rootFs string, release func() error, err error) {
+	noop := func() error { return nil }
+	cfg := s.BoxConfig
+
+	releaseFile := noop
+	if cfg.RootFsFile != "" {
+		if releaseFile, err = mountRootFsFile(cfg); err != nil {
+			return "", nil, err
+		}
+		defer func() {
+			if err != nil {
+				_ = releaseFile()
+			}
+		}()
+	}
+
+	if !cfg.Overlay {
+		return cfg.RootFs, releaseFile, nil
+	}
+
+	mnt, err := ioutil.TempDir(filepath.Dir(cfg.StateFilePath), "export")
+	if err != nil {
+		return "", nil, err
+	}
+
+	// without an upperdir, the overlay is read-only and its former upperdir is only read
+	lowerdirs := append([]string{cfg.RootFsUpperdir}, cfg.RootFsLowerdirs...)
+	data := "lowerdir=" + strings.Join(lowerdirs, ":")
+	if err = unix.Mount("overlay", mnt, "overlay", unix.MS_RDONLY, data); err != nil {
+		_ = os.Remove(mnt)
+		return "", nil, fmt.Errorf("mounting overlay: %s", err)
+	}
+
+	release = func() error {
+		if err := unix.Unmount(mnt, unix.MNT_DETACH); err != nil {
+			return fmt.Errorf("unmounting overlay: %s", err)
+		}
+		if err := os.Remove(mnt); err != nil {
+			return err
+		}
+		return releaseFile()
+	}
+
+	return mnt, release, nil
+}
@@ -0,0 +1,55 @@
+package box
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/cprates/box/boxnet"
+)
+
+// bridgePeers returns a hosts file entry for each running box attached to the same bridge as
+// this one, found by looking up the states of the boxes living next to it.
+func (b *boxInternal) bridgePeers() (hosts []boxnet.HostEntry, err error) {
+	brName := b.config.NetConfig.BridgeName()
+	if brName == "" {
+		return
+	}
+
+	boxesDir := filepath.Dir(filepath.Dir(b.config.StateFilePath))
+	entries, err := ioutil.ReadDir(boxesDir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") || e.Name() == b.config.Name {
+			continue
+		}
+
+		s, err := readState(filepath.Join(boxesDir, e.Name(), stateFilename))
+		if err != nil {
+			// not a box or still being created
+			continue
+		}
+		peerNet := s.BoxConfig.NetConfig
+		if peerNet == nil || peerNet.BridgeName() != brName || !boxAlive(s) {
+			continue
+		}
+
+		addrs, err := peerNet.Addresses()
+		if err != nil {
+			continue
+		}
+
+		names := []string{s.BoxConfig.Hostname}
+		if s.BoxConfig.Name != s.BoxConfig.Hostname {
+			names = append(names, s.BoxConfig.Name)
+		}
+		for _, addr := range addrs {
+			hosts = append(hosts, boxnet.HostEntry{IP: addr, Names: names})
+		}
+	}
+
+	return hosts, nil
+}
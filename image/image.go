@@ -0,0 +1,511 @@
+// Package image reads container images from local OCI image layouts and docker save tarballs,
+// and unpacks them into rootfs.
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	mediaTypeOCIIndex      = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerList    = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ociIndexFilename       = "index.json"
+	dockerManifestFilename = "manifest.json"
+)
+
+// defaultRegistry is the registry of image references without one
+const defaultRegistry = "docker.io"
+
+// annotations naming the images in an OCI index
+var refAnnotations = []string{
+	"org.opencontainers.image.ref.name",
+	"io.containerd.image.name",
+}
+
+// Config is the part of an OCI image config used to run boxes.
+// Check https://github.com/opencontainers/image-spec/blob/master/config.md for more details.
+type Config struct {
+	Architecture string       `json:"architecture"`
+	OS           string       `json:"os"`
+	Config       RunConfig    `json:"config"`
+	RootFS       RootFSConfig `json:"rootfs"`
+}
+
+// RunConfig contains the execution parameters of an image.
+type RunConfig struct {
+	User       string   `json:"User,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+}
+
+// RootFSConfig references the layers of an image by their uncompressed digests.
+type RootFSConfig struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// Layer is a layer of an image.
+type Layer struct {
+	// Digest is the digest of the layer as stored in the image, possibly compressed. It is
+	// unknown for docker save tarballs
+	Digest string
+	// DiffID is the digest of the uncompressed layer
+	DiffID string
+	path   string
+}
+
+// Image is an image read from an OCI image layout or a docker save tarball.
+type Image struct {
+	Config Config
+	// Layers are the image's layers, from the bottom to the top one
+	Layers     []Layer
+	configBlob []byte
+	src        source
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+type index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// Open opens the image in the given path, either an OCI image layout dir or a docker save
+// tarball, which may also be extracted to a dir. If it contains several images, ref selects
+// one by its name or tag, e.g. "alpine:3.12". Images for other platforms are ignored.
+func Open(path, ref string) (img *Image, err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var src source = dirSource(path)
+	if !fi.IsDir() {
+		f, e := os.Open(path)
+		if e != nil {
+			return nil, e
+		}
+		src = tarSource{f: f}
+	}
+	defer func() {
+		if err != nil {
+			_ = src.close()
+		}
+	}()
+
+	img = &Image{src: src}
+	err = img.loadDocker(ref)
+	if errors.Is(err, errNotFound) {
+		err = img.loadOCI(ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// ID returns the image's id, which is the digest of its config.
+func (img *Image) ID() string {
+	sum := sha256.Sum256(img.configBlob)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Close releases the resources held by the image.
+func (img *Image) Close() error {
+	return img.src.close()
+}
+
+// OpenLayer returns a reader with the uncompressed content of the given layer, which fails
+// at the end if the layer doesn't match its digests.
+func (img *Image) OpenLayer(l Layer) (io.ReadCloser, error) {
+	f, err := img.src.open(l.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rd io.Reader = f
+	if l.Digest != "" {
+		if rd, err = verify(f, l.Digest); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	drd, err := decompress(rd)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("decompressing layer: %s", err)
+	}
+
+	rd = drd
+	if l.DiffID != "" {
+		if rd, err = verify(drd, l.DiffID); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{rd, multiCloser{drd, f}}, nil
+}
+
+// Unpack applies all the image's layers to the rootfs in dst.
+func (img *Image) Unpack(dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	for i, l := range img.Layers {
+		if err := img.applyLayer(dst, l, false); err != nil {
+			return fmt.Errorf("applying layer %d: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+// UnpackLayers unpacks each of the image's layers to its own dir in dir, which can be stacked
+// with an overlay, returning them from the bottom to the top one.
+func (img *Image) UnpackLayers(dir string) (layers []string, err error) {
+	for i, l := range img.Layers {
+		dst := filepath.Join(dir, strconv.Itoa(i))
+		if err = os.MkdirAll(dst, 0755); err != nil {
+			return nil, err
+		}
+
+		if err = img.applyLayer(dst, l, true); err != nil {
+			return nil, fmt.Errorf("applying layer %d: %s", i, err)
+		}
+		layers = append(layers, dst)
+	}
+
+	return layers, nil
+}
+
+func (img *Image) applyLayer(dst string, l Layer, overlay bool) error {
+	rd, err := img.OpenLayer(l)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	return ApplyLayer(dst, rd, overlay)
+}
+
+func (img *Image) loadDocker(ref string) error {
+	var manifests []dockerManifest
+	if err := img.readJSON(dockerManifestFilename, "", &manifests); err != nil {
+		return err
+	}
+
+	var selected []dockerManifest
+	for _, m := range manifests {
+		if ref == "" || matchRef(ref, m.RepoTags...) {
+			selected = append(selected, m)
+		}
+	}
+	if err := checkSelected(len(selected), ref); err != nil {
+		return err
+	}
+
+	m := selected[0]
+	if err := img.readConfig(m.Config, ""); err != nil {
+		return fmt.Errorf("reading image config: %s", err)
+	}
+
+	diffIDs := img.Config.RootFS.DiffIDs
+	for i, p := range m.Layers {
+		l := Layer{path: p}
+		if len(diffIDs) == len(m.Layers) {
+			l.DiffID = diffIDs[i]
+		}
+		img.Layers = append(img.Layers, l)
+	}
+
+	return nil
+}
+
+func (img *Image) loadOCI(ref string) error {
+	idx := index{}
+	if err := img.readJSON(ociIndexFilename, "", &idx); err != nil {
+		return fmt.Errorf("neither a docker save tarball nor an OCI image layout: %s", err)
+	}
+
+	var selected []descriptor
+	for _, d := range idx.Manifests {
+		if ref == "" || matchRef(ref, refNames(d)...) {
+			selected = append(selected, d)
+		}
+	}
+
+	desc, err := selectManifest(selected, ref)
+	if err != nil {
+		return err
+	}
+
+	// multi-platform images reference an index per platform
+	for desc.MediaType == mediaTypeOCIIndex || desc.MediaType == mediaTypeDockerList {
+		nested := index{}
+		if err = img.readBlob(desc.Digest, &nested); err != nil {
+			return fmt.Errorf("reading index: %s", err)
+		}
+		if desc, err = selectManifest(nested.Manifests, ""); err != nil {
+			return err
+		}
+	}
+
+	m := manifest{}
+	if err = img.readBlob(desc.Digest, &m); err != nil {
+		return fmt.Errorf("reading manifest: %s", err)
+	}
+
+	p, err := blobPath(m.Config.Digest)
+	if err != nil {
+		return err
+	}
+	if err = img.readConfig(p, m.Config.Digest); err != nil {
+		return fmt.Errorf("reading image config: %s", err)
+	}
+
+	diffIDs := img.Config.RootFS.DiffIDs
+	for i, d := range m.Layers {
+		p, err := blobPath(d.Digest)
+		if err != nil {
+			return err
+		}
+
+		l := Layer{Digest: d.Digest, path: p}
+		if len(diffIDs) == len(m.Layers) {
+			l.DiffID = diffIDs[i]
+		}
+		img.Layers = append(img.Layers, l)
+	}
+
+	return nil
+}
+
+func refNames(d descriptor) (names []string) {
+	for _, a := range refAnnotations {
+		if n, ok := d.Annotations[a]; ok {
+			names = append(names, n)
+		}
+	}
+
+	return
+}
+
+// matchRef returns whether ref is one of the given names, considering the latest tag and the
+// docker hub's library namespace as the defaults.
+func matchRef(ref string, names ...string) bool {
+	full := fullRef(ref)
+	for _, n := range names {
+		// OCI layouts usually name images only by their tag
+		if n == ref || strings.HasSuffix(ref, ":"+n) || fullRef(n) == full {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fullRef returns the given image reference with the registry, namespace and tag filled in with
+// the defaults if missing, so that e.g. ubuntu and docker.io/library/ubuntu:latest are the same.
+func fullRef(ref string) string {
+	ref = NormalizeName(ref)
+	i := strings.Index(ref, "/")
+	if i == -1 || !strings.ContainsAny(ref[:i], ".:") && ref[:i] != "localhost" {
+		ref = defaultRegistry + "/" + ref
+		i = len(defaultRegistry)
+	}
+	if ref[:i] == defaultRegistry && !strings.Contains(ref[i+1:], "/") {
+		ref = defaultRegistry + "/library" + ref[i:]
+	}
+
+	return ref
+}
+
+// selectManifest returns the only manifest for the current platform.
+func selectManifest(descs []descriptor, ref string) (descriptor, error) {
+	var selected []descriptor
+	for _, d := range descs {
+		if d.Platform == nil ||
+			(d.Platform.OS == runtime.GOOS && d.Platform.Architecture == runtime.GOARCH) {
+			selected = append(selected, d)
+		}
+	}
+
+	if err := checkSelected(len(selected), ref); err != nil {
+		return descriptor{}, err
+	}
+
+	return selected[0], nil
+}
+
+func checkSelected(n int, ref string) error {
+	switch {
+	case n == 0 && ref != "":
+		return fmt.Errorf("image %q not found", ref)
+	case n == 0:
+		return errors.New("no image found for this platform")
+	case n > 1:
+		return errors.New("several images found, one must be selected by its ref")
+	}
+
+	return nil
+}
+
+func (img *Image) readBlob(digest string, v interface{}) error {
+	p, err := blobPath(digest)
+	if err != nil {
+		return err
+	}
+
+	return img.readJSON(p, digest, v)
+}
+
+func (img *Image) readJSON(name, digest string, v interface{}) error {
+	b, err := img.readFile(name, digest)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// readConfig reads the image config, keeping it as is to identify the image.
+func (img *Image) readConfig(name, digest string) (err error) {
+	if img.configBlob, err = img.readFile(name, digest); err != nil {
+		return
+	}
+
+	return json.Unmarshal(img.configBlob, &img.Config)
+}
+
+func (img *Image) readFile(name, digest string) ([]byte, error) {
+	f, err := img.src.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rd io.Reader = f
+	if digest != "" {
+		if rd, err = verify(f, digest); err != nil {
+			return nil, err
+		}
+	}
+
+	return ioutil.ReadAll(rd)
+}
+
+// blobPath returns the path of the blob with the given digest in an OCI image layout.
+func blobPath(digest string) (string, error) {
+	if _, _, err := parseDigest(digest); err != nil {
+		return "", err
+	}
+
+	return "blobs/" + strings.Replace(digest, ":", "/", 1), nil
+}
+
+func parseDigest(digest string) (h hash.Hash, sum []byte, err error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("invalid digest %q", digest)
+	}
+
+	switch parts[0] {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, nil, fmt.Errorf("unsupported digest algorithm %q", parts[0])
+	}
+
+	sum, err = hex.DecodeString(parts[1])
+	if err != nil || len(sum) != h.Size() {
+		return nil, nil, fmt.Errorf("invalid digest %q", digest)
+	}
+
+	return h, sum, nil
+}
+
+// verify returns a reader which fails at EOF if the content read doesn't match digest.
+func verify(rd io.Reader, digest string) (io.Reader, error) {
+	h, sum, err := parseDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &verifier{rd: rd, h: h, sum: sum, digest: digest}, nil
+}
+
+type verifier struct {
+	rd     io.Reader
+	h      hash.Hash
+	sum    []byte
+	digest string
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.rd.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(v.h.Sum(nil), v.sum) {
+		return n, fmt.Errorf("content doesn't match digest %s", v.digest)
+	}
+
+	return n, err
+}
+
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() (err error) {
+	for _, c := range m {
+		if e := c.Close(); err == nil {
+			err = e
+		}
+	}
+
+	return
+}
@@ -0,0 +1,392 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cprates/box/spec"
+)
+
+type entry struct {
+	name    string
+	content string
+	dir     bool
+}
+
+func layerTar(t *testing.T, entries ...entry) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name: e.name,
+			Mode: 0644,
+			Size: int64(len(e.content)),
+			Uid:  os.Getuid(),
+			Gid:  os.Getgid(),
+		}
+		if e.dir {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, b []byte) []byte {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+var testLayers = [][]entry{
+	{
+		{name: "etc/", dir: true},
+		{name: "etc/passwd", content: "root:x:0:0::/root:/bin/sh\napp:x:1000:1000::/app:/bin/sh\n"},
+		{name: "etc/group", content: "root:x:0:\napp:x:1000:\nwheel:x:10:app\n"},
+		{name: "dir/", dir: true},
+		{name: "dir/a", content: "a"},
+		{name: "dir/b", content: "b"},
+		{name: "x", content: "x"},
+	},
+	{
+		{name: ".wh.x"},
+		{name: "dir/c", content: "c"},
+		{name: "dir/.wh..wh..opq"},
+		{name: "y", content: "y"},
+	},
+}
+
+var testConfig = Config{
+	Architecture: "amd64",
+	OS:           "linux",
+	Config: RunConfig{
+		User:       "app:wheel",
+		Env:        []string{"FOO=bar"},
+		Entrypoint: []string{"/bin/sh", "-c"},
+		Cmd:        []string{"echo hi"},
+		WorkingDir: "/app",
+	},
+}
+
+// writeOCILayout writes an OCI image layout with the test layers, gzipped, to dir.
+func writeOCILayout(t *testing.T, dir string) {
+	writeBlob := func(b []byte) descriptor {
+		d := digest(b)
+		p := filepath.Join(dir, "blobs", "sha256", d[len("sha256:"):])
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return descriptor{Digest: d, Size: int64(len(b))}
+	}
+
+	cfg := testConfig
+	m := manifest{}
+	for _, l := range testLayers {
+		b := layerTar(t, l...)
+		cfg.RootFS.DiffIDs = append(cfg.RootFS.DiffIDs, digest(b))
+		m.Layers = append(m.Layers, writeBlob(gzipped(t, b)))
+	}
+	m.Config = writeBlob(mustJSON(t, cfg))
+
+	desc := writeBlob(mustJSON(t, m))
+	desc.Annotations = map[string]string{"org.opencontainers.image.ref.name": "latest"}
+	idx := index{Manifests: []descriptor{desc}}
+	err := ioutil.WriteFile(filepath.Join(dir, ociIndexFilename), mustJSON(t, idx), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeDockerSave writes a docker save tarball with the test layers to path.
+func writeDockerSave(t *testing.T, path string) {
+	cfg := testConfig
+	m := dockerManifest{Config: "config.json", RepoTags: []string{"test:1"}}
+	var entries []entry
+	for i, l := range testLayers {
+		b := layerTar(t, l...)
+		cfg.RootFS.DiffIDs = append(cfg.RootFS.DiffIDs, digest(b))
+		name := filepath.Join(string(rune('a'+i)), "layer.tar")
+		m.Layers = append(m.Layers, name)
+		entries = append(entries, entry{name: name, content: string(b)})
+	}
+	entries = append(
+		entries,
+		entry{name: "config.json", content: string(mustJSON(t, cfg))},
+		entry{name: "manifest.json", content: string(mustJSON(t, []dockerManifest{m}))},
+	)
+
+	if err := ioutil.WriteFile(path, layerTar(t, entries...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkRootFs(t *testing.T, rootFs string) {
+	for _, f := range []string{"x", "dir/a", "dir/b"} {
+		if _, err := os.Lstat(filepath.Join(rootFs, f)); !os.IsNotExist(err) {
+			t.Errorf("expected %q to be removed, got: %v", f, err)
+		}
+	}
+
+	for _, f := range []string{"dir/c", "y", "etc/passwd"} {
+		if _, err := os.Stat(filepath.Join(rootFs, f)); err != nil {
+			t.Errorf("expected %q to exist, got: %s", f, err)
+		}
+	}
+}
+
+func TestUnpack(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	layout := filepath.Join(tmp, "layout")
+	writeOCILayout(t, layout)
+	tarball := filepath.Join(tmp, "image.tar")
+	writeDockerSave(t, tarball)
+
+	tests := []struct {
+		path string
+		ref  string
+	}{
+		{path: layout},
+		{path: layout, ref: "test:latest"},
+		{path: tarball, ref: "test:1"},
+	}
+
+	for i, test := range tests {
+		img, err := Open(test.path, test.ref)
+		if err != nil {
+			t.Fatalf("%s: opening image: %s", test.path, err)
+		}
+
+		rootFs := filepath.Join(tmp, "rootfs", string(rune('a'+i)))
+		if err = img.Unpack(rootFs); err != nil {
+			t.Fatalf("%s: unpacking image: %s", test.path, err)
+		}
+		img.Close()
+
+		checkRootFs(t, rootFs)
+
+		s, err := img.Spec(spec.Root{Path: rootFs})
+		if err != nil {
+			t.Fatalf("%s: generating spec: %s", test.path, err)
+		}
+
+		expect := spec.Process{
+			Args: []string{"/bin/sh", "-c", "echo hi"},
+			Env:  []string{"FOO=bar", defaultPath},
+			Cwd:  "/app",
+			User: spec.User{UID: 1000, GID: 10},
+		}
+		if !reflect.DeepEqual(*s.Process, expect) {
+			t.Errorf("%s: expected process %+v, got %+v", test.path, expect, *s.Process)
+		}
+	}
+}
+
+func TestUnpackDigestMismatch(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	writeOCILayout(t, tmp)
+
+	img, err := Open(tmp, "")
+	if err != nil {
+		t.Fatalf("opening image: %s", err)
+	}
+	defer img.Close()
+
+	// corrupt the top layer
+	p, _ := blobPath(img.Layers[1].Digest)
+	if err = ioutil.WriteFile(filepath.Join(tmp, p), gzipped(t, layerTar(t)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = img.Unpack(filepath.Join(tmp, "rootfs")); err == nil {
+		t.Error("expected unpacking a corrupted layer to fail")
+	}
+}
+
+func TestWriteLayer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating overlay whiteouts requires root")
+	}
+
+	tmp, err := ioutil.TempDir("", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	upper := filepath.Join(tmp, "upper")
+	if err = ApplyLayer(upper, bytes.NewReader(layerTar(t, testLayers[1]...)), true); err != nil {
+		t.Fatalf("applying layer: %s", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err = WriteLayer(buf, upper); err != nil {
+		t.Fatalf("writing layer: %s", err)
+	}
+
+	var names []string
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+
+	expect := []string{"dir/", "dir/.wh..wh..opq", "dir/c", ".wh.x", "y"}
+	if !reflect.DeepEqual(names, expect) {
+		t.Errorf("expected entries %v, got %v", expect, names)
+	}
+
+	// the same dir as a tree, e.g. a whole rootfs with /dev/null placeholders
+	buf.Reset()
+	if err = WriteTree(buf, upper, ""); err != nil {
+		t.Fatalf("writing tree: %s", err)
+	}
+
+	names = nil
+	tr = tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name == "x" && (hdr.Typeflag != tar.TypeChar || hdr.Devmajor != 0 ||
+			hdr.Devminor != 0) {
+			t.Errorf("expected x to be kept as a char device, got %+v", hdr)
+		}
+	}
+
+	expect = []string{"dir/", "dir/c", "x", "y"}
+	if !reflect.DeepEqual(names, expect) {
+		t.Errorf("expected tree entries %v, got %v", expect, names)
+	}
+}
+
+func TestExtractTree(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	root := filepath.Join(tmp, "root")
+	if err = os.MkdirAll(filepath.Join(root, "dst"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	headers := []*tar.Header{
+		{Name: "d/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "d/link", Typeflag: tar.TypeSymlink, Linkname: "../../../../"},
+		{Name: "d/link/evil", Typeflag: tar.TypeReg, Mode: 0644},
+	}
+	for _, hdr := range headers {
+		hdr.Uid, hdr.Gid = os.Getuid(), os.Getgid()
+		if err = tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tree := buf.Bytes()
+
+	if err = ExtractTree(root, "/dst", bytes.NewReader(tree)); err != nil {
+		t.Fatalf("extracting into dir: %s", err)
+	}
+	if err = ExtractTree(root, "/renamed", bytes.NewReader(tree)); err != nil {
+		t.Fatalf("extracting as new path: %s", err)
+	}
+
+	for _, p := range []string{"dst/d/link", "renamed/link", "evil"} {
+		if _, err = os.Lstat(filepath.Join(root, p)); err != nil {
+			t.Errorf("expected %q to exist, got: %s", p, err)
+		}
+	}
+	if _, err = os.Lstat(filepath.Join(tmp, "evil")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written out of root, got: %v", err)
+	}
+}
+
+func TestMatchRef(t *testing.T) {
+	tests := []struct {
+		ref   string
+		name  string
+		match bool
+	}{
+		{"ubuntu", "ubuntu", true},
+		{"ubuntu", "ubuntu:latest", true},
+		{"ubuntu", "docker.io/library/ubuntu:latest", true},
+		{"library/ubuntu:20.04", "docker.io/library/ubuntu:20.04", true},
+		{"ubuntu:latest", "latest", true},
+		{"cprates/box", "docker.io/cprates/box:latest", true},
+		{"localhost:5000/box", "localhost:5000/box:latest", true},
+		{"ubuntu", "evil/ubuntu", false},
+		{"ubuntu", "docker.io/evil/ubuntu:latest", false},
+		{"ubuntu", "quay.io/ubuntu", false},
+		{"ubuntu", "ubuntu:20.04", false},
+		{"box", "localhost:5000/box", false},
+	}
+
+	for _, tt := range tests {
+		if m := matchRef(tt.ref, tt.name); m != tt.match {
+			t.Errorf("expected %q matching %q to be %v", tt.ref, tt.name, tt.match)
+		}
+	}
+}
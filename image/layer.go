@@ -0,0 +1,449 @@
+package image
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cprates/box/system"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	// opaqueWhiteout hides all the content of the dir it is in from the layers below
+	opaqueWhiteout = ".wh..wh..opq"
+	paxXattrPrefix = "SCHILY.xattr."
+	// overlayOpaqueXattr marks overlay dirs hiding all the content of the layers below
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+)
+
+// ApplyLayer extracts the given uncompressed layer into dst, on top of the layers already
+// there. Files hidden by the layer's whiteouts are removed from dst or, if overlay is set, the
+// whiteouts are converted to overlay whiteouts instead, so that dst can be used as one of the
+// lowerdirs of an overlay. File ownership is only restored when running as root.
+func ApplyLayer(dst string, layer io.Reader, overlay bool) error {
+	return extract(dst, "/", layer, extractOptions{whiteouts: true, overlay: overlay})
+}
+
+// ExtractTree extracts the given tarball, which must have a single file or dir at its root, to
+// the path dst in root: into dst if it is a dir, or as dst otherwise. Symlinks are resolved as if
+// root was the filesystem's root so that nothing is written out of it.
+func ExtractTree(root, dst string, tree io.Reader) error {
+	dst = path.Clean("/" + dst)
+	target, err := system.SecureJoin(root, dst)
+	if err != nil {
+		return err
+	}
+
+	if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+		return extract(root, dst, tree, extractOptions{})
+	}
+
+	return extract(root, path.Dir(dst), tree, extractOptions{rename: path.Base(dst)})
+}
+
+type extractOptions struct {
+	// whiteouts are applied instead of being extracted as regular files
+	whiteouts bool
+	// overlay converts whiteouts to overlay whiteouts
+	overlay bool
+	// rename replaces the first component of the extracted paths, if set
+	rename string
+}
+
+// extract extracts the given tarball into dir, which is a path in root.
+func extract(root, dir string, rd io.Reader, opts extractOptions) error {
+	type dirTimes struct {
+		path  string
+		atime time.Time
+		mtime time.Time
+	}
+
+	entryPath := func(name string) string {
+		name = path.Clean("/" + name)
+		if opts.rename != "" && name != "/" {
+			parts := strings.SplitN(name[1:], "/", 2)
+			parts[0] = opts.rename
+			name = "/" + strings.Join(parts, "/")
+		}
+		return path.Join(dir, name)
+	}
+
+	tr := tar.NewReader(rd)
+	written := map[string]bool{}
+	var dirs []dirTimes
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading layer: %s", err)
+		}
+
+		name := entryPath(hdr.Name)
+		if name == path.Clean(dir) {
+			continue
+		}
+
+		parentPath, base := path.Split(name)
+		parent, err := system.SecureJoin(root, parentPath)
+		if err != nil {
+			return fmt.Errorf("resolving %q: %s", parentPath, err)
+		}
+		if err = os.MkdirAll(parent, 0755); err != nil {
+			return fmt.Errorf("creating parent dir of %q: %s", name, err)
+		}
+
+		if opts.whiteouts && base == opaqueWhiteout {
+			if opts.overlay {
+				err = unix.Setxattr(parent, overlayOpaqueXattr, []byte("y"), 0)
+			} else {
+				err = removeHidden(parent, written)
+			}
+			if err != nil {
+				return fmt.Errorf("applying opaque whiteout %q: %s", name, err)
+			}
+			continue
+		}
+
+		if opts.whiteouts && strings.HasPrefix(base, whiteoutPrefix) {
+			target := filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix))
+			err = os.RemoveAll(target)
+			if err == nil && opts.overlay {
+				err = unix.Mknod(target, unix.S_IFCHR, 0)
+			}
+			if err != nil {
+				return fmt.Errorf("applying whiteout %q: %s", name, err)
+			}
+			continue
+		}
+
+		target := filepath.Join(parent, base)
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = entryPath(hdr.Linkname)
+		}
+		if err = extractEntry(root, target, hdr, tr); err != nil {
+			return fmt.Errorf("extracting %q: %s", name, err)
+		}
+		written[target] = true
+
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{path: target, atime: hdr.AccessTime, mtime: hdr.ModTime})
+		}
+	}
+
+	// the times of dirs are only set at the end since they change when their content does
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if d.atime.IsZero() {
+			d.atime = d.mtime
+		}
+		if err := os.Chtimes(d.path, d.atime, d.mtime); err != nil {
+			return fmt.Errorf("setting times of %q: %s", d.path, err)
+		}
+	}
+
+	// read whatever is left, such as the tar padding, so that the layer's digest is verified
+	if _, err := io.Copy(ioutil.Discard, rd); err != nil {
+		return fmt.Errorf("reading layer: %s", err)
+	}
+
+	return nil
+}
+
+// removeHidden removes everything in dir that wasn't written by the layer being applied.
+func removeHidden(dir string, written map[string]bool) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		if !written[p] {
+			if err = os.RemoveAll(p); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if e.IsDir() {
+			if err = removeHidden(p, written); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func extractEntry(root, target string, hdr *tar.Header, rd io.Reader) (err error) {
+	fi, err := os.Lstat(target)
+	if err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err = os.RemoveAll(target); err != nil {
+			return
+		}
+	}
+
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err = os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+			return
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, e := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if e != nil {
+			return e
+		}
+		_, err = io.Copy(f, rd)
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return
+		}
+	case tar.TypeSymlink:
+		if err = os.Symlink(hdr.Linkname, target); err != nil {
+			return
+		}
+	case tar.TypeLink:
+		// the link's target itself must not be followed if it is a symlink. It is already a
+		// path in root
+		linkDir, linkBase := path.Split(hdr.Linkname)
+		src, e := system.SecureJoin(root, linkDir)
+		if e != nil {
+			return e
+		}
+		return os.Link(filepath.Join(src, linkBase), target)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := uint32(unix.S_IFIFO)
+		if hdr.Typeflag == tar.TypeChar {
+			devMode = unix.S_IFCHR
+		} else if hdr.Typeflag == tar.TypeBlock {
+			devMode = unix.S_IFBLK
+		}
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err = unix.Mknod(target, devMode|uint32(mode.Perm()), int(dev)); err != nil {
+			return
+		}
+	default:
+		// nothing to extract, e.g. global headers
+		return nil
+	}
+
+	if os.Geteuid() == 0 {
+		if err = os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return
+		}
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(key, paxXattrPrefix)
+		err = unix.Lsetxattr(target, attr, []byte(value), 0)
+		if err != nil && err != unix.ENOTSUP && err != unix.EPERM {
+			return fmt.Errorf("setting xattr %q: %s", attr, err)
+		}
+	}
+
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+
+	// must be done after chown, which clears the setuid and setgid bits
+	perm := mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err = os.Chmod(target, perm); err != nil {
+		return
+	}
+
+	if hdr.Typeflag != tar.TypeDir {
+		atime := hdr.AccessTime
+		if atime.IsZero() {
+			atime = hdr.ModTime
+		}
+		err = os.Chtimes(target, atime, hdr.ModTime)
+	}
+
+	return
+}
+
+// WriteLayer writes the content of dir to w as an uncompressed layer, converting any overlay
+// whiteouts to the layer's whiteouts so that upperdirs can be written as they are. Mount points
+// in dir are written as empty dirs.
+func WriteLayer(w io.Writer, dir string) error {
+	return writeTar(w, dir, "", true)
+}
+
+// WriteTree writes the file or dir in p to w as a tarball, named name in it, or only the content
+// of the dir in p if name is empty. Unlike WriteLayer, files are written as they are, device
+// nodes included. Mount points in p are written as empty dirs.
+func WriteTree(w io.Writer, p, name string) error {
+	return writeTar(w, p, name, false)
+}
+
+// writeTar writes the content of dir to w, prefixing the names of the entries with prefix. If
+// prefix isn't empty, dir itself is also written.
+func writeTar(w io.Writer, dir, prefix string, layer bool) error {
+	var rootStat unix.Stat_t
+	if err := unix.Stat(dir, &rootStat); err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	// the first path of each hard linked inode
+	links := map[uint64]string{}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." && prefix == "" {
+			return nil
+		}
+		rel = filepath.Join(prefix, rel)
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("%q: unsupported file info", p)
+		}
+
+		if layer && fi.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0 {
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Join(filepath.Dir(rel), whiteoutPrefix+fi.Name()),
+				Mode:     0600,
+				ModTime:  fi.ModTime(),
+			})
+		}
+		if fi.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		// names from the host's user database don't mean anything in the layer
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.Format = tar.FormatPAX
+		if err = addXattrs(hdr, p); err != nil {
+			return fmt.Errorf("%q: reading xattrs: %s", p, err)
+		}
+
+		if fi.Mode().IsRegular() && st.Nlink > 1 {
+			if first, ok := links[st.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[st.Ino] = rel
+			}
+		}
+
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("%q: %s", p, err)
+			}
+		}
+
+		if !fi.IsDir() {
+			return nil
+		}
+		if uint64(st.Dev) != uint64(rootStat.Dev) {
+			return filepath.SkipDir
+		}
+
+		opaque := make([]byte, 1)
+		if n, err := unix.Lgetxattr(p, overlayOpaqueXattr, opaque); layer && err == nil &&
+			n == 1 && opaque[0] == 'y' {
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Join(rel, opaqueWhiteout),
+				Mode:     0600,
+				ModTime:  fi.ModTime(),
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// addXattrs adds the xattrs of the file in p to the given header, except overlay's.
+func addXattrs(hdr *tar.Header, p string) error {
+	size, err := unix.Llistxattr(p, nil)
+	if err == unix.ENOTSUP || size <= 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(p, buf); err != nil {
+		return err
+	}
+
+	for _, attr := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if attr == "" || strings.HasPrefix(attr, "trusted.overlay.") {
+			continue
+		}
+
+		vSize, err := unix.Lgetxattr(p, attr, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, vSize)
+		if vSize, err = unix.Lgetxattr(p, attr, value); err != nil {
+			return err
+		}
+
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[paxXattrPrefix+attr] = string(value[:vSize])
+	}
+
+	return nil
+}
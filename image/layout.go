@@ -0,0 +1,169 @@
+package image
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayerGz  = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociLayoutFilename    = "oci-layout"
+	ociLayoutVersion     = `{"imageLayoutVersion":"1.0.0"}`
+)
+
+// AddToLayout adds an image with the given config, made of the given layer dirs from the
+// bottom to the top one, to the OCI image layout in dir, which is created if needed. The image
+// is named ref, replacing any image with the same name in the layout. Returns the digest of the
+// image's manifest.
+func AddToLayout(dir, ref string, cfg Config, layerDirs []string) (digest string, err error) {
+	blobsDir := filepath.Join(dir, "blobs", "sha256")
+	if err = os.MkdirAll(blobsDir, 0755); err != nil {
+		return
+	}
+
+	layoutFile := filepath.Join(dir, ociLayoutFilename)
+	if _, err = os.Stat(layoutFile); os.IsNotExist(err) {
+		err = ioutil.WriteFile(layoutFile, []byte(ociLayoutVersion), 0644)
+	}
+	if err != nil {
+		return
+	}
+
+	m := manifest{SchemaVersion: 2, MediaType: mediaTypeOCIManifest}
+	cfg.RootFS = RootFSConfig{Type: "layers"}
+	for _, layerDir := range layerDirs {
+		desc, diffID, err := writeLayerBlob(blobsDir, layerDir)
+		if err != nil {
+			return "", fmt.Errorf("writing layer %q: %s", layerDir, err)
+		}
+		m.Layers = append(m.Layers, desc)
+		cfg.RootFS.DiffIDs = append(cfg.RootFS.DiffIDs, diffID)
+	}
+
+	if m.Config, err = writeJSONBlob(blobsDir, mediaTypeOCIConfig, cfg); err != nil {
+		return "", fmt.Errorf("writing image config: %s", err)
+	}
+
+	desc, err := writeJSONBlob(blobsDir, mediaTypeOCIManifest, m)
+	if err != nil {
+		return "", fmt.Errorf("writing manifest: %s", err)
+	}
+	desc.Annotations = map[string]string{refAnnotations[0]: ref}
+
+	return desc.Digest, addToIndex(filepath.Join(dir, ociIndexFilename), ref, desc)
+}
+
+// addToIndex adds desc to the index in path, replacing the manifests with the same ref. Other
+// manifests are kept as they are.
+func addToIndex(path, ref string, desc descriptor) error {
+	idx := struct {
+		SchemaVersion int               `json:"schemaVersion"`
+		Manifests     []json.RawMessage `json:"manifests"`
+	}{SchemaVersion: 2}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err = json.Unmarshal(b, &idx); err != nil {
+			return fmt.Errorf("parsing index: %s", err)
+		}
+	}
+
+	manifests := idx.Manifests[:0]
+	for _, raw := range idx.Manifests {
+		d := descriptor{}
+		if err = json.Unmarshal(raw, &d); err != nil {
+			return fmt.Errorf("parsing index: %s", err)
+		}
+		if d.Annotations[refAnnotations[0]] != ref {
+			manifests = append(manifests, raw)
+		}
+	}
+
+	raw, err := json.Marshal(desc)
+	if err != nil {
+		return err
+	}
+	idx.Manifests = append(manifests, raw)
+
+	if b, err = json.MarshalIndent(idx, "", "  "); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, b)
+}
+
+// writeLayerBlob writes the content of layerDir as a gzipped layer to blobsDir, returning its
+// descriptor and diffID.
+func writeLayerBlob(blobsDir, layerDir string) (desc descriptor, diffID string, err error) {
+	f, err := ioutil.TempFile(blobsDir, "layer")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	compressed := sha256.New()
+	counter := &countWriter{}
+	gz := gzip.NewWriter(io.MultiWriter(f, compressed, counter))
+	uncompressed := sha256.New()
+	if err = WriteLayer(io.MultiWriter(gz, uncompressed), layerDir); err != nil {
+		return
+	}
+	if err = gz.Close(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+
+	desc = descriptor{
+		MediaType: mediaTypeOCILayerGz,
+		Digest:    "sha256:" + hex.EncodeToString(compressed.Sum(nil)),
+		Size:      counter.n,
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return
+	}
+	if err = os.Rename(f.Name(), filepath.Join(blobsDir, desc.Digest[len("sha256:"):])); err != nil {
+		return
+	}
+
+	return desc, "sha256:" + hex.EncodeToString(uncompressed.Sum(nil)), nil
+}
+
+func writeJSONBlob(blobsDir, mediaType string, v interface{}) (desc descriptor, err error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	sum := sha256.Sum256(b)
+	desc = descriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		Size:      int64(len(b)),
+	}
+
+	return desc, writeFileAtomic(filepath.Join(blobsDir, hex.EncodeToString(sum[:])), b)
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,123 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// source gives access to the files of an image, stored either in a dir or a tarball.
+type source interface {
+	open(name string) (io.ReadCloser, error)
+	close() error
+}
+
+var errNotFound = errors.New("not found")
+
+type dirSource string
+
+func (d dirSource) open(name string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(string(d), filepath.Clean("/"+name)))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", name, errNotFound)
+	}
+
+	return f, err
+}
+
+func (d dirSource) close() error {
+	return nil
+}
+
+// tarSource reads files from a tarball, which is scanned from the beginning every time a file is
+// opened, so only one file can be read at a time.
+type tarSource struct {
+	f *os.File
+}
+
+// maxTarLinks is the max number of links followed when opening a file in a tarball.
+const maxTarLinks = 8
+
+func (t tarSource) open(name string) (io.ReadCloser, error) {
+	name = path.Clean("/" + name)
+	for i := 0; i <= maxTarLinks; i++ {
+		if _, err := t.f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		rd, err := decompress(t.f)
+		if err != nil {
+			return nil, err
+		}
+
+		tr := tar.NewReader(rd)
+		var hdr *tar.Header
+		for {
+			hdr, err = tr.Next()
+			if err == io.EOF {
+				rd.Close()
+				return nil, fmt.Errorf("%s: %w", name, errNotFound)
+			}
+			if err != nil {
+				rd.Close()
+				return nil, err
+			}
+			if path.Clean("/"+hdr.Name) == name {
+				break
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			return struct {
+				io.Reader
+				io.Closer
+			}{tr, rd}, nil
+		case tar.TypeSymlink:
+			// newer versions of docker link the legacy layer paths to the blobs
+			if path.IsAbs(hdr.Linkname) {
+				name = path.Clean(hdr.Linkname)
+			} else {
+				name = path.Join(path.Dir(name), hdr.Linkname)
+			}
+		case tar.TypeLink:
+			name = path.Clean("/" + hdr.Linkname)
+		default:
+			rd.Close()
+			return nil, fmt.Errorf("%s: not a regular file", name)
+		}
+		rd.Close()
+	}
+
+	return nil, fmt.Errorf("%s: too many links", name)
+}
+
+func (t tarSource) close() error {
+	return t.f.Close()
+}
+
+// decompress returns a reader with the decompressed content of rd, detecting its compression
+// from its first bytes.
+func decompress(rd io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(rd)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		return gzip.NewReader(br)
+	case len(magic) == 4 &&
+		magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd:
+		return nil, errors.New("zstd compression not supported")
+	}
+
+	return ioutil.NopCloser(br), nil
+}
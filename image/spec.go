@@ -0,0 +1,196 @@
+package image
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cprates/box/spec"
+	"github.com/cprates/box/system"
+)
+
+const defaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Spec returns a spec to run the image with the given root, which must have been unpacked
+// from it. The user of the image is resolved by name with the passwd and group files in it.
+func (img *Image) Spec(root spec.Root) (*spec.Spec, error) {
+	cfg := img.Config.Config
+
+	args := append(append([]string{}, cfg.Entrypoint...), cfg.Cmd...)
+	if len(args) == 0 {
+		return nil, errors.New("image has neither entrypoint nor cmd")
+	}
+
+	cwd := cfg.WorkingDir
+	if cwd == "" {
+		cwd = "/"
+	}
+
+	env := append([]string{}, cfg.Env...)
+	hasPath := false
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") {
+			hasPath = true
+		}
+	}
+	if !hasPath {
+		env = append(env, defaultPath)
+	}
+
+	// files in upper layers hide the ones below
+	dirs := []string{root.Path}
+	if len(root.Layers) > 0 {
+		dirs = dirs[:0]
+		for i := len(root.Layers) - 1; i >= 0; i-- {
+			dirs = append(dirs, root.Layers[i])
+		}
+	}
+
+	user, err := resolveUser(cfg.User, dirs)
+	if err != nil {
+		return nil, fmt.Errorf("resolving user %q: %s", cfg.User, err)
+	}
+
+	s := &spec.Spec{
+		Version: spec.Version,
+		Root:    &root,
+		Process: &spec.Process{
+			Args: args,
+			Env:  env,
+			Cwd:  cwd,
+			User: user,
+		},
+	}
+
+	return s, s.Valid()
+}
+
+// resolveUser resolves the given user, in the form user[:group], where both can be either a
+// name or an id, using the passwd and group files in the first of dirs having them.
+func resolveUser(user string, dirs []string) (u spec.User, err error) {
+	if user == "" {
+		return
+	}
+
+	name, group := user, ""
+	if i := strings.Index(user, ":"); i != -1 {
+		name, group = user[:i], user[i+1:]
+	}
+
+	passwd, err := readDB(dirs, "/etc/passwd")
+	if err != nil {
+		return
+	}
+
+	userName := ""
+	if id, e := strconv.ParseUint(name, 10, 32); e == nil {
+		u.UID = uint32(id)
+	}
+	found := false
+	for _, entry := range passwd {
+		// name:password:uid:gid:gecos:home:shell
+		if len(entry) < 4 {
+			continue
+		}
+		if entry[0] != name && entry[2] != name {
+			continue
+		}
+
+		uid, e1 := strconv.ParseUint(entry[2], 10, 32)
+		gid, e2 := strconv.ParseUint(entry[3], 10, 32)
+		if e1 != nil || e2 != nil {
+			continue
+		}
+		u.UID, u.GID, userName, found = uint32(uid), uint32(gid), entry[0], true
+		break
+	}
+	if !found {
+		if _, e := strconv.ParseUint(name, 10, 32); e != nil {
+			return u, fmt.Errorf("user %q not found", name)
+		}
+	}
+
+	groups, err := readDB(dirs, "/etc/group")
+	if err != nil {
+		return
+	}
+
+	if group != "" {
+		found = false
+		if id, e := strconv.ParseUint(group, 10, 32); e == nil {
+			u.GID, found = uint32(id), true
+		}
+		for _, entry := range groups {
+			// name:password:gid:members
+			if len(entry) < 3 || entry[0] != group {
+				continue
+			}
+			gid, e := strconv.ParseUint(entry[2], 10, 32)
+			if e != nil {
+				continue
+			}
+			u.GID, found = uint32(gid), true
+			break
+		}
+		if !found {
+			return u, fmt.Errorf("group %q not found", group)
+		}
+	}
+
+	if userName == "" {
+		return
+	}
+	for _, entry := range groups {
+		if len(entry) < 4 {
+			continue
+		}
+		gid, e := strconv.ParseUint(entry[2], 10, 32)
+		if e != nil || uint32(gid) == u.GID {
+			continue
+		}
+		for _, member := range strings.Split(entry[3], ",") {
+			if member == userName {
+				u.AdditionalGids = append(u.AdditionalGids, uint32(gid))
+				break
+			}
+		}
+	}
+
+	return u, nil
+}
+
+// readDB reads a colon separated file, such as /etc/passwd, from the first of dirs having it.
+// A missing file is returned as empty.
+func readDB(dirs []string, name string) (entries [][]string, err error) {
+	for _, dir := range dirs {
+		p, err := system.SecureJoin(dir, name)
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			entries = append(entries, strings.Split(line, ":"))
+		}
+
+		return entries, sc.Err()
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,462 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	storeIndexFilename = "images.json"
+	storeLockFilename  = "lock"
+	storeBlobsDirname  = "blobs"
+	storeLayersDirname = "layers"
+	storeTmpDirname    = "tmp"
+)
+
+// ErrImageNotFound is returned when an image isn't in the store.
+var ErrImageNotFound = errors.New("image not found")
+
+// StoredImage is an image kept in a Store.
+type StoredImage struct {
+	// Name is the name the image was imported with, in the form name:tag
+	Name string `json:"name"`
+	// ID is the digest of the image's config
+	ID string `json:"id"`
+	// Layers are the diffIDs of the image's layers, from the bottom to the top one
+	Layers []string `json:"layers"`
+	// LayerBlobs are the digests of the image's layers as stored in the image, possibly
+	// compressed, from the bottom to the top one
+	LayerBlobs []string `json:"layer_blobs,omitempty"`
+	// Created is when the image was imported
+	Created time.Time `json:"created"`
+}
+
+// Store keeps images and their layers in a root dir. Image configs and layers, as stored in the
+// images, are kept as blobs addressed by their digests, and each layer is unpacked once, keyed
+// by its diffID, so that it can be shared by all the images and boxes using it as an overlay
+// lowerdir.
+type Store struct {
+	root string
+}
+
+// NewStore returns a store kept in the given root dir, which is created on first use.
+func NewStore(root string) *Store {
+	return &Store{root: root}
+}
+
+// Import imports the image in src, either an OCI image layout or a docker save tarball, with
+// the given name, replacing any image with the same name. ref selects the image in src if there
+// are several. Layers already in the store are not unpacked again.
+func (s *Store) Import(src, ref, name string) (si StoredImage, err error) {
+	name = NormalizeName(name)
+
+	img, err := Open(src, ref)
+	if err != nil {
+		return si, fmt.Errorf("opening image: %s", err)
+	}
+	defer img.Close()
+
+	unlock, err := s.lock(unix.LOCK_EX)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	si = StoredImage{Name: name, ID: img.ID(), Created: time.Now()}
+	if err = s.writeBlob(si.ID, img.configBlob); err != nil {
+		return si, fmt.Errorf("storing image config: %s", err)
+	}
+
+	for i, l := range img.Layers {
+		digest, diffID, err := s.importLayer(img, l)
+		if err != nil {
+			return si, fmt.Errorf("importing layer %d: %s", i, err)
+		}
+		si.LayerBlobs = append(si.LayerBlobs, digest)
+		si.Layers = append(si.Layers, diffID)
+	}
+
+	images, err := s.load()
+	if err != nil {
+		return
+	}
+	images[name] = si
+
+	return si, s.save(images)
+}
+
+// Get returns the image with the given name.
+func (s *Store) Get(name string) (si StoredImage, err error) {
+	images, err := s.load()
+	if err != nil {
+		return
+	}
+
+	si, ok := images[NormalizeName(name)]
+	if !ok {
+		return si, fmt.Errorf("%w: %s", ErrImageNotFound, name)
+	}
+
+	return si, nil
+}
+
+// List returns all the images in the store, sorted by name.
+func (s *Store) List() ([]StoredImage, error) {
+	images, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]StoredImage, 0, len(images))
+	for _, si := range images {
+		list = append(list, si)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list, nil
+}
+
+// Remove removes the image with the given name from the store. Its blobs and layers are only
+// removed by Prune, once they are no longer used.
+func (s *Store) Remove(name string) error {
+	unlock, err := s.lock(unix.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	images, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	name = NormalizeName(name)
+	if _, ok := images[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrImageNotFound, name)
+	}
+	delete(images, name)
+
+	return s.save(images)
+}
+
+// Config returns the config of the image with the given name.
+func (s *Store) Config(name string) (cfg Config, err error) {
+	si, err := s.Get(name)
+	if err != nil {
+		return
+	}
+
+	b, err := ioutil.ReadFile(s.blobPath(si.ID))
+	if err != nil {
+		return cfg, fmt.Errorf("reading image config: %s", err)
+	}
+
+	return cfg, json.Unmarshal(b, &cfg)
+}
+
+// LayerDirs returns the dirs of the layers of the image with the given name, from the bottom
+// to the top one.
+func (s *Store) LayerDirs(name string) ([]string, error) {
+	si, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, 0, len(si.Layers))
+	for _, diffID := range si.Layers {
+		dirs = append(dirs, s.layerPath(diffID))
+	}
+
+	return dirs, nil
+}
+
+// Prune removes the blobs and layers which are not used by any image in the store, nor are in
+// the list of layer dirs in use returned by inUse, returning the removed ones. inUse is called
+// with the store locked, so that layers can't be taken into use meanwhile by holding RLock.
+func (s *Store) Prune(inUse func() ([]string, error)) (removed []string, err error) {
+	unlock, err := s.lock(unix.LOCK_EX)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	images, err := s.load()
+	if err != nil {
+		return
+	}
+	dirs, err := inUse()
+	if err != nil {
+		return
+	}
+
+	used := map[string]bool{}
+	for _, dir := range dirs {
+		used[filepath.Clean(dir)] = true
+	}
+	for _, si := range images {
+		used[s.blobPath(si.ID)] = true
+		for _, digest := range si.LayerBlobs {
+			used[s.blobPath(digest)] = true
+		}
+		for _, diffID := range si.Layers {
+			used[s.layerPath(diffID)] = true
+		}
+	}
+
+	for _, dir := range []string{storeBlobsDirname, storeLayersDirname} {
+		paths, err := filepath.Glob(filepath.Join(s.root, dir, "*", "*"))
+		if err != nil {
+			return removed, err
+		}
+
+		for _, p := range paths {
+			if used[p] {
+				continue
+			}
+			if err = os.RemoveAll(p); err != nil {
+				return removed, err
+			}
+			removed = append(removed, p)
+		}
+	}
+
+	// leftovers of interrupted imports
+	return removed, os.RemoveAll(filepath.Join(s.root, storeTmpDirname))
+}
+
+// RLock takes a shared lock on the store, shared by all processes using it, returning the func
+// to release it. Layers taken into use while holding it are safe from a concurrent Prune, as
+// long as they are reported in use by then.
+func (s *Store) RLock() (unlock func(), err error) {
+	return s.lock(unix.LOCK_SH)
+}
+
+// importLayer stores the blob of the given layer and unpacks it, unless already in the store,
+// returning the digest of the blob and the layer's diffID.
+func (s *Store) importLayer(img *Image, l Layer) (digest, diffID string, err error) {
+	if digest, err = s.importBlob(img, l); err != nil {
+		return
+	}
+
+	if l.DiffID != "" {
+		if _, err = os.Stat(s.layerPath(l.DiffID)); err == nil {
+			return digest, l.DiffID, nil
+		}
+	}
+
+	tmpDir := filepath.Join(s.root, storeTmpDirname)
+	if err = os.MkdirAll(tmpDir, 0700); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempDir(tmpDir, "layer")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmp)
+	if err = os.Chmod(tmp, 0755); err != nil {
+		return
+	}
+
+	f, err := os.Open(s.blobPath(digest))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	drd, err := decompress(f)
+	if err != nil {
+		return digest, "", fmt.Errorf("decompressing layer: %s", err)
+	}
+	defer drd.Close()
+
+	var rd io.Reader = drd
+	if l.DiffID != "" {
+		if rd, err = verify(drd, l.DiffID); err != nil {
+			return
+		}
+	}
+
+	h := sha256.New()
+	if err = ApplyLayer(tmp, io.TeeReader(rd, h), true); err != nil {
+		return
+	}
+
+	diffID = l.DiffID
+	if diffID == "" {
+		diffID = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	}
+
+	dst := s.layerPath(diffID)
+	if _, err = os.Stat(dst); err == nil {
+		return digest, diffID, nil
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return
+	}
+
+	return digest, diffID, os.Rename(tmp, dst)
+}
+
+// importBlob stores the given layer as stored in the image, unless already in the store,
+// returning its digest. The digest of layers of docker save tarballs is only known once read.
+func (s *Store) importBlob(img *Image, l Layer) (digest string, err error) {
+	if l.Digest != "" {
+		if _, err = os.Stat(s.blobPath(l.Digest)); err == nil {
+			return l.Digest, nil
+		}
+	}
+
+	src, err := img.src.open(l.path)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	var rd io.Reader = src
+	if l.Digest != "" {
+		if rd, err = verify(src, l.Digest); err != nil {
+			return
+		}
+	}
+
+	tmpDir := filepath.Join(s.root, storeTmpDirname)
+	if err = os.MkdirAll(tmpDir, 0700); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(tmpDir, "blob")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), rd)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+
+	digest = l.Digest
+	if digest == "" {
+		digest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	}
+
+	dst := s.blobPath(digest)
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return
+	}
+
+	return digest, os.Rename(tmp.Name(), dst)
+}
+
+func (s *Store) writeBlob(digest string, b []byte) error {
+	p := s.blobPath(digest)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p, b)
+}
+
+func (s *Store) blobPath(digest string) string {
+	return filepath.Join(s.root, storeBlobsDirname, strings.Replace(digest, ":", "/", 1))
+}
+
+func (s *Store) layerPath(diffID string) string {
+	return filepath.Join(s.root, storeLayersDirname, strings.Replace(diffID, ":", "/", 1))
+}
+
+func (s *Store) load() (images map[string]StoredImage, err error) {
+	images = map[string]StoredImage{}
+
+	b, err := ioutil.ReadFile(filepath.Join(s.root, storeIndexFilename))
+	if os.IsNotExist(err) {
+		return images, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading images: %s", err)
+	}
+
+	if err = json.Unmarshal(b, &images); err != nil {
+		return nil, fmt.Errorf("parsing images: %s", err)
+	}
+
+	return images, nil
+}
+
+func (s *Store) save(images map[string]StoredImage) error {
+	b, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(s.root, storeIndexFilename), b)
+}
+
+// lock takes a lock on the store, shared by all processes using it, either LOCK_EX or LOCK_SH.
+func (s *Store) lock(how int) (unlock func(), err error) {
+	if err = os.MkdirAll(s.root, 0755); err != nil {
+		return nil, fmt.Errorf("creating store dir: %s", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.root, storeLockFilename), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening store lock: %s", err)
+	}
+
+	if err = unix.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking store: %s", err)
+	}
+
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(b)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// NormalizeName returns the given image name with the latest tag if it has none.
+func NormalizeName(name string) string {
+	if i := strings.LastIndex(name, ":"); i == -1 || strings.Contains(name[i:], "/") {
+		return name + ":latest"
+	}
+
+	return name
+}
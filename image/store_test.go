@@ -0,0 +1,95 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func layersInUse(dirs ...string) func() ([]string, error) {
+	return func() ([]string, error) {
+		return dirs, nil
+	}
+}
+
+func TestStore(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating overlay whiteouts requires root")
+	}
+
+	tmp, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	layout := filepath.Join(tmp, "layout")
+	writeOCILayout(t, layout)
+	tarball := filepath.Join(tmp, "image.tar")
+	writeDockerSave(t, tarball)
+
+	s := NewStore(filepath.Join(tmp, "store"))
+	a, err := s.Import(layout, "", "a")
+	if err != nil {
+		t.Fatalf("importing layout: %s", err)
+	}
+	b, err := s.Import(tarball, "", "b:1")
+	if err != nil {
+		t.Fatalf("importing tarball: %s", err)
+	}
+
+	if a.Name != "a:latest" || b.Name != "b:1" {
+		t.Errorf("unexpected names %q and %q", a.Name, b.Name)
+	}
+	if !reflect.DeepEqual(a.Layers, b.Layers) {
+		t.Errorf("expected the same layers, got %v and %v", a.Layers, b.Layers)
+	}
+
+	if len(b.LayerBlobs) != len(b.Layers) {
+		t.Fatalf("expected a blob for each layer, got %v", b.LayerBlobs)
+	}
+	for _, digest := range append(a.LayerBlobs, b.LayerBlobs...) {
+		if _, err = os.Stat(s.blobPath(digest)); err != nil {
+			t.Errorf("expected the layer blob to be stored: %s", err)
+		}
+	}
+
+	dirs, err := s.LayerDirs("b:1")
+	if err != nil {
+		t.Fatalf("getting layer dirs: %s", err)
+	}
+	fi, err := os.Lstat(filepath.Join(dirs[1], "x"))
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		t.Errorf("expected an overlay whiteout, got %v, %v", fi, err)
+	}
+
+	if err = s.Remove("a"); err != nil {
+		t.Fatalf("removing image: %s", err)
+	}
+	if _, err = s.Get("a"); err == nil {
+		t.Error("expected removed image to be missing")
+	}
+
+	// only the compressed layer blobs of the layout are no longer used
+	removed, err := s.Prune(layersInUse())
+	if err != nil || len(removed) != len(a.LayerBlobs) {
+		t.Errorf("expected the blobs %v to be pruned, got %v, %v", a.LayerBlobs, removed, err)
+	}
+
+	if err = s.Remove("b:1"); err != nil {
+		t.Fatalf("removing image: %s", err)
+	}
+	removed, err = s.Prune(layersInUse(dirs[:1]...))
+	if err != nil {
+		t.Fatalf("pruning: %s", err)
+	}
+	// the config, the layer blobs and the unused layer
+	if len(removed) != 4 {
+		t.Errorf("expected 4 paths to be pruned, got %v", removed)
+	}
+	if _, err = os.Stat(dirs[0]); err != nil {
+		t.Errorf("expected layer in use to be kept, got %s", err)
+	}
+}
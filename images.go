@@ -0,0 +1,123 @@
+package box
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cprates/box/image"
+	"github.com/cprates/box/spec"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Images returns the image store used by the manager.
+func (m *manager) Images() *image.Store {
+	return m.images
+}
+
+// rootLayersFilename is the file, in the box dir, with the layers of the box's rootfs, written
+// as soon as the box is created, so that they are safe from PruneImages
+const rootLayersFilename = "root_layers.json"
+
+// PruneImages removes the blobs and layers in the image store which are used neither by its
+// images nor by any box, returning the removed ones.
+func (m *manager) PruneImages() (removed []string, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.images.Prune(m.layersInUse)
+}
+
+// layersInUse returns the rootfs layers of all the boxes. Boxes whose layers can't be read are
+// skipped, reporting them.
+func (m *manager) layersInUse() (layers []string, err error) {
+	entries, err := ioutil.ReadDir(m.workdir)
+	if err != nil {
+		return nil, fmt.Errorf("listing boxes: %s", err)
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		boxLayers, err := m.rootLayers(e.Name())
+		if err != nil {
+			log.Warnf("skipping box %q while looking for layers in use: %s", e.Name(), err)
+			continue
+		}
+		layers = append(layers, boxLayers...)
+	}
+
+	return layers, nil
+}
+
+// rootLayers returns the layers of the rootfs of the box with the given name, recorded when it
+// was created, or in its state for boxes created before they were recorded.
+func (m *manager) rootLayers(name string) (layers []string, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(m.workdir, name, rootLayersFilename))
+	if err == nil {
+		err = json.Unmarshal(b, &layers)
+		return
+	}
+	if !os.IsNotExist(err) {
+		return
+	}
+
+	state, err := m.loadStateFromName(name)
+	if err != nil {
+		return nil, fmt.Errorf("loading state: %s", err)
+	}
+
+	return state.BoxConfig.RootFsLowerdirs, nil
+}
+
+// recordRootLayers records the layers of the rootfs of a box in its dir.
+func recordRootLayers(boxDir string, s *spec.Spec) error {
+	if s.Root == nil || len(s.Root.Layers) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(s.Root.Layers)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(boxDir, rootLayersFilename), b, 0644)
+}
+
+// resolveRootImage returns the given spec with the image of its root, if any, replaced by the
+// image's layers in the image store. The store is kept locked, so that the layers can't be
+// pruned, until the returned func is called, once they are recorded in the box dir.
+func (m *manager) resolveRootImage(s *spec.Spec) (resolved *spec.Spec, unlock func(), err error) {
+	unlock = func() {}
+	if s.Root == nil || s.Root.Image == "" {
+		return s, unlock, nil
+	}
+
+	unlockStore, err := m.images.RLock()
+	if err != nil {
+		return nil, nil, fmt.Errorf("locking image store: %s", err)
+	}
+	once := sync.Once{}
+	unlock = func() { once.Do(unlockStore) }
+
+	layers, err := m.images.LayerDirs(s.Root.Image)
+	if err != nil {
+		unlock()
+		return nil, nil, fmt.Errorf("resolving root image: %w", err)
+	}
+
+	root := *s.Root
+	root.Image = ""
+	root.Layers = layers
+	r := *s
+	r.Root = &root
+
+	return &r, unlock, nil
+}
@@ -0,0 +1,48 @@
+package box
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLayersInUse(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	files := map[string]string{
+		filepath.Join("recorded", rootLayersFilename): `["/l/1", "/l/2"]`,
+		filepath.Join("old", stateFilename):           `{"BoxConfig": {"RootFsLowerdirs": ["/l/3"]}}`,
+		filepath.Join("broken", stateFilename):        `{"BoxConfig": `,
+		filepath.Join(imagesDirname, "lock"):          ``,
+	}
+	for name, content := range files {
+		p := filepath.Join(workdir, name)
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a box still being created by another process
+	if err = os.Mkdir(filepath.Join(workdir, "creating"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &manager{workdir: workdir}
+	layers, err := m.layersInUse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// boxes are listed by name
+	expects := []string{"/l/3", "/l/1", "/l/2"}
+	if !reflect.DeepEqual(layers, expects) {
+		t.Errorf("expects layers %v, got %v", expects, layers)
+	}
+}
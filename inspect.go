@@ -0,0 +1,197 @@
+package box
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Box statuses.
+const (
+	// StatusCreated is the status of a box created but not yet started
+	StatusCreated = "created"
+	// StatusRunning is the status of a box whose entry point is running
+	StatusRunning = "running"
+	// StatusStopped is the status of a box whose process is gone
+	StatusStopped = "stopped"
+)
+
+// Info describes a box, as returned by Interface.Inspect.
+type Info struct {
+	Name   string
+	Status string
+	PID    int
+	// ExitCode is the exit code of stopped boxes, only known for boxes created with a shim
+	ExitCode int `json:",omitempty"`
+	RootFs   string
+	Overlay  bool
+	// DiskUsage is the space, in bytes, taken by the changes done by the box to its rootfs, i.e.
+	// its overlay's upper layer, or by its whole rootfs if it has no overlay
+	DiskUsage int64
+	// DiskQuota is the max space, in bytes, of the box's changes to its rootfs, 0 if unlimited
+	DiskQuota int64 `json:",omitempty"`
+	// TmpUsage is the space, in bytes, used by the box's /tmp, only known while it is alive
+	TmpUsage int64    `json:",omitempty"`
+	Volumes  []string `json:",omitempty"`
+}
+
+// Stats is the usage of the disk space available to a box, as returned by Interface.Stats.
+type Stats struct {
+	Name string
+	// DiskUsage is the space, in bytes, taken by the changes done by the box to its rootfs, i.e.
+	// its overlay's upper layer, or by its whole rootfs if it has no overlay
+	DiskUsage int64
+	// DiskQuota is the max space, in bytes, of the box's changes to its rootfs, 0 if unlimited
+	DiskQuota int64 `json:",omitempty"`
+	// TmpUsage and TmpSize are the space used and the size, in bytes, of the box's /tmp, and
+	// ShmUsage and ShmSize the ones of its /dev/shm, only known while it is alive
+	TmpUsage int64 `json:",omitempty"`
+	TmpSize  int64 `json:",omitempty"`
+	ShmUsage int64 `json:",omitempty"`
+	ShmSize  int64 `json:",omitempty"`
+}
+
+// Inspect returns the description of the box with the given name.
+func (m *manager) Inspect(name string) (info Info, err error) {
+	state, err := m.loadStateFromName(name)
+	if err != nil {
+		return info, fmt.Errorf("unable to load state: %s", err)
+	}
+
+	cfg := state.BoxConfig
+	info = Info{
+		Name:      cfg.Name,
+		Status:    StatusStopped,
+		PID:       state.BoxPID,
+		ExitCode:  state.ExitCode,
+		RootFs:    cfg.RootFs,
+		Overlay:   cfg.Overlay,
+		DiskQuota: cfg.DiskQuota,
+		Volumes:   cfg.Volumes,
+	}
+
+	if boxAlive(state) {
+		info.Status = StatusRunning
+		if bootstrapping(state.BoxPID) {
+			info.Status = StatusCreated
+		}
+	}
+
+	stats, err := boxStats(state)
+	if err != nil {
+		return
+	}
+	info.DiskUsage = stats.DiskUsage
+	info.TmpUsage = stats.TmpUsage
+
+	return info, nil
+}
+
+// Stats returns the disk usage of the box with the given name.
+func (m *manager) Stats(name string) (stats Stats, err error) {
+	state, err := m.loadStateFromName(name)
+	if err != nil {
+		return stats, fmt.Errorf("unable to load state: %s", err)
+	}
+
+	return boxStats(state)
+}
+
+func boxStats(s *state) (stats Stats, err error) {
+	cfg := s.BoxConfig
+	stats = Stats{Name: cfg.Name, DiskQuota: cfg.DiskQuota}
+
+	if boxAlive(s) {
+		root := fmt.Sprintf("/proc/%d/root", s.BoxPID)
+		if stats.TmpUsage, stats.TmpSize, err = fsUsage(root + "/tmp"); err != nil {
+			return stats, fmt.Errorf("getting /tmp usage: %s", err)
+		}
+		if stats.ShmUsage, stats.ShmSize, err = fsUsage(root + "/dev/shm"); err != nil {
+			return stats, fmt.Errorf("getting /dev/shm usage: %s", err)
+		}
+	}
+
+	switch {
+	case cfg.Overlay:
+		stats.DiskUsage, err = diskUsage(cfg.RootFsUpperdir)
+	case cfg.RootFsFile == "":
+		stats.DiskUsage, err = diskUsage(cfg.RootFs)
+	}
+	if err != nil {
+		return stats, fmt.Errorf("getting disk usage: %s", err)
+	}
+
+	return stats, nil
+}
+
+// fsUsage returns the space used and the size, in bytes, of the filesystem of path.
+func fsUsage(path string) (used, size int64, err error) {
+	var st unix.Statfs_t
+	if err = unix.Statfs(path, &st); err != nil {
+		return
+	}
+
+	return int64(st.Blocks-st.Bfree) * st.Bsize, int64(st.Blocks) * st.Bsize, nil
+}
+
+// bootstrapping returns whether the process with the given pid is still the box's bootstrap,
+// waiting to be started, rather than its entry point.
+func bootstrapping(pid int) bool {
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+
+	args := bytes.Split(cmdline, []byte{0})
+	return len(args) > 1 && string(args[0]) == "/proc/self/exe" && string(args[1]) == "bootstrap"
+}
+
+// diskUsage returns the space, in bytes, taken by the files in the tree rooted at path, like
+// du -x, i.e. skipping other filesystems mounted in it, such as volumes.
+func diskUsage(path string) (usage int64, err error) {
+	var rootStat unix.Stat_t
+	if err = unix.Stat(path, &rootStat); err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return
+	}
+
+	seen := map[uint64]bool{}
+	err = filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		if uint64(st.Dev) != uint64(rootStat.Dev) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// hard links take space only once
+		if st.Nlink > 1 && !fi.IsDir() {
+			if seen[st.Ino] {
+				return nil
+			}
+			seen[st.Ino] = true
+		}
+		usage += st.Blocks * 512
+
+		return nil
+	})
+
+	return
+}
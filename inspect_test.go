@@ -0,0 +1,184 @@
+package box
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cprates/box/system"
+
+	"golang.org/x/sys/unix"
+)
+
+func blocksSize(t *testing.T, paths ...string) (size int64) {
+	for _, p := range paths {
+		var st unix.Stat_t
+		if err := unix.Lstat(p, &st); err != nil {
+			t.Fatal(err)
+		}
+		size += st.Blocks * 512
+	}
+
+	return
+}
+
+func TestDiskUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inspect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(file, make([]byte, 64<<10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// hard links are only counted once
+	if err = os.Link(file, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := diskUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := blocksSize(t, dir, file); usage != expect {
+		t.Errorf("expects usage %d, got %d", expect, usage)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+
+	// other filesystems mounted in the tree, e.g. volumes, aren't counted
+	mnt := filepath.Join(dir, "mnt")
+	if err = os.Mkdir(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = unix.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Unmount(mnt, unix.MNT_DETACH)
+	if err = ioutil.WriteFile(filepath.Join(mnt, "big"), make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if usage, err = diskUsage(dir); err != nil {
+		t.Fatal(err)
+	}
+	if expect := blocksSize(t, dir, file); usage != expect {
+		t.Errorf("expects usage %d without the mount, got %d", expect, usage)
+	}
+
+	if usage, err = diskUsage(filepath.Join(dir, "nope")); err != nil || usage != 0 {
+		t.Errorf("expects no usage for a missing dir, got %d, %v", usage, err)
+	}
+}
+
+func writeTestState(t *testing.T, workdir string, s *state) {
+	boxDir := filepath.Join(workdir, s.BoxConfig.Name)
+	if err := os.MkdirAll(boxDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(boxDir, stateFilename), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "inspect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	upper := filepath.Join(workdir, "upper")
+	if err = os.Mkdir(upper, 0755); err != nil {
+		t.Fatal(err)
+	}
+	changed := filepath.Join(upper, "changed")
+	if err = ioutil.WriteFile(changed, make([]byte, 16<<10), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	self, err := system.Stat(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := &state{
+		BoxPID:                 os.Getpid(),
+		ProcessStartClockTicks: self.StartTime + 1,
+		Exited:                 true,
+		ExitCode:               3,
+		BoxConfig: config{
+			Name:           "stopped",
+			RootFs:         "/some/rootfs",
+			Overlay:        true,
+			RootFsUpperdir: upper,
+			DiskQuota:      1 << 20,
+			Volumes:        []string{"data"},
+		},
+	}
+	writeTestState(t, workdir, stopped)
+
+	m := &manager{workdir: workdir}
+	info, err := m.Inspect("stopped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := Info{
+		Name:      "stopped",
+		Status:    StatusStopped,
+		PID:       os.Getpid(),
+		ExitCode:  3,
+		RootFs:    "/some/rootfs",
+		Overlay:   true,
+		DiskUsage: blocksSize(t, upper, changed),
+		DiskQuota: 1 << 20,
+		Volumes:   []string{"data"},
+	}
+	if !reflect.DeepEqual(info, expect) {
+		t.Errorf("expects info %+v, got %+v", expect, info)
+	}
+
+	stats, err := m.Stats("stopped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStats := Stats{Name: "stopped", DiskUsage: expect.DiskUsage, DiskQuota: 1 << 20}
+	if stats != expectStats {
+		t.Errorf("expects stats %+v, got %+v", expectStats, stats)
+	}
+
+	// this process plays the running box, whose /tmp and /dev/shm are the host's
+	if _, err = os.Stat("/dev/shm"); err != nil {
+		t.Skip("no /dev/shm")
+	}
+	running := *stopped
+	running.ProcessStartClockTicks = self.StartTime
+	running.Exited = false
+	running.BoxConfig.Name = "running"
+	writeTestState(t, workdir, &running)
+
+	if info, err = m.Inspect("running"); err != nil {
+		t.Fatal(err)
+	}
+	if info.Status != StatusRunning {
+		t.Errorf("expects status %s, got %s", StatusRunning, info.Status)
+	}
+	if stats, err = m.Stats("running"); err != nil {
+		t.Fatal(err)
+	}
+	if stats.TmpSize == 0 || stats.ShmSize == 0 || stats.TmpUsage > stats.TmpSize ||
+		stats.ShmUsage > stats.ShmSize {
+		t.Errorf("expects /tmp and /dev/shm usage and sizes, got %+v", stats)
+	}
+}
@@ -0,0 +1,59 @@
+// Package nettest provides helpers for tests setting up network resources, such as links, which
+// are isolated in throwaway network namespaces.
+package nettest
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// WithHostNs runs f with the calling thread in a throwaway NS standing for the host, which is
+// gone once f returns. The test is skipped unless run as root.
+func WithHostNs(t *testing.T, f func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+
+	host, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	defer func() {
+		if err := netns.Set(orig); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	f()
+}
+
+// AddLink adds a veth with the given name, tagged with the given alias if any, to the current
+// NS. Its peer is named after it.
+func AddLink(t *testing.T, name, alias string) {
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	link := &netlink.Veth{LinkAttrs: la, PeerName: name + "p"}
+	if err := netlink.LinkAdd(link); err != nil {
+		t.Fatal(err)
+	}
+	if alias == "" {
+		return
+	}
+	if err := netlink.LinkSetAlias(link, alias); err != nil {
+		t.Fatal(err)
+	}
+}
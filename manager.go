@@ -3,12 +3,20 @@ package box
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/cprates/box/boxlog"
+	"github.com/cprates/box/boxnet"
+	"github.com/cprates/box/image"
 	"github.com/cprates/box/spec"
 	"github.com/cprates/box/system"
+	"github.com/cprates/box/volume"
 )
 
 // Interface defines the interface through which we can manage Boxes.
@@ -17,28 +25,73 @@ type Interface interface {
 	Run(name string, io ProcessIO, spec *spec.Spec, opts ...BoxOption) (err error)
 	Load(name string, io ProcessIO) (box Box, err error)
 	Destroy(name string) (err error)
+	Inspect(name string) (info Info, err error)
+	Stats(name string) (stats Stats, err error)
+	Wait(name string) (exitCode int, err error)
+	Logs(name string, stdout, stderr io.Writer, opts boxlog.ReadOptions) (err error)
+	Attach(name string, io ProcessIO, opts AttachOptions) (err error)
+	Export(name string, w io.Writer, opts ExportOptions) (err error)
+	Commit(name, layout, ref string) (digest string, err error)
+	CopyFrom(name, src string, w io.Writer) (err error)
+	CopyTo(name, dst string, r io.Reader) (err error)
+	Images() *image.Store
+	PruneImages() (removed []string, err error)
+	Volumes() *volume.Store
+	NetGC() (removed []string, err error)
+	NetCheck(name string) (err error)
+	Networks() *boxnet.NetworkStore
+	RemoveNetwork(name string) (err error)
+	Ports(name string) (ports []boxnet.PublishedPort, err error)
 }
 
 type manager struct {
-	workdir string
-	lock    sync.Mutex
+	workdir  string
+	lock     sync.Mutex
+	images   *image.Store
+	volumes  *volume.Store
+	ipam     *boxnet.IPAM
+	networks *boxnet.NetworkStore
 }
 
 const execFifoFilename = "exec.fifo"
 
+// imagesDirname is the default dir, in the workdir, of the image store
+const imagesDirname = ".images"
+
+// volumesDirname is the dir, in the workdir, of the volume store
+const volumesDirname = ".volumes"
+
+// ipamDirname is the dir, in the workdir, of the IPAM leases
+const ipamDirname = ".ipam"
+
+// networksDirname is the dir, in the workdir, of the network store
+const networksDirname = ".networks"
+
 const stdioFdCount = 3
 
 var ErrBoxExists = errors.New("box exists")
 
+var ErrInvalidName = errors.New("invalid box name")
+
 var _ Interface = (*manager)(nil)
 
 // New returns a new ready to use Box manager which will use the given workdir to store and load
 // Boxes. The given workdir must be an absolute path.
-func New(workdir string) Interface {
-	return &manager{
-		workdir: workdir,
-		lock:    sync.Mutex{},
+func New(workdir string, opts ...Option) Interface {
+	m := &manager{
+		workdir:  workdir,
+		lock:     sync.Mutex{},
+		images:   image.NewStore(filepath.Join(workdir, imagesDirname)),
+		volumes:  volume.NewStore(filepath.Join(workdir, volumesDirname)),
+		ipam:     boxnet.NewIPAM(filepath.Join(workdir, ipamDirname)),
+		networks: boxnet.NewNetworkStore(filepath.Join(workdir, networksDirname)),
+	}
+
+	for _, opt := range opts {
+		opt(m)
 	}
+
+	return m
 }
 
 // Load loads an existing box with the given name from the configured workdir.
@@ -78,6 +131,16 @@ func (m *manager) Create(
 	box Box,
 	err error,
 ) {
+	if err = validateName(name); err != nil {
+		return
+	}
+
+	spec, unlockImages, err := m.resolveRootImage(spec)
+	if err != nil {
+		return
+	}
+	defer unlockImages()
+
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	boxDir := path.Join(m.workdir, name)
@@ -102,10 +165,32 @@ func (m *manager) Create(
 		}
 	}()
 
+	if err = recordRootLayers(boxDir, spec); err != nil {
+		err = fmt.Errorf("recording rootfs layers: %s", err)
+		return
+	}
+
+	spec, volumes, err := m.acquireVolumes(name, spec)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = m.releaseVolumes(name, volumes)
+		}
+	}()
+
+	defer func() {
+		if err != nil {
+			_ = m.ipam.Release(name)
+		}
+	}()
+
 	b := newBox()
+	opts = append(opts, withVolumes(volumes), withNetStores(m.networks, m.ipam))
 	err = b.create(name, boxDir, io, spec, opts...)
 	if err != nil {
-		err = fmt.Errorf("while creating box %q: %s", boxDir, err)
+		err = fmt.Errorf("while creating box %q: %w", boxDir, err)
 		return
 	}
 
@@ -123,6 +208,16 @@ func (m *manager) Run(
 ) (
 	err error,
 ) {
+	if err = validateName(name); err != nil {
+		return
+	}
+
+	spec, unlockImages, err := m.resolveRootImage(spec)
+	if err != nil {
+		return
+	}
+	defer unlockImages()
+
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
@@ -148,10 +243,35 @@ func (m *manager) Run(
 		}
 	}()
 
+	if err = recordRootLayers(boxDir, spec); err != nil {
+		err = fmt.Errorf("recording rootfs layers: %s", err)
+		return
+	}
+	// the box runs until it's terminated, so the store isn't kept locked meanwhile
+	unlockImages()
+
+	spec, volumes, err := m.acquireVolumes(name, spec)
+	if err != nil {
+		return
+	}
+	// the box is gone once run returns, whether it failed or not
+	defer func() {
+		if e := m.releaseVolumes(name, volumes); e != nil && err == nil {
+			err = fmt.Errorf("releasing volumes: %s", e)
+		}
+	}()
+
+	defer func() {
+		if e := m.ipam.Release(name); e != nil && err == nil {
+			err = fmt.Errorf("releasing addresses: %s", e)
+		}
+	}()
+
 	b := newBox()
+	opts = append(opts, withVolumes(volumes), withNetStores(m.networks, m.ipam))
 	err = b.run(name, boxDir, io, spec, opts...)
 	if err != nil {
-		err = fmt.Errorf("while creating box %q: %s", boxDir, err)
+		err = fmt.Errorf("while creating box %q: %w", boxDir, err)
 		return
 	}
 
@@ -167,8 +287,28 @@ func (m *manager) Destroy(name string) error {
 		return fmt.Errorf("unable to load state: %s", err)
 	}
 
+	if err = m.checkNetDependents(name); err != nil {
+		return err
+	}
+
 	stat, err := system.Stat(state.BoxPID)
 	if err != nil || stat.StartTime != state.ProcessStartClockTicks {
+		if err = releaseNet(*state); err != nil {
+			return fmt.Errorf("releasing network: %s", err)
+		}
+
+		if err = releaseRootFs(state.BoxConfig); err != nil {
+			return fmt.Errorf("releasing rootfs: %s", err)
+		}
+
+		if err = m.releaseVolumes(name, state.BoxConfig.Volumes); err != nil {
+			return fmt.Errorf("releasing volumes: %s", err)
+		}
+
+		if err = m.ipam.Release(name); err != nil {
+			return fmt.Errorf("releasing addresses: %s", err)
+		}
+
 		boxWd := path.Join(m.workdir, state.BoxConfig.Name)
 		err = os.RemoveAll(boxWd)
 		if err != nil {
@@ -191,6 +331,27 @@ func (m *manager) Destroy(name string) error {
 
 	// TODO: add a timeout
 	<-awaitProcessExit(state.BoxPID, make(chan struct{}))
+	// wait for the shim to record the exit status, otherwise it could race with the removal of
+	// the box dir
+	for shimAlive(state) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err = releaseNet(*state); err != nil {
+		return fmt.Errorf("releasing network: %s", err)
+	}
+
+	if err = releaseRootFs(state.BoxConfig); err != nil {
+		return fmt.Errorf("releasing rootfs: %s", err)
+	}
+
+	if err = m.releaseVolumes(name, state.BoxConfig.Volumes); err != nil {
+		return fmt.Errorf("releasing volumes: %s", err)
+	}
+
+	if err = m.ipam.Release(name); err != nil {
+		return fmt.Errorf("releasing addresses: %s", err)
+	}
 
 	boxWd := path.Join(m.workdir, state.BoxConfig.Name)
 	err = os.RemoveAll(boxWd)
@@ -200,3 +361,117 @@ func (m *manager) Destroy(name string) error {
 
 	return nil
 }
+
+// Wait blocks until the box with the given name exits, returning its exit code. The exit code
+// is only known for boxes created with a shim.
+func (m *manager) Wait(name string) (exitCode int, err error) {
+	for {
+		state, err := m.loadStateFromName(name)
+		if err != nil {
+			return -1, fmt.Errorf("unable to load state: %s", err)
+		}
+
+		if state.Exited {
+			if state.Error != nil {
+				return state.ExitCode, fmt.Errorf("starting box: %w", state.Error)
+			}
+			return state.ExitCode, nil
+		}
+
+		if !boxAlive(state) && !shimAlive(state) {
+			return -1, errors.New("box is stopped but its exit status is unknown")
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// boxAlive returns whether the process of the box with the given state is still alive.
+func boxAlive(s *state) bool {
+	return processAlive(s.BoxPID, s.ProcessStartClockTicks)
+}
+
+// shimAlive returns whether the shim owning the box with the given state, if any, is still alive.
+func shimAlive(s *state) bool {
+	return s.ShimPID != 0 && processAlive(s.ShimPID, s.ShimStartClockTicks)
+}
+
+// processAlive returns whether the process with the given PID and start time is still alive,
+// and not another one which reused its PID.
+func processAlive(pid int, startTime uint64) bool {
+	stat, err := system.Stat(pid)
+	return err == nil &&
+		stat.StartTime == startTime &&
+		stat.State != system.Zombie &&
+		stat.State != system.Dead
+}
+
+// Logs writes the log entries of the box with the given name to stdout and stderr, according to
+// their stream. When following the log, it returns once the box exits or opts.Stop is closed.
+func (m *manager) Logs(name string, stdout, stderr io.Writer, opts boxlog.ReadOptions) error {
+	state, err := m.loadStateFromName(name)
+	if err != nil {
+		return fmt.Errorf("unable to load state: %s", err)
+	}
+
+	if state.BoxConfig.LogFile == "" {
+		return errors.New("box was created without a log file")
+	}
+
+	if opts.Follow {
+		stop := make(chan struct{})
+		userStop := opts.Stop
+		opts.Stop = stop
+		go func() {
+			defer close(stop)
+			for {
+				select {
+				case <-userStop:
+					return
+				case <-time.After(100 * time.Millisecond):
+				}
+
+				s, err := m.loadStateFromName(name)
+				if err != nil || s.Exited || !boxAlive(s) {
+					return
+				}
+			}
+		}()
+	}
+
+	return boxlog.Read(state.BoxConfig.LogFile, opts, func(e boxlog.Entry) (err error) {
+		switch e.Stream {
+		case "stderr":
+			_, err = io.WriteString(stderr, e.Log)
+		default:
+			_, err = io.WriteString(stdout, e.Log)
+		}
+		return
+	})
+}
+
+// Attach connects the given io to the stdio of the box with the given name, returning when the
+// box exits, or ErrDetached if the client detaches from it. The box must have been created
+// with WithAttach.
+func (m *manager) Attach(name string, io ProcessIO, opts AttachOptions) error {
+	state, err := m.loadStateFromName(name)
+	if err != nil {
+		return fmt.Errorf("unable to load state: %s", err)
+	}
+
+	if !state.BoxConfig.Attach {
+		return errors.New("box was created without attach support")
+	}
+
+	return attach(path.Join(m.workdir, name, attachSocketFilename), io, opts)
+}
+
+// validateName checks that the given box name can be used as its dir name in the workdir,
+// where names starting with a dot are reserved for the manager's own dirs.
+func validateName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "/") {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	return nil
+}
@@ -0,0 +1,295 @@
+package box
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cprates/box/boxnet"
+)
+
+// releaseNet releases the host side network resources of the box with the given state.
+func releaseNet(s state) error {
+	return boxnet.Release(s.Net, boxnet.Tag(filepath.Dir(s.BoxConfig.StateFilePath)))
+}
+
+// resolveNetwork resolves the network the box is attached to, if any, and fills in the box's
+// netconf with the addresses allocated by the IPAM, leased to the box's name. The manager
+// releases them once the box is gone.
+func (b *boxInternal) resolveNetwork() (err error) {
+	if netConf := b.config.NetConfig; netConf != nil {
+		if err = netConf.CheckMode(); err != nil {
+			return
+		}
+		if owner := netConf.NetBox(); owner != "" {
+			return b.joinNetBox(owner)
+		}
+	}
+
+	if b.networks != nil {
+		if b.config.NetConfig, err = b.networks.Resolve(b.config.NetConfig); err != nil {
+			return
+		}
+	}
+
+	if b.ipam != nil {
+		b.config.NetConfig, err = b.ipam.Assign(b.config.NetConfig, b.config.Name)
+	}
+
+	return
+}
+
+// joinNetBox sets the box up to join the NS of the given running box, its owner, whose
+// addresses and, unless set, DNS config are used for the box's hosts and resolv.conf files.
+func (b *boxInternal) joinNetBox(owner string) error {
+	if owner == b.config.Name {
+		return errors.New("a box can't join its own network")
+	}
+
+	workdir := filepath.Dir(filepath.Dir(b.config.StateFilePath))
+	s, err := readState(filepath.Join(workdir, owner, stateFilename))
+	if err != nil {
+		return fmt.Errorf("loading state of box %q: %s", owner, err)
+	}
+	if !boxAlive(s) {
+		return fmt.Errorf("box %q isn't running", owner)
+	}
+	b.config.NetNSPID = s.BoxPID
+
+	ownerNet := s.BoxConfig.NetConfig
+	if ownerNet == nil {
+		return nil
+	}
+	if b.config.NetAddresses, err = ownerNet.Addresses(); err != nil {
+		return fmt.Errorf("getting addresses of box %q: %s", owner, err)
+	}
+	b.config.NetAddresses = append(b.config.NetAddresses, s.BoxConfig.NetAddresses...)
+
+	// the netconf may be shared with the caller
+	netConf := *b.config.NetConfig
+	if len(netConf.DNS.Nameservers) == 0 {
+		netConf.DNS.Nameservers = ownerNet.DNS.Nameservers
+		netConf.DNS.Domain = ownerNet.DNS.Domain
+		netConf.DNS.Search = ownerNet.DNS.Search
+	}
+	b.config.NetConfig = &netConf
+
+	return nil
+}
+
+// checkNetDependents returns an error if any box in the workdir joins the NS of the box with
+// the given name, which must be destroyed after them.
+func (m *manager) checkNetDependents(name string) error {
+	dependents, err := m.netDependents(name)
+	if err != nil {
+		return err
+	}
+	if len(dependents) > 0 {
+		return fmt.Errorf(
+			"box %s shares the network of box %s, destroy it first",
+			dependents[0].BoxConfig.Name, name,
+		)
+	}
+
+	return nil
+}
+
+// netDependents returns the states of the boxes in the workdir joining the NS of the box with the
+// given name. Boxes without a state yet don't hold the NS.
+func (m *manager) netDependents(name string) (dependents []*state, err error) {
+	entries, err := ioutil.ReadDir(m.workdir)
+	if err != nil {
+		return nil, fmt.Errorf("listing boxes: %s", err)
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") || e.Name() == name {
+			continue
+		}
+
+		state, err := m.loadStateFromName(e.Name())
+		if err != nil {
+			continue
+		}
+		if netConf := state.BoxConfig.NetConfig; netConf != nil && netConf.NetBox() == name {
+			dependents = append(dependents, state)
+		}
+	}
+
+	return dependents, nil
+}
+
+// applyNetResult records the addresses and DNS config set up by the box's network model, if
+// any, in its config. The DNS config of the netconf takes precedence.
+func (b *boxInternal) applyNetResult() (err error) {
+	cni := b.state.Net.CNI
+	if cni == nil {
+		return nil
+	}
+
+	if b.config.NetAddresses, err = cni.Addresses(); err != nil {
+		return err
+	}
+	dns, err := cni.DNS()
+	if err != nil {
+		return err
+	}
+
+	// the netconf may be shared with the caller
+	netConf := *b.config.NetConfig
+	if len(netConf.DNS.Nameservers) == 0 {
+		netConf.DNS.Nameservers = dns.Nameservers
+	}
+	if netConf.DNS.Domain == "" {
+		netConf.DNS.Domain = dns.Domain
+	}
+	if len(netConf.DNS.Search) == 0 {
+		netConf.DNS.Search = dns.Search
+	}
+	b.config.NetConfig = &netConf
+
+	return nil
+}
+
+// NetCheck checks that the network of the box with the given name is as set up, which is only
+// supported for boxes attached to a CNI network, running the CHECK command of its plugins.
+func (m *manager) NetCheck(name string) error {
+	state, err := m.loadStateFromName(name)
+	if err != nil {
+		return fmt.Errorf("unable to load state: %s", err)
+	}
+	if state.Net.CNI == nil {
+		return fmt.Errorf("box %q isn't attached to a CNI network", name)
+	}
+
+	return state.Net.CNI.Check()
+}
+
+// Networks returns the network store used by the manager.
+func (m *manager) Networks() *boxnet.NetworkStore {
+	return m.networks
+}
+
+// RemoveNetwork removes the network with the given name, unless some box is attached to it.
+func (m *manager) RemoveNetwork(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entries, err := ioutil.ReadDir(m.workdir)
+	if err != nil {
+		return fmt.Errorf("listing boxes: %s", err)
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		state, err := m.loadStateFromName(e.Name())
+		if err != nil {
+			// the box may still be being created by another process so, better safe than sorry
+			return fmt.Errorf("loading state of box %q: %s", e.Name(), err)
+		}
+		if netConf := state.BoxConfig.NetConfig; netConf != nil && netConf.NetworkName() == name {
+			return fmt.Errorf("network %s used by box %s", name, e.Name())
+		}
+	}
+
+	return m.networks.Remove(name)
+}
+
+// NetGC deletes the host side network resources tagged by boxes in the workdir which are no
+// longer running, nor joined by running boxes, which are leaked when a box's NS outlives it or
+// its teardown fails, such as their links and DNAT rules, along with the masquerade rules of
+// bridges not created by a network which no box uses. It returns the names of the deleted links.
+func (m *manager) NetGC() (removed []string, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	prefix := boxnet.Tag(m.workdir + "/")
+	tagged, err := boxnet.TaggedLinks(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for tag, links := range tagged {
+		name := strings.TrimPrefix(tag, prefix)
+		if !m.boxGone(name) {
+			continue
+		}
+
+		for _, link := range links {
+			if err = boxnet.DeleteLink(link, tag); err != nil {
+				return removed, fmt.Errorf("box %q: %s", name, err)
+			}
+			removed = append(removed, link)
+		}
+	}
+	sort.Strings(removed)
+
+	// the DNAT rules of published ports are tagged the same way as links
+	natTags, err := boxnet.NATTags(prefix)
+	if err != nil {
+		return removed, err
+	}
+	for _, tag := range natTags {
+		name := strings.TrimPrefix(tag, prefix)
+		if !m.boxGone(name) {
+			continue
+		}
+		if err = boxnet.DeleteNATRules(tag); err != nil {
+			return removed, fmt.Errorf("box %q: %s", name, err)
+		}
+	}
+
+	// the masquerade rules of bridges not created by a network are shared by all their boxes
+	bridgePrefix := boxnet.NATTag("", "")
+	bridgeTags, err := boxnet.NATTags(bridgePrefix)
+	if err != nil {
+		return removed, err
+	}
+	for _, tag := range bridgeTags {
+		if err = boxnet.ReleaseMasquerade(strings.TrimPrefix(tag, bridgePrefix)); err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+// createGracePeriod is how long a box without a readable state is taken as still being created,
+// by another process, since its state is only saved once its network is set up.
+const createGracePeriod = time.Minute
+
+// boxGone returns whether the box with the given name is no longer running, which includes boxes
+// whose state can't be read, unless their dir was changed within the createGracePeriod. Boxes
+// whose NS is joined by running boxes aren't gone, since the NS is still in use.
+func (m *manager) boxGone(name string) bool {
+	s, err := m.loadStateFromName(name)
+	if err == nil && boxAlive(s) {
+		return false
+	}
+	if err != nil {
+		fi, err := os.Stat(filepath.Join(m.workdir, name))
+		if err == nil && time.Since(fi.ModTime()) <= createGracePeriod {
+			return false
+		}
+	}
+
+	dependents, err := m.netDependents(name)
+	if err != nil {
+		return false
+	}
+	for _, d := range dependents {
+		if boxAlive(d) {
+			return false
+		}
+	}
+
+	return true
+}
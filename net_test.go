@@ -0,0 +1,257 @@
+package box
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cprates/box/boxnet"
+	"github.com/cprates/box/internal/nettest"
+	"github.com/cprates/box/system"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestNetGC(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "netgc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	// this process plays the running box
+	self, err := system.Stat(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := &state{
+		BoxPID:                 os.Getpid(),
+		ProcessStartClockTicks: self.StartTime,
+		BoxConfig:              config{Name: "running"},
+	}
+	writeTestState(t, workdir, running)
+	stopped := *running
+	stopped.ProcessStartClockTicks++
+	stopped.BoxConfig.Name = "stopped"
+	writeTestState(t, workdir, &stopped)
+
+	// the NS of a stopped box joined by a running box is still in use, unlike when joined by a
+	// stopped one
+	joined := stopped
+	joined.BoxConfig.Name = "joined"
+	writeTestState(t, workdir, &joined)
+	joiner := *running
+	joiner.BoxConfig.Name = "joiner"
+	joiner.BoxConfig.NetConfig = &boxnet.NetConf{Mode: boxnet.NetModeBoxPrefix + "joined"}
+	writeTestState(t, workdir, &joiner)
+	exited := stopped
+	exited.BoxConfig.Name = "exited"
+	exited.BoxConfig.NetConfig = &boxnet.NetConf{Mode: boxnet.NetModeBoxPrefix + "stopped"}
+	writeTestState(t, workdir, &exited)
+
+	// boxes without a readable state are only taken as being created for a while
+	for _, name := range []string{"creating", "broken"} {
+		dir := filepath.Join(workdir, name)
+		if err = os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, stateFilename), []byte("{"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * createGracePeriod)
+	if err = os.Chtimes(filepath.Join(workdir, "broken"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	nettest.WithHostNs(t, func() {
+		boxes := []string{"running", "stopped", "joined", "creating", "broken", "gone"}
+		for _, name := range boxes {
+			nettest.AddLink(t, name, boxnet.Tag(filepath.Join(workdir, name)))
+		}
+		// links of boxes in other workdirs are left alone
+		nettest.AddLink(t, "other", boxnet.Tag("/other/workdir/gone"))
+		// DNAT rules of published ports
+		for _, name := range []string{"running", "joined", "gone"} {
+			m := boxnet.PortMapping{HostPort: 8080, BoxPort: 80}
+			tag := boxnet.Tag(filepath.Join(workdir, name))
+			if err := boxnet.AddDNAT(m, net.ParseIP("10.88.0.2"), tag); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the masquerade rule of a bridge, not created by a network, which is gone
+		_, subnet, _ := net.ParseCIDR("10.88.0.0/16")
+		if err := boxnet.EnsureMasquerade(subnet, "gone0", boxnet.NATTag("", "gone0")); err != nil {
+			t.Fatal(err)
+		}
+
+		m := &manager{workdir: workdir}
+		removed, err := m.NetGC()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"broken", "gone", "stopped"}
+		if !reflect.DeepEqual(removed, expected) {
+			t.Errorf("expected %v to be removed, got %v", expected, removed)
+		}
+		for _, name := range []string{"running", "joined", "creating", "other"} {
+			if _, err = netlink.LinkByName(name); err != nil {
+				t.Errorf("expected link %s to be kept: %s", name, err)
+			}
+		}
+		tags, err := boxnet.NATTags(boxnet.Tag(workdir + "/"))
+		sort.Strings(tags)
+		expected = []string{
+			boxnet.Tag(filepath.Join(workdir, "joined")),
+			boxnet.Tag(filepath.Join(workdir, "running")),
+		}
+		if err != nil || !reflect.DeepEqual(tags, expected) {
+			t.Errorf("expected only the DNAT rules of %v to be kept, got %v, %v", expected, tags,
+				err)
+		}
+		if tags, err := boxnet.NATTags(boxnet.NATTag("", "")); err != nil || len(tags) != 0 {
+			t.Errorf("expected unused masquerade rule to be deleted, got %v, %v", tags, err)
+		}
+	})
+}
+
+func TestJoinNetBox(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "joinnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	// this process plays the running owner
+	self, err := system.Stat(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := &state{
+		BoxPID:                 os.Getpid(),
+		ProcessStartClockTicks: self.StartTime,
+		BoxConfig: config{
+			Name: "web",
+			NetConfig: &boxnet.NetConf{
+				Interfaces: []map[string]interface{}{
+					{
+						"type":      "veth",
+						"name":      "veth0",
+						"peer_name": "eth0",
+						"peer_ip":   "10.0.0.2/24",
+					},
+				},
+				DNS: boxnet.DNSConf{
+					Nameservers: []string{"10.0.0.1"},
+					Domain:      "web.test",
+					Search:      []string{"web.test"},
+				},
+			},
+			NetAddresses: []string{"10.88.0.5"},
+		},
+	}
+	writeTestState(t, workdir, owner)
+	stopped := *owner
+	stopped.ProcessStartClockTicks++
+	stopped.BoxConfig.Name = "stopped"
+	writeTestState(t, workdir, &stopped)
+
+	join := func(name, mode string, dns boxnet.DNSConf) (*boxInternal, error) {
+		netConf := &boxnet.NetConf{Mode: mode, DNS: dns}
+		b := &boxInternal{config: config{
+			Name:          name,
+			StateFilePath: filepath.Join(workdir, name, stateFilename),
+			NetConfig:     netConf,
+		}}
+		err := b.resolveNetwork()
+		if !reflect.DeepEqual(netConf.DNS, dns) {
+			t.Errorf("expected the given netconf to be left untouched, got %+v", netConf)
+		}
+		return b, err
+	}
+
+	b, err := join("app", "box:web", boxnet.DNSConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.config.NetNSPID != os.Getpid() {
+		t.Errorf("expected to join the NS of PID %d, got %d", os.Getpid(), b.config.NetNSPID)
+	}
+	expectAddrs := []string{"10.0.0.2", "10.88.0.5"}
+	if !reflect.DeepEqual(b.config.NetAddresses, expectAddrs) {
+		t.Errorf("expected the owner's addresses %v, got %v", expectAddrs, b.config.NetAddresses)
+	}
+	if dns := b.config.NetConfig.DNS; !reflect.DeepEqual(dns, owner.BoxConfig.NetConfig.DNS) {
+		t.Errorf("expected the owner's DNS config, got %+v", dns)
+	}
+
+	// the box's own DNS config is kept
+	ownDNS := boxnet.DNSConf{Nameservers: []string{"1.1.1.1"}}
+	if b, err = join("app", "box:web", ownDNS); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b.config.NetConfig.DNS, ownDNS) {
+		t.Errorf("expected the box's DNS config to be kept, got %+v", b.config.NetConfig.DNS)
+	}
+
+	for _, tt := range []struct {
+		name, mode, err string
+	}{
+		{"app", "box:stopped", "isn't running"},
+		{"app", "box:missing", "loading state"},
+		{"web", "box:web", "own network"},
+	} {
+		if _, err = join(tt.name, tt.mode, boxnet.DNSConf{}); err == nil ||
+			!strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s joining %s: expected error %q, got %v", tt.name, tt.mode, tt.err, err)
+		}
+	}
+}
+
+func TestDestroyNetOwner(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "joinnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	// a stopped owner, so that destroying it doesn't kill anything
+	self, err := system.Stat(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := &state{
+		BoxPID:                 os.Getpid(),
+		ProcessStartClockTicks: self.StartTime + 1,
+		BoxConfig:              config{Name: "db"},
+	}
+	writeTestState(t, workdir, owner)
+	dependent := *owner
+	dependent.BoxConfig.Name = "worker"
+	dependent.BoxConfig.NetConfig = &boxnet.NetConf{Mode: boxnet.NetModeBoxPrefix + "db"}
+	writeTestState(t, workdir, &dependent)
+
+	m := New(workdir)
+	err = m.Destroy("db")
+	if err == nil || !strings.Contains(err.Error(), "worker shares the network of box db") {
+		t.Fatalf("expected destroying the owner to be refused, got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(workdir, "db")); err != nil {
+		t.Errorf("expected the owner to be kept: %s", err)
+	}
+
+	if err = m.Destroy("worker"); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Destroy("db"); err != nil {
+		t.Errorf("expected the owner to be destroyed once its dependent is: %s", err)
+	}
+}
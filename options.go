@@ -1,6 +1,11 @@
 package box
 
-import "github.com/cprates/box/boxnet"
+import (
+	"path/filepath"
+
+	"github.com/cprates/box/boxnet"
+	"github.com/cprates/box/image"
+)
 
 type BoxOption func(*boxInternal)
 
@@ -10,3 +15,120 @@ func WithNetwork(netConf *boxnet.NetConf) BoxOption {
 		c.config.NetConfig = netConf
 	}
 }
+
+// WithConsoleSocket sets the path of a unix socket to which the box's pty master is sent when
+// the spec requests a terminal. If not set, the console is proxied through the box's ProcessIO.
+func WithConsoleSocket(path string) BoxOption {
+	return func(c *boxInternal) {
+		c.config.ConsoleSocket = path
+	}
+}
+
+// WithShim creates the box through a long-lived shim process, which becomes the parent of the
+// box, holding its stdio and reaping it once it exits. This allows the creating process to exit
+// right after the box is created, while keeping track of its exit status.
+// The shim re-executes the current binary with the argument "shim", which must call Shim.
+func WithShim() BoxOption {
+	return func(c *boxInternal) {
+		c.config.Shim = true
+	}
+}
+
+// WithLogFile logs the output of the box to the file at path, as JSON lines, instead of
+// writing it to the box's ProcessIO. If path is empty, the log is stored in the box's workdir.
+// The process owning the box must outlive it for the whole output to be logged, hence this
+// is usually used along with WithShim.
+func WithLogFile(path string) BoxOption {
+	return func(c *boxInternal) {
+		if path == "" {
+			path = filepath.Join(filepath.Dir(c.config.StateFilePath), logFilename)
+		}
+		c.config.LogFile = path
+	}
+}
+
+// WithLogRotation sets the max size in bytes of the box's log file before being rotated and
+// how many rotated files are kept. Defaults to boxlog.DefaultMaxSize and
+// boxlog.DefaultMaxFiles.
+func WithLogRotation(maxSize int64, maxFiles int) BoxOption {
+	return func(c *boxInternal) {
+		c.config.LogMaxSize = maxSize
+		c.config.LogMaxFiles = maxFiles
+	}
+}
+
+// WithAttach serves the box's stdio through a unix socket in the box's workdir, so that
+// clients can attach to it with Interface.Attach. The box's output then goes to the attached
+// clients, and to its log if configured, instead of its ProcessIO.
+func WithAttach() BoxOption {
+	return func(c *boxInternal) {
+		c.config.Attach = true
+	}
+}
+
+// WithOverlay mounts the box's rootfs as an overlay on top of the spec's rootfs, which is only
+// read, so that it can be shared by several boxes. The box's changes are discarded when it is
+// destroyed unless keepUpper is set, in which case they are moved to the .layers dir in the
+// manager's workdir, named after the box.
+func WithOverlay(keepUpper bool) BoxOption {
+	return func(c *boxInternal) {
+		c.config.Overlay = true
+		c.config.KeepUpper = keepUpper
+	}
+}
+
+// WithDiskQuota limits the space, in bytes, taken by the changes done by the box to its rootfs,
+// which must be an overlay. The overlay's upper dir is kept in an ext4 image file of the given
+// size, so a bit of it is taken by the filesystem itself.
+func WithDiskQuota(size int64) BoxOption {
+	return func(c *boxInternal) {
+		c.config.DiskQuota = size
+	}
+}
+
+// WithTmpfsSizes sets the sizes, in bytes, of the box's /tmp and /dev/shm, which are tmpfs. A
+// size of 0 keeps the default, half of the RAM for /tmp and bootstrap.DefaultShmSize for
+// /dev/shm.
+func WithTmpfsSizes(tmpSize, shmSize int64) BoxOption {
+	return func(c *boxInternal) {
+		c.config.TmpSize = tmpSize
+		c.config.ShmSize = shmSize
+	}
+}
+
+// withVolumes records the names of the volumes used by a box, acquired by the manager.
+func withVolumes(names []string) BoxOption {
+	return func(c *boxInternal) {
+		c.config.Volumes = names
+	}
+}
+
+// withNetStores sets the stores resolving the network of a box and allocating its addresses.
+func withNetStores(networks *boxnet.NetworkStore, ipam *boxnet.IPAM) BoxOption {
+	return func(c *boxInternal) {
+		c.networks = networks
+		c.ipam = ipam
+	}
+}
+
+// Option configures a Box manager.
+type Option func(*manager)
+
+// WithImageRoot sets the root dir of the image store, which defaults to the .images dir in the
+// manager's workdir.
+func WithImageRoot(root string) Option {
+	return func(m *manager) {
+		m.images = image.NewStore(root)
+	}
+}
+
+// WithNetworkModel registers a network model with the given name, set up for the boxes whose
+// netconf has a model of that type. Models are registered process wide with
+// boxnet.RegisterModel so, when boxes are created with WithShim, the binary must register the
+// model in the shim process as well, e.g. in an init function, since it's the one setting up
+// the network.
+func WithNetworkModel(name string, model boxnet.NetModel) Option {
+	return func(*manager) {
+		boxnet.RegisterModel(name, model)
+	}
+}
@@ -0,0 +1,119 @@
+package box
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+
+	"github.com/cprates/box/boxnet"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// publishPorts publishes the ports of the box's netconf with DNAT rules pointing at its first
+// IPv4 address, unless the netconf asks for the userspace proxy, which is also used if the box has
+// no address or the rules can't be installed. Proxies live in this process, the box's parent,
+// until closed with closeProxies, or once the box exits for boxes created without a shim.
+func (b *boxInternal) publishPorts() (ports []boxnet.PublishedPort, err error) {
+	netConf := b.config.NetConfig
+	if len(netConf.Ports) == 0 {
+		return nil, nil
+	}
+
+	proxy := netConf.PortProxy
+	if !proxy {
+		tag := boxnet.Tag(filepath.Dir(b.config.StateFilePath))
+		if ports, err = publishDNAT(netConf, b.config.NetAddresses, tag); err == nil {
+			return ports, nil
+		}
+
+		log.Warnf("publishing ports of box %q with DNAT: %s, using proxy", b.config.Name, err)
+		if err = boxnet.DeleteNATRules(tag); err != nil {
+			return nil, err
+		}
+	}
+
+	defer func() {
+		if err != nil {
+			b.closeProxies()
+		}
+	}()
+	for _, m := range netConf.Ports {
+		p, err := boxnet.NewPortProxy(m, b.childProcess.pid)
+		if err != nil {
+			return nil, fmt.Errorf("proxying %s: %s", m, err)
+		}
+		b.childProcess.proxies = append(b.childProcess.proxies, p)
+		ports = append(ports, boxnet.PublishedPort{PortMapping: m, Proxy: true})
+	}
+
+	return ports, nil
+}
+
+// publishDNAT publishes the ports of the given netconf with DNAT rules tagged with tag,
+// pointing at the first IPv4 address of its interfaces or else, of the given model addresses.
+func publishDNAT(
+	netConf *boxnet.NetConf,
+	modelAddrs []string,
+	tag string,
+) (
+	ports []boxnet.PublishedPort,
+	err error,
+) {
+	addrs, err := netConf.Addresses()
+	if err != nil {
+		return
+	}
+	addrs = append(addrs, modelAddrs...)
+	var boxIP net.IP
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip.To4() != nil {
+			boxIP = ip
+			break
+		}
+	}
+	if boxIP == nil {
+		return nil, fmt.Errorf("box has no IPv4 address")
+	}
+
+	for _, m := range netConf.Ports {
+		if err = boxnet.AddDNAT(m, boxIP, tag); err != nil {
+			return nil, fmt.Errorf("publishing %s: %s", m, err)
+		}
+		ports = append(ports, boxnet.PublishedPort{PortMapping: m, BoxIP: boxIP.String()})
+	}
+
+	return ports, nil
+}
+
+// closeProxies stops the proxies of the box's published ports, if any.
+func (b *boxInternal) closeProxies() {
+	for _, p := range b.childProcess.proxies {
+		_ = p.Close()
+	}
+	b.childProcess.proxies = nil
+}
+
+// closeProxiesOnExit closes the proxies of the box's published ports, if any, once its process
+// exits. Used for boxes created without a shim, whose parent, this process, may never reap them.
+func (b *boxInternal) closeProxiesOnExit() {
+	if len(b.childProcess.proxies) == 0 {
+		return
+	}
+
+	exited := awaitProcessExit(b.childProcess.pid, make(chan struct{}))
+	go func() {
+		<-exited
+		b.closeProxies()
+	}()
+}
+
+// Ports returns the ports published by the box with the given name.
+func (m *manager) Ports(name string) ([]boxnet.PublishedPort, error) {
+	state, err := m.loadStateFromName(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load state: %s", err)
+	}
+
+	return state.Net.Ports, nil
+}
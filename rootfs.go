@@ -0,0 +1,225 @@
+package box
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cprates/box/image"
+	"github.com/cprates/box/system"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	rootFsDirname  = "rootfs"
+	overlayDirname = "overlay"
+	// rootFsFileDirname is where the rootfs file is mounted when used as an overlay's lowerdir
+	rootFsFileDirname = "image"
+	// etcDirname is the dir, in the box's workdir, where its /etc files are generated
+	etcDirname = "etc"
+	// mountpointsDirname is the dir, in the box's workdir, where the mount points missing in
+	// its rootfs are provided
+	mountpointsDirname = "mountpoints"
+	// quotaImageFilename is the image file holding the overlay dir of boxes with a disk quota
+	quotaImageFilename = "overlay.img"
+	// keptLayersDirname is the dir, in the manager's workdir, where the upper layers of
+	// destroyed boxes are kept
+	keptLayersDirname = ".layers"
+)
+
+// prepareRootFs sets up the dirs needed by the box's rootfs in its workdir. If the box uses
+// an overlay, the spec's rootfs becomes its read-only lowerdir and the box's changes are
+// stored in the upperdir, leaving the original rootfs untouched.
+func (b *boxInternal) prepareRootFs(workdir string) error {
+	if b.config.RootFsFile != "" {
+		if _, err := os.Stat(b.config.RootFsFile); err != nil {
+			return fmt.Errorf("checking rootfs file: %s", err)
+		}
+
+		b.config.RootFsFileMount = filepath.Join(workdir, rootFsDirname)
+		if b.config.Overlay {
+			b.config.RootFsFileMount = filepath.Join(workdir, rootFsFileDirname)
+			b.config.RootFsLowerdirs = []string{b.config.RootFsFileMount}
+		}
+		b.config.RootFs = filepath.Join(workdir, rootFsDirname)
+
+		if err := os.MkdirAll(b.config.RootFsFileMount, 0755); err != nil {
+			return fmt.Errorf("creating rootfs file mount point: %s", err)
+		}
+	}
+
+	if !b.config.Overlay {
+		if b.config.DiskQuota > 0 {
+			return errors.New("disk quota requires an overlay")
+		}
+		return nil
+	}
+
+	if len(b.config.RootFsLowerdirs) == 0 {
+		if _, err := os.Stat(b.config.RootFs); err != nil {
+			return fmt.Errorf("checking rootfs: %s", err)
+		}
+		b.config.RootFsLowerdirs = []string{b.config.RootFs}
+	}
+	b.config.RootFsUpperdir = filepath.Join(workdir, overlayDirname, "upper")
+	b.config.RootFsWorkdir = filepath.Join(workdir, overlayDirname, "work")
+	b.config.RootFs = filepath.Join(workdir, rootFsDirname)
+
+	if b.config.DiskQuota > 0 {
+		if err := mountQuota(workdir, b.config.DiskQuota); err != nil {
+			return fmt.Errorf("mounting disk quota: %s", err)
+		}
+	}
+
+	for _, dir := range []string{
+		b.config.RootFsUpperdir,
+		b.config.RootFsWorkdir,
+		b.config.RootFs,
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			_ = releaseQuota(b.config)
+			return fmt.Errorf("creating overlay dir: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// mountQuota mounts an ext4 image file with the given size, in bytes, at the overlay dir in the
+// given box workdir, so that the overlay's upper dir, created in it, can't grow beyond it.
+func mountQuota(workdir string, size int64) error {
+	dir := filepath.Join(workdir, overlayDirname)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	img := filepath.Join(workdir, quotaImageFilename)
+	if err := system.CreateExt4Image(img, size); err != nil {
+		return fmt.Errorf("creating image: %s", err)
+	}
+
+	dev, err := system.AttachLoop(img, false)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	return unix.Mount(dev.Name(), dir, "ext4", 0, "")
+}
+
+// releaseQuota unmounts the image file holding the overlay dir of the box with the given config,
+// if it has a disk quota. Its loop device is detached once unmounted.
+func releaseQuota(cfg config) error {
+	if cfg.DiskQuota == 0 {
+		return nil
+	}
+
+	err := unix.Unmount(filepath.Dir(cfg.RootFsUpperdir), unix.MNT_DETACH)
+	if err != nil && !errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("unmounting disk quota: %s", err)
+	}
+
+	return nil
+}
+
+// overlayLowerdirs returns the given layers, from the bottom to the top one, in the order
+// expected by overlay's lowerdir option.
+func overlayLowerdirs(layers []string) []string {
+	if len(layers) == 0 {
+		return nil
+	}
+
+	dirs := make([]string, 0, len(layers))
+	for i := len(layers) - 1; i >= 0; i-- {
+		dirs = append(dirs, layers[i])
+	}
+
+	return dirs
+}
+
+// releaseRootFs releases the resources held by the rootfs of the box with the given config,
+// whose workdir is about to be removed. The upper layer of overlays is either discarded or
+// moved to the kept layers dir, according to the box's config.
+func releaseRootFs(cfg config) error {
+	if cfg.RootFsDevice != "" {
+		if err := system.DetachLoop(cfg.RootFsDevice, cfg.RootFsFile); err != nil {
+			return fmt.Errorf("detaching rootfs file: %s", err)
+		}
+	}
+
+	if cfg.Overlay && cfg.KeepUpper {
+		if err := keepUpper(cfg); err != nil {
+			return err
+		}
+	}
+
+	return releaseQuota(cfg)
+}
+
+// keepUpper moves the upper layer of the box with the given config to the kept layers dir.
+func keepUpper(cfg config) error {
+	boxDir := filepath.Dir(cfg.StateFilePath)
+	keptDir := filepath.Join(filepath.Dir(boxDir), keptLayersDirname)
+	if err := os.MkdirAll(keptDir, 0755); err != nil {
+		return fmt.Errorf("creating kept layers dir: %s", err)
+	}
+
+	dst := filepath.Join(keptDir, cfg.Name)
+	if err := os.RemoveAll(dst); err != nil {
+		return fmt.Errorf("removing previously kept layer: %s", err)
+	}
+
+	if cfg.DiskQuota > 0 {
+		// the upper dir is in a filesystem of its own so, it can't be just renamed
+		if err := copyLayer(cfg.RootFsUpperdir, dst); err != nil {
+			return fmt.Errorf("keeping upper layer: %s", err)
+		}
+		return nil
+	}
+
+	if err := os.Rename(cfg.RootFsUpperdir, dst); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("keeping upper layer: %s", err)
+	}
+
+	return nil
+}
+
+// copyLayer copies the overlay layer in src, along with its whiteouts, to dst.
+func copyLayer(src, dst string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(image.WriteLayer(pw, src))
+	}()
+
+	err := image.ApplyLayer(dst, pr, true)
+	// unblocks the writer if the layer wasn't fully read
+	_ = pr.CloseWithError(err)
+
+	return err
+}
+
+// mountRootFsFile mounts the rootfs file of the box with the given config, read-only, at its
+// mount point in this process' mount namespace, until release is called. This gives access to
+// its contents outside of the box, which mounts it in its own mount namespace.
+func mountRootFsFile(cfg config) (release func() error, err error) {
+	dev, err := system.AttachLoop(cfg.RootFsFile, true)
+	if err != nil {
+		return nil, fmt.Errorf("attaching rootfs file: %s", err)
+	}
+	defer dev.Close()
+
+	err = unix.Mount(dev.Name(), cfg.RootFsFileMount, cfg.RootFsType, unix.MS_RDONLY, "")
+	if err != nil {
+		return nil, fmt.Errorf("mounting rootfs file: %s", err)
+	}
+
+	return func() error {
+		if err := unix.Unmount(cfg.RootFsFileMount, unix.MNT_DETACH); err != nil {
+			return fmt.Errorf("unmounting rootfs file: %s", err)
+		}
+		return nil
+	}, nil
+}
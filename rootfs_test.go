@@ -0,0 +1,188 @@
+package box
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOverlayLowerdirs(t *testing.T) {
+	// overlay expects the top layer first
+	dirs := overlayLowerdirs([]string{"/l/base", "/l/app", "/l/config"})
+	expects := []string{"/l/config", "/l/app", "/l/base"}
+	if !reflect.DeepEqual(dirs, expects) {
+		t.Errorf("expects lowerdirs %v, got %v", expects, dirs)
+	}
+
+	if dirs = overlayLowerdirs(nil); dirs != nil {
+		t.Errorf("expects no lowerdirs without layers, got %v", dirs)
+	}
+}
+
+func TestPrepareRootFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "source")
+	if err = os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	rootfsFile := filepath.Join(dir, "rootfs.img")
+	if err = ioutil.WriteFile(rootfsFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		cfg       config
+		lowerdirs []string
+		mount     string
+		err       string
+	}{
+		{
+			name:      "rootfs",
+			cfg:       config{RootFs: rootfs, Overlay: true},
+			lowerdirs: []string{rootfs},
+		},
+		{
+			name:      "layers",
+			cfg:       config{RootFsLowerdirs: []string{"/l/app", "/l/base"}, Overlay: true},
+			lowerdirs: []string{"/l/app", "/l/base"},
+		},
+		{
+			name:      "rootfs file",
+			cfg:       config{RootFsFile: rootfsFile, Overlay: true},
+			lowerdirs: []string{rootFsFileDirname},
+			mount:     rootFsFileDirname,
+		},
+		{
+			name:  "rootfs file without overlay",
+			cfg:   config{RootFsFile: rootfsFile},
+			mount: rootFsDirname,
+		},
+		{
+			name: "missing rootfs",
+			cfg:  config{RootFs: filepath.Join(dir, "missing"), Overlay: true},
+			err:  "checking rootfs",
+		},
+		{
+			name: "quota without overlay",
+			cfg:  config{RootFs: rootfs, DiskQuota: 1 << 20},
+			err:  "requires an overlay",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workdir := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-"))
+			b := &boxInternal{config: tt.cfg}
+			err := b.prepareRootFs(workdir)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expects error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := b.config
+			var lowerdirs []string
+			for _, l := range tt.lowerdirs {
+				if !filepath.IsAbs(l) {
+					l = filepath.Join(workdir, l)
+				}
+				lowerdirs = append(lowerdirs, l)
+			}
+			if !reflect.DeepEqual(cfg.RootFsLowerdirs, lowerdirs) {
+				t.Errorf("expects lowerdirs %v, got %v", lowerdirs, cfg.RootFsLowerdirs)
+			}
+			if tt.mount != "" && cfg.RootFsFileMount != filepath.Join(workdir, tt.mount) {
+				t.Errorf("expects rootfs file mount point %s, got %s", tt.mount,
+					cfg.RootFsFileMount)
+			}
+
+			expects := map[string]string{"rootfs": filepath.Join(workdir, rootFsDirname)}
+			if tt.cfg.Overlay {
+				expects["upperdir"] = filepath.Join(workdir, overlayDirname, "upper")
+				expects["workdir"] = filepath.Join(workdir, overlayDirname, "work")
+			}
+			got := map[string]string{
+				"rootfs":   cfg.RootFs,
+				"upperdir": cfg.RootFsUpperdir,
+				"workdir":  cfg.RootFsWorkdir,
+			}
+			for name, path := range expects {
+				if got[name] != path {
+					t.Errorf("expects %s %s, got %s", name, path, got[name])
+				}
+			}
+			dirs := []string{cfg.RootFsUpperdir, cfg.RootFsWorkdir, cfg.RootFs, cfg.RootFsFileMount}
+			for _, path := range dirs {
+				if path == "" {
+					continue
+				}
+				if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+					t.Errorf("expects dir %s to be created: %v", path, err)
+				}
+			}
+		})
+	}
+}
+
+func TestKeepUpper(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	boxDir := filepath.Join(workdir, "box")
+	cfg := config{
+		Name:           "box",
+		StateFilePath:  filepath.Join(boxDir, stateFilename),
+		Overlay:        true,
+		KeepUpper:      true,
+		RootFsUpperdir: filepath.Join(boxDir, overlayDirname, "upper"),
+	}
+	kept := filepath.Join(workdir, keptLayersDirname, "box")
+
+	files := map[string]string{
+		filepath.Join(cfg.RootFsUpperdir, "etc", "motd"): "changed",
+		filepath.Join(kept, "stale"):                     "previous box",
+	}
+	for p, content := range files {
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = releaseRootFs(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(kept, "etc", "motd")); err != nil ||
+		string(b) != "changed" {
+		t.Errorf("expects the upper layer to be kept, got %q, %v", b, err)
+	}
+	if _, err = os.Stat(filepath.Join(kept, "stale")); !os.IsNotExist(err) {
+		t.Errorf("expects the previously kept layer to be replaced, got %v", err)
+	}
+	if _, err = os.Stat(cfg.RootFsUpperdir); !os.IsNotExist(err) {
+		t.Errorf("expects the upper layer to be moved, got %v", err)
+	}
+
+	// boxes which never started have no upper layer to keep
+	if err = releaseRootFs(cfg); err != nil {
+		t.Errorf("expects a missing upper layer to be ignored, got %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/cprates/box/bootstrap"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// shimResult is sent by the shim to its parent once the box is created.
+type shimResult struct {
+	Error string `json:"error,omitempty"`
+	// BootstrapError is set if the box failed to bootstrap
+	BootstrapError *bootstrap.Error `json:"bootstrap_error,omitempty"`
+}
+
+// shimError keeps the message of an error reported by the shim along with its typed cause.
+type shimError struct {
+	msg   string
+	cause error
+}
+
+func (e *shimError) Error() string {
+	return e.msg
+}
+
+func (e *shimError) Unwrap() error {
+	return e.cause
+}
+
+// createOnShim spawns a new shim process which creates the box and stays around as its
+// parent, so that this process can exit right after.
+func (b *boxInternal) createOnShim() (err error) {
+	cmd := exec.Command("/proc/self/exe", "shim")
+	if b.childProcess.io.In != nil {
+		cmd.Stdin = b.childProcess.io.In
+	}
+	if b.childProcess.io.Out != nil {
+		cmd.Stdout = b.childProcess.io.Out
+	}
+	if b.childProcess.io.Err != nil {
+		cmd.Stderr = b.childProcess.io.Err
+	}
+	// the shim must not be killed along with the session of the caller
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	configRPipe, configWPipe, err := os.Pipe()
+	if err != nil {
+		err = fmt.Errorf("creating configPipe: %s", err)
+		return
+	}
+	defer configWPipe.Close()
+	defer configRPipe.Close()
+
+	syncRPipe, syncWPipe, err := os.Pipe()
+	if err != nil {
+		err = fmt.Errorf("creating syncPipe: %s", err)
+		return
+	}
+	defer syncWPipe.Close()
+	defer syncRPipe.Close()
+
+	cmd.ExtraFiles = []*os.File{configRPipe, syncWPipe}
+	cmd.Env = []string{
+		"BOX_SHIM_CONFIG_FD=" + strconv.Itoa(stdioFdCount),
+		"BOX_SHIM_SYNC_FD=" + strconv.Itoa(stdioFdCount+1),
+		"BOX_DEBUG=" + os.Getenv("BOX_DEBUG"),
+	}
+
+	if err = json.NewEncoder(configWPipe).Encode(&b.config); err != nil {
+		err = fmt.Errorf("sending config to shim: %s", err)
+		return
+	}
+
+	if err = cmd.Start(); err != nil {
+		err = fmt.Errorf("starting shim: %s", err)
+		return
+	}
+	// the shim outlives this process so, release it but make sure it doesn't become a zombie
+	// while this process is still around
+	go func() {
+		_ = cmd.Wait()
+	}()
+	syncWPipe.Close()
+
+	result := shimResult{}
+	if err = json.NewDecoder(syncRPipe).Decode(&result); err != nil {
+		err = fmt.Errorf("reading result from shim: %s", err)
+		return
+	}
+	if result.BootstrapError != nil {
+		err = &shimError{msg: result.Error, cause: result.BootstrapError}
+		return
+	}
+	if result.Error != "" {
+		err = errors.New(result.Error)
+		return
+	}
+
+	err = b.loadState()
+	if err != nil {
+		err = fmt.Errorf("loading state created by shim: %s", err)
+		return
+	}
+	b.childProcess.pid = b.state.BoxPID
+	b.childProcess.created = b.state.Created
+
+	return
+}
+
+// Shim is the entry point of the shim process. It creates the box with the config read from
+// configFd, reports the result through syncFd and then waits for the box to exit, recording
+// its exit status in the box's state.
+func Shim(configFd, syncFd string) (err error) {
+	configPipe, err := fdFile(configFd, "configPipe")
+	if err != nil {
+		return fmt.Errorf("opening config pipe: %s", err)
+	}
+	syncPipe, err := fdFile(syncFd, "syncPipe")
+	if err != nil {
+		return fmt.Errorf("opening sync pipe: %s", err)
+	}
+
+	b := &boxInternal{
+		childProcess: process{
+			io: ProcessIO{In: os.Stdin, Out: os.Stdout, Err: os.Stderr},
+		},
+	}
+	err = json.NewDecoder(configPipe).Decode(&b.config)
+	_ = configPipe.Close()
+	if err != nil {
+		err = fmt.Errorf("reading config: %s", err)
+		_ = json.NewEncoder(syncPipe).Encode(shimResult{Error: err.Error()})
+		return
+	}
+
+	result := shimResult{}
+	if err = b.createBox(); err != nil {
+		result.Error = err.Error()
+		errors.As(err, &result.BootstrapError)
+	}
+	if e := json.NewEncoder(syncPipe).Encode(result); e != nil && err == nil {
+		err = fmt.Errorf("reporting result: %s", e)
+	}
+	_ = syncPipe.Close()
+	if err != nil {
+		return
+	}
+
+	return b.reap()
+}
+
+// reap waits for the box's process to exit and records its exit status.
+func (b *boxInternal) reap() (err error) {
+	err = b.childProcess.cmd.Wait()
+	b.closeIO()
+	b.closeProxies()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if execErr := <-b.childProcess.execResult; execErr != nil {
+		log.Errorf("box %q failed to start: %s", b.config.Name, execErr)
+		errors.As(execErr, &b.state.Error)
+	}
+	b.state.Exited = true
+	finishedAt := time.Now()
+	b.state.FinishedAt = &finishedAt
+	b.state.ExitCode = exitCode(b.childProcess.cmd.ProcessState)
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			log.Errorf("waiting for box %q: %s", b.config.Name, err)
+		}
+	}
+
+	if err = b.saveState(); err != nil {
+		return fmt.Errorf("saving exit status: %s", err)
+	}
+
+	return nil
+}
+
+// exitCode returns the exit code of a process following the shell convention of reporting
+// 128+n for processes killed by signal n.
+func exitCode(ps *os.ProcessState) int {
+	if ps == nil {
+		return -1
+	}
+
+	if status, ok := ps.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return ps.ExitCode()
+}
+
+func fdFile(sFd, name string) (*os.File, error) {
+	fd, err := strconv.Atoi(sFd)
+	if err != nil {
+		return nil, fmt.Errorf("parsing fd: %s", err)
+	}
+
+	return os.NewFile(uintptr(fd), name), nil
+}
@@ -0,0 +1,141 @@
+package box
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cprates/box/bootstrap"
+	"github.com/cprates/box/spec"
+)
+
+// TestMain lets the test binary play the box binary, re-executed to bootstrap boxes and run
+// their shims.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bootstrap":
+			_ = bootstrap.Boot(
+				os.Getenv("BOX_BOOTSTRAP_CONFIG_FD"),
+				os.Getenv("BOX_BOOTSTRAP_LOG_FD"),
+			)
+			os.Exit(1)
+		case "shim":
+			err := Shim(os.Getenv("BOX_SHIM_CONFIG_FD"), os.Getenv("BOX_SHIM_SYNC_FD"))
+			if err != nil {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
+
+	os.Exit(m.Run())
+}
+
+// testSpec returns the spec of a box running the given shell command, on a rootfs sharing the
+// host's /usr.
+func testSpec(t *testing.T, rootfs, cmd string) *spec.Spec {
+	for _, dir := range []string{"usr", "proc", "dev", "sys", "tmp", "etc"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"hostname", "hosts", "resolv.conf"} {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the host's top level dirs, which may be links into /usr
+	for _, dir := range []string{"bin", "lib", "lib64", "sbin"} {
+		target, err := os.Readlink(filepath.Join("/", dir))
+		if err != nil {
+			t.Skipf("/%s isn't a link into /usr", dir)
+		}
+		if err = os.Symlink(target, filepath.Join(rootfs, dir)); err != nil && !os.IsExist(err) {
+			t.Fatal(err)
+		}
+	}
+
+	return &spec.Spec{
+		Version: spec.Version,
+		Root:    &spec.Root{Path: rootfs},
+		Process: &spec.Process{
+			Args: []string{"/bin/sh", "-c", cmd},
+			Env:  []string{"PATH=/usr/sbin:/usr/bin:/sbin:/bin"},
+			Cwd:  "/",
+		},
+		Mounts: []spec.Mount{
+			{Destination: "/usr", Type: spec.MountBind, Source: "/usr", Options: []string{"ro"}},
+		},
+	}
+}
+
+func TestShimExitStatus(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	workdir, err := ioutil.TempDir("", "shim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+	rootfs := filepath.Join(workdir, ".rootfs")
+
+	m := New(workdir)
+	start := func(name, cmd string) *state {
+		b, err := m.Create(name, ProcessIO{}, testSpec(t, rootfs, cmd), WithShim())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = m.Destroy(name) })
+		if err = b.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := m.(*manager).loadStateFromName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !shimAlive(s) {
+			t.Fatalf("expected shim of box %s to be alive", name)
+		}
+		return s
+	}
+
+	before := time.Now()
+	start("exits", "exit 3")
+	code, err := m.Wait("exits")
+	if err != nil || code != 3 {
+		t.Errorf("expected exit code 3, got %d, %v", code, err)
+	}
+	s, err := m.(*manager).loadStateFromName("exits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Exited || s.ExitCode != 3 || s.FinishedAt == nil || s.FinishedAt.Before(before) {
+		t.Errorf("expected exit status 3 to be recorded, got %+v", s)
+	}
+
+	// boxes killed by a signal exit with 128+signal
+	s = start("killed", "sleep 60")
+	if err = syscall.Kill(s.BoxPID, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	if code, err = m.Wait("killed"); err != nil || code != 128+int(syscall.SIGKILL) {
+		t.Errorf("expected exit code %d, got %d, %v", 128+int(syscall.SIGKILL), code, err)
+	}
+
+	// the shim is no longer taken as alive once its PID is reused
+	s.ShimStartClockTicks++
+	if shimAlive(s) {
+		t.Error("expected a shim with another start time not to be alive")
+	}
+	s.ShimPID = os.Getpid()
+	if shimAlive(s) {
+		t.Error("expected a process other than the shim not to be taken as the shim")
+	}
+}
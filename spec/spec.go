@@ -7,6 +7,9 @@ import (
 	"os"
 )
 
+// Version is the version of the Open Container Initiative Runtime Specification supported.
+const Version = "1.0.1"
+
 // Spec is the base configuration for the container.
 // Check https://github.com/opencontainers/runtime-spec/blob/master/config.md for more details.
 // If you cannot find here a field  documented in the link above, is because it is not supported.
@@ -19,6 +22,8 @@ type Spec struct {
 	Root *Root `json:"root,omitempty"`
 	// Hostname configures the container's hostname.
 	Hostname string `json:"hostname,omitempty"`
+	// Mounts configures additional mounts, on top of the container's root filesystem.
+	Mounts []Mount `json:"mounts,omitempty"`
 }
 
 // Process contains information to start a specific application inside the container.
@@ -32,19 +37,65 @@ type Process struct {
 	// Cwd is the current working directory for the process and must be
 	// relative to the container's root
 	Cwd string `json:"cwd"`
+	// User specifies user information for the process
+	User User `json:"user"`
 	// TODO
 	//Rlimits []POSIXRlimit `json:"rlimits,omitempty" platform:"linux,solaris"`
 }
 
+// User specifies the identity of the container's process.
+type User struct {
+	// UID is the user id
+	UID uint32 `json:"uid"`
+	// GID is the group id
+	GID uint32 `json:"gid"`
+	// AdditionalGids are additional group ids set for the container's process
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
 // Root contains information about the container's root filesystem on the host
 type Root struct {
-	// Path is the absolute path to the container's root filesystem
-	Path string `json:"path"`
+	// Path is the absolute path to the container's root filesystem. Only one of Path, Layers,
+	// Image and File can be set
+	Path string `json:"path,omitempty"`
+	// Layers is a list of absolute paths to read-only layers, from the bottom to the top one,
+	// stacked with an overlay to build the container's root filesystem
+	Layers []string `json:"layers,omitempty"`
+	// Image is the name of an image in the image store, in the form name:tag, whose layers are
+	// stacked like Layers
+	Image string `json:"image,omitempty"`
+	// File is the absolute path to a filesystem image file, e.g. squashfs or ext4, which is
+	// mounted read-only through a loop device as the container's root filesystem
+	File string `json:"file,omitempty"`
+	// FsType is the type of the filesystem in File
+	FsType string `json:"fsType,omitempty"`
 	// TODO: not fully implemented yet
 	// Readonly makes the root filesystem for the container readonly before the process is executed
 	Readonly bool `json:"readonly,omitempty"`
 }
 
+// Mount types.
+const (
+	// MountBind bind mounts the path in Source
+	MountBind = "bind"
+	// MountVolume mounts the volume named in Source, from the volume store
+	MountVolume = "volume"
+	// MountTmpfs mounts a new tmpfs
+	MountTmpfs = "tmpfs"
+)
+
+// Mount specifies a mount for a container.
+type Mount struct {
+	// Destination is the absolute path, in the container, where the mount is placed
+	Destination string `json:"destination"`
+	// Type is the type of the mount, one of bind, volume and tmpfs
+	Type string `json:"type"`
+	// Source is the absolute path, on the host, of bind mounts, or the name of volumes
+	Source string `json:"source,omitempty"`
+	// Options are fstab style mount options, e.g. ro or size=64m
+	Options []string `json:"options,omitempty"`
+}
+
 // LoadFromFile a Box spec in the given path.
 func LoadFromFile(path string) (spec *Spec, err error) {
 	f, err := os.Open(path)
@@ -2,6 +2,7 @@ package spec
 
 import (
 	"errors"
+	"fmt"
 	"path/filepath"
 	"strings"
 )
@@ -28,6 +29,12 @@ func (s Spec) Valid() error {
 		return err
 	}
 
+	for _, m := range s.Mounts {
+		if err := m.Valid(); err != nil {
+			return fmt.Errorf("mount %q: %s", m.Destination, err)
+		}
+	}
+
 	return nil
 }
 
@@ -51,6 +58,46 @@ func (r Root) Valid() error {
 	if r.Readonly {
 		return errors.New("read-only root not supported")
 	}
+	set := 0
+	for _, isSet := range []bool{r.Path != "", len(r.Layers) > 0, r.Image != "", r.File != ""} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("exactly one of root path, layers, image and file must be specified")
+	}
+	if r.File != "" {
+		if !filepath.IsAbs(r.File) {
+			return errors.New("root file must be an absolute path")
+		}
+		if r.FsType == "" {
+			return errors.New("fs type of the root file must be specified")
+		}
+	}
+
+	return nil
+}
+
+// Valid validates a container's mount, returning an error if it is not valid.
+func (m Mount) Valid() error {
+	if !filepath.IsAbs(m.Destination) {
+		return errors.New("destination must be an absolute path")
+	}
+
+	switch m.Type {
+	case MountBind:
+		if !filepath.IsAbs(m.Source) {
+			return errors.New("source of bind mounts must be an absolute path")
+		}
+	case MountVolume:
+		if m.Source == "" {
+			return errors.New("source of volume mounts must be a volume name")
+		}
+	case MountTmpfs:
+	default:
+		return fmt.Errorf("unknown mount type %q", m.Type)
+	}
 
 	return nil
 }
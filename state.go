@@ -2,8 +2,13 @@ package box
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/cprates/box/bootstrap"
+	"github.com/cprates/box/boxnet"
 )
 
 const stateFilename = "state.json"
@@ -13,17 +18,44 @@ type state struct {
 	Created                bool
 	ProcessStartClockTicks uint64
 	BoxConfig              config
+	// ShimPID is the PID of the shim owning the box, if any
+	ShimPID int `json:",omitempty"`
+	// ShimStartClockTicks is the start time of the shim, telling it apart from processes reusing
+	// its PID
+	ShimStartClockTicks uint64 `json:",omitempty"`
+	// Exited is set by the shim once the box's process is reaped
+	Exited     bool
+	ExitCode   int
+	FinishedAt *time.Time `json:",omitempty"`
+	// Error is set if the box failed to execute its entry point
+	Error *bootstrap.Error `json:",omitempty"`
+	// Net are the host side network resources of the box, released once it is destroyed
+	Net boxnet.Resources
 }
 
+// saveState atomically replaces the state file, since it may be read by other processes at
+// any time.
 func (b *boxInternal) saveState() (err error) {
-	f, err := os.Create(b.config.StateFilePath)
+	dir, name := filepath.Split(b.config.StateFilePath)
+	f, err := ioutil.TempFile(dir, "."+name)
 	if err != nil {
 		return
 	}
-	defer f.Close()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
 
 	err = json.NewEncoder(f).Encode(b.state)
-	return
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+
+	return os.Rename(f.Name(), b.config.StateFilePath)
 }
 
 func (b *boxInternal) loadState() (err error) {
@@ -38,7 +70,11 @@ func (b *boxInternal) loadState() (err error) {
 }
 
 func (m *manager) loadStateFromName(name string) (s *state, err error) {
-	f, err := os.Open(filepath.Join(m.workdir, name, stateFilename))
+	return readState(filepath.Join(m.workdir, name, stateFilename))
+}
+
+func readState(path string) (s *state, err error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return
 	}
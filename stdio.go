@@ -0,0 +1,167 @@
+package box
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/cprates/box/boxlog"
+)
+
+const logFilename = "box.log"
+
+// setupStdio sets the stdio of the box's process. If a log file or attaching is configured,
+// the box's output goes to them instead of the ProcessIO, and its input comes from the
+// attached clients. The returned function must be called right after the process is started,
+// successfully or not.
+func (b *boxInternal) setupStdio(cmd *exec.Cmd) (started func(), err error) {
+	pio := b.childProcess.io
+	if pio.In != nil {
+		cmd.Stdin = pio.In
+	}
+	if pio.Out != nil {
+		cmd.Stdout = pio.Out
+	}
+	if pio.Err != nil {
+		cmd.Stderr = pio.Err
+	}
+
+	noop := func() {}
+	if b.config.LogFile == "" && !b.config.Attach {
+		return noop, nil
+	}
+
+	defer func() {
+		if err != nil {
+			b.closeIO()
+		}
+	}()
+
+	if b.config.LogFile != "" {
+		b.childProcess.logger, err = boxlog.NewWriter(
+			b.config.LogFile, b.config.LogMaxSize, b.config.LogMaxFiles,
+		)
+		if err != nil {
+			return
+		}
+	}
+
+	if b.config.Attach {
+		sockPath := filepath.Join(filepath.Dir(b.config.StateFilePath), attachSocketFilename)
+		b.childProcess.attach, err = newAttachServer(sockPath, b.config.Terminal)
+		if err != nil {
+			err = fmt.Errorf("creating attach server: %s", err)
+			return
+		}
+	}
+
+	if b.config.Terminal {
+		// the output is copied from the console instead
+		return noop, nil
+	}
+
+	var childEnds []*os.File
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("creating stdout pipe: %s", err)
+	}
+	childEnds = append(childEnds, outW)
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		outR.Close()
+		outW.Close()
+		return nil, fmt.Errorf("creating stderr pipe: %s", err)
+	}
+	childEnds = append(childEnds, errW)
+	cmd.Stdout = outW
+	cmd.Stderr = errW
+
+	var inW *os.File
+	if b.config.Attach {
+		var inR *os.File
+		inR, inW, err = os.Pipe()
+		if err != nil {
+			for _, f := range append(childEnds, outR, errR) {
+				f.Close()
+			}
+			return nil, fmt.Errorf("creating stdin pipe: %s", err)
+		}
+		childEnds = append(childEnds, inR)
+		cmd.Stdin = inR
+	}
+
+	started = func() {
+		// only the child must hold its ends, so that the copy ends when it exits
+		for _, f := range childEnds {
+			f.Close()
+		}
+
+		b.childProcess.ioWG.Add(2)
+		go b.copyOutput(streamStdout, outR)
+		go b.copyOutput(streamStderr, errR)
+
+		if b.childProcess.attach != nil {
+			b.childProcess.attach.serve(inW, nil)
+		}
+	}
+
+	return started, nil
+}
+
+// copyOutput copies the output of the box from src to the configured log and attached clients.
+func (b *boxInternal) copyOutput(stream byte, src io.ReadCloser) {
+	defer b.childProcess.ioWG.Done()
+	defer src.Close()
+
+	sink := outputSink{stream: stream, attach: b.childProcess.attach}
+	if b.childProcess.logger != nil {
+		sink.log = b.childProcess.logger.Stream(streamNames[stream])
+		defer sink.log.Close()
+	}
+
+	_, _ = io.Copy(sink, src)
+}
+
+// closeIO waits until all the output of the box is copied, then closes the log and stops
+// serving attached clients.
+func (b *boxInternal) closeIO() {
+	b.childProcess.ioWG.Wait()
+
+	if b.childProcess.logger != nil {
+		b.childProcess.logger.Close()
+	}
+	if b.childProcess.attach != nil {
+		b.childProcess.attach.close()
+	}
+}
+
+const (
+	streamStdin byte = iota
+	streamStdout
+	streamStderr
+)
+
+var streamNames = map[byte]string{
+	streamStdout: "stdout",
+	streamStderr: "stderr",
+}
+
+type outputSink struct {
+	stream byte
+	log    io.WriteCloser
+	attach *attachServer
+}
+
+func (s outputSink) Write(p []byte) (int, error) {
+	if s.log != nil {
+		// losing log entries must not block the box's output
+		_, _ = s.log.Write(p)
+	}
+	if s.attach != nil {
+		s.attach.broadcast(s.stream, p)
+	}
+
+	return len(p), nil
+}
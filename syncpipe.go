@@ -0,0 +1,63 @@
+package box
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/cprates/box/bootstrap"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// waitBootstrap reads the progress reported by the box's process through the sync pipe until
+// it's ready to execute its entry point, returning a *bootstrap.Error if it fails.
+func waitBootstrap(dec *json.Decoder) error {
+	stage := ""
+	for {
+		msg := bootstrap.SyncMsg{}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("box process died during bootstrap stage %q", stage)
+			}
+			return fmt.Errorf("reading bootstrap progress: %s", err)
+		}
+
+		switch msg.Type {
+		case bootstrap.MsgStage:
+			stage = msg.Stage
+			log.Debugf("box bootstrap stage: %s", stage)
+		case bootstrap.MsgReady:
+			return nil
+		case bootstrap.MsgError:
+			if msg.Error == nil {
+				return fmt.Errorf("box failed on bootstrap stage %q", stage)
+			}
+			return msg.Error
+		}
+	}
+}
+
+// awaitExec waits for the box's process to execute its entry point, which closes the sync
+// pipe, sending nil on success or the reported *bootstrap.Error otherwise.
+func awaitExec(dec *json.Decoder, pipe io.Closer) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		defer pipe.Close()
+
+		msg := bootstrap.SyncMsg{}
+		err := dec.Decode(&msg)
+		switch {
+		case err == io.EOF:
+			result <- nil
+		case err != nil:
+			result <- fmt.Errorf("reading bootstrap result: %s", err)
+		case msg.Type == bootstrap.MsgError && msg.Error != nil:
+			result <- msg.Error
+		default:
+			result <- fmt.Errorf("unexpected bootstrap message %q", msg.Type)
+		}
+	}()
+
+	return result
+}
@@ -0,0 +1,141 @@
+package box
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/cprates/box/bootstrap"
+)
+
+var bootstrapStages = []string{
+	bootstrap.StageConfig, bootstrap.StageRootFs, bootstrap.StageMounts, bootstrap.StageDevices,
+	bootstrap.StageHostname, bootstrap.StageNetwork, bootstrap.StageDNS, bootstrap.StageEnv,
+	bootstrap.StageChroot, bootstrap.StageCwd, bootstrap.StageConsole,
+	bootstrap.StageEntryPoint, bootstrap.StageSync, bootstrap.StageUser, bootstrap.StageExec,
+}
+
+// syncStream returns a decoder of the given messages, as written by the box's process.
+func syncStream(t *testing.T, msgs ...bootstrap.SyncMsg) *json.Decoder {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return json.NewDecoder(buf)
+}
+
+// stagesUpTo returns the stage messages sent up to the given stage, included.
+func stagesUpTo(stage string) (msgs []bootstrap.SyncMsg) {
+	for _, s := range bootstrapStages {
+		msgs = append(msgs, bootstrap.SyncMsg{Type: bootstrap.MsgStage, Stage: s})
+		if s == stage {
+			break
+		}
+	}
+
+	return
+}
+
+func TestWaitBootstrap(t *testing.T) {
+	msgs := append(stagesUpTo(bootstrap.StageSync), bootstrap.SyncMsg{Type: bootstrap.MsgReady})
+	if err := waitBootstrap(syncStream(t, msgs...)); err != nil {
+		t.Fatalf("expects a successful bootstrap, got: %s", err)
+	}
+
+	for _, stage := range bootstrapStages {
+		reported := &bootstrap.Error{
+			Stage:   stage,
+			Path:    "/some/path",
+			Errno:   syscall.EACCES,
+			Message: "permission denied",
+		}
+		msgs := append(stagesUpTo(stage), bootstrap.SyncMsg{
+			Type:  bootstrap.MsgError,
+			Error: reported,
+		})
+
+		err := waitBootstrap(syncStream(t, msgs...))
+		var bErr *bootstrap.Error
+		if !errors.As(err, &bErr) {
+			t.Errorf("stage %s: expects a *bootstrap.Error, got %v", stage, err)
+			continue
+		}
+		if *bErr != *reported {
+			t.Errorf("stage %s: expects error %+v, got %+v", stage, reported, bErr)
+		}
+		if !errors.Is(err, syscall.EACCES) {
+			t.Errorf("stage %s: expects the error to match its errno", stage)
+		}
+	}
+
+	// an error with no details is still reported with the last known stage
+	msgs = append(stagesUpTo(bootstrap.StageChroot), bootstrap.SyncMsg{Type: bootstrap.MsgError})
+	err := waitBootstrap(syncStream(t, msgs...))
+	if err == nil || !strings.Contains(err.Error(), `"chroot"`) {
+		t.Errorf("expects a failure on stage chroot, got: %v", err)
+	}
+}
+
+func TestWaitBootstrapEOF(t *testing.T) {
+	err := waitBootstrap(syncStream(t, stagesUpTo(bootstrap.StageDevices)...))
+	if err == nil || !strings.Contains(err.Error(), `died during bootstrap stage "devices"`) {
+		t.Errorf("expects the box to have died on stage devices, got: %v", err)
+	}
+
+	err = waitBootstrap(syncStream(t))
+	if err == nil || !strings.Contains(err.Error(), `died during bootstrap stage ""`) {
+		t.Errorf("expects the box to have died before any stage, got: %v", err)
+	}
+
+	err = waitBootstrap(json.NewDecoder(strings.NewReader(`{"type": "stage", "sta`)))
+	if err == nil || !strings.Contains(err.Error(), "reading bootstrap progress") {
+		t.Errorf("expects a read error on a truncated message, got: %v", err)
+	}
+}
+
+type closeRecorder struct {
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestAwaitExec(t *testing.T) {
+	// the pipe is closed without any message once the entry point is executed
+	pipe := &closeRecorder{}
+	if err := <-awaitExec(syncStream(t), pipe); err != nil {
+		t.Errorf("expects a successful exec, got: %s", err)
+	}
+	if !pipe.closed {
+		t.Error("expects the sync pipe to be closed")
+	}
+
+	reported := &bootstrap.Error{
+		Stage:   bootstrap.StageExec,
+		Path:    "/bin/nope",
+		Errno:   syscall.ENOENT,
+		Message: "no such file or directory",
+	}
+	dec := syncStream(t, bootstrap.SyncMsg{Type: bootstrap.MsgError, Error: reported})
+	err := <-awaitExec(dec, ioutil.NopCloser(nil))
+	var bErr *bootstrap.Error
+	if !errors.As(err, &bErr) || *bErr != *reported {
+		t.Errorf("expects error %+v, got %v", reported, err)
+	}
+
+	dec = syncStream(t, bootstrap.SyncMsg{Type: bootstrap.MsgReady})
+	err = <-awaitExec(dec, ioutil.NopCloser(nil))
+	if err == nil || !strings.Contains(err.Error(), `unexpected bootstrap message "ready"`) {
+		t.Errorf("expects an unexpected message error, got: %v", err)
+	}
+}
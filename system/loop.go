@@ -0,0 +1,149 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const loopControlPath = "/dev/loop-control"
+
+// AttachLoop attaches the file at path to a free loop device, returning the open device. The
+// device is set to autoclear, so that it is detached by the kernel once it is no longer used,
+// hence it must be used, e.g. mounted, before the returned device is closed by the caller.
+func AttachLoop(path string, readOnly bool) (dev *os.File, err error) {
+	flags := os.O_RDWR
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening backing file: %s", err)
+	}
+	defer f.Close()
+
+	ctl, err := os.OpenFile(loopControlPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening loop control: %s", err)
+	}
+	defer ctl.Close()
+
+	// another process may grab the same free device before us, in which case we just retry
+	for attempt := 0; attempt < 10; attempt++ {
+		n, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return nil, fmt.Errorf("getting free loop device: %s", err)
+		}
+
+		dev, err = os.OpenFile(fmt.Sprintf("/dev/loop%d", n), flags, 0)
+		if err != nil {
+			return nil, fmt.Errorf("opening loop device: %s", err)
+		}
+
+		err = unix.IoctlSetInt(int(dev.Fd()), unix.LOOP_SET_FD, int(f.Fd()))
+		if errors.Is(err, unix.EBUSY) {
+			dev.Close()
+			continue
+		}
+		if err != nil {
+			dev.Close()
+			return nil, fmt.Errorf("setting loop device fd: %s", err)
+		}
+
+		info := unix.LoopInfo64{Flags: unix.LO_FLAGS_AUTOCLEAR}
+		if readOnly {
+			info.Flags |= unix.LO_FLAGS_READ_ONLY
+		}
+		copy(info.File_name[:], path)
+		_, _, errno := unix.Syscall(
+			unix.SYS_IOCTL,
+			dev.Fd(),
+			unix.LOOP_SET_STATUS64,
+			uintptr(unsafe.Pointer(&info)),
+		)
+		if errno != 0 {
+			_ = unix.IoctlSetInt(int(dev.Fd()), unix.LOOP_CLR_FD, 0)
+			dev.Close()
+			return nil, fmt.Errorf("setting loop device status: %s", errno)
+		}
+
+		return dev, nil
+	}
+
+	return nil, errors.New("no free loop device")
+}
+
+// DetachLoop detaches the loop device at path from its backing file, unless it is no longer
+// attached to it. Devices attached with AttachLoop are detached automatically, in which case
+// the device may have been reused for another file by the time this is called. If the backing
+// file no longer exists, the device can't be told to be attached to it so, it's left as is.
+func DetachLoop(path, backingFile string) error {
+	dev, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	var info unix.LoopInfo64
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		dev.Fd(),
+		unix.LOOP_GET_STATUS64,
+		uintptr(unsafe.Pointer(&info)),
+	)
+	if errno == unix.ENXIO {
+		// not attached
+		return nil
+	}
+	if errno != 0 {
+		return fmt.Errorf("getting loop device status: %s", errno)
+	}
+
+	var st unix.Stat_t
+	if err = unix.Stat(backingFile, &st); err != nil {
+		if err == unix.ENOENT {
+			return nil
+		}
+		return fmt.Errorf("checking backing file: %s", err)
+	}
+	if info.Device != uint64(st.Dev) || info.Inode != st.Ino {
+		return nil
+	}
+
+	err = unix.IoctlSetInt(int(dev.Fd()), unix.LOOP_CLR_FD, 0)
+	if err != nil && !errors.Is(err, unix.ENXIO) {
+		return err
+	}
+
+	return nil
+}
+
+// CreateExt4Image creates a sparse image file at path with the given size, formatted with ext4,
+// to be attached to a loop device.
+func CreateExt4Image(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(size)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.Command("mkfs.ext4", "-q", "-F", "-m", "0", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("formatting: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// loopAttached returns whether the loop device in dev is attached to any file.
+func loopAttached(t *testing.T, dev string) bool {
+	f, err := os.Open(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var info unix.LoopInfo64
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		f.Fd(),
+		unix.LOOP_GET_STATUS64,
+		uintptr(unsafe.Pointer(&info)),
+	)
+	if errno == unix.ENXIO {
+		return false
+	}
+	if errno != 0 {
+		t.Fatalf("getting loop device status: %s", errno)
+	}
+
+	return true
+}
+
+func TestDetachLoop(t *testing.T) {
+	if _, err := os.Stat(loopControlPath); err != nil {
+		t.Skip("loop devices not available")
+	}
+
+	tmp, err := ioutil.TempDir("", "loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	backing := filepath.Join(tmp, "image")
+	other := filepath.Join(tmp, "other")
+	for _, p := range []string{backing, other} {
+		if err = ioutil.WriteFile(p, make([]byte, 1<<20), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dev, err := AttachLoop(backing, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the device is only cleared automatically once it is no longer open
+	defer dev.Close()
+
+	if err = DetachLoop(dev.Name(), other); err != nil {
+		t.Fatalf("detaching from another file: %s", err)
+	}
+	if !loopAttached(t, dev.Name()) {
+		t.Fatal("expected the device to be kept for another file")
+	}
+
+	if err = DetachLoop(dev.Name(), filepath.Join(tmp, "removed")); err != nil {
+		t.Errorf("expected a missing backing file to be ignored, got: %s", err)
+	}
+	if !loopAttached(t, dev.Name()) {
+		t.Fatal("expected the device to be kept for a missing file")
+	}
+
+	if err = DetachLoop(dev.Name(), backing); err != nil {
+		t.Fatalf("detaching: %s", err)
+	}
+	dev.Close()
+	if loopAttached(t, dev.Name()) {
+		t.Error("expected the device to be detached")
+	}
+
+	// already detached
+	if err = DetachLoop(dev.Name(), backing); err != nil {
+		t.Errorf("detaching again: %s", err)
+	}
+}
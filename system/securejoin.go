@@ -0,0 +1,72 @@
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// maxSymlinks is the max number of symlinks followed by SecureJoin, same as Linux's.
+const maxSymlinks = 40
+
+// SecureJoin joins unsafePath to root, resolving its symlinks as if root was the filesystem's
+// root, so that the returned path never escapes root. Components that don't exist are joined
+// as they are.
+func SecureJoin(root, unsafePath string) (string, error) {
+	root = filepath.Clean(root)
+
+	resolved := "/"
+	pending := strings.Split(unsafePath, "/")
+	links := 0
+	for len(pending) > 0 {
+		c := pending[0]
+		pending = pending[1:]
+
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, c)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) || isNotDir(err) {
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", &os.PathError{Op: "securejoin", Path: unsafePath, Err: syscall.ELOOP}
+		}
+
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+
+	return filepath.Join(root, resolved), nil
+}
+
+func isNotDir(err error) bool {
+	if pErr, ok := err.(*os.PathError); ok {
+		return pErr.Err == syscall.ENOTDIR
+	}
+
+	return false
+}
@@ -0,0 +1,63 @@
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecureJoin(t *testing.T) {
+	root, err := ioutil.TempDir("", "securejoin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	must := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(os.MkdirAll(filepath.Join(root, "usr/lib"), 0755))
+	must(ioutil.WriteFile(filepath.Join(root, "file"), nil, 0644))
+	must(os.Symlink("/usr/lib", filepath.Join(root, "lib")))
+	must(os.Symlink("../../../../etc", filepath.Join(root, "usr/escape")))
+	must(os.Symlink("/../../etc/passwd", filepath.Join(root, "abs")))
+	must(os.Symlink("loop2", filepath.Join(root, "loop1")))
+	must(os.Symlink("loop1", filepath.Join(root, "loop2")))
+
+	tests := []struct {
+		path   string
+		expect string
+		err    bool
+	}{
+		{path: "/", expect: "/"},
+		{path: "usr/lib/x", expect: "/usr/lib/x"},
+		{path: "/lib/x", expect: "/usr/lib/x"},
+		{path: "../../usr/./lib", expect: "/usr/lib"},
+		{path: "/usr/escape/passwd", expect: "/etc/passwd"},
+		{path: "abs", expect: "/etc/passwd"},
+		{path: "missing/../lib", expect: "/usr/lib"},
+		{path: "file/x", expect: "/file/x"},
+		{path: "loop1/x", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := SecureJoin(root, test.path)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got path %q", test.path, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.path, err)
+			continue
+		}
+
+		if expect := filepath.Join(root, test.expect); got != expect {
+			t.Errorf("%q: expected %q, got %q", test.path, expect, got)
+		}
+	}
+}
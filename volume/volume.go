@@ -0,0 +1,406 @@
+// Package volume manages named volumes, storage kept apart from the boxes using it so that it
+// outlives them.
+package volume
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cprates/box/system"
+
+	"golang.org/x/sys/unix"
+)
+
+// Volume drivers.
+const (
+	// DriverDir stores the volume's data in a plain dir
+	DriverDir = "dir"
+	// DriverTmpfs stores the volume's data in a tmpfs, which is mounted while the volume is in
+	// use and discarded once the last box using it releases it
+	DriverTmpfs = "tmpfs"
+	// DriverLoop stores the volume's data in an ext4 image file, which is loop mounted while
+	// the volume is in use
+	DriverLoop = "loop"
+)
+
+const (
+	volumeFilename = "volume.json"
+	dataDirname    = "_data"
+	imageFilename  = "disk.img"
+	// volume names can't start with a dot so, the lock never clashes with a volume
+	lockFilename = ".lock"
+)
+
+var (
+	// ErrVolumeNotFound is returned when a volume doesn't exist.
+	ErrVolumeNotFound = errors.New("volume not found")
+	// ErrVolumeExists is returned when creating a volume whose name is already taken.
+	ErrVolumeExists = errors.New("volume exists")
+	// ErrVolumeInUse is returned when removing a volume used by some box.
+	ErrVolumeInUse = errors.New("volume in use")
+	// ErrInvalidName is returned when a volume name can't be used as a dir name.
+	ErrInvalidName = errors.New("invalid volume name")
+)
+
+// Options configures a new volume.
+type Options struct {
+	// Driver is the volume's driver, defaults to DriverDir
+	Driver string
+	// Size is the max size in bytes of the volume's data. It is required by DriverLoop, and
+	// defaults to half of the RAM with DriverTmpfs. Not supported by DriverDir
+	Size int64
+}
+
+// Volume is a volume kept in a Store.
+type Volume struct {
+	Name    string    `json:"name"`
+	Driver  string    `json:"driver"`
+	Size    int64     `json:"size,omitempty"`
+	Created time.Time `json:"created"`
+	// Users are the names of the boxes using the volume, which can't be removed while in use
+	Users []string `json:"users,omitempty"`
+	// Mountpoint is the host path of the volume's data, only accessible while in use unless
+	// the volume is backed by a dir
+	Mountpoint string `json:"mountpoint"`
+}
+
+// Store keeps volumes in a root dir, each in its own dir named after it, holding the volume's
+// metadata and its data.
+type Store struct {
+	root string
+}
+
+// NewStore returns a store kept in the given root dir, which is created on first use.
+func NewStore(root string) *Store {
+	return &Store{root: root}
+}
+
+// Create creates a new volume with the given name and options.
+func (s *Store) Create(name string, opts Options) (v Volume, err error) {
+	if err = validateName(name); err != nil {
+		return
+	}
+
+	if opts.Driver == "" {
+		opts.Driver = DriverDir
+	}
+	switch opts.Driver {
+	case DriverDir:
+		if opts.Size != 0 {
+			return v, errors.New("size not supported by the dir driver")
+		}
+	case DriverTmpfs:
+	case DriverLoop:
+		if opts.Size <= 0 {
+			return v, errors.New("size required by the loop driver")
+		}
+	default:
+		return v, fmt.Errorf("unknown driver %q", opts.Driver)
+	}
+	if opts.Size < 0 {
+		return v, errors.New("size must not be negative")
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	dir := filepath.Join(s.root, name)
+	if err = os.Mkdir(dir, 0755); err != nil {
+		if os.IsExist(err) {
+			err = fmt.Errorf("%w: %s", ErrVolumeExists, name)
+		}
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+
+	if err = os.Mkdir(filepath.Join(dir, dataDirname), 0755); err != nil {
+		return
+	}
+
+	if opts.Driver == DriverLoop {
+		img := filepath.Join(dir, imageFilename)
+		if err = system.CreateExt4Image(img, opts.Size); err != nil {
+			return v, fmt.Errorf("creating image: %s", err)
+		}
+	}
+
+	v = Volume{
+		Name:       name,
+		Driver:     opts.Driver,
+		Size:       opts.Size,
+		Created:    time.Now(),
+		Mountpoint: filepath.Join(dir, dataDirname),
+	}
+
+	return v, s.save(v)
+}
+
+// Get returns the volume with the given name.
+func (s *Store) Get(name string) (v Volume, err error) {
+	if err = validateName(name); err != nil {
+		return
+	}
+
+	return s.load(name)
+}
+
+// List returns all the volumes in the store, sorted by name.
+func (s *Store) List() ([]Volume, error) {
+	entries, err := ioutil.ReadDir(s.root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing volumes: %s", err)
+	}
+
+	var list []Volume
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		v, err := s.load(e.Name())
+		if errors.Is(err, ErrVolumeNotFound) {
+			// being created or removed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list, nil
+}
+
+// Remove removes the volume with the given name, along with its data. Volumes in use can't be
+// removed.
+func (s *Store) Remove(name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	v, err := s.load(name)
+	if err != nil {
+		return err
+	}
+
+	if len(v.Users) > 0 {
+		return fmt.Errorf("%w: %s used by %s", ErrVolumeInUse, name, strings.Join(v.Users, ", "))
+	}
+
+	if err = unmount(v.Mountpoint); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(filepath.Join(s.root, name))
+}
+
+// Acquire marks the volume with the given name as used by user, mounting its data if it isn't
+// yet, and returns it. Each user must release the volume once done with it.
+func (s *Store) Acquire(name, user string) (v Volume, err error) {
+	if err = validateName(name); err != nil {
+		return
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	if v, err = s.load(name); err != nil {
+		return
+	}
+
+	// mounts don't survive reboots so, whether the data is mounted is checked on every use
+	if err = v.mount(filepath.Join(s.root, name)); err != nil {
+		return v, fmt.Errorf("mounting volume %s: %s", name, err)
+	}
+
+	for _, u := range v.Users {
+		if u == user {
+			return v, nil
+		}
+	}
+	v.Users = append(v.Users, user)
+
+	return v, s.save(v)
+}
+
+// Release marks the volume with the given name as no longer used by user, unmounting its data
+// if it was the last one. Releasing a volume which doesn't exist is a no-op.
+func (s *Store) Release(name, user string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	v, err := s.load(name)
+	if errors.Is(err, ErrVolumeNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	users := v.Users[:0]
+	for _, u := range v.Users {
+		if u != user {
+			users = append(users, u)
+		}
+	}
+	v.Users = users
+
+	if len(v.Users) == 0 {
+		if err = unmount(v.Mountpoint); err != nil {
+			return fmt.Errorf("unmounting volume %s: %s", name, err)
+		}
+	}
+
+	return s.save(v)
+}
+
+// mount mounts the volume's data at its mountpoint, according to its driver, unless it is
+// already mounted. dir is the volume's dir.
+func (v Volume) mount(dir string) error {
+	if v.Driver == DriverDir {
+		return nil
+	}
+
+	mounted, err := isMountpoint(v.Mountpoint)
+	if err != nil || mounted {
+		return err
+	}
+
+	switch v.Driver {
+	case DriverTmpfs:
+		data := "mode=755"
+		if v.Size > 0 {
+			data += ",size=" + strconv.FormatInt(v.Size, 10)
+		}
+		return unix.Mount("tmpfs", v.Mountpoint, "tmpfs", unix.MS_NODEV|unix.MS_NOSUID, data)
+	case DriverLoop:
+		dev, err := system.AttachLoop(filepath.Join(dir, imageFilename), false)
+		if err != nil {
+			return err
+		}
+		defer dev.Close()
+
+		return unix.Mount(dev.Name(), v.Mountpoint, "ext4", unix.MS_NODEV|unix.MS_NOSUID, "")
+	}
+
+	return fmt.Errorf("unknown driver %q", v.Driver)
+}
+
+// unmount unmounts whatever is mounted at path, if anything.
+func unmount(path string) error {
+	mounted, err := isMountpoint(path)
+	if err != nil || !mounted {
+		return err
+	}
+
+	return unix.Unmount(path, unix.MNT_DETACH)
+}
+
+// isMountpoint returns whether something is mounted at path, which is assumed to not be the
+// root of a bind mount of the same filesystem as its parent.
+func isMountpoint(path string) (bool, error) {
+	var st, parent unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return false, err
+	}
+	if err := unix.Stat(filepath.Dir(path), &parent); err != nil {
+		return false, err
+	}
+
+	return st.Dev != parent.Dev, nil
+}
+
+func (s *Store) load(name string) (v Volume, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.root, name, volumeFilename))
+	if os.IsNotExist(err) {
+		return v, fmt.Errorf("%w: %s", ErrVolumeNotFound, name)
+	}
+	if err != nil {
+		return v, fmt.Errorf("reading volume: %s", err)
+	}
+
+	if err = json.Unmarshal(b, &v); err != nil {
+		return v, fmt.Errorf("parsing volume: %s", err)
+	}
+	// the store may have been moved since the volume was created
+	v.Mountpoint = filepath.Join(s.root, name, dataDirname)
+
+	return v, nil
+}
+
+func (s *Store) save(v Volume) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	p := filepath.Join(s.root, v.Name, volumeFilename)
+	tmp := p + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p)
+}
+
+// lock takes an exclusive lock on the store, shared by all processes using it.
+func (s *Store) lock() (unlock func(), err error) {
+	if err = os.MkdirAll(s.root, 0755); err != nil {
+		return nil, fmt.Errorf("creating store dir: %s", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.root, lockFilename), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening store lock: %s", err)
+	}
+
+	if err = unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking store: %s", err)
+	}
+
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// validateName checks that the given volume name can be used as its dir name in the store.
+func validateName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "/") {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package volume
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "volume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	s := NewStore(tmp)
+	v, err := s.Create("data", Options{})
+	if err != nil {
+		t.Fatalf("creating volume: %s", err)
+	}
+	if v.Driver != DriverDir || v.Mountpoint != filepath.Join(tmp, "data", dataDirname) {
+		t.Errorf("unexpected volume %+v", v)
+	}
+
+	if _, err = s.Create("data", Options{}); !errors.Is(err, ErrVolumeExists) {
+		t.Errorf("expected ErrVolumeExists, got: %v", err)
+	}
+	if _, err = s.Create(".data", Options{}); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("expected ErrInvalidName, got: %v", err)
+	}
+	if _, err = s.Create("disk", Options{Driver: DriverLoop}); err == nil {
+		t.Error("expected loop volumes without size to be refused")
+	}
+
+	for _, user := range []string{"a", "b", "a"} {
+		if _, err = s.Acquire("data", user); err != nil {
+			t.Fatalf("acquiring volume: %s", err)
+		}
+	}
+	if v, err = s.Get("data"); err != nil {
+		t.Fatalf("getting volume: %s", err)
+	}
+	if !reflect.DeepEqual(v.Users, []string{"a", "b"}) {
+		t.Errorf("expected users [a b], got %v", v.Users)
+	}
+
+	if err = s.Release("data", "a"); err != nil {
+		t.Fatalf("releasing volume: %s", err)
+	}
+	if err = s.Remove("data"); !errors.Is(err, ErrVolumeInUse) {
+		t.Errorf("expected ErrVolumeInUse, got: %v", err)
+	}
+
+	if err = s.Release("data", "b"); err != nil {
+		t.Fatalf("releasing volume: %s", err)
+	}
+	if err = s.Remove("data"); err != nil {
+		t.Fatalf("removing volume: %s", err)
+	}
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatalf("listing volumes: %s", err)
+	}
+	if len(list) != 0 {
+		t.Errorf("expected no volumes, got %v", list)
+	}
+	if err = s.Release("data", "b"); err != nil {
+		t.Errorf("expected releasing a removed volume to succeed, got: %s", err)
+	}
+}
@@ -0,0 +1,65 @@
+package box
+
+import (
+	"fmt"
+
+	"github.com/cprates/box/spec"
+	"github.com/cprates/box/volume"
+)
+
+// Volumes returns the volume store used by the manager.
+func (m *manager) Volumes() *volume.Store {
+	return m.volumes
+}
+
+// acquireVolumes returns the given spec with its volume mounts resolved to bind mounts of the
+// volumes' data, which are marked as used by the box with the given name, returning their
+// names as well. The volumes must be released with releaseVolumes once the box is gone.
+func (m *manager) acquireVolumes(
+	name string,
+	s *spec.Spec,
+) (
+	resolved *spec.Spec,
+	volumes []string,
+	err error,
+) {
+	var mounts []spec.Mount
+	for _, mnt := range s.Mounts {
+		if mnt.Type != spec.MountVolume {
+			mounts = append(mounts, mnt)
+			continue
+		}
+
+		v, err := m.volumes.Acquire(mnt.Source, name)
+		if err != nil {
+			_ = m.releaseVolumes(name, volumes)
+			return nil, nil, fmt.Errorf("acquiring volume: %w", err)
+		}
+		volumes = append(volumes, v.Name)
+
+		mnt.Type = spec.MountBind
+		mnt.Source = v.Mountpoint
+		mounts = append(mounts, mnt)
+	}
+
+	if len(volumes) == 0 {
+		return s, nil, nil
+	}
+
+	resolved = &spec.Spec{}
+	*resolved = *s
+	resolved.Mounts = mounts
+
+	return resolved, volumes, nil
+}
+
+// releaseVolumes releases the given volumes used by the box with the given name.
+func (m *manager) releaseVolumes(name string, volumes []string) error {
+	for _, v := range volumes {
+		if err := m.volumes.Release(v, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}